@@ -515,6 +515,15 @@ func (rg *registry) SetNumber(reg int, val LNumber) {
 	}
 }
 
+func (rg *registry) SetInteger(reg int, val LInteger) {
+	newSize := reg + 1
+	// +inline-call rg.checkSize newSize
+	rg.array[reg] = rg.alloc.LInteger2I(val)
+	if reg >= rg.top {
+		rg.top = reg + 1
+	}
+}
+
 func (rg *registry) IsFull() bool {
 	return rg.top >= cap(rg.array)
 }
@@ -1208,6 +1217,7 @@ func (ls *LState) Close() {
 		file.Close()
 		os.Remove(file.Name())
 	}
+	ls.closeJsonStreams(nil, "closed")
 	ls.stack.FreeAll()
 	ls.stack = nil
 }
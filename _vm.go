@@ -355,6 +355,8 @@ func init() {
 			unaryv := L.rkValue(B)
 			if nm, ok := unaryv.(LNumber); ok {
 				reg.SetNumber(RA, -nm)
+			} else if it, ok := unaryv.(LInteger); ok {
+				reg.SetInteger(RA, -it)
 			} else {
 				op := L.metaOp1(unaryv, "__unm")
 				if op.Type() == LTFunction {
@@ -363,8 +365,12 @@ func init() {
 					L.Call(1, 1)
 					reg.Set(RA, reg.Pop())
 				} else if str, ok1 := unaryv.(LString); ok1 {
-					if num, err := parseNumber(string(str)); err == nil {
-						reg.Set(RA, -num)
+					if num, err := parseNumberValue(string(str), L.Options.Integers); err == nil {
+						if it, ok := num.(LInteger); ok {
+							reg.SetInteger(RA, -it)
+						} else {
+							reg.SetNumber(RA, -num.(LNumber))
+						}
 					} else {
 						L.RaiseError("__unm undefined")
 					}
@@ -397,7 +403,7 @@ func init() {
 			B := int(inst & 0x1ff) //GETB
 			switch lv := L.rkValue(B).(type) {
 			case LString:
-				reg.SetNumber(RA, LNumber(len(lv)))
+				L.setLength(RA, len(lv))
 			default:
 				op := L.metaOp1(lv, "__len")
 				if op.Type() == LTFunction {
@@ -406,12 +412,12 @@ func init() {
 					L.Call(1, 1)
 					ret := reg.Pop()
 					if ret.Type() == LTNumber {
-						reg.SetNumber(RA, ret.(LNumber))
+						reg.Set(RA, ret)
 					} else {
 						reg.SetNumber(RA, LNumber(0))
 					}
 				} else if lv.Type() == LTTable {
-					reg.SetNumber(RA, LNumber(lv.(*LTable).Len()))
+					L.setLength(RA, lv.(*LTable).Len())
 				} else {
 					L.RaiseError("__len undefined")
 				}
@@ -478,7 +484,11 @@ func init() {
 
 			if v1, ok1 := lhs.assertFloat64(); ok1 {
 				if v2, ok2 := rhs.assertFloat64(); ok2 {
-					ret = v1 <= v2
+					if L.Options.Integers {
+						ret = numberLessThan(lhs, rhs, v1, v2, true)
+					} else {
+						ret = v1 <= v2
+					}
 				} else {
 					L.RaiseError("attempt to compare %v with %v", lhs.Type().String(), rhs.Type().String())
 				}
@@ -666,6 +676,26 @@ func init() {
 			lbase := cf.LocalBase
 			A := int(inst>>18) & 0xff //GETA
 			RA := lbase + A
+			if L.Options.Integers {
+				if idx, ok := reg.Get(RA).(LInteger); ok {
+					count, ok1 := reg.Get(RA + 1).(LInteger)
+					step, ok2 := reg.Get(RA + 2).(LInteger)
+					if !ok1 || !ok2 {
+						L.RaiseError("for statement limit must be a number")
+					}
+					if count != 0 {
+						idx += step
+						reg.SetInteger(RA, idx)
+						reg.SetInteger(RA+1, count-1)
+						Sbx := int(inst&0x3ffff) - opMaxArgSbx //GETSBX
+						cf.Pc += Sbx
+						reg.SetInteger(RA+3, idx)
+					} else {
+						reg.SetTop(RA + 1)
+					}
+					return 0
+				}
+			}
 			if init, ok1 := reg.Get(RA).assertFloat64(); ok1 {
 				if limit, ok2 := reg.Get(RA + 1).assertFloat64(); ok2 {
 					if step, ok3 := reg.Get(RA + 2).assertFloat64(); ok3 {
@@ -696,6 +726,16 @@ func init() {
 			A := int(inst>>18) & 0xff //GETA
 			RA := lbase + A
 			Sbx := int(inst&0x3ffff) - opMaxArgSbx //GETSBX
+			if L.Options.Integers {
+				if init, ok1 := reg.Get(RA).(LInteger); ok1 {
+					if step, ok2 := reg.Get(RA + 2).(LInteger); ok2 {
+						if !forPrepInteger(L, RA, init, step) {
+							cf.Pc += Sbx + 1
+						}
+						return 0
+					}
+				}
+			}
 			if init, ok1 := reg.Get(RA).assertFloat64(); ok1 {
 				if step, ok2 := reg.Get(RA + 2).assertFloat64(); ok2 {
 					reg.SetNumber(RA, LNumber(init-step))
@@ -805,10 +845,43 @@ func init() {
 		func(L *LState, inst uint32, baseframe *callFrame) int { //OP_NOP
 			return 0
 		},
+		opArith, // OP_IDIV
+		opArith, // OP_BAND
+		opArith, // OP_BOR
+		opArith, // OP_BXOR
+		opArith, // OP_SHL
+		opArith, // OP_SHR
+		func(L *LState, inst uint32, baseframe *callFrame) int { //OP_BNOT
+			reg := L.reg
+			cf := L.currentFrame
+			lbase := cf.LocalBase
+			A := int(inst>>18) & 0xff //GETA
+			RA := lbase + A
+			B := int(inst & 0x1ff) //GETB
+			unaryv := L.rkValue(B)
+			if it, ok := unaryv.(LInteger); ok {
+				reg.SetInteger(RA, ^it)
+			} else {
+				op := L.metaOp1(unaryv, "__bnot")
+				if op.Type() == LTFunction {
+					reg.Push(op)
+					reg.Push(unaryv)
+					L.Call(1, 1)
+					reg.Set(RA, reg.Pop())
+				} else if it, ok := toInteger(unaryv); ok {
+					reg.SetInteger(RA, ^it)
+				} else if unaryv.Type() == LTNumber {
+					L.RaiseError("number has no integer representation")
+				} else {
+					L.RaiseError("__bnot undefined")
+				}
+			}
+			return 0
+		},
 	}
 }
 
-func opArith(L *LState, inst uint32, baseframe *callFrame) int { //OP_ADD, OP_SUB, OP_MUL, OP_DIV, OP_MOD, OP_POW
+func opArith(L *LState, inst uint32, baseframe *callFrame) int { //OP_ADD, OP_SUB, OP_MUL, OP_DIV, OP_MOD, OP_POW, OP_IDIV, OP_BAND, OP_BOR, OP_BXOR, OP_SHL, OP_SHR
 	reg := L.reg
 	cf := L.currentFrame
 	lbase := cf.LocalBase
@@ -822,7 +895,13 @@ func opArith(L *LState, inst uint32, baseframe *callFrame) int { //OP_ADD, OP_SU
 	v1, ok1 := lhs.assertFloat64()
 	v2, ok2 := rhs.assertFloat64()
 	if ok1 && ok2 {
-		reg.SetNumber(RA, numberArith(L, opcode, LNumber(v1), LNumber(v2)))
+		if !L.Options.Integers || isFloatArith(opcode, lhs, rhs) {
+			reg.SetNumber(RA, numberArith(L, opcode, LNumber(v1), LNumber(v2)))
+		} else if ret, msg := integerArith(opcode, lhs, rhs); len(msg) == 0 {
+			reg.SetInteger(RA, ret)
+		} else {
+			L.RaiseError("%v", msg)
+		}
 	} else {
 		reg.Set(RA, objectArith(L, opcode, lhs, rhs))
 	}
@@ -855,11 +934,197 @@ func numberArith(L *LState, opcode int, lhs, rhs LNumber) LNumber {
 		flhs := float64(lhs)
 		frhs := float64(rhs)
 		return LNumber(math.Pow(flhs, frhs))
+	case OP_IDIV:
+		return LNumber(math.Floor(float64(lhs / rhs)))
 	}
 	panic("should not reach here")
 	return LNumber(0)
 }
 
+// isFloatArith reports whether opcode computes a float: / and ^ always do,
+// the other operators of Lua 5.1 and // unless both operands are integers,
+// and the bitwise operators never do.
+func isFloatArith(opcode int, lhs, rhs LValue) bool {
+	switch opcode {
+	case OP_DIV, OP_POW:
+		return true
+	case OP_ADD, OP_SUB, OP_MUL, OP_MOD, OP_IDIV:
+		if _, ok := lhs.(LInteger); ok {
+			_, ok = rhs.(LInteger)
+			return !ok
+		}
+		return true
+	}
+	return false
+}
+
+// integerArith computes opcode on the integer values of lhs and rhs, with
+// wrap around like Lua 5.3. It returns an error message if an operand has no
+// integer value or the operation divides by zero.
+func integerArith(opcode int, lhs, rhs LValue) (LInteger, string) {
+	a, ok1 := toInteger(lhs)
+	b, ok2 := toInteger(rhs)
+	if !ok1 || !ok2 {
+		return 0, "number has no integer representation"
+	}
+	switch opcode {
+	case OP_ADD:
+		return a + b, ""
+	case OP_SUB:
+		return a - b, ""
+	case OP_MUL:
+		return a * b, ""
+	case OP_MOD:
+		if b == 0 {
+			return 0, "attempt to perform 'n%0'"
+		}
+		m := a % b
+		if m != 0 && (m^b) < 0 {
+			m += b
+		}
+		return m, ""
+	case OP_IDIV:
+		if b == 0 {
+			return 0, "attempt to perform 'n//0'"
+		}
+		q := a / b
+		if a%b != 0 && (a^b) < 0 {
+			q--
+		}
+		return q, ""
+	case OP_BAND:
+		return a & b, ""
+	case OP_BOR:
+		return a | b, ""
+	case OP_BXOR:
+		return a ^ b, ""
+	case OP_SHL:
+		return shiftLeft(a, b), ""
+	case OP_SHR:
+		return shiftLeft(a, -b), ""
+	}
+	panic("should not reach here")
+}
+
+// shiftLeft shifts a logically by n bits, to the right if n is negative.
+func shiftLeft(a, n LInteger) LInteger {
+	switch {
+	case n <= -64 || n >= 64:
+		return 0
+	case n < 0:
+		return LInteger(uint64(a) >> uint(-n))
+	}
+	return LInteger(uint64(a) << uint(n))
+}
+
+// numberLessThan compares the numbers lhs and rhs, whose float values are v1
+// and v2, exactly even if integers do not fit into floats.
+func numberLessThan(lhs, rhs LValue, v1, v2 float64, orEqual bool) bool {
+	i1, ok1 := lhs.(LInteger)
+	i2, ok2 := rhs.(LInteger)
+	switch {
+	case ok1 && ok2:
+		if orEqual {
+			return i1 <= i2
+		}
+		return i1 < i2
+	case ok1:
+		return intLessThanFloat(i1, v2, orEqual)
+	case ok2:
+		return !math.IsNaN(v1) && !intLessThanFloat(i2, v1, !orEqual)
+	}
+	if orEqual {
+		return v1 <= v2
+	}
+	return v1 < v2
+}
+
+func intLessThanFloat(i LInteger, f float64, orEqual bool) bool {
+	switch {
+	case math.IsNaN(f):
+		return false
+	case f >= 1<<63:
+		return true
+	case f < -(1 << 63):
+		return false
+	case orEqual:
+		return i <= LInteger(math.Floor(f))
+	}
+	return i < LInteger(math.Ceil(f))
+}
+
+// numberEquals is numberLessThan for equality.
+func numberEquals(lhs, rhs LValue, v1, v2 float64) bool {
+	i1, ok1 := lhs.(LInteger)
+	i2, ok2 := rhs.(LInteger)
+	switch {
+	case ok1 && ok2:
+		return i1 == i2
+	case ok1:
+		i2, ok2 = floatToInteger(v2)
+		return ok2 && i1 == i2
+	case ok2:
+		i1, ok1 = floatToInteger(v1)
+		return ok1 && i1 == i2
+	}
+	return v1 == v2
+}
+
+// forPrepInteger prepares a for loop of integers like Lua 5.3, which runs
+// the body first and counts the remaining iterations in R(A+1), so that the
+// index cannot overflow. It returns false if the loop does not run.
+func forPrepInteger(L *LState, RA int, init, step LInteger) bool {
+	reg := L.reg
+	if step == 0 {
+		L.RaiseError("'for' step is zero")
+	}
+	limit, ok := forLimit(L, reg.Get(RA+1), step)
+	if !ok || step > 0 && init > limit || step < 0 && init < limit {
+		return false
+	}
+	var count uint64
+	if step > 0 {
+		count = (uint64(limit) - uint64(init)) / uint64(step)
+	} else {
+		count = (uint64(init) - uint64(limit)) / (uint64(-(step + 1)) + 1)
+	}
+	reg.SetInteger(RA+1, LInteger(count))
+	reg.SetInteger(RA+3, init)
+	return true
+}
+
+// forLimit converts the limit of a for loop of integers, clipping floats. It
+// returns false if the loop does not run.
+func forLimit(L *LState, lv LValue, step LInteger) (LInteger, bool) {
+	switch limit := lv.(type) {
+	case LInteger:
+		return limit, true
+	case LNumber:
+		f := float64(limit)
+		switch {
+		case math.IsNaN(f):
+			return 0, false
+		case step > 0:
+			f = math.Floor(f)
+			if f >= 1<<63 {
+				return math.MaxInt64, true
+			} else if f < -(1 << 63) {
+				return 0, false
+			}
+		default:
+			f = math.Ceil(f)
+			if f < -(1 << 63) {
+				return math.MinInt64, true
+			} else if f >= 1<<63 {
+				return 0, false
+			}
+		}
+		return LInteger(f), true
+	}
+	L.RaiseError("for statement limit must be a number")
+	return 0, false
+}
+
 func objectArith(L *LState, opcode int, lhs, rhs LValue) LValue {
 	event := ""
 	switch opcode {
@@ -875,6 +1140,18 @@ func objectArith(L *LState, opcode int, lhs, rhs LValue) LValue {
 		event = "__mod"
 	case OP_POW:
 		event = "__pow"
+	case OP_IDIV:
+		event = "__idiv"
+	case OP_BAND:
+		event = "__band"
+	case OP_BOR:
+		event = "__bor"
+	case OP_BXOR:
+		event = "__bxor"
+	case OP_SHL:
+		event = "__shl"
+	case OP_SHR:
+		event = "__shr"
 	}
 	op := L.metaOp2(lhs, rhs, event)
 	if op.Type() == LTFunction {
@@ -885,18 +1162,25 @@ func objectArith(L *LState, opcode int, lhs, rhs LValue) LValue {
 		return L.reg.Pop()
 	}
 	if str, ok := lhs.(LString); ok {
-		if lnum, err := parseNumber(string(str)); err == nil {
+		if lnum, err := parseNumberValue(string(str), L.Options.Integers); err == nil {
 			lhs = lnum
 		}
 	}
 	if str, ok := rhs.(LString); ok {
-		if rnum, err := parseNumber(string(str)); err == nil {
+		if rnum, err := parseNumberValue(string(str), L.Options.Integers); err == nil {
 			rhs = rnum
 		}
 	}
 	if v1, ok1 := lhs.assertFloat64(); ok1 {
 		if v2, ok2 := rhs.assertFloat64(); ok2 {
-			return numberArith(L, opcode, LNumber(v1), LNumber(v2))
+			if !L.Options.Integers || isFloatArith(opcode, lhs, rhs) {
+				return numberArith(L, opcode, LNumber(v1), LNumber(v2))
+			}
+			ret, msg := integerArith(opcode, lhs, rhs)
+			if len(msg) != 0 {
+				L.RaiseError("%v", msg)
+			}
+			return ret
 		}
 	}
 	L.RaiseError(fmt.Sprintf("cannot perform %v operation between %v and %v",
@@ -905,6 +1189,15 @@ func objectArith(L *LState, opcode int, lhs, rhs LValue) LValue {
 	return LNil
 }
 
+// setLength sets R(A) to the length n, an integer if integers are enabled.
+func (L *LState) setLength(RA int, n int) {
+	if L.Options.Integers {
+		L.reg.SetInteger(RA, LInteger(n))
+	} else {
+		L.reg.SetNumber(RA, LNumber(n))
+	}
+}
+
 func stringConcat(L *LState, total, last int) LValue {
 	rhs := L.reg.Get(last)
 	total--
@@ -946,7 +1239,10 @@ func lessThan(L *LState, lhs, rhs LValue) bool {
 	// optimization for numbers
 	if v1, ok1 := lhs.assertFloat64(); ok1 {
 		if v2, ok2 := rhs.assertFloat64(); ok2 {
-			return v1 < v2
+			if !L.Options.Integers {
+				return v1 < v2
+			}
+			return numberLessThan(lhs, rhs, v1, v2, false)
 		}
 		L.RaiseError("attempt to compare %v with %v", lhs.Type().String(), rhs.Type().String())
 	}
@@ -976,7 +1272,11 @@ func equals(L *LState, lhs, rhs LValue, raw bool) bool {
 	case LTNumber:
 		v1, _ := lhs.assertFloat64()
 		v2, _ := rhs.assertFloat64()
-		ret = v1 == v2
+		if L.Options.Integers {
+			ret = numberEquals(lhs, rhs, v1, v2)
+		} else {
+			ret = v1 == v2
+		}
 	case LTBool:
 		ret = bool(lhs.(LBool)) == bool(rhs.(LBool))
 	case LTString:
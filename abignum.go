@@ -0,0 +1,613 @@
+package lua
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+/*
+  Arbitrary precision numbers.
+
+  The bigint module makes integers of any size and the decimal module fixed
+  point decimals, for amounts that a Lua number can not hold exactly:
+
+	local bigint, decimal = require("bigint"), require("decimal")
+	local n = bigint.new("123456789012345678901234567890") * 10 + 1
+	local price = decimal.new("19.99") * 3   -- 59.97
+	decimal.new(1, 4) / 3                    -- 0.3333
+
+  Arithmetic mixes them with numbers and numeric strings. Results are
+  bigints if all operands are integers, else decimals with the largest scale
+  of the operands, rounded half to even. Division of bigints is floor
+  division. Like other values of different types, they are not equal to
+  numbers, use cmp to compare them.
+
+  JSON keeps their value, numbers decode to them if a Lua number can not
+  hold them exactly. CBOR keeps their type too.
+*/
+
+// ABigIntPreload adds bigint to the given Lua state's package.preload table:
+//
+//	local bigint = require("bigint")
+func ABigIntPreload(L *LState) {
+	L.PreloadModule("bigint", ABigIntLoader)
+}
+
+// ABigIntLoader is the module loader function.
+func ABigIntLoader(L *LState) int {
+	t := L.NewTable()
+	L.SetFuncs(t, bigIntFuncs)
+	L.Push(t)
+	return 1
+}
+
+// ADecimalPreload adds decimal to the given Lua state's package.preload table:
+//
+//	local decimal = require("decimal")
+func ADecimalPreload(L *LState) {
+	L.PreloadModule("decimal", ADecimalLoader)
+}
+
+// ADecimalLoader is the module loader function.
+func ADecimalLoader(L *LState) int {
+	t := L.NewTable()
+	L.SetFuncs(t, decimalFuncs)
+	L.Push(t)
+	return 1
+}
+
+var bigIntFuncs = map[string]LGFunction{
+	"new": bigIntNew,
+	"is":  bigIntIs,
+}
+
+var decimalFuncs = map[string]LGFunction{
+	"new": decimalNew,
+	"is":  decimalIs,
+}
+
+const (
+	lBigIntClass  = "bigint*"
+	lDecimalClass = "decimal*"
+
+	// MaxDecimalScale is the largest number of digits after the point.
+	MaxDecimalScale = 1000
+	// bignumMaxBits limits the size of powers.
+	bignumMaxBits = 1 << 20
+)
+
+var (
+	errDivideByZero = errors.New("division by zero")
+	errDecimalScale = fmt.Errorf("decimal scale out of range 0 to %v", MaxDecimalScale)
+)
+
+/* Decimal {{{ */
+
+// Decimal is the fixed point number Unscaled / 10^Scale.
+type Decimal struct {
+	Unscaled *big.Int
+	Scale    int
+}
+
+// ParseDecimal parses a decimal number like "-12.50" or "1.5e-3", the
+// scale is the number of digits after the point.
+func ParseDecimal(s string) (*Decimal, error) {
+	mantissa, exp := s, 0
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		e, err := strconv.Atoi(s[i+1:])
+		if err != nil || e < -MaxDecimalScale || e > MaxDecimalScale {
+			return nil, fmt.Errorf("invalid decimal %q", s)
+		}
+		mantissa, exp = s[:i], e
+	}
+	digits, scale := mantissa, 0
+	if i := strings.IndexByte(mantissa, '.'); i >= 0 {
+		digits, scale = mantissa[:i]+mantissa[i+1:], len(mantissa)-i-1
+	}
+	unsigned := strings.TrimLeft(digits, "+-")
+	if len(digits)-len(unsigned) > 1 || len(unsigned) == 0 || strings.Trim(unsigned, "0123456789") != "" {
+		return nil, fmt.Errorf("invalid decimal %q", s)
+	}
+	n, _ := new(big.Int).SetString(digits, 10)
+	d := &Decimal{Unscaled: n, Scale: scale - exp}
+	if d.Scale < 0 {
+		return d.Rescale(0), nil
+	}
+	if d.Scale > MaxDecimalScale {
+		return nil, errDecimalScale
+	}
+	return d, nil
+}
+
+// decimalFromInt returns n as a decimal of scale 0.
+func decimalFromInt(n *big.Int) *Decimal {
+	return &Decimal{Unscaled: n, Scale: 0}
+}
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
+
+// roundQuo returns n / m rounded half to even.
+func roundQuo(n, m *big.Int) *big.Int {
+	q, r := new(big.Int).QuoRem(n, m, new(big.Int))
+	if r.Sign() == 0 {
+		return q
+	}
+	r.Abs(r)
+	c := r.Lsh(r, 1).CmpAbs(m)
+	if c > 0 || c == 0 && q.Bit(0) == 1 {
+		if n.Sign() == m.Sign() {
+			q.Add(q, big.NewInt(1))
+		} else {
+			q.Sub(q, big.NewInt(1))
+		}
+	}
+	return q
+}
+
+// floorMod returns n modulo m with the sign of m, like the % of Lua.
+func floorMod(n, m *big.Int) *big.Int {
+	r := new(big.Int).Rem(n, m)
+	if r.Sign() != 0 && r.Sign() != m.Sign() {
+		r.Add(r, m)
+	}
+	return r
+}
+
+// Rescale returns d with scale digits after the point, rounded half to even.
+func (d *Decimal) Rescale(scale int) *Decimal {
+	switch {
+	case scale > d.Scale:
+		return &Decimal{new(big.Int).Mul(d.Unscaled, pow10(scale-d.Scale)), scale}
+	case scale < d.Scale:
+		return &Decimal{roundQuo(d.Unscaled, pow10(d.Scale-scale)), scale}
+	}
+	return d
+}
+
+// Cmp compares d and o like big.Int.Cmp.
+func (d *Decimal) Cmp(o *Decimal) int {
+	scale := d.Scale
+	if o.Scale > scale {
+		scale = o.Scale
+	}
+	return d.Rescale(scale).Unscaled.Cmp(o.Rescale(scale).Unscaled)
+}
+
+// Float64 returns the nearest float64 to d.
+func (d *Decimal) Float64() float64 {
+	f, _ := new(big.Rat).SetFrac(d.Unscaled, pow10(d.Scale)).Float64()
+	return f
+}
+
+func (d *Decimal) String() string {
+	digits := new(big.Int).Abs(d.Unscaled).String()
+	sign := ""
+	if d.Unscaled.Sign() < 0 {
+		sign = "-"
+	}
+	if d.Scale == 0 {
+		return sign + digits
+	}
+	if len(digits) <= d.Scale {
+		digits = strings.Repeat("0", d.Scale-len(digits)+1) + digits
+	}
+	point := len(digits) - d.Scale
+	return sign + digits[:point] + "." + digits[point:]
+}
+
+/* }}} */
+
+/* userdata {{{ */
+
+// NewBigInt returns n as a bigint userdata.
+func (ls *LState) NewBigInt(n *big.Int) *LUserData {
+	ud := ls.NewUserData()
+	ud.Value = n
+	ls.SetMetatable(ud, ls.bignumMetatable(lBigIntClass))
+	return ud
+}
+
+// NewDecimal returns d as a decimal userdata.
+func (ls *LState) NewDecimal(d *Decimal) *LUserData {
+	ud := ls.NewUserData()
+	ud.Value = d
+	ls.SetMetatable(ud, ls.bignumMetatable(lDecimalClass))
+	return ud
+}
+
+// bignumMetatable returns the metatable of class. Both classes share their
+// metamethods, as Lua compares values only if they have the same ones.
+func (ls *LState) bignumMetatable(class string) *LTable {
+	if mt, ok := ls.GetTypeMetatable(class).(*LTable); ok {
+		return mt
+	}
+	ops := ls.NewTable()
+	ls.SetFuncs(ops, bignumOps)
+	for name, methods := range map[string]map[string]LGFunction{
+		lBigIntClass:  bigIntMethods,
+		lDecimalClass: decimalMethods,
+	} {
+		mt := ls.NewTypeMetatable(name)
+		ops.ForEach(func(key, value LValue) { mt.RawSet(key, value) })
+		mt.RawSetString("__index", ls.SetFuncs(ls.NewTable(), methods))
+	}
+	return ls.GetTypeMetatable(class).(*LTable)
+}
+
+// The metamethods refer to the metatables, so they are set in init.
+var bignumOps, bigIntMethods, decimalMethods map[string]LGFunction
+
+func init() {
+	bignumOps = map[string]LGFunction{
+		"__add":      bignumArith('+'),
+		"__sub":      bignumArith('-'),
+		"__mul":      bignumArith('*'),
+		"__div":      bignumArith('/'),
+		"__mod":      bignumArith('%'),
+		"__pow":      bignumArith('^'),
+		"__unm":      bignumUnm,
+		"__eq":       bignumEq,
+		"__lt":       bignumLt,
+		"__le":       bignumLe,
+		"__tostring": bignumToString,
+		"__concat":   errorConcat,
+	}
+	bigIntMethods = map[string]LGFunction{
+		"tostring": bigIntToString,
+		"tonumber": bignumToNumber,
+		"abs":      bignumAbs,
+		"sign":     bignumSign,
+		"cmp":      bignumCmp,
+	}
+	decimalMethods = map[string]LGFunction{
+		"tostring": bignumToString,
+		"tonumber": bignumToNumber,
+		"abs":      bignumAbs,
+		"sign":     bignumSign,
+		"cmp":      bignumCmp,
+		"scale":    decimalScale,
+		"rescale":  decimalRescale,
+	}
+}
+
+// toBignum converts a bigint, decimal, number or numeric string to a
+// *big.Int or a *Decimal.
+func toBignum(lv LValue) (interface{}, error) {
+	switch v := lv.(type) {
+	case *LUserData:
+		switch n := v.Value.(type) {
+		case *big.Int, *Decimal:
+			return n, nil
+		}
+	case LInteger:
+		return big.NewInt(int64(v)), nil
+	case LNumber:
+		f := float64(v)
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, fmt.Errorf("%v has no exact value", f)
+		}
+		if f == math.Trunc(f) {
+			n, _ := big.NewFloat(f).Int(nil)
+			return n, nil
+		}
+		return ParseDecimal(strconv.FormatFloat(f, 'g', -1, 64))
+	case LString:
+		s := strings.TrimSpace(string(v))
+		if n, ok := new(big.Int).SetString(s, 0); ok {
+			return n, nil
+		}
+		return ParseDecimal(s)
+	}
+	return nil, fmt.Errorf("cannot convert %v to a number", lv.Type())
+}
+
+func toDecimal(n interface{}) *Decimal {
+	if i, ok := n.(*big.Int); ok {
+		return decimalFromInt(i)
+	}
+	return n.(*Decimal)
+}
+
+// checkBignum returns the argument at n converted by toBignum.
+func checkBignum(L *LState, n int) interface{} {
+	v, err := toBignum(L.CheckAny(n))
+	if err != nil {
+		L.ArgError(n, err.Error())
+	}
+	return v
+}
+
+func checkBigIntOrDecimal(L *LState, n int) interface{} {
+	ud := L.CheckUserData(n)
+	switch v := ud.Value.(type) {
+	case *big.Int, *Decimal:
+		return v
+	}
+	L.ArgError(n, "bigint or decimal expected")
+	return nil
+}
+
+// operands converts the operands of a metamethod.
+func bignumOperands(L *LState) (interface{}, interface{}) {
+	a, err := toBignum(L.Get(1))
+	if err == nil {
+		var b interface{}
+		if b, err = toBignum(L.Get(2)); err == nil {
+			return a, b
+		}
+	}
+	L.RaiseError("attempt to perform arithmetic: %v", err)
+	return nil, nil
+}
+
+func pushBignum(L *LState, n interface{}) int {
+	if i, ok := n.(*big.Int); ok {
+		L.Push(L.NewBigInt(i))
+	} else {
+		L.Push(L.NewDecimal(n.(*Decimal)))
+	}
+	return 1
+}
+
+// powExponent returns the exponent of a power of a base of size bits.
+func powExponent(L *LState, bits int, e interface{}) int64 {
+	n, ok := e.(*big.Int)
+	if !ok || n.Sign() < 0 || n.Cmp(big.NewInt(bignumMaxBits)) > 0 || n.Int64()*int64(bits+1) > bignumMaxBits {
+		L.RaiseAAppError(NewAAppError(ErrCodeInvalid, "exponent must be a small non-negative integer", nil))
+	}
+	return n.Int64()
+}
+
+func bignumArith(op byte) LGFunction {
+	return func(L *LState) int {
+		a, b := bignumOperands(L)
+		x, ok1 := a.(*big.Int)
+		y, ok2 := b.(*big.Int)
+		if ok1 && ok2 {
+			return pushBignum(L, bigIntArith(L, op, x, y))
+		}
+		return pushBignum(L, decimalArith(L, op, toDecimal(a), b))
+	}
+}
+
+func bigIntArith(L *LState, op byte, x, y *big.Int) *big.Int {
+	z := new(big.Int)
+	switch op {
+	case '+':
+		return z.Add(x, y)
+	case '-':
+		return z.Sub(x, y)
+	case '*':
+		return z.Mul(x, y)
+	case '^':
+		return z.Exp(x, big.NewInt(powExponent(L, x.BitLen(), y)), nil)
+	}
+	if y.Sign() == 0 {
+		L.RaiseAAppError(NewAAppError(ErrCodeInvalid, "", errDivideByZero))
+	}
+	m := floorMod(x, y)
+	if op == '%' {
+		return m
+	}
+	return z.Quo(z.Sub(x, m), y)
+}
+
+func decimalArith(L *LState, op byte, x *Decimal, b interface{}) *Decimal {
+	if op == '^' {
+		bits := x.Unscaled.BitLen()
+		if 4*x.Scale > bits {
+			bits = 4 * x.Scale
+		}
+		e := powExponent(L, bits, b)
+		n := new(big.Int).Exp(x.Unscaled, big.NewInt(e), nil)
+		return (&Decimal{n, x.Scale * int(e)}).Rescale(x.Scale)
+	}
+	y := toDecimal(b)
+	scale := x.Scale
+	if y.Scale > scale {
+		scale = y.Scale
+	}
+	switch op {
+	case '*':
+		n := new(big.Int).Mul(x.Unscaled, y.Unscaled)
+		return (&Decimal{n, x.Scale + y.Scale}).Rescale(scale)
+	case '/':
+		if y.Unscaled.Sign() == 0 {
+			L.RaiseAAppError(NewAAppError(ErrCodeInvalid, "", errDivideByZero))
+		}
+		n := new(big.Int).Mul(x.Unscaled, pow10(scale-x.Scale+y.Scale))
+		return &Decimal{roundQuo(n, y.Unscaled), scale}
+	}
+	i, j := x.Rescale(scale).Unscaled, y.Rescale(scale).Unscaled
+	switch op {
+	case '+':
+		return &Decimal{new(big.Int).Add(i, j), scale}
+	case '-':
+		return &Decimal{new(big.Int).Sub(i, j), scale}
+	}
+	if j.Sign() == 0 {
+		L.RaiseAAppError(NewAAppError(ErrCodeInvalid, "", errDivideByZero))
+	}
+	return &Decimal{floorMod(i, j), scale}
+}
+
+func bignumUnm(L *LState) int {
+	switch n := checkBigIntOrDecimal(L, 1).(type) {
+	case *big.Int:
+		return pushBignum(L, new(big.Int).Neg(n))
+	case *Decimal:
+		return pushBignum(L, &Decimal{new(big.Int).Neg(n.Unscaled), n.Scale})
+	}
+	return 0
+}
+
+// bignumCompare compares the operands of a metamethod.
+func bignumCompare(L *LState) int {
+	a, b := bignumOperands(L)
+	x, ok1 := a.(*big.Int)
+	y, ok2 := b.(*big.Int)
+	if ok1 && ok2 {
+		return x.Cmp(y)
+	}
+	return toDecimal(a).Cmp(toDecimal(b))
+}
+
+func bignumEq(L *LState) int {
+	L.Push(LBool(bignumCompare(L) == 0))
+	return 1
+}
+
+func bignumLt(L *LState) int {
+	L.Push(LBool(bignumCompare(L) < 0))
+	return 1
+}
+
+func bignumLe(L *LState) int {
+	L.Push(LBool(bignumCompare(L) <= 0))
+	return 1
+}
+
+// n:cmp(o) returns -1, 0 or 1 if n is less than, equal to or greater than o,
+// which may be a number or a numeric string.
+func bignumCmp(L *LState) int {
+	checkBigIntOrDecimal(L, 1)
+	checkBignum(L, 2)
+	L.Push(LNumber(bignumCompare(L)))
+	return 1
+}
+
+func bignumToString(L *LState) int {
+	L.Push(LString(fmt.Sprint(checkBigIntOrDecimal(L, 1))))
+	return 1
+}
+
+// n:tostring([base])
+func bigIntToString(L *LState) int {
+	n, ok := checkBigIntOrDecimal(L, 1).(*big.Int)
+	if !ok {
+		L.ArgError(1, "bigint expected")
+	}
+	base := L.OptInt(2, 10)
+	if base < 2 || base > 62 {
+		L.ArgError(2, "base out of range")
+	}
+	L.Push(LString(n.Text(base)))
+	return 1
+}
+
+// n:tonumber() returns the nearest Lua number.
+func bignumToNumber(L *LState) int {
+	switch n := checkBigIntOrDecimal(L, 1).(type) {
+	case *big.Int:
+		f, _ := new(big.Float).SetInt(n).Float64()
+		L.Push(LNumber(f))
+	case *Decimal:
+		L.Push(LNumber(n.Float64()))
+	}
+	return 1
+}
+
+func bignumAbs(L *LState) int {
+	switch n := checkBigIntOrDecimal(L, 1).(type) {
+	case *big.Int:
+		return pushBignum(L, new(big.Int).Abs(n))
+	case *Decimal:
+		return pushBignum(L, &Decimal{new(big.Int).Abs(n.Unscaled), n.Scale})
+	}
+	return 0
+}
+
+func bignumSign(L *LState) int {
+	switch n := checkBigIntOrDecimal(L, 1).(type) {
+	case *big.Int:
+		L.Push(LNumber(n.Sign()))
+	case *Decimal:
+		L.Push(LNumber(n.Unscaled.Sign()))
+	}
+	return 1
+}
+
+// checkScale returns the scale argument at n.
+func checkScale(L *LState, n int) int {
+	scale := L.CheckInt(n)
+	if scale < 0 || scale > MaxDecimalScale {
+		L.ArgError(n, errDecimalScale.Error())
+	}
+	return scale
+}
+
+func checkDecimal(L *LState, n int) *Decimal {
+	d, ok := checkBigIntOrDecimal(L, n).(*Decimal)
+	if !ok {
+		L.ArgError(n, "decimal expected")
+	}
+	return d
+}
+
+// d:scale()
+func decimalScale(L *LState) int {
+	L.Push(LNumber(checkDecimal(L, 1).Scale))
+	return 1
+}
+
+// d:rescale(scale) returns d rounded half to even to scale digits.
+func decimalRescale(L *LState) int {
+	return pushBignum(L, checkDecimal(L, 1).Rescale(checkScale(L, 2)))
+}
+
+/* }}} */
+
+/* modules {{{ */
+
+// bigint.new(v) converts an integer number, a string in base 10, or in base
+// 16, 8 or 2 with the prefix 0x, 0o or 0b, or a bigint.
+func bigIntNew(L *LState) int {
+	switch n := checkBignum(L, 1).(type) {
+	case *big.Int:
+		return pushBignum(L, n)
+	case *Decimal:
+		if n.Scale == 0 || n.Rescale(0).Cmp(n) == 0 {
+			return pushBignum(L, n.Rescale(0).Unscaled)
+		}
+	}
+	L.ArgError(1, "integer expected")
+	return 0
+}
+
+// bigint.is(v)
+func bigIntIs(L *LState) int {
+	ud, ok := L.Get(1).(*LUserData)
+	if ok {
+		_, ok = ud.Value.(*big.Int)
+	}
+	L.Push(LBool(ok))
+	return 1
+}
+
+// decimal.new(v [, scale]) converts a number, a numeric string, a bigint or
+// a decimal. The scale defaults to the digits after the point of v.
+func decimalNew(L *LState) int {
+	d := toDecimal(checkBignum(L, 1))
+	if L.GetTop() >= 2 {
+		d = d.Rescale(checkScale(L, 2))
+	}
+	return pushBignum(L, d)
+}
+
+// decimal.is(v)
+func decimalIs(L *LState) int {
+	ud, ok := L.Get(1).(*LUserData)
+	if ok {
+		_, ok = ud.Value.(*Decimal)
+	}
+	L.Push(LBool(ok))
+	return 1
+}
+
+/* }}} */
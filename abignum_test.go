@@ -0,0 +1,93 @@
+package lua
+
+import (
+	"context"
+	"testing"
+)
+
+func TestBigInt(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	ABigIntPreload(L)
+	ADecimalPreload(L)
+	errorIfScriptFail(t, L, `
+	local bigint, decimal = require("bigint"), require("decimal")
+	local n = bigint.new("123456789012345678901234567890")
+	assert(tostring(n * 10 + 1) == "1234567890123456789012345678901")
+	assert(n - n == bigint.new(0) and -n < n and n <= n and n > bigint.new(2^53))
+	assert(tostring(bigint.new(2) ^ 100) == "1267650600228229401496703205376")
+	assert(tostring(bigint.new(-7) / 2) == "-4" and tostring(bigint.new(-7) % 2) == "1")
+	assert(bigint.new("0xff"):tostring(2) == "11111111" and bigint.new(255) == bigint.new("0xff"))
+	assert("n=" .. bigint.new(5) == "n=5" and bigint.new(5) .. "" == "5")
+	assert(n:cmp(1) == 1 and bigint.new(-3):abs():sign() == 1 and bigint.new(2^53):tonumber() == 2^53)
+	assert(bigint.is(n) and not bigint.is(1) and not decimal.is(n))
+
+	assert(not pcall(bigint.new, 1.5) and not pcall(bigint.new, "x"))
+	local ok, e = pcall(function() return n / 0 end)
+	assert(not ok and error.is(e, error.INVALID), tostring(e))
+	assert(not pcall(function() return n + {} end))
+	assert(not pcall(function() return bigint.new(2) ^ -1 end))
+	`)
+}
+
+func TestDecimal(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	ABigIntPreload(L)
+	ADecimalPreload(L)
+	errorIfScriptFail(t, L, `
+	local bigint, decimal = require("bigint"), require("decimal")
+	local price = decimal.new("19.99")
+	assert(tostring(price * 3) == "59.97" and price:scale() == 2)
+	assert(tostring(decimal.new(1, 4) / 3) == "0.3333" and tostring(decimal.new(2, 4) / 3) == "0.6667")
+	assert(tostring(decimal.new("0.1") + 0.2) == "0.3" and tostring(price + "0.001") == "19.991")
+	assert(tostring(decimal.new("-0.05")) == "-0.05" and tostring(-decimal.new("0.05")) == "-0.05")
+	assert(tostring(decimal.new("2.5"):rescale(0)) == "2" and tostring(decimal.new("3.5"):rescale(0)) == "4")
+	assert(tostring(decimal.new("-2.5"):rescale(0)) == "-2" and tostring(decimal.new("1.5e-3")) == "0.0015")
+	assert(tostring(decimal.new("-7.5") % 2) == "0.5" and tostring(decimal.new("1.1") ^ 2) == "1.2")
+	assert(decimal.new("1.50") == decimal.new("1.5") and decimal.new("1.5") == bigint.new(3) / 2 + 0.5)
+	assert(decimal.new("1.5") < bigint.new(2) and price:cmp("19.990") == 0 and price:tonumber() == 19.99)
+	assert(tostring(bigint.new(10) * decimal.new("0.5")) == "5.0")
+	assert(decimal.is(price) and tostring(decimal.new(bigint.new(7), 2)) == "7.00")
+
+	local ok, e = pcall(function() return price / 0 end)
+	assert(not ok and error.is(e, error.INVALID), tostring(e))
+	assert(not pcall(decimal.new, "1.2.3") and not pcall(decimal.new, 1, -1))
+	`)
+}
+
+func TestBignumCodecs(t *testing.T) {
+	L, err := NewMFSState(context.Background(), nil, nil)
+	errorIfNotNil(t, err)
+	defer L.Close()
+	errorIfNotNil(t, L.MFS_Mkdir("/Data", true))
+	AJsonPreload(L)
+	ACborPreload(L)
+	ABigIntPreload(L)
+	ADecimalPreload(L)
+	errorIfScriptFail(t, L, `
+	local json, cbor = require("json"), require("cbor")
+	local bigint, decimal = require("bigint"), require("decimal")
+	local v = {big = bigint.new("123456789012345678901234567890"), price = decimal.new("19.990"), small = bigint.new(1)}
+	local text = json.encode(v)
+	assert(text == '{"big":123456789012345678901234567890,"price":19.990,"small":1}', text)
+	local d = json.decode(text)
+	assert(d.big == v.big and d.price == 19.99 and d.small == 1)
+	local exact = json.decode('[0.1,0.10000000000000000001,-12345678901234567890]')
+	assert(exact[1] == 0.1 and decimal.is(exact[2]) and tostring(exact[2]) == "0.10000000000000000001")
+	assert(bigint.is(exact[3]) and json.encode(exact) == '[0.1,0.10000000000000000001,-12345678901234567890]')
+	local huge = "1" .. string.rep("0", 400)
+	local far = json.decode("[" .. huge .. ",1e400,-2.5e-400]")
+	assert(bigint.is(far[1]) and tostring(far[1]) == huge and decimal.is(far[2]) and decimal.is(far[3]))
+	assert(json.decode(huge, {numbers = "string"}) == huge and json.decode("1e400", {numbers = "float"}) == nil)
+
+	local c = cbor.decode(cbor.encode(v))
+	assert(bigint.is(c.small) and c.big == v.big and decimal.is(c.price) and c.price:scale() == 3)
+
+	local db = adb.open("/bignumtest")
+	db:put("k", v)
+	local stored = db:get("k")
+	assert(stored.big == v.big and tostring(stored.big) == "123456789012345678901234567890")
+	db:close()
+	`)
+}
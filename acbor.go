@@ -0,0 +1,622 @@
+package lua
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"sort"
+)
+
+/*
+  CBOR codec.
+
+  A compact binary encoding of Lua values (RFC 8949) that, unlike JSON,
+  keeps the type of keys and strings as raw bytes. Numbers that are
+  integers are encoded as CBOR integers, others as doubles. Tables are
+  arrays like in JSON if they are tagged json.array or are sequences, else
+  maps with keys of any type, so sparse and mixed tables need no options.
+  Holes in arrays and nil are encoded as undefined, json.null as null, so
+  both survive the round trip. Map keys are sorted by their encoding, equal
+  values have equal encodings. Bigints are bignums (tags 2 and 3) and
+  decimals decimal fractions (tag 4), larger integers decode to bigints.
+*/
+
+// ACborPreload adds cbor to the given Lua state's package.preload table:
+//
+//	local cbor = require("cbor")
+func ACborPreload(L *LState) {
+	L.PreloadModule("cbor", ACborLoader)
+}
+
+// ACborLoader is the module loader function.
+func ACborLoader(L *LState) int {
+	t := L.NewTable()
+	L.SetFuncs(t, cborApi)
+	L.Push(t)
+	return 1
+}
+
+var cborApi = map[string]LGFunction{
+	"decode": cborApiDecode,
+	"encode": cborApiEncode,
+}
+
+// cbor.decode(s)
+func cborApiDecode(L *LState) int {
+	str := L.CheckString(1)
+
+	value, err := L.DecodeCBOR([]byte(str))
+	if err != nil {
+		L.Push(LNil)
+		L.Push(LString(err.Error()))
+		return 2
+	}
+	L.Push(value)
+	return 1
+}
+
+// cbor.encode(v)
+func cborApiEncode(L *LState) int {
+	value := L.CheckAny(1)
+
+	data, err := EncodeCBOR(value)
+	if err != nil {
+		L.Push(LNil)
+		L.Push(LString(err.Error()))
+		return 2
+	}
+	L.Push(LString(string(data)))
+	return 1
+}
+
+const (
+	cborUnsigned = 0
+	cborNegative = 1
+	cborBytes    = 2
+	cborText     = 3
+	cborArray    = 4
+	cborMap      = 5
+	cborTag      = 6
+	cborSimple   = 7
+
+	cborFalse     = 0xf4
+	cborTrue      = 0xf5
+	cborNull      = 0xf6
+	cborUndefined = 0xf7
+	cborFloat64   = 0xfb
+	cborBreak     = 0xff
+
+	cborIndefinite = 31
+	cborMaxDepth   = 10000
+
+	cborTagPosBignum = 2
+	cborTagNegBignum = 3
+	cborTagDecimal   = 4
+)
+
+var (
+	errCborNested = errors.New("cannot encode recursively nested tables to CBOR")
+	errCborDepth  = errors.New("CBOR data nested too deeply")
+)
+
+/* encoding {{{ */
+
+// EncodeCBOR returns the CBOR encoding of value.
+func EncodeCBOR(value LValue) ([]byte, error) {
+	e := &cborEncoder{visited: make(map[*LTable]bool)}
+	if err := e.encode(value); err != nil {
+		return nil, err
+	}
+	return e.buf.Bytes(), nil
+}
+
+type cborEncoder struct {
+	buf     bytes.Buffer
+	visited map[*LTable]bool
+}
+
+// head writes the initial byte of an item of type major and its argument n.
+func (e *cborEncoder) head(major byte, n uint64) {
+	var arg [8]byte
+	switch {
+	case n < 24:
+		e.buf.WriteByte(major<<5 | byte(n))
+	case n <= math.MaxUint8:
+		e.buf.Write([]byte{major<<5 | 24, byte(n)})
+	case n <= math.MaxUint16:
+		e.buf.WriteByte(major<<5 | 25)
+		binary.BigEndian.PutUint16(arg[:], uint16(n))
+		e.buf.Write(arg[:2])
+	case n <= math.MaxUint32:
+		e.buf.WriteByte(major<<5 | 26)
+		binary.BigEndian.PutUint32(arg[:], uint32(n))
+		e.buf.Write(arg[:4])
+	default:
+		e.buf.WriteByte(major<<5 | 27)
+		binary.BigEndian.PutUint64(arg[:], n)
+		e.buf.Write(arg[:])
+	}
+}
+
+func (e *cborEncoder) number(n LNumber) {
+	f := float64(n)
+	// larger integers would decode as bigints, they stay floats
+	if f == math.Trunc(f) && f >= -(1<<53) && f <= 1<<53 && !(f == 0 && math.Signbit(f)) {
+		if i := int64(f); i >= 0 {
+			e.head(cborUnsigned, uint64(i))
+		} else {
+			e.head(cborNegative, uint64(-1-i))
+		}
+		return
+	}
+	var arg [8]byte
+	binary.BigEndian.PutUint64(arg[:], math.Float64bits(f))
+	e.buf.WriteByte(cborFloat64)
+	e.buf.Write(arg[:])
+}
+
+// integer writes n as an integer if it fits, else as a bignum.
+func (e *cborEncoder) integer(n *big.Int) {
+	if n.IsUint64() {
+		e.head(cborUnsigned, n.Uint64())
+	} else if m := new(big.Int).Sub(big.NewInt(-1), n); m.IsUint64() {
+		e.head(cborNegative, m.Uint64())
+	} else {
+		e.bignum(n)
+	}
+}
+
+// bignum writes n as a bignum, its bytes are those of n or of -1-n.
+func (e *cborEncoder) bignum(n *big.Int) {
+	if n.Sign() >= 0 {
+		e.head(cborTag, cborTagPosBignum)
+	} else {
+		e.head(cborTag, cborTagNegBignum)
+		n = new(big.Int).Sub(big.NewInt(-1), n)
+	}
+	data := n.Bytes()
+	e.head(cborBytes, uint64(len(data)))
+	e.buf.Write(data)
+}
+
+func (e *cborEncoder) encode(value LValue) error {
+	switch converted := value.(type) {
+	case *LNilType:
+		e.buf.WriteByte(cborUndefined)
+	case LBool:
+		if converted {
+			e.buf.WriteByte(cborTrue)
+		} else {
+			e.buf.WriteByte(cborFalse)
+		}
+	case LNumber:
+		e.number(converted)
+	case LInteger:
+		e.integer(big.NewInt(int64(converted)))
+	case LString:
+		e.head(cborBytes, uint64(len(converted)))
+		e.buf.WriteString(string(converted))
+	case *LUserData:
+		switch n := converted.Value.(type) {
+		case jsonNullValue:
+			e.buf.WriteByte(cborNull)
+		case *big.Int:
+			e.bignum(n)
+		case *Decimal:
+			e.head(cborTag, cborTagDecimal)
+			e.head(cborArray, 2)
+			e.number(LNumber(-n.Scale))
+			e.integer(n.Unscaled)
+		default:
+			return fmt.Errorf("cannot encode %v to CBOR", value.Type())
+		}
+	case *LTable:
+		if e.visited[converted] {
+			return errCborNested
+		}
+		e.visited[converted] = true
+		defer delete(e.visited, converted)
+		return e.table(converted)
+	default:
+		return fmt.Errorf("cannot encode %v to CBOR", value.Type())
+	}
+	return nil
+}
+
+func (e *cborEncoder) table(tb *LTable) error {
+	n, max, total := 0, 0, 0
+	tb.ForEach(func(key, _ LValue) {
+		total++
+		if k, ok := key.(LNumber); ok {
+			if i := int(k); LNumber(i) == k && i > 0 {
+				n++
+				if i > max {
+					max = i
+				}
+			}
+		}
+	})
+
+	kind := jsonTableKind(tb)
+	if kind == jsonArray && n != total {
+		return errInvalidKeys
+	}
+	if kind == jsonArray || kind == "" && n == total && max == n {
+		e.head(cborArray, uint64(max))
+		for i := 1; i <= max; i++ {
+			if err := e.encode(tb.RawGetInt(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// encode the members on their own to sort them by their keys
+	type member struct{ key, value []byte }
+	members := make([]member, 0, total)
+	var err error
+	tb.ForEach(func(key, value LValue) {
+		if err != nil {
+			return
+		}
+		switch key.(type) {
+		case LNumber, LInteger, LString, LBool:
+		default:
+			err = errInvalidKeys
+			return
+		}
+		sub := &cborEncoder{visited: e.visited}
+		sub.encode(key)
+		k := sub.buf.Len()
+		if err = sub.encode(value); err == nil {
+			data := sub.buf.Bytes()
+			members = append(members, member{data[:k], data[k:]})
+		}
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(members, func(i, j int) bool { return bytes.Compare(members[i].key, members[j].key) < 0 })
+
+	e.head(cborMap, uint64(len(members)))
+	for _, m := range members {
+		e.buf.Write(m.key)
+		e.buf.Write(m.value)
+	}
+	return nil
+}
+
+/* }}} */
+
+/* decoding {{{ */
+
+// DecodeCBOR converts the CBOR encoded data to Lua values. Arrays and maps
+// are tagged json.array and json.object, unknown tags are skipped.
+func (ls *LState) DecodeCBOR(data []byte) (LValue, error) {
+	d := &cborDecoder{L: ls, data: data}
+	value, err := d.value()
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(d.data) {
+		return nil, errors.New("invalid data after top-level CBOR value")
+	}
+	return value, nil
+}
+
+type cborDecoder struct {
+	L     *LState
+	data  []byte
+	pos   int
+	depth int
+}
+
+var errCborBreak = errors.New("unexpected CBOR break")
+
+// arg reads the argument of an item with the additional information info.
+func (d *cborDecoder) arg(info byte) (uint64, error) {
+	if info < 24 {
+		return uint64(info), nil
+	}
+	if info > 27 {
+		return 0, fmt.Errorf("invalid CBOR additional information %v", info)
+	}
+	size := 1 << (info - 24)
+	if len(d.data)-d.pos < size {
+		return 0, io.ErrUnexpectedEOF
+	}
+	var n uint64
+	for _, b := range d.data[d.pos : d.pos+size] {
+		n = n<<8 | uint64(b)
+	}
+	d.pos += size
+	return n, nil
+}
+
+// length reads the length of a string, array or map, which needs at least
+// the remaining data.
+func (d *cborDecoder) length(info byte) (int, error) {
+	n, err := d.arg(info)
+	if err != nil {
+		return 0, err
+	}
+	if n > uint64(len(d.data)-d.pos) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return int(n), nil
+}
+
+func (d *cborDecoder) value() (LValue, error) {
+	if d.pos >= len(d.data) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	ib := d.data[d.pos]
+	d.pos++
+	major, info := ib>>5, ib&0x1f
+
+	switch major {
+	case cborUnsigned, cborNegative:
+		n, err := d.arg(info)
+		if err != nil {
+			return nil, err
+		}
+		if d.L.Options.Integers && n <= math.MaxInt64 {
+			if major == cborNegative {
+				return LInteger(-1 - int64(n)), nil
+			}
+			return LInteger(n), nil
+		}
+		if n > 1<<53 {
+			i := new(big.Int).SetUint64(n)
+			if major == cborNegative {
+				i.Sub(big.NewInt(-1), i)
+			}
+			return d.L.NewBigInt(i), nil
+		}
+		if major == cborNegative {
+			return LNumber(-1 - float64(n)), nil
+		}
+		return LNumber(n), nil
+	case cborBytes, cborText:
+		if info != cborIndefinite {
+			n, err := d.length(info)
+			if err != nil {
+				return nil, err
+			}
+			d.pos += n
+			return LString(d.data[d.pos-n : d.pos]), nil
+		}
+		// the chunks are definite strings of the same type, RFC 8949 3.2.3
+		var buf bytes.Buffer
+		for {
+			if d.pos >= len(d.data) {
+				return nil, io.ErrUnexpectedEOF
+			}
+			cb := d.data[d.pos]
+			d.pos++
+			if cb == cborBreak {
+				return LString(buf.String()), nil
+			}
+			if cb>>5 != major || cb&0x1f == cborIndefinite {
+				return nil, errors.New("invalid chunk of indefinite CBOR string")
+			}
+			n, err := d.length(cb & 0x1f)
+			if err != nil {
+				return nil, err
+			}
+			buf.Write(d.data[d.pos : d.pos+n])
+			d.pos += n
+		}
+	case cborArray, cborMap:
+		if d.depth++; d.depth > cborMaxDepth {
+			return nil, errCborDepth
+		}
+		defer func() { d.depth-- }()
+		if major == cborArray {
+			return d.array(info)
+		}
+		return d.object(info)
+	case cborTag:
+		tag, err := d.arg(info)
+		if err != nil {
+			return nil, err
+		}
+		// nested tags nest like arrays
+		if d.depth++; d.depth > cborMaxDepth {
+			return nil, errCborDepth
+		}
+		defer func() { d.depth-- }()
+		switch tag {
+		case cborTagPosBignum, cborTagNegBignum:
+			return d.bignum(tag)
+		case cborTagDecimal:
+			return d.decimal()
+		}
+		return d.value()
+	}
+	return d.simple(info)
+}
+
+// bignum reads the byte string of a bignum with tag.
+func (d *cborDecoder) bignum(tag uint64) (LValue, error) {
+	data, err := d.value()
+	str, ok := data.(LString)
+	if err != nil || !ok {
+		return nil, errors.New("invalid CBOR bignum")
+	}
+	n := new(big.Int).SetBytes([]byte(str))
+	if tag == cborTagNegBignum {
+		n.Sub(big.NewInt(-1), n)
+	}
+	return d.L.NewBigInt(n), nil
+}
+
+// decimal reads the array of exponent and mantissa of a decimal fraction.
+func (d *cborDecoder) decimal() (LValue, error) {
+	errDecimal := errors.New("invalid CBOR decimal fraction")
+	if d.pos >= len(d.data) || d.data[d.pos] != cborArray<<5|2 {
+		return nil, errDecimal
+	}
+	d.pos++
+	exp, err := d.value()
+	if err != nil {
+		return nil, err
+	}
+	e, ok := exp.(LNumber)
+	if i, isInteger := exp.(LInteger); isInteger {
+		e, ok = LNumber(i), true
+	}
+	if !ok || e != LNumber(int(e)) || e < -MaxDecimalScale || e > MaxDecimalScale {
+		return nil, errDecimal
+	}
+	mantissa, err := d.value()
+	if err != nil {
+		return nil, err
+	}
+	var n interface{}
+	switch mantissa.(type) {
+	case LNumber, LInteger, *LUserData:
+		n, err = toBignum(mantissa)
+	}
+	m, ok := n.(*big.Int)
+	if err != nil || !ok {
+		return nil, errDecimal
+	}
+	dec := &Decimal{m, -int(e)}
+	if dec.Scale < 0 {
+		dec = dec.Rescale(0)
+	}
+	return d.L.NewDecimal(dec), nil
+}
+
+func (d *cborDecoder) simple(info byte) (LValue, error) {
+	switch info {
+	case cborFalse & 0x1f:
+		return LFalse, nil
+	case cborTrue & 0x1f:
+		return LTrue, nil
+	case cborNull & 0x1f:
+		return d.L.jsonNull(), nil
+	case cborUndefined & 0x1f:
+		return LNil, nil
+	case cborBreak & 0x1f:
+		return nil, errCborBreak
+	case 25, 26, 27:
+		n, err := d.arg(info)
+		if err != nil {
+			return nil, err
+		}
+		switch info {
+		case 25:
+			return LNumber(float16(uint16(n))), nil
+		case 26:
+			return LNumber(math.Float32frombits(uint32(n))), nil
+		}
+		return LNumber(math.Float64frombits(n)), nil
+	}
+	return nil, fmt.Errorf("unsupported CBOR simple value %v", info)
+}
+
+// float16 converts an IEEE 754 half precision float.
+func float16(h uint16) float64 {
+	exp, frac := int(h>>10&0x1f), float64(h&0x3ff)
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(frac, -24)
+	case 0x1f:
+		f = math.Inf(1)
+		if frac != 0 {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(frac+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		f = -f
+	}
+	return f
+}
+
+// items calls item for each item of an array or map with length info, or
+// until the break of an indefinite one.
+func (d *cborDecoder) items(info byte, item func() error) error {
+	if info == cborIndefinite {
+		for {
+			if d.pos < len(d.data) && d.data[d.pos] == cborBreak {
+				d.pos++
+				return nil
+			}
+			if err := item(); err != nil {
+				return err
+			}
+		}
+	}
+	n, err := d.length(info)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		if err := item(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *cborDecoder) array(info byte) (LValue, error) {
+	arr := d.L.NewTable()
+	i := 0
+	err := d.items(info, func() error {
+		item, err := d.value()
+		if err != nil {
+			return err
+		}
+		i++
+		if item != LNil {
+			arr.RawSetInt(i, item)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	d.L.SetMetatable(arr, d.L.jsonMarker(jsonArray))
+	return arr, nil
+}
+
+func (d *cborDecoder) object(info byte) (LValue, error) {
+	tbl := d.L.NewTable()
+	err := d.items(info, func() error {
+		key, err := d.value()
+		if err != nil {
+			return err
+		}
+		switch k := key.(type) {
+		case LNumber:
+			if math.IsNaN(float64(k)) {
+				return errInvalidKeys
+			}
+		case LInteger, LString, LBool:
+		default:
+			return errInvalidKeys
+		}
+		item, err := d.value()
+		if err != nil {
+			return err
+		}
+		tbl.RawSet(key, item)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	d.L.SetMetatable(tbl, d.L.jsonMarker(jsonObject))
+	return tbl, nil
+}
+
+/* }}} */
@@ -0,0 +1,132 @@
+package lua
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"testing"
+)
+
+func TestCborEncode(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	tb := L.NewTable()
+	tb.RawSetString("a", LNumber(1))
+	tb.RawSetInt(3, LNumber(-500))
+	tb.RawSetString("f", LNumber(1.5))
+	data, err := EncodeCBOR(tb)
+	errorIfNotNil(t, err)
+	errorIfNotEqual(t, "a3033901f34161014166fb3ff8000000000000", hex.EncodeToString(data))
+
+	// RFC 8949 appendix A: indefinite lengths, half floats and text
+	data, _ = hex.DecodeString("bf61610161629f0203ffff")
+	lv, err := L.DecodeCBOR(data)
+	errorIfNotNil(t, err)
+	errorIfNotEqual(t, LNumber(3), lv.(*LTable).RawGetString("b").(*LTable).RawGetInt(2))
+	data, _ = hex.DecodeString("f93e00")
+	lv, err = L.DecodeCBOR(data)
+	errorIfNotNil(t, err)
+	errorIfNotEqual(t, LNumber(1.5), lv)
+
+	data, _ = hex.DecodeString("5f42010243030405ff")
+	lv, err = L.DecodeCBOR(data)
+	errorIfNotNil(t, err)
+	errorIfNotEqual(t, LString("\x01\x02\x03\x04\x05"), lv)
+
+	for _, bad := range []string{"", "9f01", "c401", "c2f6", "5a00000010", "0101", "a1f601", "5f5f4101ffff", "5f6161ff", "7f4161ff"} {
+		data, _ = hex.DecodeString(bad)
+		_, err = L.DecodeCBOR(data)
+		errorIfFalse(t, err != nil, "expected %v to fail", bad)
+	}
+	// long runs of tags must not exhaust the stack
+	_, err = L.DecodeCBOR(append(bytes.Repeat([]byte{0xc6}, 1<<20), 0x01))
+	errorIfFalse(t, err != nil, "expected nested tags to fail")
+}
+
+func TestCborBignums(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	// RFC 8949 appendix A
+	for _, vector := range []struct{ hex, text string }{
+		{"c249010000000000000000", "18446744073709551616"},
+		{"c349010000000000000000", "-18446744073709551617"},
+		{"c48221196ab3", "273.15"},
+		{"1b0020000000000001", "9007199254740993"},
+	} {
+		data, _ := hex.DecodeString(vector.hex)
+		lv, err := L.DecodeCBOR(data)
+		errorIfNotNil(t, err)
+		errorIfNotEqual(t, vector.text, fmt.Sprint(lv.(*LUserData).Value))
+		if vector.hex[0] == 'c' {
+			data, err = EncodeCBOR(lv)
+			errorIfNotNil(t, err)
+			errorIfNotEqual(t, vector.hex, hex.EncodeToString(data))
+		}
+	}
+}
+
+func TestCborRoundTrip(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	AJsonPreload(L)
+	ACborPreload(L)
+	errorIfScriptFail(t, L, `
+	local cbor, json = require("cbor"), require("json")
+	local v = {1, nil, 3, name = "x\0y", [true] = {}, [2.5] = json.null, nested = {ok = false}}
+	local data = assert(cbor.encode(v))
+	local d = assert(cbor.decode(data))
+	assert(d[1] == 1 and d[2] == nil and d[3] == 3 and d.name == "x\0y" and d[2.5] == json.null)
+	assert(d.nested.ok == false and next(d[true]) == nil)
+	assert(cbor.encode(d) == data)
+	assert(#cbor.encode(-0) == 9 and 1 / cbor.decode(cbor.encode(-0)) < 0)
+	assert(cbor.decode(cbor.encode(2^53)) == 2^53)
+	assert(type(cbor.decode(cbor.encode(2^60))) == "number" and cbor.decode(cbor.encode(-2^60)) < 1)
+	assert(#cbor.encode(2^60) == 9 and cbor.decode(cbor.encode(2^70)) == 2^70)
+
+	local empty = cbor.decode(cbor.encode(json.object()))
+	assert(json.encode(empty) == "{}" and json.encode(cbor.decode(cbor.encode({}))) == "[]")
+	local shared = {1}
+	assert(cbor.encode({shared, shared}))
+	local cycle = {}
+	cycle.self = cycle
+	assert(select(2, cbor.encode(cycle)):find("nested"))
+	assert(cbor.encode({[{}] = 1}) == nil and cbor.encode(print) == nil)
+	`)
+}
+
+func TestAdbCborEncoding(t *testing.T) {
+	L, err := NewMFSState(context.Background(), nil, nil, Options{AdbEncoding: "cbor"})
+	errorIfNotNil(t, err)
+	defer L.Close()
+	errorIfNotNil(t, L.MFS_Mkdir("/Data", true))
+	errorIfScriptFail(t, L, `
+	local db = adb.open("/cbortest")
+	db:put("k", {[1] = "a", [5] = "e", mixed = true})
+	local v = db:get("k")
+	assert(v[1] == "a" and v[5] == "e" and v.mixed == true)
+	local batch = db:newBatch()
+	batch:put("b", {2, 3})
+	batch:write()
+	local it = db:newIterator()
+	assert(it:first() and it:key() == "b" and it:value()[2] == 3)
+	it:release()
+	db:close()
+
+	local jdb = adb.open("/jsontest2", {encoding = "json"})
+	assert(not pcall(jdb.put, jdb, "k", {[1] = "a", [5] = "e"}))
+	jdb:close()
+	assert(not pcall(adb.open, "/x", {encoding = "xml"}))
+
+	-- the encoding is stored with the database
+	local ok, e = pcall(adb.open, "/cbortest", {encoding = "json"})
+	assert(not ok and error.is(e, error.INVALID) and tostring(e):find("encoded in cbor"), tostring(e))
+	assert(not pcall(adb.open, "/jsontest2"))
+	db = adb.open("/cbortest")
+	assert(db:get("b")[1] == 2)
+	it = db:newIterator()
+	assert(it:first() and it:key() == "b" and it:next() and it:key() == "k" and not it:next())
+	it:release()
+	db:close()
+	`)
+}
@@ -0,0 +1,216 @@
+package lua
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"hash"
+	"math/big"
+
+	"github.com/btcsuite/btcd/btcec"
+	mh "github.com/multiformats/go-multihash"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/sha3"
+)
+
+/*
+  Cryptography for contracts.
+
+  The crypto module hashes strings and verifies signatures, so that AApps
+  can authenticate their callers. Digests are hex strings, or raw strings
+  if the last argument is true:
+
+	local crypto = require("crypto")
+	crypto.sha256("abc")                  -- "ba7816bf..."
+	crypto.keccak256("abc", true)         -- 32 bytes
+	crypto.hmac("sha256", key, msg)
+	crypto.ed25519_verify(pub, msg, sig)  -- true or false
+
+  Keys and signatures are raw strings, crypto.unhex converts hex ones.
+*/
+
+// ACryptoPreload adds crypto to the given Lua state's package.preload table:
+//
+//	local crypto = require("crypto")
+func ACryptoPreload(L *LState) {
+	L.PreloadModule("crypto", ACryptoLoader)
+}
+
+// ACryptoLoader is the module loader function.
+func ACryptoLoader(L *LState) int {
+	t := L.NewTable()
+	L.SetFuncs(t, cryptoFuncs)
+	for name, newHash := range cryptoHashes {
+		t.RawSetString(name, L.NewFunction(cryptoHashFunc(newHash)))
+	}
+	L.Push(t)
+	return 1
+}
+
+var cryptoFuncs = map[string]LGFunction{
+	"hmac":              cryptoHmac,
+	"multihash":         cryptoMultihash,
+	"hex":               cryptoHex,
+	"unhex":             cryptoUnhex,
+	"ed25519_verify":    cryptoEd25519Verify,
+	"secp256k1_verify":  cryptoSecp256k1Verify,
+	"secp256k1_recover": cryptoSecp256k1Recover,
+}
+
+var cryptoHashes = map[string]func() hash.Hash{
+	"sha256":    sha256.New,
+	"sha512":    sha512.New,
+	"sha3_256":  sha3.New256,
+	"sha3_512":  sha3.New512,
+	"keccak256": sha3.NewLegacyKeccak256,
+	"blake2b": func() hash.Hash {
+		h, _ := blake2b.New256(nil)
+		return h
+	},
+	"blake2b512": func() hash.Hash {
+		h, _ := blake2b.New512(nil)
+		return h
+	},
+}
+
+// pushDigest pushes sum as hex, or raw if the argument at n is true.
+func pushDigest(L *LState, sum []byte, n int) int {
+	if L.OptBool(n, false) {
+		L.Push(LString(sum))
+	} else {
+		L.Push(LString(hex.EncodeToString(sum)))
+	}
+	return 1
+}
+
+// crypto.<hash>(data [, raw])
+func cryptoHashFunc(newHash func() hash.Hash) LGFunction {
+	return func(L *LState) int {
+		h := newHash()
+		h.Write([]byte(L.CheckString(1)))
+		return pushDigest(L, h.Sum(nil), 2)
+	}
+}
+
+// crypto.hmac(hash, key, data [, raw])
+func cryptoHmac(L *LState) int {
+	name := L.CheckString(1)
+	newHash, ok := cryptoHashes[name]
+	if !ok {
+		L.ArgError(1, "unknown hash '"+name+"'")
+	}
+	mac := hmac.New(newHash, []byte(L.CheckString(2)))
+	mac.Write([]byte(L.CheckString(3)))
+	return pushDigest(L, mac.Sum(nil), 4)
+}
+
+// crypto.multihash(data [, name [, raw]]) returns the multihash of data with
+// the hash function name, e.g. "sha2-256". It defaults to the hash of the CID
+// builder of the AApp, which MFS_OpenFile uses for new files.
+func cryptoMultihash(L *LState) int {
+	data := []byte(L.CheckString(1))
+	var sum mh.Multihash
+	var err error
+	if name := L.OptString(2, ""); len(name) > 0 {
+		code, ok := mh.Names[name]
+		if !ok {
+			L.ArgError(2, "unknown multihash '"+name+"'")
+		}
+		sum, err = mh.Sum(data, code, -1)
+	} else if L.ProtoNode != nil {
+		c, cerr := L.ProtoNode.CidBuilder().Sum(data)
+		sum, err = c.Hash(), cerr
+	} else {
+		sum, err = mh.Sum(data, mh.SHA2_256, -1)
+	}
+	if err != nil {
+		L.RaiseAAppError(NewAAppError(ErrCodeInvalid, "", err))
+	}
+	return pushDigest(L, sum, 3)
+}
+
+// crypto.hex(s)
+func cryptoHex(L *LState) int {
+	L.Push(LString(hex.EncodeToString([]byte(L.CheckString(1)))))
+	return 1
+}
+
+// crypto.unhex(s) returns nil and a message if s is not hex.
+func cryptoUnhex(L *LState) int {
+	data, err := hex.DecodeString(L.CheckString(1))
+	if err != nil {
+		L.Push(LNil)
+		L.Push(LString(err.Error()))
+		return 2
+	}
+	L.Push(LString(data))
+	return 1
+}
+
+// crypto.ed25519_verify(pubkey, message, signature)
+func cryptoEd25519Verify(L *LState) int {
+	pub, msg, sig := L.CheckString(1), L.CheckString(2), L.CheckString(3)
+	if len(pub) != ed25519.PublicKeySize || len(sig) != ed25519.SignatureSize {
+		L.Push(LFalse)
+		return 1
+	}
+	L.Push(LBool(ed25519.Verify(ed25519.PublicKey(pub), []byte(msg), []byte(sig))))
+	return 1
+}
+
+// parseSecp256k1Signature parses a DER signature or the 64 bytes of r and s.
+func parseSecp256k1Signature(sig []byte) (*btcec.Signature, error) {
+	if len(sig) == 64 {
+		return &btcec.Signature{
+			R: new(big.Int).SetBytes(sig[:32]),
+			S: new(big.Int).SetBytes(sig[32:]),
+		}, nil
+	}
+	return btcec.ParseDERSignature(sig, btcec.S256())
+}
+
+// crypto.secp256k1_verify(pubkey, hash, signature) verifies the signature of
+// a 32 byte hash, the key is compressed or not, the signature DER or r and s.
+func cryptoSecp256k1Verify(L *LState) int {
+	pub, digest, sig := L.CheckString(1), L.CheckString(2), L.CheckString(3)
+	key, err := btcec.ParsePubKey([]byte(pub), btcec.S256())
+	if err != nil {
+		L.Push(LFalse)
+		return 1
+	}
+	signature, err := parseSecp256k1Signature([]byte(sig))
+	if err != nil {
+		L.Push(LFalse)
+		return 1
+	}
+	L.Push(LBool(signature.Verify([]byte(digest), key)))
+	return 1
+}
+
+// crypto.secp256k1_recover(hash, signature) returns the uncompressed public
+// key that made a 65 byte signature of r, s and the recovery id v, 0 or 1 or
+// 27 or 28, as Ethereum does. It returns nil if there is none.
+func cryptoSecp256k1Recover(L *LState) int {
+	digest, sig := L.CheckString(1), L.CheckString(2)
+	if len(sig) != 65 {
+		L.ArgError(2, "65 byte signature expected")
+	}
+	v := sig[64]
+	if v >= 27 {
+		v -= 27
+	}
+	if v > 1 {
+		L.Push(LNil)
+		return 1
+	}
+	compact := append([]byte{27 + v}, sig[:64]...)
+	key, _, err := btcec.RecoverCompact(btcec.S256(), compact, []byte(digest))
+	if err != nil {
+		L.Push(LNil)
+		return 1
+	}
+	L.Push(LString(key.SerializeUncompressed()))
+	return 1
+}
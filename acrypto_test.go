@@ -0,0 +1,69 @@
+package lua
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
+func TestCryptoHashes(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	ACryptoPreload(L)
+	errorIfScriptFail(t, L, `
+	local crypto = require("crypto")
+	local sha = "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"
+	assert(crypto.sha256("abc") == sha)
+	assert(crypto.sha256("abc", true) == crypto.unhex(sha) and crypto.hex(crypto.sha256("abc", true)) == sha)
+	assert(crypto.keccak256("") == "c5d2460186f7233c927e7db2dcc703c0e500b653ca82273b7bfad8045d85a470")
+	assert(crypto.sha3_256("") == "a7ffc6f8bf1ed76651c14756a061d662f580ff4de43b49fa82d80a4b80f8434a")
+	assert(crypto.blake2b("") == "0e5751c026e543b2e8ab2eb06099daa1d1e5df47778f7787faab45cdf12fe3a8")
+	assert(#crypto.blake2b512("", true) == 64 and #crypto.sha512("") == 128)
+	assert(crypto.hmac("sha256", "Jefe", "what do ya want for nothing?") == "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843")
+	assert(crypto.multihash("abc", "sha2-256") == "1220" .. sha)
+	assert(crypto.multihash("abc") == "1220" .. sha)
+	assert(not pcall(crypto.hmac, "md5", "k", "m"))
+	assert(crypto.unhex("zz") == nil)
+	`)
+}
+
+func TestCryptoSignatures(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	ACryptoPreload(L)
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	errorIfNotNil(t, err)
+	L.SetGlobal("ed_pub", LString(pub))
+	L.SetGlobal("ed_sig", LString(ed25519.Sign(priv, []byte("hello"))))
+
+	key, err := btcec.NewPrivateKey(btcec.S256())
+	errorIfNotNil(t, err)
+	digest := make([]byte, 32)
+	digest[0] = 1
+	sig, err := key.Sign(digest)
+	errorIfNotNil(t, err)
+	compact, err := btcec.SignCompact(btcec.S256(), key, digest, false)
+	errorIfNotNil(t, err)
+	L.SetGlobal("k_pub", LString(key.PubKey().SerializeCompressed()))
+	L.SetGlobal("k_full", LString(key.PubKey().SerializeUncompressed()))
+	L.SetGlobal("k_digest", LString(digest))
+	L.SetGlobal("k_der", LString(sig.Serialize()))
+	L.SetGlobal("k_rsv", LString(append(compact[1:], compact[0]-27)))
+
+	errorIfScriptFail(t, L, `
+	local crypto = require("crypto")
+	assert(crypto.ed25519_verify(ed_pub, "hello", ed_sig))
+	assert(not crypto.ed25519_verify(ed_pub, "hellO", ed_sig))
+	assert(not crypto.ed25519_verify("short", "hello", ed_sig))
+
+	assert(crypto.secp256k1_verify(k_pub, k_digest, k_der))
+	assert(crypto.secp256k1_verify(k_full, k_digest, k_rsv:sub(1, 64)))
+	assert(not crypto.secp256k1_verify(k_pub, crypto.sha256("x", true), k_der))
+	assert(not crypto.secp256k1_verify("bad", k_digest, k_der))
+	assert(crypto.secp256k1_recover(k_digest, k_rsv) == k_full)
+	assert(crypto.secp256k1_recover(crypto.sha256("x", true), k_rsv) ~= k_full)
+	`)
+}
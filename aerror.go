@@ -0,0 +1,283 @@
+package lua
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+/*
+  Typed errors.
+
+  adb, io and the MFS functions fail with an AAppError, whose Code tells
+  scripts and hosts what went wrong. In Lua it is a userdata with the fields
+  code, message and cause, raised by adb and returned by io in place of the
+  message string, and tested with error.is(e, code):
+
+	local ok, e = pcall(db.get, db, "key")
+	if not ok and error.is(e, error.NOT_FOUND) then ... end
+
+  The error function becomes a table that is called like it to hold is, new
+  and the codes. tostring and .. give the message string that scripts got
+  before, with the position of a raised error.
+
+  On the Go side the codes match the sentinel errors below with errors.Is,
+  also through an ApiError returned by PCall.
+*/
+
+const (
+	ErrCodeNotFound   = "not_found"
+	ErrCodeExists     = "exists"
+	ErrCodeInvalid    = "invalid"
+	ErrCodePermission = "permission"
+	ErrCodeClosed     = "closed"
+	ErrCodeIO         = "io"
+)
+
+var (
+	ErrNotFound   = errors.New("not found")
+	ErrExists     = errors.New("already exists")
+	ErrInvalid    = errors.New("invalid argument")
+	ErrPermission = errors.New("permission denied")
+	ErrClosed     = errors.New("closed")
+	ErrIO         = errors.New("i/o failure")
+)
+
+var errorCodeSentinels = map[string]error{
+	ErrCodeNotFound:   ErrNotFound,
+	ErrCodeExists:     ErrExists,
+	ErrCodeInvalid:    ErrInvalid,
+	ErrCodePermission: ErrPermission,
+	ErrCodeClosed:     ErrClosed,
+	ErrCodeIO:         ErrIO,
+}
+
+const lAAppErrorClass = "error*"
+
+// AAppError is an error with a code, see the ErrCode constants.
+type AAppError struct {
+	Code    string
+	Message string
+	Cause   error
+	// where is the position a script raised the error at.
+	where string
+}
+
+// NewAAppError returns an error with code, message may be empty if there is
+// a cause.
+func NewAAppError(code, message string, cause error) *AAppError {
+	if len(message) == 0 && cause != nil {
+		message = cause.Error()
+	}
+	return &AAppError{Code: code, Message: message, Cause: cause}
+}
+
+func (e *AAppError) Error() string {
+	if e.Cause != nil && e.Cause.Error() != e.Message {
+		return e.Message + ": " + e.Cause.Error()
+	}
+	return e.Message
+}
+
+func (e *AAppError) Unwrap() error {
+	return e.Cause
+}
+
+// Is reports whether target is the sentinel error of the code of e.
+func (e *AAppError) Is(target error) bool {
+	return target != nil && errorCodeSentinels[e.Code] == target
+}
+
+// Unwrap returns the AAppError a script raised, or else the Cause.
+func (e *ApiError) Unwrap() error {
+	if ud, ok := e.Object.(*LUserData); ok {
+		if aerr, ok := ud.Value.(*AAppError); ok {
+			return aerr
+		}
+	}
+	return e.Cause
+}
+
+// toAAppError returns err as an AAppError, with a code guessed from err if it
+// is not one already.
+func toAAppError(err error) *AAppError {
+	var aerr *AAppError
+	if errors.As(err, &aerr) {
+		return aerr
+	}
+	code := ErrCodeIO
+	switch {
+	case errors.Is(err, leveldb.ErrNotFound), errors.Is(err, os.ErrNotExist):
+		code = ErrCodeNotFound
+	case errors.Is(err, os.ErrExist):
+		code = ErrCodeExists
+	case errors.Is(err, os.ErrPermission):
+		code = ErrCodePermission
+	case errors.Is(err, leveldb.ErrClosed), errors.Is(err, os.ErrClosed):
+		code = ErrCodeClosed
+	}
+	return NewAAppError(code, "", err)
+}
+
+// NewErrorValue returns err as an error userdata.
+func (ls *LState) NewErrorValue(err error) *LUserData {
+	ud := ls.NewUserData()
+	ud.Value = toAAppError(err)
+	ls.SetMetatable(ud, ls.errorMetatable())
+	return ud
+}
+
+// RaiseAAppError raises err as an error userdata.
+func (ls *LState) RaiseAAppError(err error) {
+	aerr := *toAAppError(err)
+	aerr.where = ls.where(0, true)
+	ud := ls.NewUserData()
+	ud.Value = &aerr
+	ls.SetMetatable(ud, ls.errorMetatable())
+	ls.Error(ud, 1)
+}
+
+// errorCode returns the code of an error value, an error userdata or a table
+// with a code field.
+func errorCode(lv LValue) (string, bool) {
+	switch v := lv.(type) {
+	case *LUserData:
+		if aerr, ok := v.Value.(*AAppError); ok {
+			return aerr.Code, true
+		}
+	case *LTable:
+		if code, ok := v.RawGetString("code").(LString); ok {
+			return string(code), true
+		}
+	}
+	return "", false
+}
+
+func (ls *LState) errorMetatable() *LTable {
+	if mt, ok := ls.GetTypeMetatable(lAAppErrorClass).(*LTable); ok {
+		return mt
+	}
+	mt := ls.NewTypeMetatable(lAAppErrorClass)
+	// not a package level map, errorIndex creates error values itself
+	ls.SetFuncs(mt, map[string]LGFunction{
+		"__index":    errorIndex,
+		"__tostring": errorToString,
+		"__concat":   errorConcat,
+	})
+	return mt
+}
+
+func checkAAppError(L *LState, n int) *AAppError {
+	ud := L.CheckUserData(n)
+	if aerr, ok := ud.Value.(*AAppError); ok {
+		return aerr
+	}
+	L.ArgError(n, "error expected")
+	return nil
+}
+
+func errorIndex(L *LState) int {
+	aerr := checkAAppError(L, 1)
+	switch L.CheckString(2) {
+	case "code":
+		L.Push(LString(aerr.Code))
+	case "message":
+		L.Push(LString(aerr.Message))
+	case "cause":
+		var cause *AAppError
+		switch {
+		case aerr.Cause == nil:
+			L.Push(LNil)
+		case errors.As(aerr.Cause, &cause):
+			L.Push(L.NewErrorValue(cause))
+		default:
+			L.Push(LString(aerr.Cause.Error()))
+		}
+	default:
+		L.Push(LNil)
+	}
+	return 1
+}
+
+// errorToString returns the message like RaiseError did.
+func errorToString(L *LState) int {
+	aerr := checkAAppError(L, 1)
+	if len(aerr.where) > 0 {
+		L.Push(LString(fmt.Sprintf("%v %v", aerr.where, aerr.Error())))
+	} else {
+		L.Push(LString(aerr.Error()))
+	}
+	return 1
+}
+
+func errorConcat(L *LState) int {
+	a, b := L.ToStringMeta(L.Get(1)), L.ToStringMeta(L.Get(2))
+	L.Push(LString(a.String() + b.String()))
+	return 1
+}
+
+/* error library {{{ */
+
+// OpenError replaces the error function with the error library, which is
+// called like it.
+func OpenError(L *LState) int {
+	L.SetGlobal(ErrorLibName, LNil)
+	mod := L.RegisterModule(ErrorLibName, errorFuncs).(*LTable)
+	for code := range errorCodeSentinels {
+		mod.RawSetString(strings.ToUpper(code), LString(code))
+	}
+	mt := L.NewTable()
+	mt.RawSetString("__call", L.NewFunction(errorCall))
+	L.SetMetatable(mod, mt)
+	L.Push(mod)
+	return 1
+}
+
+var errorFuncs = map[string]LGFunction{
+	"is":  errorIs,
+	"new": errorNew,
+}
+
+// error(message [, level]) raises message like the error function of Lua.
+func errorCall(L *LState) int {
+	L.Remove(1)
+	return baseError(L)
+}
+
+// error.is(e, code) tells whether e is an error with code, following causes.
+func errorIs(L *LState) int {
+	code := L.CheckString(2)
+	if ud, ok := L.Get(1).(*LUserData); ok {
+		if aerr, ok := ud.Value.(*AAppError); ok {
+			L.Push(LBool(errors.Is(aerr, errorCodeSentinels[code]) || aerr.Code == code))
+			return 1
+		}
+	}
+	got, ok := errorCode(L.Get(1))
+	L.Push(LBool(ok && got == code))
+	return 1
+}
+
+// error.new(code, message [, cause]) returns an error userdata, to be raised
+// by error or returned.
+func errorNew(L *LState) int {
+	aerr := NewAAppError(L.CheckString(1), L.CheckString(2), nil)
+	switch cause := L.Get(3).(type) {
+	case *LNilType:
+	case *LUserData:
+		if c, ok := cause.Value.(*AAppError); ok {
+			aerr.Cause = c
+		} else {
+			aerr.Cause = errors.New(L.ToStringMeta(cause).String())
+		}
+	default:
+		aerr.Cause = errors.New(L.ToStringMeta(cause).String())
+	}
+	L.Push(L.NewErrorValue(aerr))
+	return 1
+}
+
+/* }}} */
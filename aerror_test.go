@@ -0,0 +1,57 @@
+package lua
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestAAppErrors(t *testing.T) {
+	L, err := NewMFSState(context.Background(), nil, nil)
+	errorIfNotNil(t, err)
+	defer L.Close()
+	errorIfNotNil(t, L.MFS_Mkdir("/Data", true))
+
+	errorIfScriptFail(t, L, `
+	assert(type(error) == "table" and getmetatable(print) == nil)
+	local ok, e = pcall(function() error("still raises") end)
+	assert(not ok and e:find("^<string>:%d+: still raises$"), e)
+	ok, e = pcall(error, {code = "x"}, 2)
+	assert(not ok and error.is(e, "x") and select(2, pcall(error, "plain", 0)) == "plain")
+
+	local f, e = io.open("missing.txt")
+	assert(f == nil)
+	assert(error.is(e, error.NOT_FOUND), tostring(e))
+	assert(e.code == "not_found" and not error.is(e, error.IO))
+	assert(tostring(e):find("^/Data/missing.txt"), tostring(e))
+	assert(("failed: " .. e):find("^failed: /Data/missing.txt"))
+
+	local db = adb.open("/test")
+	local ok, e = pcall(db.get, db, "missing")
+	assert(not ok and error.is(e, "not_found"), tostring(e))
+	assert(tostring(e):find("^<string>:%d+: "), tostring(e))
+	db:close()
+
+	local quota = error.new("quota", "too big", e)
+	assert(error.is(quota, "quota") and error.is(quota, "not_found"))
+	assert(quota.message == "too big" and quota.cause.code == "not_found")
+	assert(error.is({code = "quota"}, "quota") and not error.is("quota", "quota"))
+	`)
+	errorIfScriptNotFail(t, L, "return print.x", "attempt to index a non-table object\\(function\\)")
+
+	err = L.DoString(`local db = adb.open("/test"); db:get("missing")`)
+	errorIfFalse(t, errors.Is(err, ErrNotFound), "expected ErrNotFound, got %v", err)
+	errorIfFalse(t, !errors.Is(err, ErrIO), "unexpected ErrIO %v", err)
+	var aerr *AAppError
+	errorIfFalse(t, errors.As(err, &aerr), "expected an AAppError, got %v", err)
+	errorIfNotEqual(t, ErrCodeNotFound, aerr.Code)
+	data, _ := json.Marshal(err)
+	errorIfFalse(t, strings.Contains(string(data), `"code":"not_found"`), "unexpected JSON %s", data)
+
+	_, err = L.MFS_LookupDir("/nothing")
+	errorIfFalse(t, errors.Is(err, ErrNotFound), "expected ErrNotFound, got %v", err)
+	_, err = L.MFS_LookupFile("/Data")
+	errorIfFalse(t, errors.Is(err, ErrInvalid), "expected ErrInvalid, got %v", err)
+}
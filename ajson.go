@@ -1,14 +1,47 @@
 package lua
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
 )
 
+/*
+  JSON codec.
+
+  Tables have no type of their own, so with the markers option the codec
+  tags the tables it decodes with the metatables json.array and json.object
+  to encode them again as they were, empty and sparse ones included. Scripts
+  tag their own tables with json.array(t) and json.object(t), or with a
+  __jsontype field of "array" or "object" in any metatable. Without the
+  null_as_nil option null is json.null, which is not nil, so that null
+  members and elements survive the round trip:
+
+	local opts = {markers = true, null_as_nil = false}
+	local t = json.decode('{"list": [], "map": {}, "none": null}', opts)
+	assert(json.encode(t) == '{"list":[],"map":{},"none":null}')
+
+  Both are off by default, as decoded values were plain tables and nil
+  before, and Options.Json turns them on for the state and adb.
+
+  Untagged tables are encoded by their keys as before: empty tables and
+  sequences are arrays, tables with string keys objects. Numbers that a Lua
+  number can not hold exactly are decoded to bigint and decimal userdata,
+  which are encoded with all their digits, see JsonNumberMode.
+*/
+
 // Preload adds json to the given Lua state's package.preload table. After it
 // has been preloaded, it can be loaded using require:
 //
-//  local json = require("json")
+//	local json = require("json")
 func AJsonPreload(L *LState) {
 	L.PreloadModule("json", AJsonLoader)
 }
@@ -17,19 +50,99 @@ func AJsonPreload(L *LState) {
 func AJsonLoader(L *LState) int {
 	t := L.NewTable()
 	L.SetFuncs(t, api)
+	t.RawSetString("null", L.jsonNull())
 	L.Push(t)
 	return 1
 }
 
 var api = map[string]LGFunction{
-	"decode": apiDecode,
-	"encode": apiEncode,
+	"decode":    apiDecode,
+	"encode":    apiEncode,
+	"array":     apiArray,
+	"object":    apiObject,
+	"canonical": apiCanonical,
+	"stream":    apiStream,
+	"events":    apiEvents,
+	"elements":  apiElements,
 }
 
+// JsonNumberMode tells how numbers that a Lua number can not hold exactly
+// are decoded.
+type JsonNumberMode int
+
+const (
+	// JsonNumberExact decodes integers to bigint and others to decimal.
+	JsonNumberExact JsonNumberMode = iota
+	// JsonNumberFloat rounds them to the nearest Lua number.
+	JsonNumberFloat
+	// JsonNumberString decodes integers to strings of their digits and
+	// rounds others.
+	JsonNumberString
+)
+
+var jsonNumberModeNames = map[string]JsonNumberMode{
+	"exact":  JsonNumberExact,
+	"float":  JsonNumberFloat,
+	"string": JsonNumberString,
+}
+
+// JsonOptions are the options of the JSON codec, the zero value encodes like
+// encoding/json and decodes null to nil and tables untagged.
+type JsonOptions struct {
+	// EmptyObject encodes untagged empty tables as {} in place of [].
+	EmptyObject bool
+	// SparseArrays encodes untagged tables with holes in their integer keys
+	// as arrays, with null for the holes.
+	SparseArrays bool
+	// MixedKeys encodes untagged tables with string and number keys as
+	// objects, with the numbers as strings.
+	MixedKeys bool
+	// Canonical encodes in the canonical form of RFC 8785 (JCS) for hashing
+	// and signatures: members sorted by the UTF-16 code units of their names,
+	// numbers in their shortest form, only the escapes strings need and no
+	// invalid UTF-8.
+	Canonical bool
+
+	Numbers JsonNumberMode
+	// Nulls decodes null to json.null, in place of nil that drops null
+	// members and leaves holes in arrays.
+	Nulls bool
+	// Markers tags decoded tables with json.array and json.object.
+	Markers bool
+}
+
+// jsonOptionsArg returns opts with the fields set in the options table at n.
+func jsonOptionsArg(L *LState, n int, opts JsonOptions) JsonOptions {
+	tb := L.OptTable(n, nil)
+	if tb == nil {
+		return opts
+	}
+	flag := func(name string, field *bool, invert bool) {
+		if v := tb.RawGetString(name); v != LNil {
+			*field = LVAsBool(v) != invert
+		}
+	}
+	flag("empty_object", &opts.EmptyObject, false)
+	flag("sparse", &opts.SparseArrays, false)
+	flag("mixed_keys", &opts.MixedKeys, false)
+	flag("canonical", &opts.Canonical, false)
+	flag("null_as_nil", &opts.Nulls, true)
+	flag("markers", &opts.Markers, false)
+	if v := tb.RawGetString("numbers"); v != LNil {
+		mode, ok := jsonNumberModeNames[v.String()]
+		if !ok {
+			L.ArgError(n, fmt.Sprintf("invalid numbers option '%v'", v))
+		}
+		opts.Numbers = mode
+	}
+	return opts
+}
+
+// json.decode(s [, options])
 func apiDecode(L *LState) int {
 	str := L.CheckString(1)
 
-	value, err := L.Decode([]byte(str))
+	value, err := L.DecodeWith([]byte(str), jsonOptionsArg(L, 2, L.Options.Json))
 	if err != nil {
 		L.Push(LNil)
 		L.Push(LString(err.Error()))
@@ -39,10 +152,27 @@ func apiDecode(L *LState) int {
 	return 1
 }
 
+// json.encode(v [, options])
 func apiEncode(L *LState) int {
 	value := L.CheckAny(1)
 
-	data, err := Encode(value)
+	data, err := EncodeWith(value, jsonOptionsArg(L, 2, L.Options.Json))
+	if err != nil {
+		L.Push(LNil)
+		L.Push(LString(err.Error()))
+		return 2
+	}
+	L.Push(LString(string(data)))
+	return 1
+}
+
+// json.canonical(v [, options]) encodes v in the canonical form.
+func apiCanonical(L *LState) int {
+	value := L.CheckAny(1)
+
+	opts := jsonOptionsArg(L, 2, L.Options.Json)
+	opts.Canonical = true
+	data, err := EncodeWith(value, opts)
 	if err != nil {
 		L.Push(LNil)
 		L.Push(LString(err.Error()))
@@ -52,10 +182,74 @@ func apiEncode(L *LState) int {
 	return 1
 }
 
+// json.array([t]) tags t, or a new table, to be encoded as an array.
+func apiArray(L *LState) int {
+	tb := L.OptTable(1, L.NewTable())
+	L.SetMetatable(tb, L.jsonMarker(jsonArray))
+	L.Push(tb)
+	return 1
+}
+
+// json.object([t]) tags t, or a new table, to be encoded as an object.
+func apiObject(L *LState) int {
+	tb := L.OptTable(1, L.NewTable())
+	L.SetMetatable(tb, L.jsonMarker(jsonObject))
+	L.Push(tb)
+	return 1
+}
+
+const (
+	jsonArray  = "array"
+	jsonObject = "object"
+)
+
+type jsonNullValue struct{}
+
+// jsonNull returns the json.null of the state.
+func (ls *LState) jsonNull() *LUserData {
+	if ud, ok := ls.G.Registry.RawGetString("json.null").(*LUserData); ok {
+		return ud
+	}
+	ud := ls.NewUserData()
+	ud.Value = jsonNullValue{}
+	mt := ls.NewTable()
+	mt.RawSetString("__tostring", ls.NewFunction(func(L *LState) int {
+		L.Push(LString("null"))
+		return 1
+	}))
+	ls.SetMetatable(ud, mt)
+	ls.G.Registry.RawSetString("json.null", ud)
+	return ud
+}
+
+// jsonMarker returns the metatable that tags tables as JSON arrays or
+// objects.
+func (ls *LState) jsonMarker(kind string) *LTable {
+	if mt, ok := ls.GetTypeMetatable("json." + kind).(*LTable); ok {
+		return mt
+	}
+	mt := ls.NewTypeMetatable("json." + kind)
+	mt.RawSetString("__jsontype", LString(kind))
+	return mt
+}
+
+// jsonTableKind returns the __jsontype of the metatable of tb.
+func jsonTableKind(tb *LTable) string {
+	if mt, ok := tb.Metatable.(*LTable); ok {
+		if kind, ok := mt.RawGetString("__jsontype").(LString); ok {
+			return string(kind)
+		}
+	}
+	return ""
+}
+
+/* encoding {{{ */
+
 var (
 	errNested      = errors.New("cannot encode recursively nested tables to JSON")
 	errSparseArray = errors.New("cannot encode sparse array")
 	errInvalidKeys = errors.New("cannot encode mixed or invalid key types")
+	errInvalidUTF8 = errors.New("cannot encode invalid UTF-8 in canonical JSON")
 )
 
 type invalidTypeError LValueType
@@ -64,93 +258,401 @@ func (i invalidTypeError) Error() string {
 	return `cannot encode ` + LValueType(i).String() + ` to JSON`
 }
 
-// Encode returns the JSON encoding of value.
+// Encode returns the JSON encoding of value with the default options.
 func Encode(value LValue) ([]byte, error) {
-	return json.Marshal(jsonValue{
-		LValue:  value,
-		visited: make(map[*LTable]bool),
-	})
+	return EncodeWith(value, JsonOptions{})
 }
 
-type jsonValue struct {
-	LValue
+// EncodeWith returns the JSON encoding of value.
+func EncodeWith(value LValue, opts JsonOptions) ([]byte, error) {
+	e := &jsonEncoder{opts: opts, visited: make(map[*LTable]bool)}
+	if err := e.encode(value); err != nil {
+		return nil, err
+	}
+	return e.buf.Bytes(), nil
+}
+
+type jsonEncoder struct {
+	buf     bytes.Buffer
+	opts    JsonOptions
 	visited map[*LTable]bool
 }
 
-func (j jsonValue) MarshalJSON() (data []byte, err error) {
-	switch converted := j.LValue.(type) {
+func (e *jsonEncoder) encode(value LValue) error {
+	switch converted := value.(type) {
 	case LBool:
-		data, err = json.Marshal(bool(converted))
+		e.buf.WriteString(strconv.FormatBool(bool(converted)))
 	case LNumber:
-		data, err = json.Marshal(float64(converted))
+		data, err := e.number(converted)
+		if err != nil {
+			return err
+		}
+		e.buf.WriteString(data)
+	case LInteger:
+		e.buf.WriteString(converted.String())
 	case *LNilType:
-		data = []byte(`null`)
+		e.buf.WriteString(`null`)
 	case LString:
-		data, err = json.Marshal(string(converted))
+		return e.string(string(converted))
+	case *LUserData:
+		switch n := converted.Value.(type) {
+		case jsonNullValue:
+			e.buf.WriteString(`null`)
+		case *big.Int, *Decimal:
+			e.buf.WriteString(fmt.Sprint(n))
+		default:
+			return invalidTypeError(value.Type())
+		}
 	case *LTable:
-		if j.visited[converted] {
-			return nil, errNested
-		}
-		j.visited[converted] = true
-
-		key, value := converted.Next(LNil)
-
-		switch key.Type() {
-		case LTNil: // empty table
-			data = []byte(`[]`)
-		case LTNumber:
-			arr := make([]jsonValue, 0, converted.Len())
-			expectedKey := LNumber(1)
-			for key != LNil {
-				if key.Type() != LTNumber {
-					err = errInvalidKeys
-					return
-				}
-				if expectedKey != key {
-					err = errSparseArray
-					return
-				}
-				arr = append(arr, jsonValue{value, j.visited})
-				expectedKey++
-				key, value = converted.Next(key)
+		if e.visited[converted] {
+			return errNested
+		}
+		e.visited[converted] = true
+		defer delete(e.visited, converted)
+		return e.table(converted)
+	default:
+		return invalidTypeError(value.Type())
+	}
+	return nil
+}
+
+func (e *jsonEncoder) number(n LNumber) (string, error) {
+	if e.opts.Canonical && n == 0 {
+		return "0", nil // not -0
+	}
+	// encoding/json formats floats like ECMAScript, as JCS requires
+	data, err := json.Marshal(float64(n))
+	return string(data), err
+}
+
+func (e *jsonEncoder) string(s string) error {
+	if !e.opts.Canonical {
+		data, _ := json.Marshal(s)
+		e.buf.Write(data)
+		return nil
+	}
+	if !utf8.ValidString(s) {
+		return errInvalidUTF8
+	}
+	e.buf.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"', '\\':
+			e.buf.WriteByte('\\')
+			e.buf.WriteRune(r)
+		case '\b':
+			e.buf.WriteString(`\b`)
+		case '\f':
+			e.buf.WriteString(`\f`)
+		case '\n':
+			e.buf.WriteString(`\n`)
+		case '\r':
+			e.buf.WriteString(`\r`)
+		case '\t':
+			e.buf.WriteString(`\t`)
+		default:
+			if r < 0x20 {
+				fmt.Fprintf(&e.buf, `\u%04x`, r)
+			} else {
+				e.buf.WriteRune(r)
 			}
-			data, err = json.Marshal(arr)
-		case LTString:
-			obj := make(map[string]jsonValue)
-			for key != LNil {
-				if key.Type() != LTString {
-					err = errInvalidKeys
-					return
+		}
+	}
+	e.buf.WriteByte('"')
+	return nil
+}
+
+// keyString returns the member name of a key.
+func (e *jsonEncoder) keyString(key LValue) (string, error) {
+	if n, ok := key.(LNumber); ok && e.opts.Canonical {
+		return e.number(n)
+	}
+	return key.String(), nil
+}
+
+// utf16Less compares strings by their UTF-16 code units, as JCS sorts names.
+func utf16Less(a, b string) bool {
+	ua, ub := utf16.Encode([]rune(a)), utf16.Encode([]rune(b))
+	for i := 0; i < len(ua) && i < len(ub); i++ {
+		if ua[i] != ub[i] {
+			return ua[i] < ub[i]
+		}
+	}
+	return len(ua) < len(ub)
+}
+
+func (e *jsonEncoder) table(tb *LTable) error {
+	// count the positive integer keys and collect the others
+	n, max, other := 0, 0, false
+	var keys []LValue
+	tb.ForEach(func(key, _ LValue) {
+		switch k := key.(type) {
+		case LNumber:
+			if i := int(k); LNumber(i) == k && i > 0 {
+				n++
+				if i > max {
+					max = i
 				}
-				obj[key.String()] = jsonValue{value, j.visited}
-				key, value = converted.Next(key)
+				return
 			}
-			data, err = json.Marshal(obj)
+		case LString:
 		default:
-			err = errInvalidKeys
+			other = true
+		}
+		keys = append(keys, key)
+	})
+
+	switch jsonTableKind(tb) {
+	case jsonArray:
+		if len(keys) > 0 || other {
+			return errInvalidKeys
+		}
+		return e.array(tb, max)
+	case jsonObject:
+		if other {
+			return errInvalidKeys
+		}
+		return e.object(tb)
+	}
+	switch {
+	case other:
+		return errInvalidKeys
+	case n == 0 && len(keys) == 0:
+		if e.opts.EmptyObject {
+			e.buf.WriteString(`{}`)
+		} else {
+			e.buf.WriteString(`[]`)
+		}
+		return nil
+	case len(keys) == 0:
+		if max != n && !e.opts.SparseArrays {
+			return errSparseArray
+		}
+		return e.array(tb, max)
+	case n > 0 && !e.opts.MixedKeys:
+		return errInvalidKeys
+	}
+	for _, key := range keys {
+		if _, ok := key.(LString); !ok && !e.opts.MixedKeys {
+			return errInvalidKeys
 		}
-	default:
-		err = invalidTypeError(j.LValue.Type())
 	}
-	return
+	return e.object(tb)
 }
 
-// Decode converts the JSON encoded data to Lua values.
-func ( l *LState ) Decode(data []byte) (LValue, error) {
+func (e *jsonEncoder) array(tb *LTable, n int) error {
+	e.buf.WriteByte('[')
+	for i := 1; i <= n; i++ {
+		if i > 1 {
+			e.buf.WriteByte(',')
+		}
+		if err := e.encode(tb.RawGetInt(i)); err != nil {
+			return err
+		}
+	}
+	e.buf.WriteByte(']')
+	return nil
+}
 
-	var value interface{}
-	err := json.Unmarshal(data, &value)
+func (e *jsonEncoder) object(tb *LTable) error {
+	members := make(map[string]LValue)
+	var names []string
+	var err error
+	tb.ForEach(func(key, value LValue) {
+		name, kerr := e.keyString(key)
+		if kerr != nil {
+			err = kerr
+		} else if _, ok := members[name]; ok {
+			err = errInvalidKeys // e.g. 1 and "1"
+		}
+		members[name] = value
+		names = append(names, name)
+	})
 	if err != nil {
+		return err
+	}
+	if e.opts.Canonical {
+		sort.Slice(names, func(i, j int) bool { return utf16Less(names[i], names[j]) })
+	} else {
+		sort.Strings(names)
+	}
+
+	e.buf.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			e.buf.WriteByte(',')
+		}
+		if err := e.string(name); err != nil {
+			return err
+		}
+		e.buf.WriteByte(':')
+		if err := e.encode(members[name]); err != nil {
+			return err
+		}
+	}
+	e.buf.WriteByte('}')
+	return nil
+}
+
+/* }}} */
+
+/* decoding {{{ */
+
+// Decode converts the JSON encoded data to Lua values, with the Json options
+// of the state.
+func (l *LState) Decode(data []byte) (LValue, error) {
+	return l.DecodeWith(data, l.Options.Json)
+}
+
+// DecodeWith converts the JSON encoded data to Lua values.
+func (l *LState) DecodeWith(data []byte, opts JsonOptions) (LValue, error) {
+	d := &jsonDecoder{L: l, dec: json.NewDecoder(bytes.NewReader(data)), opts: opts}
+	d.dec.UseNumber()
+	value, err := d.value()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := d.dec.Token(); err != io.EOF {
+		return nil, errors.New("invalid data after top-level JSON value")
+	}
+	return value, nil
+}
+
+type jsonDecoder struct {
+	L    *LState
+	dec  *json.Decoder
+	opts JsonOptions
+}
+
+func (d *jsonDecoder) value() (LValue, error) {
+	tok, err := d.dec.Token()
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if delim, ok := tok.(json.Delim); ok {
+		if delim == '[' {
+			return d.array()
+		}
+		return d.object()
+	}
+	return d.scalar(tok)
+}
+
+// scalar converts a token that is not a delimiter.
+func (d *jsonDecoder) scalar(tok json.Token) (LValue, error) {
+	switch converted := tok.(type) {
+	case bool:
+		return LBool(converted), nil
+	case string:
+		return LString(converted), nil
+	case json.Number:
+		return d.L.jsonNumber(string(converted), d.opts.Numbers)
+	case nil:
+		if d.opts.Nulls {
+			return d.L.jsonNull(), nil
+		}
+		return LNil, nil
+	}
+	return nil, fmt.Errorf("unexpected JSON token %v", tok)
+}
+
+func (d *jsonDecoder) array() (LValue, error) {
+	arr := d.L.NewTable()
+	for i := 1; d.dec.More(); i++ {
+		item, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		if item != LNil {
+			arr.RawSetInt(i, item)
+		}
+	}
+	if _, err := d.dec.Token(); err != nil {
 		return nil, err
 	}
-	return l.DecodeValue(value), nil
+	if d.opts.Markers {
+		d.L.SetMetatable(arr, d.L.jsonMarker(jsonArray))
+	}
+	return arr, nil
+}
+
+func (d *jsonDecoder) object() (LValue, error) {
+	tbl := d.L.NewTable()
+	for d.dec.More() {
+		key, err := d.dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		item, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		tbl.RawSetString(key.(string), item)
+	}
+	if _, err := d.dec.Token(); err != nil {
+		return nil, err
+	}
+	if d.opts.Markers {
+		d.L.SetMetatable(tbl, d.L.jsonMarker(jsonObject))
+	}
+	return tbl, nil
+}
+
+// jsonNumber converts the number literal lit.
+func (ls *LState) jsonNumber(lit string, mode JsonNumberMode) (LValue, error) {
+	integral := !strings.ContainsAny(lit, ".eE")
+	f, err := strconv.ParseFloat(lit, 64)
+	if err != nil {
+		// out of the range of floats, only exact numbers and strings hold it
+		ne, ok := err.(*strconv.NumError)
+		if !ok || ne.Err != strconv.ErrRange || mode == JsonNumberFloat || mode == JsonNumberString && !integral {
+			return nil, fmt.Errorf("cannot decode JSON number %v: %v", lit, err)
+		}
+	}
+	if !integral {
+		if mode != JsonNumberExact {
+			return LNumber(f), nil
+		}
+		// the shortest literal of f has its value if it is exact
+		d, derr := ParseDecimal(lit)
+		if derr != nil {
+			return nil, fmt.Errorf("cannot decode JSON number %v exactly", lit)
+		}
+		if short, serr := ParseDecimal(strconv.FormatFloat(f, 'g', -1, 64)); serr == nil && short.Cmp(d) == 0 {
+			return LNumber(f), nil
+		}
+		return ls.NewDecimal(d), nil
+	}
+	if ls.Options.Integers {
+		if i, ok := parseInteger(lit); ok {
+			return i, nil
+		}
+	}
+	if err == nil && strconv.FormatFloat(f, 'f', -1, 64) == lit {
+		return LNumber(f), nil
+	}
+	switch mode {
+	case JsonNumberFloat:
+		return LNumber(f), nil
+	case JsonNumberString:
+		return LString(lit), nil
+	}
+	n, ok := new(big.Int).SetString(lit, 10)
+	if !ok {
+		return nil, fmt.Errorf("cannot decode JSON number %v", lit)
+	}
+	return ls.NewBigInt(n), nil
 }
 
 // DecodeValue converts the value to a Lua value.
 //
 // This function only converts values that the encoding/json package decodes to.
-// All other values will return lua.LNil.
-func ( l *LState ) DecodeValue( value interface{}) LValue {
+// All other values will return lua.LNil. Numbers that a Lua number can not
+// hold exactly are kept as strings.
+func (l *LState) DecodeValue(value interface{}) LValue {
 	switch converted := value.(type) {
 	case bool:
 		return LBool(converted)
@@ -159,6 +661,9 @@ func ( l *LState ) DecodeValue( value interface{}) LValue {
 	case string:
 		return LString(converted)
 	case json.Number:
+		if lv, err := l.jsonNumber(string(converted), JsonNumberString); err == nil {
+			return lv
+		}
 		return LString(converted)
 	case []interface{}:
 		arr := l.CreateTable(len(converted), 0)
@@ -178,3 +683,5 @@ func ( l *LState ) DecodeValue( value interface{}) LValue {
 
 	return LNil
 }
+
+/* }}} */
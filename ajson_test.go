@@ -0,0 +1,210 @@
+package lua
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func TestJsonRoundTrip(t *testing.T) {
+	L := NewState(Options{Json: JsonOptions{Nulls: true, Markers: true}})
+	defer L.Close()
+	AJsonPreload(L)
+	errorIfScriptFail(t, L, `
+	local json = require("json")
+	local src = '{"big":9007199254740993,"empty":{},"list":[1,null,3],"none":null,"nums":[],"x":1.5}'
+	assert(json.encode(json.decode(src)) == src)
+	local t = assert(json.decode(src, {numbers = "string"}))
+	assert(t.big == "9007199254740993" and t.none == json.null and t.list[2] == json.null)
+	assert(json.encode(t) == src:gsub('9007199254740993', '"9007199254740993"'), json.encode(t))
+	assert(json.decode(src, {numbers = "float"}).big == 9007199254740992)
+
+	local n = json.decode('[1,null,3]', {null_as_nil = true})
+	assert(n[2] == nil and json.encode(n) == "[1,null,3]")
+	assert(json.encode(json.decode('{}', {markers = false})) == "[]")
+
+	assert(json.encode({}) == "[]" and json.encode({}, {empty_object = true}) == "{}")
+	assert(json.encode(json.object()) == "{}" and json.encode(json.array({})) == "[]")
+	assert(json.encode(json.object({1, 2})) == '{"1":1,"2":2}')
+	assert(json.encode(setmetatable({a = 1}, {__jsontype = "object"})) == '{"a":1}')
+
+	local sparse = {[1] = 1, [3] = 3}
+	assert(json.encode(sparse) == nil)
+	assert(json.encode(sparse, {sparse = true}) == "[1,null,3]")
+	assert(json.encode(json.array(sparse)) == "[1,null,3]")
+	local mixed = {1, a = 2}
+	assert(json.encode(mixed) == nil)
+	assert(json.encode(mixed, {mixed_keys = true}) == '{"1":1,"a":2}')
+	assert(json.encode(json.array({a = 1})) == nil)
+
+	local shared = {1}
+	assert(json.encode({shared, shared}) == "[[1],[1]]")
+	local cycle = {}
+	cycle[1] = cycle
+	assert(select(2, json.encode(cycle)):find("nested"))
+	assert(json.decode("[1] x") == nil and json.decode("[1") == nil)
+	assert(tostring(json.null) == "null")
+	`)
+}
+
+func TestJsonDecodeDefaults(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	AJsonPreload(L)
+	errorIfScriptFail(t, L, `
+	local json = require("json")
+	local t = json.decode('{"a": null, "b": [1, null, 3], "c": {}}')
+	assert(t.a == nil and t.b[2] == nil and t.b[3] == 3)
+	assert(getmetatable(t) == nil and getmetatable(t.b) == nil and getmetatable(t.c) == nil)
+	assert(json.encode(t.c) == "[]" and json.encode(t.b) == nil)
+	t = json.decode('[null]', {null_as_nil = false, markers = true})
+	assert(t[1] == json.null and json.encode(t) == "[null]")
+	`)
+}
+
+func TestJsonEncodeCompat(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	tb := L.NewTable()
+	tb.RawSetString("b", LString("<x>"))
+	tb.RawSetString("a", LNumber(1e21))
+	data, err := Encode(tb)
+	errorIfNotNil(t, err)
+	errorIfNotEqual(t, `{"a":1e+21,"b":"\u003cx\u003e"}`, string(data))
+
+	errorIfNotEqual(t, LString("12345678901234567890"), L.DecodeValue(json.Number("12345678901234567890")))
+	errorIfNotEqual(t, LNumber(12), L.DecodeValue(json.Number("12")))
+}
+
+func TestAdbJsonOptions(t *testing.T) {
+	L, err := NewMFSState(context.Background(), nil, nil, Options{Json: JsonOptions{EmptyObject: true, Nulls: true, Markers: true}})
+	errorIfNotNil(t, err)
+	defer L.Close()
+	errorIfNotNil(t, L.MFS_Mkdir("/Data", true))
+	AJsonPreload(L)
+	errorIfScriptFail(t, L, `
+	local json = require("json")
+	local db = adb.open("/jsontest")
+	db:put("k", {a = {}, b = json.array(), c = json.null})
+	local v = db:get("k")
+	assert(json.encode(v) == '{"a":{},"b":[],"c":null}', json.encode(v))
+	assert(json.encode({}) == "{}")
+	db:close()
+	`)
+}
+
+func TestJsonCanonical(t *testing.T) {
+	L := NewState(Options{CanonicalResults: true})
+	defer L.Close()
+	AJsonPreload(L)
+	errorIfScriptFail(t, L, `
+	local json = require("json")
+	assert(json.canonical({1e21, 1e-7, -0, 333333333.33333329, 4.5}) == "[1e+21,1e-7,0,333333333.3333333,4.5]")
+	assert(json.canonical("€$\15\nA'B\"\\/<") == [["€$\u000f\nA'B\"\\/<"]])
+	local keys = {["€"] = 1, ["\r"] = 2, ["\239\172\179"] = 3, ["1"] = 4, ["😀"] = 5, ["\194\128"] = 6, ["ö"] = 7}
+	assert(json.canonical(keys) == '{"\\r":2,"1":4,"\194\128":6,"ö":7,"€":1,"😀":5,"\239\172\179":3}', json.canonical(keys))
+	assert(json.canonical("\255") == nil)
+	assert(json.encode("<") == '"\\u003c"' and json.encode("\255"))
+	function result() return {b = "<", a = -0} end
+	`)
+	data, err := L.PerfromGlobal("result")
+	errorIfNotNil(t, err)
+	errorIfNotEqual(t, `{"a":0,"b":"<"}`, string(data))
+}
+
+func TestJsonStream(t *testing.T) {
+	L, err := NewMFSState(context.Background(), nil, nil, Options{Json: JsonOptions{Nulls: true}})
+	errorIfNotNil(t, err)
+	defer L.Close()
+	errorIfNotNil(t, L.MFS_Mkdir("/Data", true))
+	AJsonPreload(L)
+	errorIfScriptFail(t, L, `
+	local json = require("json")
+	local f = io.open("items.json", "w")
+	f:write('[{"id": 1, "tags": ["a"]}, null, "x", {"id": 2}]')
+	f:close()
+
+	f = io.open("items.json")
+	local ids = {}
+	for i, item in json.elements(f) do
+		ids[#ids + 1] = i .. "=" .. (type(item) == "table" and json.encode(item) or tostring(item))
+	end
+	assert(table.concat(ids, " ") == '1={"id":1,"tags":["a"]} 2=null 3=x 4={"id":2}', table.concat(ids, " "))
+
+	local events = {}
+	for event, value in json.events(f) do
+		events[#events + 1] = event .. (value ~= nil and "(" .. tostring(value) .. ")" or "")
+	end
+	assert(table.concat(events, " ") == "start_array start_object key(id) value(1) key(tags) start_array value(a) end_array end_object value(null) value(x) start_object key(id) value(2) end_object end_array", table.concat(events, " "))
+
+	local s = json.stream(f)
+	assert(s:element().id == 1)
+	s:close()
+	assert(s:element() == nil)
+	f:close()
+
+	-- the streams are closed, the file can be written again
+	f = io.open("items.json", "w")
+	f:write("{}")
+	f:close()
+	local ok, e = pcall(function() for _ in json.elements(io.open("items.json")) do end end)
+	assert(not ok and error.is(e, error.INVALID), tostring(e))
+	assert(select("#", json.stream('{"a": [1, 2]}'):next()) == 2)
+	`)
+}
+
+func TestJsonStreamLeftOpen(t *testing.T) {
+	L, err := NewMFSState(context.Background(), nil, nil)
+	errorIfNotNil(t, err)
+	defer L.Close()
+	errorIfNotNil(t, L.MFS_Mkdir("/Data", true))
+	AJsonPreload(L)
+	errorIfScriptFail(t, L, `
+	local json = require("json")
+	local f = io.open("items.json", "w")
+	f:write("[1, 2, 3]")
+	f:close()
+
+	-- leaving a loop early must not keep the file locked
+	local r = io.open("items.json")
+	for i, v in json.elements(r) do break end
+	f = io.open("items.json", "w")
+	f:write("[4, 5, 6]")
+	f:close()
+
+	local ok, e = pcall(function() for i, v in json.elements(r) do error("stop") end end)
+	assert(not ok and tostring(e):find("stop"), tostring(e))
+	r:close()
+	f = io.open("items.json", "w")
+	f:write("[7, 8, 9]")
+	f:close()
+
+	local s = json.stream(io.open("items.json"))
+	assert(s:element() == 7)
+
+	-- a write in the loop ends it with an error, not silently
+	ok, e = pcall(function()
+		for i, v in json.elements(io.open("items.json")) do
+			local w = io.open("items.json", "w")
+			w:write("[1, 2, 3]")
+			w:close()
+		end
+	end)
+	assert(not ok and error.is(e, error.CLOSED) and tostring(e):find("written"), tostring(e))
+
+	f = io.open("other.json", "w")
+	f:write("[1, 2]")
+	f:close()
+	items, other = json.stream(io.open("items.json")), json.stream(io.open("other.json"))
+	assert(items:element() == 1 and other:element() == 1)
+	`)
+	_, err = L.FlushMFS()
+	errorIfNotNil(t, err)
+	_, err = L.MFS_Flush("/Data/items.json")
+	errorIfNotNil(t, err)
+	errorIfScriptFail(t, L, `
+	local ok, e = pcall(items.element, items)
+	assert(not ok and error.is(e, error.CLOSED) and tostring(e):find("flushed"), tostring(e))
+	assert(other:element() == 2 and other:element() == nil)
+	`)
+}
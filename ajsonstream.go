@@ -0,0 +1,352 @@
+package lua
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ipfs/go-mfs"
+)
+
+/*
+  Streaming JSON decoding.
+
+  A JsonStream decodes a document token by token from a reader, such as a
+  file of /Data, without loading it whole. Next returns SAX-like events,
+  Element the elements of a top-level array one by one:
+
+	local f = io.open("big.json")
+	for i, item in json.elements(f) do ... end
+	for event, value in json.events(f) do ... end
+
+  The iterators close the stream at the end of the document, a loop that
+  stops early closes it with the stream returned by json.stream. A stream
+  reads from the position of the file and does not move it.
+
+  A stream of a file holds a read lock of the MFS file until it is closed,
+  so the streams of a file are also closed when the file is closed, written
+  or flushed, and when the state is closed. The next call of a stream that
+  was closed this way fails, a loop over it does not just end early.
+*/
+
+// Events of a JsonStream.
+const (
+	JsonStartObject = "start_object"
+	JsonEndObject   = "end_object"
+	JsonStartArray  = "start_array"
+	JsonEndArray    = "end_array"
+	// JsonKey comes with the name of a member, which is followed by its value.
+	JsonKey = "key"
+	// JsonValue comes with a string, number, boolean or null.
+	JsonValue = "value"
+)
+
+const lJsonStreamClass = "json.stream*"
+
+type jsonFrame struct {
+	object    bool
+	expectKey bool
+}
+
+// JsonStream decodes a JSON document from a reader, either by events with
+// Next or by the elements of a top-level array with Element.
+type JsonStream struct {
+	jsonDecoder
+	closer  io.Closer
+	stack   []jsonFrame
+	started bool
+	done    bool
+	// vfp is the MFS file that a stream of a file reads.
+	vfp *mfs.File
+	// interrupted is the error of a stream that closeJsonStreams closed.
+	interrupted error
+}
+
+// NewJsonStream returns a stream that decodes from r, it closes r on Close
+// if r is an io.Closer.
+func (ls *LState) NewJsonStream(r io.Reader, opts JsonOptions) *JsonStream {
+	s := &JsonStream{jsonDecoder: jsonDecoder{L: ls, dec: json.NewDecoder(r), opts: opts}}
+	s.dec.UseNumber()
+	s.closer, _ = r.(io.Closer)
+	return s
+}
+
+// Next returns the next event and its value, io.EOF at the end of the
+// document.
+func (s *JsonStream) Next() (string, LValue, error) {
+	if s.interrupted != nil {
+		return "", nil, s.interrupted
+	}
+	if s.done {
+		return "", nil, io.EOF
+	}
+	tok, err := s.dec.Token()
+	if err != nil {
+		return "", nil, err
+	}
+
+	var top *jsonFrame
+	if n := len(s.stack); n > 0 {
+		top = &s.stack[n-1]
+	}
+	switch converted := tok.(type) {
+	case json.Delim:
+		switch converted {
+		case '{':
+			s.stack = append(s.stack, jsonFrame{object: true, expectKey: true})
+			return JsonStartObject, LNil, nil
+		case '[':
+			s.stack = append(s.stack, jsonFrame{})
+			return JsonStartArray, LNil, nil
+		}
+		s.stack = s.stack[:len(s.stack)-1]
+		s.valueDone()
+		if converted == '}' {
+			return JsonEndObject, LNil, nil
+		}
+		return JsonEndArray, LNil, nil
+	case string:
+		if top != nil && top.expectKey {
+			top.expectKey = false
+			return JsonKey, LString(converted), nil
+		}
+	}
+
+	value, err := s.scalar(tok)
+	if err != nil {
+		return "", nil, err
+	}
+	s.valueDone()
+	return JsonValue, value, nil
+}
+
+// valueDone expects the next key if the value was a member of an object.
+func (s *JsonStream) valueDone() {
+	if n := len(s.stack); n > 0 && s.stack[n-1].object {
+		s.stack[n-1].expectKey = true
+	}
+}
+
+// Element returns the next element of the top-level array, io.EOF after the
+// last one.
+func (s *JsonStream) Element() (LValue, error) {
+	if s.interrupted != nil {
+		return nil, s.interrupted
+	}
+	if s.done {
+		return nil, io.EOF
+	}
+	if !s.started {
+		s.started = true
+		tok, err := s.dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		if tok != json.Delim('[') {
+			return nil, errors.New("top-level JSON value is not an array")
+		}
+	}
+	if s.dec.More() {
+		return s.value()
+	}
+	if _, err := s.dec.Token(); err != nil {
+		return nil, err
+	}
+	s.done = true
+	return nil, io.EOF
+}
+
+// Close closes the reader of the stream.
+func (s *JsonStream) Close() error {
+	s.done = true
+	if s.vfp != nil {
+		delete(s.L.G.jsonStreams, s)
+	}
+	if s.closer == nil {
+		return nil
+	}
+	closer := s.closer
+	s.closer = nil
+	return closer.Close()
+}
+
+// closeJsonStreams closes the streams of the MFS file vfp, or all streams of
+// files if vfp is nil, because the file was closed, written or flushed as
+// reason tells.
+func (ls *LState) closeJsonStreams(vfp *mfs.File, reason string) {
+	for s := range ls.G.jsonStreams {
+		if vfp == nil || s.vfp == vfp {
+			s.interrupted = NewAAppError(ErrCodeClosed, "JSON stream closed, its file was "+reason, nil)
+			s.Close()
+		}
+	}
+}
+
+// raiseJsonStreamError closes s and raises err, an error of the data unless
+// the stream was interrupted.
+func raiseJsonStreamError(L *LState, s *JsonStream, err error) {
+	s.Close()
+	if err != s.interrupted {
+		err = NewAAppError(ErrCodeInvalid, "", err)
+	}
+	L.RaiseAAppError(err)
+}
+
+/* Lua API {{{ */
+
+var jsonStreamMethods = map[string]LGFunction{
+	"next":     jsonStreamNext,
+	"element":  jsonStreamElement,
+	"events":   jsonStreamEvents,
+	"elements": jsonStreamElements,
+	"close":    jsonStreamClose,
+}
+
+// newJsonStream returns a stream userdata for the file or string at 1, with
+// the options at 2.
+func newJsonStream(L *LState) (*LUserData, *JsonStream) {
+	var r io.Reader
+	var vfp *mfs.File
+	switch src := L.Get(1).(type) {
+	case LString:
+		r = strings.NewReader(string(src))
+	case *LUserData:
+		file, ok := src.Value.(*lFile)
+		if !ok {
+			L.ArgError(1, "file or string expected")
+		}
+		errorIfFileIsClosed(L, file)
+		if !file.readable {
+			L.RaiseAAppError(NewAAppError(ErrCodePermission, fmt.Sprintf("%s is opened for only writing.", file.Name()), nil))
+		}
+		rd, err := file.getReader(L)
+		if err != nil {
+			L.RaiseAAppError(err)
+		}
+		r, vfp = rd, file.vfp
+	default:
+		L.ArgError(1, "file or string expected")
+	}
+
+	s := L.NewJsonStream(r, jsonOptionsArg(L, 2, L.Options.Json))
+	if vfp != nil {
+		s.vfp = vfp
+		if L.G.jsonStreams == nil {
+			L.G.jsonStreams = make(map[*JsonStream]bool)
+		}
+		L.G.jsonStreams[s] = true
+	}
+	ud := L.NewUserData()
+	ud.Value = s
+	mt, ok := L.GetTypeMetatable(lJsonStreamClass).(*LTable)
+	if !ok {
+		mt = L.NewTypeMetatable(lJsonStreamClass)
+		mt.RawSetString("__index", L.SetFuncs(L.NewTable(), jsonStreamMethods))
+	}
+	L.SetMetatable(ud, mt)
+	return ud, s
+}
+
+func checkJsonStream(L *LState) *JsonStream {
+	ud := L.CheckUserData(1)
+	if s, ok := ud.Value.(*JsonStream); ok {
+		return s
+	}
+	L.ArgError(1, "json stream expected")
+	return nil
+}
+
+// json.stream(src [, options]) returns a stream over a file or a string.
+func apiStream(L *LState) int {
+	ud, _ := newJsonStream(L)
+	L.Push(ud)
+	return 1
+}
+
+// json.events(src [, options]) iterates over the events of a file or string.
+func apiEvents(L *LState) int {
+	ud, _ := newJsonStream(L)
+	L.Push(L.NewFunction(jsonStreamNext))
+	L.Push(ud)
+	return 2
+}
+
+// json.elements(src [, options]) iterates over the index and the value of
+// the elements of the top-level array in a file or string.
+func apiElements(L *LState) int {
+	ud, _ := newJsonStream(L)
+	L.Push(L.NewFunction(jsonStreamElementsIter))
+	L.Push(ud)
+	L.Push(LNumber(0))
+	return 3
+}
+
+// stream:next() returns the next event and its value, nothing at the end.
+func jsonStreamNext(L *LState) int {
+	s := checkJsonStream(L)
+	event, value, err := s.Next()
+	if err == io.EOF {
+		s.Close()
+		return 0
+	}
+	if err != nil {
+		raiseJsonStreamError(L, s, err)
+	}
+	L.Push(LString(event))
+	L.Push(value)
+	return 2
+}
+
+// stream:element() returns the next element of the top-level array, nothing
+// after the last one.
+func jsonStreamElement(L *LState) int {
+	s := checkJsonStream(L)
+	value, err := s.Element()
+	if err == io.EOF {
+		s.Close()
+		return 0
+	}
+	if err != nil {
+		raiseJsonStreamError(L, s, err)
+	}
+	L.Push(value)
+	return 1
+}
+
+func jsonStreamElementsIter(L *LState) int {
+	i := L.CheckInt(2)
+	L.SetTop(1)
+	if jsonStreamElement(L) == 0 {
+		return 0
+	}
+	L.Insert(LNumber(i+1), 2)
+	return 2
+}
+
+// stream:events() iterates over the events of the stream.
+func jsonStreamEvents(L *LState) int {
+	checkJsonStream(L)
+	L.Push(L.NewFunction(jsonStreamNext))
+	L.Push(L.Get(1))
+	return 2
+}
+
+// stream:elements() iterates over the elements of the top-level array.
+func jsonStreamElements(L *LState) int {
+	checkJsonStream(L)
+	L.Push(L.NewFunction(jsonStreamElementsIter))
+	L.Push(L.Get(1))
+	L.Push(LNumber(0))
+	return 3
+}
+
+func jsonStreamClose(L *LState) int {
+	if err := checkJsonStream(L).Close(); err != nil {
+		L.RaiseAAppError(err)
+	}
+	return 0
+}
+
+/* }}} */
@@ -17,10 +17,12 @@ var _fv float64
 var _uv uintptr
 
 var preloads [int(preloadLimit)]LValue
+var ipreloads [int(preloadLimit)]LValue
 
 func init() {
 	for i := 0; i < int(preloadLimit); i++ {
 		preloads[i] = LNumber(i)
+		ipreloads[i] = LInteger(i)
 	}
 }
 
@@ -29,9 +31,12 @@ type allocator struct {
 	size    int
 	fptrs   []float64
 	fheader *reflect.SliceHeader
+	iptrs   []int64
 
 	scratchValue  LValue
 	scratchValueP *iface
+	scratchInt    LValue
+	scratchIntP   *iface
 }
 
 func newAllocator(size int) *allocator {
@@ -43,6 +48,8 @@ func newAllocator(size int) *allocator {
 	al.fheader = (*reflect.SliceHeader)(unsafe.Pointer(&al.fptrs))
 	al.scratchValue = LNumber(0)
 	al.scratchValueP = (*iface)(unsafe.Pointer(&al.scratchValue))
+	al.scratchInt = LInteger(0)
+	al.scratchIntP = (*iface)(unsafe.Pointer(&al.scratchInt))
 
 	return al
 }
@@ -77,3 +84,20 @@ func (al *allocator) LNumber2I(v LNumber) LValue {
 
 	return al.scratchValue
 }
+
+// LInteger2I is LNumber2I for integers, which have blocks of their own.
+func (al *allocator) LInteger2I(v LInteger) LValue {
+	if v >= 0 && v < LInteger(preloadLimit) {
+		return ipreloads[int(v)]
+	}
+
+	if cap(al.iptrs) == len(al.iptrs) {
+		al.iptrs = make([]int64, 0, al.size)
+	}
+
+	// the block never grows, the address of its last element stays valid
+	al.iptrs = append(al.iptrs, int64(v))
+	al.scratchIntP.word = unsafe.Pointer(&al.iptrs[len(al.iptrs)-1])
+
+	return al.scratchInt
+}
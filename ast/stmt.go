@@ -21,8 +21,9 @@ type AssignStmt struct {
 type LocalAssignStmt struct {
 	StmtBase
 
-	Names []string
-	Exprs []Expr
+	Names    []string
+	Exprs    []Expr
+	Function bool // local function name funcbody
 }
 
 type FuncCallStmt struct {
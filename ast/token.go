@@ -20,3 +20,12 @@ type Token struct {
 func (self *Token) String() string {
 	return fmt.Sprintf("<type:%v, str:%v>", self.Name, self.Str)
 }
+
+type Comment struct {
+	// Text is the comment as written in the source, including the leading
+	// "--" and the brackets of a long comment.
+	Text string
+	Pos  Position
+	// OwnLine reports whether no token precedes the comment on its line.
+	OwnLine bool
+}
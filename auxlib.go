@@ -22,6 +22,9 @@ func (ls *LState) CheckInt(n int) int {
 	if intv, ok := v.(LNumber); ok {
 		return int(intv)
 	}
+	if intv, ok := v.(LInteger); ok {
+		return int(intv)
+	}
 	ls.TypeError(n, LTNumber)
 	return 0
 }
@@ -31,6 +34,9 @@ func (ls *LState) CheckInt64(n int) int64 {
 	if intv, ok := v.(LNumber); ok {
 		return int64(intv)
 	}
+	if intv, ok := v.(LInteger); ok {
+		return int64(intv)
+	}
 	ls.TypeError(n, LTNumber)
 	return 0
 }
@@ -40,6 +46,9 @@ func (ls *LState) CheckNumber(n int) LNumber {
 	if lv, ok := v.(LNumber); ok {
 		return lv
 	}
+	if lv, ok := v.(LInteger); ok {
+		return LNumber(lv)
+	}
 	ls.TypeError(n, LTNumber)
 	return 0
 }
@@ -142,6 +151,9 @@ func (ls *LState) OptInt(n int, d int) int {
 	if intv, ok := v.(LNumber); ok {
 		return int(intv)
 	}
+	if intv, ok := v.(LInteger); ok {
+		return int(intv)
+	}
 	ls.TypeError(n, LTNumber)
 	return 0
 }
@@ -154,6 +166,9 @@ func (ls *LState) OptInt64(n int, d int64) int64 {
 	if intv, ok := v.(LNumber); ok {
 		return int64(intv)
 	}
+	if intv, ok := v.(LInteger); ok {
+		return int64(intv)
+	}
 	ls.TypeError(n, LTNumber)
 	return 0
 }
@@ -166,6 +181,9 @@ func (ls *LState) OptNumber(n int, d LNumber) LNumber {
 	if lv, ok := v.(LNumber); ok {
 		return lv
 	}
+	if lv, ok := v.(LInteger); ok {
+		return LNumber(lv)
+	}
 	ls.TypeError(n, LTNumber)
 	return 0
 }
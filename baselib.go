@@ -3,7 +3,6 @@ package lua
 import (
 	"errors"
 	"fmt"
-	"github.com/ipfs/go-mfs"
 	"io"
 	"runtime"
 	"strconv"
@@ -88,14 +87,7 @@ func baseDoFile(L *LState) int {
 		return L.GetTop() - top
 	}
 
-	rd, err := ifi.Open(mfs.Flags{Read:true})
-	if err != nil {
-		L.Push(LString(err.Error()))
-		L.Panic(L)
-		return L.GetTop() - top
-	}
-
-	fn, err := L.Load( rd, path )
+	fn, err := L.loadScriptFile(ifi, path)
 	if err != nil {
 		L.Push(LString(err.Error()))
 		L.Panic(L)
@@ -131,8 +123,8 @@ func baseGetFEnv(L *LState) int {
 		return 1
 	}
 
-	if number, ok := value.(LNumber); ok {
-		level := int(float64(number))
+	if number, ok := value.assertFloat64(); ok {
+		level := int(number)
 		if level <= 0 {
 			L.Push(L.Env)
 		} else {
@@ -158,6 +150,26 @@ func baseGetMetatable(L *LState) int {
 	return 1
 }
 
+// tableKey returns a key of a table the way scripts see it: with integers
+// enabled, keys with an integer value are integers.
+func (ls *LState) tableKey(key LValue) LValue {
+	if n, ok := key.(LNumber); ok && ls.Options.Integers {
+		if it, ok := floatToInteger(float64(n)); ok {
+			return it
+		}
+	}
+	return key
+}
+
+// pushInteger pushes v as an integer if integers are enabled.
+func pushInteger(L *LState, v int64) {
+	if L.Options.Integers {
+		L.Push(LInteger(v))
+	} else {
+		L.Push(LNumber(v))
+	}
+}
+
 func ipairsaux(L *LState) int {
 	tb := L.CheckTable(1)
 	i := L.CheckInt(2)
@@ -167,8 +179,8 @@ func ipairsaux(L *LState) int {
 		return 0
 	} else {
 		L.Pop(1)
-		L.Push(LNumber(i))
-		L.Push(LNumber(i))
+		L.Push(L.tableKey(LNumber(i)))
+		L.Push(L.tableKey(LNumber(i)))
 		L.Push(v)
 		return 2
 	}
@@ -230,11 +242,7 @@ func baseLoad(L *LState) int {
 
 func baseLoadFile(L *LState) int {
 
-	var reader io.Reader
-	var chunkname string
-	var err error
-
-	chunkname = L.CheckString(1)
+	chunkname := L.CheckString(1)
 	path, err := checkScriptPath(chunkname)
 	if err != nil {
 		L.Push(LNil)
@@ -246,16 +254,18 @@ func baseLoadFile(L *LState) int {
 	if err != nil {
 		L.Push(LNil)
 		L.Push(LString(fmt.Sprintf("can not open file: %v", chunkname)))
+		return 2
 	}
 
-	reader, err = ifi.Open(mfs.Flags{Read:true})
+	fn, err := L.loadScriptFile(ifi, chunkname)
 	if err != nil {
 		L.Push(LNil)
-		L.Push(LString(fmt.Sprintf("can not open file: %v", chunkname)))
+		L.Push(LString(err.Error()))
 		return 2
 	}
 
-	return loadaux(L, reader, chunkname)
+	L.Push(fn)
+	return 1
 }
 
 func baseLoadString(L *LState) int {
@@ -276,7 +286,7 @@ func baseNext(L *LState) int {
 		L.Push(LNil)
 		return 1
 	}
-	L.Push(key)
+	L.Push(L.tableKey(key))
 	L.Push(value)
 	return 2
 }
@@ -287,6 +297,7 @@ func pairsaux(L *LState) int {
 	if key == LNil {
 		return 0
 	} else {
+		key = L.tableKey(key)
 		L.Pop(1)
 		L.Push(key)
 		L.Push(key)
@@ -306,7 +317,7 @@ func basePairs(L *LState) int {
 func basePCall(L *LState) int {
 	L.CheckAny(1)
 	v := L.Get(1)
-	if v.Type() != LTFunction {
+	if fn, _ := L.metaCall(v); fn == nil {
 		L.Push(LFalse)
 		L.Push(LString("attempt to call a " + v.Type().String() + " value"))
 		return 2
@@ -365,9 +376,9 @@ func baseRawSet(L *LState) int {
 func baseSelect(L *LState) int {
 	L.CheckTypes(1, LTNumber, LTString)
 	switch lv := L.Get(1).(type) {
-	case LNumber:
-		idx := int(lv)
-		num := L.reg.Top() - L.indexToReg(int(lv)) - 1
+	case LNumber, LInteger:
+		idx := L.CheckInt(1)
+		num := L.reg.Top() - L.indexToReg(idx) - 1
 		if idx < 0 {
 			num++
 		}
@@ -376,7 +387,7 @@ func baseSelect(L *LState) int {
 		if string(lv) != "#" {
 			L.ArgError(1, "invalid string '"+string(lv)+"'")
 		}
-		L.Push(LNumber(L.GetTop() - 1))
+		pushInteger(L, int64(L.GetTop()-1))
 		return 1
 	}
 	return 0
@@ -401,8 +412,8 @@ func baseSetFEnv(L *LState) int {
 		}
 	}
 
-	if number, ok := value.(LNumber); ok {
-		level := int(float64(number))
+	if number, ok := value.assertFloat64(); ok {
+		level := int(number)
 		if level <= 0 {
 			L.Env = env
 			return 0
@@ -447,11 +458,17 @@ func baseToNumber(L *LState) int {
 	noBase := L.Get(2) == LNil
 
 	switch lv := L.CheckAny(1).(type) {
-	case LNumber:
+	case LNumber, LInteger:
 		L.Push(lv)
 	case LString:
 		str := strings.Trim(string(lv), " \n\t")
-		if strings.Index(str, ".") > -1 {
+		if L.Options.Integers && noBase {
+			if v, err := parseNumberValue(str, true); err != nil {
+				L.Push(LNil)
+			} else {
+				L.Push(v)
+			}
+		} else if strings.Index(str, ".") > -1 {
 			if v, err := strconv.ParseFloat(str, LNumberBit); err != nil {
 				L.Push(LNil)
 			} else {
@@ -463,6 +480,8 @@ func baseToNumber(L *LState) int {
 			}
 			if v, err := strconv.ParseInt(str, base, LNumberBit); err != nil {
 				L.Push(LNil)
+			} else if L.Options.Integers {
+				L.Push(LInteger(v))
 			} else {
 				L.Push(LNumber(v))
 			}
@@ -0,0 +1,743 @@
+// Binding of Go values to Lua by reflection.
+//
+// A Binder converts Go values to Lua values and back. Booleans, numbers and
+// strings become the Lua values of the same kind and Go functions become Lua
+// functions. Structs, pointers, maps and slices become userdata whose
+// metatable dispatches to their exported methods, called with a colon like
+// obj:Method(x), their fields, keys and elements. Arguments and results are
+// converted along, a non-nil error as the last result of a function or
+// method is raised as an AApp error.
+//
+// Only the types that were allowed with Allow are exposed, apart from the
+// basic types above, so a sandboxed script can not reach further into the
+// host than it was meant to. Struct fields are renamed with a tag like
+// `lua:"name"` and hidden with `lua:"-"`, unexported fields and methods are
+// never exposed.
+package bind
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/ayachain/go-aya-alvm"
+)
+
+const proxyClass = "bind.proxy*"
+
+var (
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+	lvalueType  = reflect.TypeOf((*lua.LValue)(nil)).Elem()
+	bytesType   = reflect.TypeOf([]byte(nil))
+	emptyIfType = reflect.TypeOf((*interface{})(nil)).Elem()
+
+	errCycle = errors.New("table contains itself")
+)
+
+// Binder converts values between Go and Lua, it is safe for concurrent use.
+type Binder struct {
+	mu      sync.RWMutex
+	allowed map[reflect.Type]bool
+	fields  map[reflect.Type]map[string][]int
+}
+
+// New returns a Binder that allows no types yet.
+func New() *Binder {
+	return &Binder{
+		allowed: make(map[reflect.Type]bool),
+		fields:  make(map[reflect.Type]map[string][]int),
+	}
+}
+
+// Allow allows the types of values to be exposed, e.g. Allow(&Account{}).
+// A struct type and the pointer to it are allowed together.
+func (b *Binder) Allow(values ...interface{}) {
+	for _, v := range values {
+		b.AllowType(reflect.TypeOf(v))
+	}
+}
+
+// AllowType allows types to be exposed.
+func (b *Binder) AllowType(types ...reflect.Type) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, t := range types {
+		b.allowed[t] = true
+		if t.Kind() == reflect.Ptr && t.Elem().Kind() == reflect.Struct {
+			b.allowed[t.Elem()] = true
+		} else if t.Kind() == reflect.Struct {
+			b.allowed[reflect.PtrTo(t)] = true
+		}
+	}
+}
+
+func (b *Binder) isAllowed(t reflect.Type) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.allowed[t]
+}
+
+// SetGlobal sets the global name to v converted by ToLua.
+func (b *Binder) SetGlobal(L *lua.LState, name string, v interface{}) error {
+	lv, err := b.ToLua(L, v)
+	if err != nil {
+		return err
+	}
+	L.SetGlobal(name, lv)
+	return nil
+}
+
+// ToLua converts v to a Lua value, it fails for types that were not allowed.
+func (b *Binder) ToLua(L *lua.LState, v interface{}) (lua.LValue, error) {
+	return b.toLua(L, reflect.ValueOf(v))
+}
+
+// FromLua converts lv to a Go value of type t.
+func (b *Binder) FromLua(L *lua.LState, lv lua.LValue, t reflect.Type) (reflect.Value, error) {
+	return b.fromLua(L, lv, t)
+}
+
+/* Go to Lua {{{ */
+
+type proxy struct {
+	v reflect.Value
+	b *Binder
+}
+
+func (b *Binder) toLua(L *lua.LState, rv reflect.Value) (lua.LValue, error) {
+	if !rv.IsValid() {
+		return lua.LNil, nil
+	}
+	if rv.Type().Implements(lvalueType) && rv.CanInterface() {
+		if lv, ok := rv.Interface().(lua.LValue); ok && lv != nil {
+			return lv, nil
+		}
+	}
+	switch rv.Kind() {
+	case reflect.Interface:
+		if rv.IsNil() {
+			return lua.LNil, nil
+		}
+		return b.toLua(L, rv.Elem())
+	case reflect.Bool:
+		return lua.LBool(rv.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return lua.LNumber(rv.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return lua.LNumber(rv.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return lua.LNumber(rv.Float()), nil
+	case reflect.String:
+		return lua.LString(rv.String()), nil
+	case reflect.Ptr, reflect.Map, reflect.Func, reflect.Chan:
+		if rv.IsNil() {
+			return lua.LNil, nil
+		}
+	}
+
+	if !b.isAllowed(rv.Type()) {
+		if rv.Type().Implements(errorType) {
+			return L.NewErrorValue(rv.Interface().(error)), nil
+		}
+		return nil, fmt.Errorf("bind: type %v is not allowed", rv.Type())
+	}
+	switch rv.Kind() {
+	case reflect.Func:
+		return L.NewFunction(b.caller(rv, false)), nil
+	case reflect.Struct, reflect.Ptr, reflect.Map, reflect.Slice, reflect.Array:
+		ud := L.NewUserData()
+		ud.Value = &proxy{rv, b}
+		L.SetMetatable(ud, proxyMetatable(L))
+		return ud, nil
+	}
+	return nil, fmt.Errorf("bind: can not convert %v", rv.Type())
+}
+
+// push pushes rv converted to Lua or raises an error.
+func (b *Binder) push(L *lua.LState, rv reflect.Value) {
+	lv, err := b.toLua(L, rv)
+	if err != nil {
+		L.RaiseError("%v", err.Error())
+	}
+	L.Push(lv)
+}
+
+// caller returns a Lua function that calls fn, skipping the receiver
+// argument of a method call.
+func (b *Binder) caller(fn reflect.Value, method bool) lua.LGFunction {
+	return func(L *lua.LState) int {
+		ft := fn.Type()
+		base := 1
+		if method {
+			base = 2
+		}
+		nin := ft.NumIn()
+		fixed := nin
+		if ft.IsVariadic() {
+			fixed--
+		}
+		args := make([]reflect.Value, 0, nin)
+		for i := 0; i < fixed; i++ {
+			arg, err := b.fromLua(L, L.Get(base+i), ft.In(i))
+			if err != nil {
+				L.ArgError(base+i, err.Error())
+			}
+			args = append(args, arg)
+		}
+		if ft.IsVariadic() {
+			elem := ft.In(fixed).Elem()
+			for i := base + fixed; i <= L.GetTop(); i++ {
+				arg, err := b.fromLua(L, L.Get(i), elem)
+				if err != nil {
+					L.ArgError(i, err.Error())
+				}
+				args = append(args, arg)
+			}
+		}
+
+		results := fn.Call(args)
+		if n := len(results); n > 0 && ft.Out(n-1) == errorType {
+			if err, _ := results[n-1].Interface().(error); err != nil {
+				L.RaiseAAppError(err)
+			}
+			results = results[:n-1]
+		}
+		for _, r := range results {
+			b.push(L, r)
+		}
+		return len(results)
+	}
+}
+
+/* }}} */
+
+/* proxy metatable {{{ */
+
+func proxyMetatable(L *lua.LState) *lua.LTable {
+	if mt, ok := L.GetTypeMetatable(proxyClass).(*lua.LTable); ok {
+		return mt
+	}
+	mt := L.NewTypeMetatable(proxyClass)
+	L.SetFuncs(mt, map[string]lua.LGFunction{
+		"__index":    proxyIndex,
+		"__newindex": proxyNewIndex,
+		"__len":      proxyLen,
+		"__tostring": proxyToString,
+		"__eq":       proxyEq,
+	})
+	return mt
+}
+
+func checkProxy(L *lua.LState, n int) *proxy {
+	ud := L.CheckUserData(n)
+	if p, ok := ud.Value.(*proxy); ok {
+		return p
+	}
+	L.ArgError(n, "bound Go value expected")
+	return nil
+}
+
+// structValue returns the struct of a struct or a pointer to one.
+func structValue(v reflect.Value) (reflect.Value, bool) {
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	return v, v.Kind() == reflect.Struct
+}
+
+func proxyIndex(L *lua.LState) int {
+	p := checkProxy(L, 1)
+	key := L.Get(2)
+	if name, ok := key.(lua.LString); ok {
+		if m := p.v.MethodByName(string(name)); m.IsValid() {
+			L.Push(L.NewFunction(p.b.caller(m, true)))
+			return 1
+		}
+	}
+
+	switch v := p.v; v.Kind() {
+	case reflect.Map:
+		k, err := p.b.fromLua(L, key, v.Type().Key())
+		if err != nil {
+			L.ArgError(2, err.Error())
+		}
+		p.b.push(L, v.MapIndex(k))
+	case reflect.Slice, reflect.Array:
+		if i, ok := index(key, v.Len()); ok {
+			p.b.push(L, v.Index(i))
+		} else {
+			L.Push(lua.LNil)
+		}
+	default:
+		sv, ok := structValue(v)
+		name, isname := key.(lua.LString)
+		if !ok || !isname {
+			L.Push(lua.LNil)
+			return 1
+		}
+		if idx, ok := p.b.fieldIndex(sv.Type())[string(name)]; ok {
+			p.b.push(L, sv.FieldByIndex(idx))
+		} else {
+			L.Push(lua.LNil)
+		}
+	}
+	return 1
+}
+
+func proxyNewIndex(L *lua.LState) int {
+	p := checkProxy(L, 1)
+	key, value := L.Get(2), L.Get(3)
+
+	var target reflect.Value
+	switch v := p.v; v.Kind() {
+	case reflect.Map:
+		k, err := p.b.fromLua(L, key, v.Type().Key())
+		if err != nil {
+			L.ArgError(2, err.Error())
+		}
+		if value == lua.LNil {
+			v.SetMapIndex(k, reflect.Value{})
+			return 0
+		}
+		val, err := p.b.fromLua(L, value, v.Type().Elem())
+		if err != nil {
+			L.ArgError(3, err.Error())
+		}
+		v.SetMapIndex(k, val)
+		return 0
+	case reflect.Slice, reflect.Array:
+		i, ok := index(key, v.Len())
+		if !ok {
+			L.RaiseError("index %v out of range", key)
+		}
+		target = v.Index(i)
+	default:
+		sv, _ := structValue(v)
+		name, _ := key.(lua.LString)
+		idx, ok := p.b.fieldIndex(sv.Type())[string(name)]
+		if !ok {
+			L.RaiseError("no field %v in %v", key, sv.Type())
+		}
+		target = sv.FieldByIndex(idx)
+	}
+	if !target.CanSet() {
+		L.RaiseError("can not set %v of a %v value", key, p.v.Type())
+	}
+	val, err := p.b.fromLua(L, value, target.Type())
+	if err != nil {
+		L.ArgError(3, err.Error())
+	}
+	target.Set(val)
+	return 0
+}
+
+func proxyLen(L *lua.LState) int {
+	p := checkProxy(L, 1)
+	switch p.v.Kind() {
+	case reflect.Map, reflect.Slice, reflect.Array:
+		L.Push(lua.LNumber(p.v.Len()))
+	default:
+		L.RaiseError("attempt to get length of a %v value", p.v.Type())
+	}
+	return 1
+}
+
+func proxyToString(L *lua.LState) int {
+	p := checkProxy(L, 1)
+	L.Push(lua.LString(fmt.Sprint(p.v.Interface())))
+	return 1
+}
+
+func proxyEq(L *lua.LState) int {
+	a, b := checkProxy(L, 1), checkProxy(L, 2)
+	L.Push(lua.LBool(a.v.Type() == b.v.Type() && a.v.Type().Comparable() && a.v.Interface() == b.v.Interface()))
+	return 1
+}
+
+// index returns the 0 based index of a Lua index into a sequence of length n.
+func index(key lua.LValue, n int) (int, bool) {
+	num, ok := luaInt(key)
+	if !ok || num < 1 || num > int64(n) {
+		return 0, false
+	}
+	return int(num) - 1, true
+}
+
+// luaInt returns the value of an integer, or of a float without fraction.
+func luaInt(lv lua.LValue) (int64, bool) {
+	switch num := lv.(type) {
+	case lua.LInteger:
+		return int64(num), true
+	case lua.LNumber:
+		if float64(num) == math.Trunc(float64(num)) {
+			return int64(num), true
+		}
+	}
+	return 0, false
+}
+
+// fieldIndex returns the exposed fields of a struct type by their Lua names,
+// including the fields of embedded structs that are not shadowed.
+func (b *Binder) fieldIndex(t reflect.Type) map[string][]int {
+	b.mu.RLock()
+	fields, ok := b.fields[t]
+	b.mu.RUnlock()
+	if ok {
+		return fields
+	}
+
+	fields = make(map[string][]int)
+	var embedded []reflect.StructField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("lua")
+		if tag == "-" {
+			continue
+		}
+		if f.Anonymous && len(tag) == 0 {
+			if ft := f.Type; ft.Kind() == reflect.Struct || ft.Kind() == reflect.Ptr && ft.Elem().Kind() == reflect.Struct {
+				embedded = append(embedded, f)
+				continue
+			}
+		}
+		if len(f.PkgPath) > 0 {
+			continue // unexported
+		}
+		name := f.Name
+		if len(tag) > 0 {
+			name = strings.Split(tag, ",")[0]
+		}
+		fields[name] = f.Index
+	}
+	for _, f := range embedded {
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			// a nil pointer would panic in FieldByIndex
+			continue
+		}
+		for name, idx := range b.fieldIndex(ft) {
+			if _, ok := fields[name]; !ok {
+				fields[name] = append(append([]int(nil), f.Index...), idx...)
+			}
+		}
+	}
+
+	b.mu.Lock()
+	b.fields[t] = fields
+	b.mu.Unlock()
+	return fields
+}
+
+/* }}} */
+
+/* Lua to Go {{{ */
+
+func (b *Binder) fromLua(L *lua.LState, lv lua.LValue, t reflect.Type) (reflect.Value, error) {
+	return b.convert(L, lv, t, nil)
+}
+
+// enterTable marks tb as being converted, a table that contains itself can
+// not be converted.
+func enterTable(visited map[*lua.LTable]bool, tb *lua.LTable) error {
+	if visited[tb] {
+		return errCycle
+	}
+	visited[tb] = true
+	return nil
+}
+
+// convert converts lv to t, visited holds the tables being converted.
+func (b *Binder) convert(L *lua.LState, lv lua.LValue, t reflect.Type, visited map[*lua.LTable]bool) (reflect.Value, error) {
+	if lv == nil {
+		lv = lua.LNil
+	}
+	if _, ok := lv.(*lua.LTable); ok && visited == nil {
+		visited = make(map[*lua.LTable]bool)
+	}
+	if reflect.TypeOf(lv).AssignableTo(t) && t != emptyIfType {
+		rv := reflect.New(t).Elem()
+		rv.Set(reflect.ValueOf(lv))
+		return rv, nil
+	}
+	if ud, ok := lv.(*lua.LUserData); ok {
+		var v reflect.Value
+		if p, ok := ud.Value.(*proxy); ok {
+			v = p.v
+		} else {
+			v = reflect.ValueOf(ud.Value)
+		}
+		switch {
+		case !v.IsValid():
+		case v.Type().AssignableTo(t):
+			return v, nil
+		case v.Kind() == reflect.Ptr && v.Elem().Type().AssignableTo(t):
+			return v.Elem(), nil
+		}
+		if t != emptyIfType {
+			return reflect.Value{}, fmt.Errorf("%v expected, got %v", t, v.Type())
+		}
+		return v, nil
+	}
+
+	mismatch := func() (reflect.Value, error) {
+		return reflect.Value{}, fmt.Errorf("%v expected, got %v", t, lv.Type())
+	}
+	switch t.Kind() {
+	case reflect.Interface:
+		if lv == lua.LNil {
+			return reflect.Zero(t), nil
+		}
+		if t == errorType {
+			if str, ok := lv.(lua.LString); ok {
+				return reflect.ValueOf(errors.New(string(str))), nil
+			}
+			return mismatch()
+		}
+		if t.NumMethod() > 0 {
+			return mismatch()
+		}
+		return b.natural(L, lv, visited)
+	case reflect.Bool:
+		return reflect.ValueOf(lua.LVAsBool(lv)).Convert(t), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		num, ok := luaInt(lv)
+		if !ok {
+			return mismatch()
+		}
+		rv := reflect.New(t).Elem()
+		if rv.OverflowInt(num) {
+			return reflect.Value{}, fmt.Errorf("%v overflows %v", num, t)
+		}
+		rv.SetInt(num)
+		return rv, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		var num uint64
+		switch n := lv.(type) {
+		case lua.LInteger:
+			if n < 0 {
+				return mismatch()
+			}
+			num = uint64(n)
+		case lua.LNumber:
+			if n < 0 || float64(n) != math.Trunc(float64(n)) {
+				return mismatch()
+			}
+			num = uint64(n)
+		default:
+			return mismatch()
+		}
+		rv := reflect.New(t).Elem()
+		if rv.OverflowUint(num) {
+			return reflect.Value{}, fmt.Errorf("%v overflows %v", num, t)
+		}
+		rv.SetUint(num)
+		return rv, nil
+	case reflect.Float32, reflect.Float64:
+		if it, ok := lv.(lua.LInteger); ok {
+			lv = lua.LNumber(it)
+		}
+		num, ok := lv.(lua.LNumber)
+		if !ok {
+			return mismatch()
+		}
+		return reflect.ValueOf(float64(num)).Convert(t), nil
+	case reflect.String:
+		switch lv.(type) {
+		case lua.LString, lua.LNumber, lua.LInteger:
+			return reflect.ValueOf(lv.String()).Convert(t), nil
+		}
+		return mismatch()
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Func:
+		if lv == lua.LNil {
+			return reflect.Zero(t), nil
+		}
+	}
+
+	if tb, ok := lv.(*lua.LTable); ok {
+		if err := enterTable(visited, tb); err != nil {
+			return reflect.Value{}, err
+		}
+		defer delete(visited, tb)
+	}
+	switch t.Kind() {
+	case reflect.Slice:
+		if str, ok := lv.(lua.LString); ok && t.Elem().Kind() == reflect.Uint8 {
+			return reflect.ValueOf([]byte(string(str))).Convert(t), nil
+		}
+		tb, ok := lv.(*lua.LTable)
+		if !ok {
+			return mismatch()
+		}
+		rv := reflect.MakeSlice(t, tb.Len(), tb.Len())
+		return rv, b.fillSequence(L, tb, rv, visited)
+	case reflect.Array:
+		tb, ok := lv.(*lua.LTable)
+		if !ok || tb.Len() > t.Len() {
+			return mismatch()
+		}
+		rv := reflect.New(t).Elem()
+		return rv, b.fillSequence(L, tb, rv, visited)
+	case reflect.Map:
+		tb, ok := lv.(*lua.LTable)
+		if !ok {
+			return mismatch()
+		}
+		rv := reflect.MakeMap(t)
+		var err error
+		tb.ForEach(func(key, value lua.LValue) {
+			if err != nil {
+				return
+			}
+			var k, v reflect.Value
+			if k, err = b.convert(L, key, t.Key(), visited); err != nil {
+				return
+			}
+			if v, err = b.convert(L, value, t.Elem(), visited); err != nil {
+				return
+			}
+			rv.SetMapIndex(k, v)
+		})
+		return rv, err
+	case reflect.Struct:
+		tb, ok := lv.(*lua.LTable)
+		if !ok {
+			return mismatch()
+		}
+		rv := reflect.New(t).Elem()
+		return rv, b.fillStruct(L, tb, rv, visited)
+	case reflect.Ptr:
+		if _, ok := lv.(*lua.LTable); ok && t.Elem().Kind() == reflect.Struct {
+			rv := reflect.New(t.Elem())
+			return rv, b.fillStruct(L, lv.(*lua.LTable), rv.Elem(), visited)
+		}
+		return mismatch()
+	case reflect.Func:
+		fn, ok := lv.(*lua.LFunction)
+		if !ok {
+			return mismatch()
+		}
+		return b.goFunc(L, fn, t), nil
+	}
+	return mismatch()
+}
+
+func (b *Binder) fillSequence(L *lua.LState, tb *lua.LTable, rv reflect.Value, visited map[*lua.LTable]bool) error {
+	for i := 0; i < tb.Len(); i++ {
+		v, err := b.convert(L, tb.RawGetInt(i+1), rv.Type().Elem(), visited)
+		if err != nil {
+			return fmt.Errorf("[%v]: %v", i+1, err)
+		}
+		rv.Index(i).Set(v)
+	}
+	return nil
+}
+
+func (b *Binder) fillStruct(L *lua.LState, tb *lua.LTable, rv reflect.Value, visited map[*lua.LTable]bool) error {
+	for name, idx := range b.fieldIndex(rv.Type()) {
+		value := tb.RawGetString(name)
+		if value == lua.LNil {
+			continue
+		}
+		field := rv.FieldByIndex(idx)
+		v, err := b.convert(L, value, field.Type(), visited)
+		if err != nil {
+			return fmt.Errorf("%v: %v", name, err)
+		}
+		field.Set(v)
+	}
+	return nil
+}
+
+// natural converts lv to the Go value that suits it best: tables become
+// []interface{} if they are sequences and else map[string]interface{}.
+func (b *Binder) natural(L *lua.LState, lv lua.LValue, visited map[*lua.LTable]bool) (reflect.Value, error) {
+	var v interface{}
+	switch val := lv.(type) {
+	case lua.LBool:
+		v = bool(val)
+	case lua.LNumber:
+		v = float64(val)
+	case lua.LInteger:
+		v = int64(val)
+	case lua.LString:
+		v = string(val)
+	case *lua.LTable:
+		if err := enterTable(visited, val); err != nil {
+			return reflect.Value{}, err
+		}
+		defer delete(visited, val)
+		if n := val.Len(); n > 0 {
+			rv := reflect.MakeSlice(reflect.TypeOf([]interface{}(nil)), n, n)
+			return rv, b.fillSequence(L, val, rv, visited)
+		}
+		rv := reflect.MakeMap(reflect.TypeOf(map[string]interface{}(nil)))
+		var err error
+		val.ForEach(func(key, value lua.LValue) {
+			if err != nil {
+				return
+			}
+			var elem reflect.Value
+			if elem, err = b.natural(L, value, visited); err == nil {
+				rv.SetMapIndex(reflect.ValueOf(key.String()), elem)
+			}
+		})
+		return rv, err
+	default:
+		v = lv
+	}
+	rv := reflect.New(emptyIfType).Elem()
+	rv.Set(reflect.ValueOf(v))
+	return rv, nil
+}
+
+// goFunc returns a Go function of type t that calls fn in L. If the Lua
+// function fails, the error is returned as the last result of type error if
+// t has one, else it panics.
+func (b *Binder) goFunc(L *lua.LState, fn *lua.LFunction, t reflect.Type) reflect.Value {
+	return reflect.MakeFunc(t, func(args []reflect.Value) []reflect.Value {
+		nout := t.NumOut()
+		witherr := nout > 0 && t.Out(nout-1) == errorType
+		nret := nout
+		if witherr {
+			nret--
+		}
+		results := make([]reflect.Value, nout)
+		for i := range results {
+			results[i] = reflect.Zero(t.Out(i))
+		}
+		fail := func(err error) []reflect.Value {
+			if !witherr {
+				panic(err)
+			}
+			results[nout-1] = reflect.ValueOf(&err).Elem()
+			return results
+		}
+
+		largs := make([]lua.LValue, 0, len(args))
+		for _, arg := range args {
+			lv, err := b.toLua(L, arg)
+			if err != nil {
+				return fail(err)
+			}
+			largs = append(largs, lv)
+		}
+		if err := L.CallByParam(lua.P{Fn: fn, NRet: nret, Protect: true}, largs...); err != nil {
+			return fail(err)
+		}
+		top := L.GetTop()
+		defer L.Pop(nret)
+		for i := 0; i < nret; i++ {
+			v, err := b.fromLua(L, L.Get(top-nret+1+i), t.Out(i))
+			if err != nil {
+				return fail(err)
+			}
+			results[i] = v
+		}
+		return results
+	})
+}
+
+/* }}} */
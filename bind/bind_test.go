@@ -0,0 +1,193 @@
+package bind
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ayachain/go-aya-alvm"
+)
+
+type account struct {
+	Name    string `lua:"name"`
+	Balance int    `lua:"balance"`
+	Secret  string `lua:"-"`
+	hidden  string
+	Tags    []string          `lua:"tags"`
+	Meta    map[string]string `lua:"meta"`
+}
+
+func (a *account) Deposit(n int) (int, error) {
+	if n <= 0 {
+		return a.Balance, errors.New("invalid amount")
+	}
+	a.Balance += n
+	return a.Balance, nil
+}
+
+func (a *account) Sum(ns ...int) int {
+	for _, n := range ns {
+		a.Balance += n
+	}
+	return a.Balance
+}
+
+func newBinder(t *testing.T) (*lua.LState, *Binder, *account) {
+	L := lua.NewState()
+	b := New()
+	b.Allow(&account{}, []string(nil), map[string]string(nil))
+	acc := &account{Name: "alice", Balance: 10, Secret: "s", hidden: "h",
+		Tags: []string{"a", "b"}, Meta: map[string]string{"k": "v"}}
+	if err := b.SetGlobal(L, "acc", acc); err != nil {
+		t.Fatal(err)
+	}
+	return L, b, acc
+}
+
+func TestStructBinding(t *testing.T) {
+	L, _, acc := newBinder(t)
+	defer L.Close()
+	err := L.DoString(`
+	assert(acc.name == "alice" and acc.balance == 10)
+	assert(acc.Secret == nil and acc.secret == nil and acc.hidden == nil and acc.Name == nil)
+	assert(acc:Deposit(5) == 15)
+	assert(acc:Sum(1, 2, 3) == 21)
+	acc.balance = 100
+	assert(#acc.tags == 2 and acc.tags[2] == "b" and acc.tags[3] == nil)
+	acc.tags[1] = "x"
+	assert(acc.meta.k == "v")
+	acc.meta.n = "m"
+	acc.meta.k = nil
+	assert(#acc.meta == 1)
+	assert(not pcall(function() acc.Secret = "x" end))
+	assert(not pcall(function() acc.balance = "x" end))
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acc.Balance != 100 || acc.Tags[0] != "x" || acc.Meta["n"] != "m" || len(acc.Meta) != 1 {
+		t.Errorf("unexpected account %+v", acc)
+	}
+}
+
+func TestErrorResult(t *testing.T) {
+	L, _, _ := newBinder(t)
+	defer L.Close()
+	err := L.DoString(`
+	local ok, e = pcall(acc.Deposit, acc, -1)
+	assert(not ok and e.message == "invalid amount", tostring(e))
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAllowList(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	b := New()
+	if _, err := b.ToLua(L, &account{}); err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Errorf("expected the type to be rejected, got %v", err)
+	}
+	if lv, err := b.ToLua(L, 42); err != nil || lv != lua.LNumber(42) {
+		t.Errorf("unexpected %v, %v", lv, err)
+	}
+
+	b.Allow(func(string, int) string { return "" })
+	err := b.SetGlobal(L, "rep", func(s string, n int) string { return strings.Repeat(s, n) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := L.DoString(`assert(rep("ab", 2) == "abab")`); err != nil {
+		t.Error(err)
+	}
+	if err := L.DoString(`rep("ab", 1.5)`); err == nil {
+		t.Error("expected a fractional int to fail")
+	}
+}
+
+func TestFromLua(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	b := New()
+	if err := L.DoString(`
+	t = {name = "bob", balance = 3, tags = {"x"}, Secret = "s"}
+	f = function(a, b) return a + b end
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	rv, err := b.FromLua(L, L.GetGlobal("t"), reflect.TypeOf(&account{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	acc := rv.Interface().(*account)
+	if acc.Name != "bob" || acc.Balance != 3 || len(acc.Tags) != 1 || acc.Secret != "" {
+		t.Errorf("unexpected account %+v", acc)
+	}
+
+	rv, err = b.FromLua(L, L.GetGlobal("f"), reflect.TypeOf(func(int, interface{}) (int, error) { return 0, nil }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	add := rv.Interface().(func(int, interface{}) (int, error))
+	if n, err := add(2, 3); n != 5 || err != nil {
+		t.Errorf("unexpected %v, %v", n, err)
+	}
+	if _, err := add(2, nil); err == nil {
+		t.Error("expected the Lua error to be returned")
+	}
+
+	rv, err = b.FromLua(L, L.GetGlobal("t"), reflect.TypeOf((*interface{})(nil)).Elem())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, ok := rv.Interface().(map[string]interface{}); !ok || m["name"] != "bob" {
+		t.Errorf("unexpected %#v", rv.Interface())
+	}
+}
+
+type node struct {
+	Name string `lua:"name"`
+	Next *node  `lua:"next"`
+}
+
+func TestFromLuaCycles(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	b := New()
+	take := func(v interface{}) {}
+	b.Allow(take)
+	if err := b.SetGlobal(L, "take", take); err != nil {
+		t.Fatal(err)
+	}
+	if err := L.DoString(`
+	seq = {}; seq[1] = seq
+	map = {}; map.self = map
+	list = {name = "a", next = {name = "b"}}; list.next.next = list
+	local shared = {1}
+	dag = {shared, shared}
+	assert(not pcall(take, seq) and not pcall(take, map))
+	take(dag)
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name string
+		t    reflect.Type
+	}{
+		{"seq", reflect.TypeOf((*interface{})(nil)).Elem()},
+		{"seq", reflect.TypeOf([]interface{}(nil))},
+		{"map", reflect.TypeOf(map[string]interface{}(nil))},
+		{"list", reflect.TypeOf(&node{})},
+	} {
+		if _, err := b.FromLua(L, L.GetGlobal(c.name), c.t); err == nil || !strings.Contains(err.Error(), "contains itself") {
+			t.Errorf("%v to %v: unexpected %v", c.name, c.t, err)
+		}
+	}
+	if _, err := b.FromLua(L, L.GetGlobal("dag"), reflect.TypeOf([][]int(nil))); err != nil {
+		t.Error(err)
+	}
+}
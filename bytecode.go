@@ -0,0 +1,363 @@
+package lua
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+)
+
+/*
+  Binary chunk format of a FunctionProto.
+
+  All integers are unsigned varints unless noted otherwise, strings are a
+  varint length followed by the raw bytes.
+
+  header:
+    signature   4 bytes  "\x1bALV"
+    version     1 byte   BytecodeVersion
+    numbersize  1 byte   LNumberBit / 8
+    flags       1 byte   bit 0: compiled with integers (Options.Integers)
+
+  function:
+    source name, line defined, last line defined (zigzag varints)
+    upvalues, parameters, vararg flag, used registers  (1 byte each)
+    code        count + fixed 4 byte little endian instructions
+    constants   count + (type byte + payload), integers are zigzag varints
+    protos      count + nested functions
+    positions   count + zigzag varints
+    locals      count + (name, start pc, end pc)
+    calls       count + (name, pc)
+    upvalues    count + names
+*/
+
+// BytecodeSignature is the leading bytes of every binary chunk.
+const BytecodeSignature = "\x1bALV"
+
+// BytecodeVersion is the version of the binary chunk format. Chunks and
+// cache entries written with another version are rejected.
+const BytecodeVersion = 2
+
+const (
+	bcConstNil byte = iota
+	bcConstFalse
+	bcConstTrue
+	bcConstNumber
+	bcConstString
+	bcConstInteger
+)
+
+const bcFlagIntegers byte = 1
+
+// maximum nesting of function prototypes accepted while undumping.
+const bcMaxProtoDepth = 200
+
+var (
+	ErrBytecodeSignature = errors.New("bytecode: not a binary chunk")
+	ErrBytecodeVersion   = errors.New("bytecode: version mismatch")
+	ErrBytecodeTruncated = errors.New("bytecode: truncated chunk")
+)
+
+/* dump {{{ */
+
+type protoWriter struct {
+	buf []byte
+	tmp [binary.MaxVarintLen64]byte
+}
+
+func (w *protoWriter) uvarint(v uint64) {
+	n := binary.PutUvarint(w.tmp[:], v)
+	w.buf = append(w.buf, w.tmp[:n]...)
+}
+
+func (w *protoWriter) varint(v int64) {
+	n := binary.PutVarint(w.tmp[:], v)
+	w.buf = append(w.buf, w.tmp[:n]...)
+}
+
+func (w *protoWriter) str(s string) {
+	w.uvarint(uint64(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+func (w *protoWriter) function(fp *FunctionProto) error {
+	w.str(fp.SourceName)
+	w.varint(int64(fp.LineDefined))
+	w.varint(int64(fp.LastLineDefined))
+	w.buf = append(w.buf, fp.NumUpvalues, fp.NumParameters, fp.IsVarArg, fp.NumUsedRegisters)
+
+	w.uvarint(uint64(len(fp.Code)))
+	for _, inst := range fp.Code {
+		w.buf = append(w.buf, byte(inst), byte(inst>>8), byte(inst>>16), byte(inst>>24))
+	}
+
+	w.uvarint(uint64(len(fp.Constants)))
+	for _, k := range fp.Constants {
+		switch kv := k.(type) {
+		case *LNilType:
+			w.buf = append(w.buf, bcConstNil)
+		case LBool:
+			if kv {
+				w.buf = append(w.buf, bcConstTrue)
+			} else {
+				w.buf = append(w.buf, bcConstFalse)
+			}
+		case LNumber:
+			w.buf = append(w.buf, bcConstNumber)
+			bits := math.Float64bits(float64(kv))
+			for i := uint(0); i < 8; i++ {
+				w.buf = append(w.buf, byte(bits>>(8*i)))
+			}
+		case LString:
+			w.buf = append(w.buf, bcConstString)
+			w.str(string(kv))
+		case LInteger:
+			w.buf = append(w.buf, bcConstInteger)
+			w.varint(int64(kv))
+		default:
+			return fmt.Errorf("bytecode: cannot dump constant of type %v", k.Type())
+		}
+	}
+
+	w.uvarint(uint64(len(fp.FunctionPrototypes)))
+	for _, child := range fp.FunctionPrototypes {
+		if err := w.function(child); err != nil {
+			return err
+		}
+	}
+
+	w.uvarint(uint64(len(fp.DbgSourcePositions)))
+	for _, line := range fp.DbgSourcePositions {
+		w.varint(int64(line))
+	}
+
+	w.uvarint(uint64(len(fp.DbgLocals)))
+	for _, local := range fp.DbgLocals {
+		w.str(local.Name)
+		w.varint(int64(local.StartPc))
+		w.varint(int64(local.EndPc))
+	}
+
+	w.uvarint(uint64(len(fp.DbgCalls)))
+	for _, call := range fp.DbgCalls {
+		w.str(call.Name)
+		w.varint(int64(call.Pc))
+	}
+
+	w.uvarint(uint64(len(fp.DbgUpvalues)))
+	for _, name := range fp.DbgUpvalues {
+		w.str(name)
+	}
+	return nil
+}
+
+// DumpFunctionProto writes proto to w in the binary chunk format.
+func DumpFunctionProto(w io.Writer, proto *FunctionProto) error {
+	pw := &protoWriter{buf: make([]byte, 0, 64+len(proto.Code)*4)}
+	pw.buf = append(pw.buf, BytecodeSignature...)
+	var flags byte
+	if proto.Integers {
+		flags |= bcFlagIntegers
+	}
+	pw.buf = append(pw.buf, BytecodeVersion, LNumberBit/8, flags)
+	if err := pw.function(proto); err != nil {
+		return err
+	}
+	_, err := w.Write(pw.buf)
+	return err
+}
+
+/* }}} */
+
+/* undump {{{ */
+
+type protoReader struct {
+	data     []byte
+	pos      int
+	integers bool
+}
+
+func (r *protoReader) fail(format string, args ...interface{}) {
+	panic(fmt.Errorf("bytecode: "+format, args...))
+}
+
+func (r *protoReader) byte() byte {
+	if r.pos >= len(r.data) {
+		panic(ErrBytecodeTruncated)
+	}
+	b := r.data[r.pos]
+	r.pos++
+	return b
+}
+
+func (r *protoReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.data[r.pos:])
+	if n <= 0 {
+		panic(ErrBytecodeTruncated)
+	}
+	r.pos += n
+	return v
+}
+
+func (r *protoReader) varint() int {
+	v, n := binary.Varint(r.data[r.pos:])
+	if n <= 0 {
+		panic(ErrBytecodeTruncated)
+	}
+	if v < math.MinInt32 || v > math.MaxInt32 {
+		r.fail("integer out of range: %v", v)
+	}
+	r.pos += n
+	return int(v)
+}
+
+// count reads a length prefix and checks that at least size bytes per
+// element are left, so a forged length cannot trigger huge allocations.
+func (r *protoReader) count(size int) int {
+	n := r.uvarint()
+	if n > uint64(len(r.data)-r.pos)/uint64(size) {
+		panic(ErrBytecodeTruncated)
+	}
+	return int(n)
+}
+
+func (r *protoReader) str() string {
+	n := r.count(1)
+	s := string(r.data[r.pos : r.pos+n])
+	r.pos += n
+	return s
+}
+
+func (r *protoReader) function(depth int) *FunctionProto {
+	if depth > bcMaxProtoDepth {
+		r.fail("function prototypes nested too deeply")
+	}
+	fp := &FunctionProto{Integers: r.integers}
+	fp.SourceName = r.str()
+	fp.LineDefined = r.varint()
+	fp.LastLineDefined = r.varint()
+	fp.NumUpvalues = r.byte()
+	fp.NumParameters = r.byte()
+	fp.IsVarArg = r.byte()
+	fp.NumUsedRegisters = r.byte()
+
+	fp.Code = make([]uint32, r.count(4))
+	for i := range fp.Code {
+		fp.Code[i] = binary.LittleEndian.Uint32(r.data[r.pos:])
+		r.pos += 4
+	}
+
+	fp.Constants = make([]LValue, r.count(1))
+	fp.stringConstants = make([]string, len(fp.Constants))
+	for i := range fp.Constants {
+		switch tp := r.byte(); tp {
+		case bcConstNil:
+			fp.Constants[i] = LNil
+		case bcConstFalse:
+			fp.Constants[i] = LFalse
+		case bcConstTrue:
+			fp.Constants[i] = LTrue
+		case bcConstNumber:
+			if len(r.data)-r.pos < 8 {
+				panic(ErrBytecodeTruncated)
+			}
+			fp.Constants[i] = LNumber(math.Float64frombits(binary.LittleEndian.Uint64(r.data[r.pos:])))
+			r.pos += 8
+		case bcConstString:
+			s := r.str()
+			fp.Constants[i] = LString(s)
+			fp.stringConstants[i] = s
+		case bcConstInteger:
+			v, n := binary.Varint(r.data[r.pos:])
+			if n <= 0 {
+				panic(ErrBytecodeTruncated)
+			}
+			r.pos += n
+			fp.Constants[i] = LInteger(v)
+		default:
+			r.fail("unknown constant type %v", tp)
+		}
+	}
+
+	fp.FunctionPrototypes = make([]*FunctionProto, r.count(1))
+	for i := range fp.FunctionPrototypes {
+		fp.FunctionPrototypes[i] = r.function(depth + 1)
+	}
+
+	fp.DbgSourcePositions = make([]int, r.count(1))
+	for i := range fp.DbgSourcePositions {
+		fp.DbgSourcePositions[i] = r.varint()
+	}
+	if len(fp.DbgSourcePositions) != len(fp.Code) {
+		r.fail("%v source positions for %v instructions", len(fp.DbgSourcePositions), len(fp.Code))
+	}
+
+	fp.DbgLocals = make([]*DbgLocalInfo, r.count(3))
+	for i := range fp.DbgLocals {
+		fp.DbgLocals[i] = &DbgLocalInfo{Name: r.str(), StartPc: r.varint(), EndPc: r.varint()}
+	}
+
+	fp.DbgCalls = make([]DbgCall, r.count(2))
+	for i := range fp.DbgCalls {
+		fp.DbgCalls[i] = DbgCall{Name: r.str(), Pc: r.varint()}
+	}
+
+	fp.DbgUpvalues = make([]string, r.count(1))
+	for i := range fp.DbgUpvalues {
+		fp.DbgUpvalues[i] = r.str()
+	}
+	if len(fp.DbgUpvalues) != int(fp.NumUpvalues) {
+		r.fail("%v upvalue names for %v upvalues", len(fp.DbgUpvalues), fp.NumUpvalues)
+	}
+	return fp
+}
+
+// UndumpFunctionProto reads a FunctionProto written by DumpFunctionProto.
+// Chunks with another signature or format version are rejected with
+// ErrBytecodeSignature and ErrBytecodeVersion.
+func UndumpFunctionProto(reader io.Reader) (proto *FunctionProto, err error) {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < len(BytecodeSignature)+3 || string(data[:len(BytecodeSignature)]) != BytecodeSignature {
+		return nil, ErrBytecodeSignature
+	}
+	hdr := data[len(BytecodeSignature):]
+	if hdr[0] != BytecodeVersion {
+		return nil, ErrBytecodeVersion
+	}
+	if hdr[1] != LNumberBit/8 {
+		return nil, fmt.Errorf("bytecode: number size %v, expected %v", hdr[1], LNumberBit/8)
+	}
+
+	if hdr[2]&^bcFlagIntegers != 0 {
+		return nil, fmt.Errorf("bytecode: unknown flags %#x", hdr[2])
+	}
+
+	r := &protoReader{data: data, pos: len(BytecodeSignature) + 3, integers: hdr[2]&bcFlagIntegers != 0}
+	defer func() {
+		if rcv := recover(); rcv != nil {
+			if rerr, ok := rcv.(error); ok {
+				proto, err = nil, rerr
+				return
+			}
+			panic(rcv)
+		}
+	}()
+	proto = r.function(0)
+	if r.pos != len(data) {
+		r.fail("%v trailing bytes", len(data)-r.pos)
+	}
+	return proto, nil
+}
+
+// IsBinaryChunk reports whether data starts with the binary chunk signature.
+func IsBinaryChunk(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(BytecodeSignature))
+}
+
+/* }}} */
@@ -0,0 +1,223 @@
+package lua
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ayachain/go-aya-alvm/parse"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-merkledag"
+)
+
+const bytecodeTestSrc = `
+local t = {1, 2, 3, name = "alvm", flag = true}
+local function sum(...)
+  local s = 0
+  for _, v in ipairs({...}) do s = s + v end
+  return s
+end
+result = sum(unpack(t)) * 1.5 .. t.name
+`
+
+func compileTestProto(t *testing.T, src string) *FunctionProto {
+	chunk, err := parse.Parse(strings.NewReader(src), "<test>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proto, err := Compile(chunk, "<test>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return proto
+}
+
+func TestBytecodeRoundTrip(t *testing.T) {
+	proto := compileTestProto(t, bytecodeTestSrc)
+
+	var buf bytes.Buffer
+	errorIfNotNil(t, DumpFunctionProto(&buf, proto))
+	errorIfFalse(t, IsBinaryChunk(buf.Bytes()), "binary chunk expected")
+
+	loaded, err := UndumpFunctionProto(bytes.NewReader(buf.Bytes()))
+	errorIfNotNil(t, err)
+	errorIfNotEqual(t, proto.String(), loaded.String())
+
+	L := NewState()
+	defer L.Close()
+	L.Push(L.NewFunctionFromProto(loaded))
+	errorIfNotNil(t, L.PCall(0, 0, nil))
+	errorIfNotEqual(t, "9alvm", L.GetGlobal("result").String())
+}
+
+func TestBytecodeRejectsStaleAndBroken(t *testing.T) {
+	var buf bytes.Buffer
+	errorIfNotNil(t, DumpFunctionProto(&buf, compileTestProto(t, bytecodeTestSrc)))
+	data := buf.Bytes()
+
+	stale := append([]byte{}, data...)
+	stale[len(BytecodeSignature)] = BytecodeVersion + 1
+	_, err := UndumpFunctionProto(bytes.NewReader(stale))
+	errorIfNotEqual(t, ErrBytecodeVersion, err)
+
+	_, err = UndumpFunctionProto(strings.NewReader("return 1"))
+	errorIfNotEqual(t, ErrBytecodeSignature, err)
+
+	for i := len(BytecodeSignature) + 2; i < len(data); i++ {
+		if _, err := UndumpFunctionProto(bytes.NewReader(data[:i])); err == nil {
+			t.Fatalf("truncated chunk of %v bytes accepted", i)
+		}
+	}
+}
+
+func TestProtoCache(t *testing.T) {
+	proto := compileTestProto(t, bytecodeTestSrc)
+	key := ProtoCacheKey{Cid: merkledag.NodeWithData([]byte(bytecodeTestSrc)).Cid()}
+
+	for _, cache := range []ProtoCache{NewProtoCache(2), NewDatastoreProtoCache(datastore.NewMapDatastore())} {
+		_, ok := cache.Get(key)
+		errorIfFalse(t, !ok, "empty cache should miss")
+		cache.Put(key, proto)
+		cached, ok := cache.Get(key)
+		errorIfFalse(t, ok, "cache should hit")
+		errorIfNotEqual(t, proto.String(), cached.String())
+		_, ok = cache.Get(ProtoCacheKey{Cid: cid.Undef})
+		errorIfFalse(t, !ok, "unknown key should miss")
+		_, ok = cache.Get(ProtoCacheKey{Cid: key.Cid, Integers: true})
+		errorIfFalse(t, !ok, "key with integers should miss")
+	}
+
+	lru := NewProtoCache(2)
+	keys := make([]ProtoCacheKey, 3)
+	for i := range keys {
+		keys[i] = ProtoCacheKey{Cid: merkledag.NodeWithData([]byte{byte(i)}).Cid()}
+	}
+	lru.Put(keys[0], proto)
+	lru.Put(keys[1], proto)
+	lru.Get(keys[0])
+	lru.Put(keys[2], proto)
+	_, ok := lru.Get(keys[1])
+	errorIfFalse(t, !ok, "least recently used entry should be dropped")
+	_, ok = lru.Get(keys[0])
+	errorIfFalse(t, ok, "recently used entry should stay")
+
+	ds := datastore.NewMapDatastore()
+	cache := NewDatastoreProtoCache(ds)
+	cache.Put(key, proto)
+	dk := datastore.NewKey(protoCacheKeyPrefix + key.Cid.String())
+	val, _ := ds.Get(dk)
+	val[len(BytecodeSignature)] = BytecodeVersion + 1
+	ds.Put(dk, val)
+	_, ok = cache.Get(key)
+	errorIfFalse(t, !ok, "stale entry should miss")
+	has, _ := ds.Has(dk)
+	errorIfFalse(t, !has, "stale entry should be removed")
+}
+
+// countingProtoCache counts the misses of the cache it wraps.
+type countingProtoCache struct {
+	ProtoCache
+	misses int
+}
+
+func (cc *countingProtoCache) Get(key ProtoCacheKey) (*FunctionProto, bool) {
+	proto, ok := cc.ProtoCache.Get(key)
+	if !ok {
+		cc.misses++
+	}
+	return proto, ok
+}
+
+func TestLoadScriptProtoCache(t *testing.T) {
+	cache := &countingProtoCache{ProtoCache: NewProtoCache(DefaultProtoCacheSize)}
+	newState := func(opts Options) *LState {
+		opts.ProtoCache = cache
+		L, err := NewMFSState(context.Background(), nil, nil, opts)
+		errorIfNotNil(t, err)
+		errorIfNotNil(t, L.MFS_Mkdir(ALVM_PATH_Script, true))
+		fi, err := L.MFS_OpenFile("/Script/main.lua", os.O_CREATE)
+		errorIfNotNil(t, err)
+		w, err := L.MFS_OpenWriter(fi, 0)
+		errorIfNotNil(t, err)
+		_, err = w.Write([]byte("return 7 / 2"))
+		errorIfNotNil(t, err)
+		errorIfNotNil(t, w.(interface{ Close() error }).Close())
+		return L
+	}
+	floats, integers := newState(Options{}), newState(Options{Integers: true})
+	defer floats.Close()
+	defer integers.Close()
+
+	// states with either kind of numbers keep their own entry
+	for i := 0; i < 3; i++ {
+		for _, L := range []*LState{floats, integers} {
+			fn, err := L.LoadScript("/main.lua")
+			errorIfNotNil(t, err)
+			errorIfNotEqual(t, L.Options.Integers, fn.Proto.Integers)
+		}
+	}
+	errorIfNotEqual(t, 2, cache.misses)
+}
+
+func TestStringDumpAndLoadBinary(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+	local function add(a, b) return a + b end
+	chunk = string.dump(add)
+	`)
+	errorIfScriptNotFail(t, L, `string.dump(print)`, "unable to dump")
+
+	chunk := L.GetGlobal("chunk").String()
+	fn, err := L.Load(strings.NewReader(chunk), "=chunk")
+	errorIfNotNil(t, err)
+	L.Push(fn)
+	L.Push(LNumber(1))
+	L.Push(LNumber(2))
+	L.Call(2, 1)
+	errorIfNotEqual(t, LNumber(3), L.Get(-1))
+
+	L2 := NewState(Options{DisableBinaryChunks: true})
+	defer L2.Close()
+	_, err = L2.Load(strings.NewReader(chunk), "=chunk")
+	errorIfFalse(t, err != nil && strings.Contains(err.Error(), "binary chunk"), "binary chunk should be refused")
+}
+
+func TestCheckProtoRejectsMalformedCode(t *testing.T) {
+	for _, script := range []string{"base.lua", "coroutine.lua", "issues.lua", "table.lua", "vm.lua", "strings.lua"} {
+		file, err := os.Open(filepath.Join("_glua-tests", script))
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunk, err := parse.Parse(file, script)
+		file.Close()
+		errorIfNotNil(t, err)
+		proto, err := Compile(chunk, script)
+		errorIfNotNil(t, err)
+		errorIfNotNil(t, VerifyProto(proto))
+	}
+
+	mutations := map[string]func(fp *FunctionProto){
+		"opcode":   func(fp *FunctionProto) { fp.Code[0] = uint32(opCodeMax+1) << 26 },
+		"register": func(fp *FunctionProto) { opSetArgA(&fp.Code[0], int(fp.NumUsedRegisters)) },
+		"constant": func(fp *FunctionProto) { fp.Code[0] = opCreateABx(OP_LOADK, 0, len(fp.Constants)) },
+		"jump":     func(fp *FunctionProto) { fp.Code[0] = opCreateASbx(OP_JMP, 0, len(fp.Code)) },
+		"upvalue":  func(fp *FunctionProto) { fp.Code[0] = opCreateABC(OP_GETUPVAL, 0, 0, 0) },
+		"return":   func(fp *FunctionProto) { fp.Code[len(fp.Code)-1] = opCreateABC(OP_MOVE, 0, 0, 0) },
+	}
+	for name, mutate := range mutations {
+		proto := compileTestProto(t, bytecodeTestSrc)
+		mutate(proto)
+		var buf bytes.Buffer
+		errorIfNotNil(t, DumpFunctionProto(&buf, proto))
+
+		L := NewState()
+		_, err := L.Load(bytes.NewReader(buf.Bytes()), "=chunk")
+		errorIfFalse(t, err != nil, "%v: malformed chunk accepted", name)
+		L.Close()
+	}
+}
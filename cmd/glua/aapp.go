@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/ayachain/go-aya-alvm"
+	bsrv "github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	ipld "github.com/ipfs/go-ipld-format"
+	dag "github.com/ipfs/go-merkledag"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+/*
+  AApp mode.
+
+  glua -aapp mounts a local directory or a root saved by an earlier run as the
+  MFS of the state, so io.open, require, dofile and adb.open work like they do
+  in an AVM. The blocks are kept in a LevelDB repo, ~/.glua/repo unless -repo
+  is given, and the root CID is printed when glua exits so that it can be
+  mounted again.
+*/
+
+// levelDatastore is a ds.Batching in a LevelDB database.
+type levelDatastore struct {
+	db *leveldb.DB
+}
+
+func (d *levelDatastore) Put(key ds.Key, value []byte) error {
+	return d.db.Put(key.Bytes(), value, nil)
+}
+
+func (d *levelDatastore) Get(key ds.Key) ([]byte, error) {
+	value, err := d.db.Get(key.Bytes(), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, ds.ErrNotFound
+	}
+	return value, err
+}
+
+func (d *levelDatastore) Has(key ds.Key) (bool, error) {
+	return d.db.Has(key.Bytes(), nil)
+}
+
+func (d *levelDatastore) GetSize(key ds.Key) (int, error) {
+	value, err := d.Get(key)
+	if err != nil {
+		return -1, err
+	}
+	return len(value), nil
+}
+
+func (d *levelDatastore) Delete(key ds.Key) error {
+	return d.db.Delete(key.Bytes(), nil)
+}
+
+func (d *levelDatastore) Query(q query.Query) (query.Results, error) {
+	var entries []query.Entry
+	it := d.db.NewIterator(util.BytesPrefix([]byte(q.Prefix)), nil)
+	for it.Next() {
+		entry := query.Entry{Key: string(it.Key())}
+		if !q.KeysOnly {
+			entry.Value = append([]byte(nil), it.Value()...)
+		}
+		entries = append(entries, entry)
+	}
+	it.Release()
+	if err := it.Error(); err != nil {
+		return nil, err
+	}
+	return query.NaiveQueryApply(q, query.ResultsWithEntries(q, entries)), nil
+}
+
+func (d *levelDatastore) Batch() (ds.Batch, error) {
+	return ds.NewBasicBatch(d), nil
+}
+
+func (d *levelDatastore) Close() error {
+	return d.db.Close()
+}
+
+// openRepo returns a DAGService over the blocks in the repo at path, an
+// empty path opens ~/.glua/repo.
+func openRepo(path string) (ipld.DAGService, func() error, error) {
+	if len(path) == 0 {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil, err
+		}
+		path = filepath.Join(home, ".glua", "repo")
+	}
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	bstore := blockstore.NewBlockstore(&levelDatastore{db})
+	return dag.NewDAGService(bsrv.New(bstore, offline.Exchange(bstore))), db.Close, nil
+}
+
+// newAAppState returns a state with the directory or the root CID aapp
+// mounted as its MFS.
+func newAAppState(aapp, repo string, opts lua.Options) (*lua.LState, func(), error) {
+	ctx := context.Background()
+	dserv, closeRepo, err := openRepo(repo)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var L *lua.LState
+	if info, statErr := os.Stat(aapp); statErr == nil && info.IsDir() {
+		if L, err = lua.NewMFSState(ctx, dserv, nil, opts); err == nil {
+			err = L.MFS_ImportDir(aapp, "/")
+		}
+	} else {
+		var c cid.Cid
+		var nd ipld.Node
+		if c, err = cid.Decode(aapp); err != nil {
+			err = fmt.Errorf("%v is neither a directory nor a CID", aapp)
+		} else if nd, err = dserv.Get(ctx, c); err == nil {
+			pbnd, ok := nd.(*dag.ProtoNode)
+			if !ok {
+				err = fmt.Errorf("%v is not a directory", aapp)
+			} else {
+				L, err = lua.NewMFSState(ctx, dserv, pbnd, opts)
+			}
+		}
+	}
+	if err != nil {
+		if L != nil {
+			L.Close()
+		}
+		closeRepo()
+		return nil, nil, err
+	}
+	return L, func() { closeRepo() }, nil
+}
+
+// runAApp runs the aapp.lua of the mounted AApp.
+func runAApp(L *lua.LState) error {
+	fn, err := L.LoadScript(lua.ALVM_PATH_Maincript)
+	if err != nil {
+		return err
+	}
+	L.Push(fn)
+	return L.PCall(0, 0, nil)
+}
+
+// callAApp calls the global fn with args and prints the JSON encoded results.
+func callAApp(L *lua.LState, fn string, args []string) error {
+	ret, err := L.PerfromGlobal(fn, args...)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(ret))
+	return nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"github.com/ayachain/go-aya-alvm"
+	"github.com/chzyer/readline"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+const debugHelp = `Commands:
+  c, continue          run until the next breakpoint
+  s, step              step into the next line
+  n, next              step over the next line
+  f, finish            run until the current function returns
+  b [file:]line|func   set a breakpoint
+  d [file:]line|func   delete a breakpoint
+  bt                   print the stack
+  frame N              select frame N
+  locals               print the locals of the selected frame
+  upvalues             print the upvalues of the selected frame
+  p expr               evaluate expr in the selected frame
+  list                 print the source around the current line
+  h, help              print this help
+  q, quit              quit`
+
+// interactive debugger of glua -debug
+type debugREPL struct {
+	rl     *readline.Instance
+	script string
+	level  int
+	quit   bool
+}
+
+func newDebugger(script string) (*lua.Debugger, func(), error) {
+	rl, err := readline.New("(debug) ")
+	if err != nil {
+		return nil, nil, err
+	}
+	r := &debugREPL{rl: rl, script: script}
+	d := lua.NewDebugger(r.handle)
+	// stop before the first line of the script
+	d.Pause()
+	return d, func() { rl.Close() }, nil
+}
+
+func (r *debugREPL) handle(d *lua.Debugger, reason lua.DebugReason) lua.DebugAction {
+	if r.quit {
+		return lua.DebugContinue
+	}
+	r.level = 0
+	if frames := d.Stack(); len(frames) > 0 {
+		fmt.Printf("%v at %v\n", reason, formatFrame(frames[0]))
+		r.printLines(frames[0], 0)
+	}
+	for {
+		line, err := r.rl.Readline()
+		if err != nil {
+			r.quit = true
+			return lua.DebugContinue
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		arg := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), fields[0]))
+		switch fields[0] {
+		case "c", "continue":
+			return lua.DebugContinue
+		case "s", "step":
+			return lua.DebugStepIn
+		case "n", "next":
+			return lua.DebugStepOver
+		case "f", "finish":
+			return lua.DebugStepOut
+		case "b", "break", "d", "delete":
+			r.breakpoint(d, fields[0] == "b" || fields[0] == "break", arg)
+		case "bt":
+			for _, f := range d.Stack() {
+				fmt.Printf("#%v %v\n", f.Level, formatFrame(f))
+			}
+		case "frame":
+			level, err := strconv.Atoi(arg)
+			if frames := d.Stack(); err != nil || level < 0 || level >= len(frames) {
+				fmt.Println("invalid frame")
+			} else {
+				r.level = level
+				fmt.Printf("#%v %v\n", level, formatFrame(frames[level]))
+			}
+		case "locals":
+			printVariables(d.Locals(r.level))
+		case "upvalues":
+			printVariables(d.Upvalues(r.level))
+		case "p", "print":
+			values, err := d.Eval(r.level, arg)
+			if err != nil {
+				fmt.Println(err.Error())
+				continue
+			}
+			for _, lv := range values {
+				fmt.Println(lv.String())
+			}
+		case "list":
+			if frames := d.Stack(); r.level < len(frames) {
+				r.printLines(frames[r.level], 5)
+			}
+		case "h", "help":
+			fmt.Println(debugHelp)
+		case "q", "quit":
+			r.quit = true
+			return lua.DebugContinue
+		default:
+			fmt.Printf("unknown command '%v', try 'help'\n", fields[0])
+		}
+	}
+}
+
+// add or remove the breakpoint [file:]line|func
+func (r *debugREPL) breakpoint(d *lua.Debugger, add bool, spec string) {
+	source, pos := r.script, spec
+	if i := strings.LastIndex(spec, ":"); i > 0 {
+		if _, err := strconv.Atoi(spec[i+1:]); err == nil {
+			source, pos = spec[:i], spec[i+1:]
+		}
+	}
+	if spec == "" {
+		fmt.Println("usage: b [file:]line|func")
+		return
+	}
+	if line, err := strconv.Atoi(pos); err == nil {
+		if add {
+			d.AddBreakpoint(source, line)
+		} else {
+			d.RemoveBreakpoint(source, line)
+		}
+	} else if add {
+		d.AddFunctionBreakpoint(spec)
+	} else {
+		d.RemoveFunctionBreakpoint(spec)
+	}
+}
+
+// print the source lines around the line of f
+func (r *debugREPL) printLines(f lua.DebugFrame, around int) {
+	if f.Line < 0 {
+		return
+	}
+	src, err := ioutil.ReadFile(f.Source)
+	if err != nil {
+		return
+	}
+	lines := strings.Split(string(src), "\n")
+	for n := f.Line - around; n <= f.Line+around; n++ {
+		if n < 1 || n > len(lines) {
+			continue
+		}
+		mark := " "
+		if n == f.Line {
+			mark = ">"
+		}
+		fmt.Printf("%v %4d  %v\n", mark, n, lines[n-1])
+	}
+}
+
+func formatFrame(f lua.DebugFrame) string {
+	name := f.Name
+	if name == "" {
+		name = "?"
+	}
+	if f.Line < 0 {
+		return fmt.Sprintf("%v %v", f.Source, name)
+	}
+	return fmt.Sprintf("%v:%v %v", f.Source, f.Line, name)
+}
+
+func printVariables(vars []lua.DebugVariable) {
+	for _, v := range vars {
+		fmt.Printf("%v = %v\n", v.Name, v.Value.String())
+	}
+}
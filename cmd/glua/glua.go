@@ -1,33 +1,53 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"github.com/ayachain/go-aya-alvm"
+	"github.com/ayachain/go-aya-alvm/dap"
+	"github.com/ayachain/go-aya-alvm/format"
+	"github.com/ayachain/go-aya-alvm/lint"
+	"github.com/ayachain/go-aya-alvm/luatest"
 	"github.com/ayachain/go-aya-alvm/parse"
-	"github.com/chzyer/readline"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"regexp"
 	"runtime/pprof"
+	"strings"
 )
 
 func main() {
 	os.Exit(mainAux())
 }
 
-func mainAux() int {
-	var opt_e, opt_l, opt_p string
-	var opt_i, opt_v, opt_dt, opt_dc bool
+func mainAux() (status int) {
+	var opt_e, opt_l, opt_p, opt_lp, opt_cover, opt_dap, opt_aapp, opt_repo string
+	var opt_i, opt_v, opt_dt, opt_dc, opt_debug bool
 	var opt_m int
 	flag.StringVar(&opt_e, "e", "", "")
 	flag.StringVar(&opt_l, "l", "", "")
 	flag.StringVar(&opt_p, "p", "", "")
+	flag.StringVar(&opt_lp, "lp", "", "")
+	flag.StringVar(&opt_cover, "cover", "", "")
+	flag.StringVar(&opt_dap, "dap", "", "")
+	flag.StringVar(&opt_aapp, "aapp", "", "")
+	flag.StringVar(&opt_repo, "repo", "", "")
 	flag.IntVar(&opt_m, "mx", 0, "")
 	flag.BoolVar(&opt_i, "i", false, "")
 	flag.BoolVar(&opt_v, "v", false, "")
 	flag.BoolVar(&opt_dt, "dt", false, "")
 	flag.BoolVar(&opt_dc, "dc", false, "")
+	flag.BoolVar(&opt_debug, "debug", false, "")
 	flag.Usage = func() {
 		fmt.Println(`Usage: glua [options] [script [args]].
+       glua -aapp dir|cid [options] [function [args]]
+       glua lint file|dir...
+       glua fmt [-w] file|dir...
+       glua test [-fixture dir] [-run regexp] [-format tap|junit] [-o file]
+                 [-cover file] file|dir...
 Available options are:
   -e stat  execute string 'stat'
   -l name  require library 'name'
@@ -35,10 +55,31 @@ Available options are:
   -dt      dump AST trees
   -dc      dump VM codes
   -i       enter interactive mode after executing 'script'
+  -debug   debug 'script' interactively
+  -dap addr  serve the Debug Adapter Protocol for the AApp directory
+           'script' on addr, 'stdio' or a local TCP address like ':4711'
   -p file  write cpu profiles to the file
+  -lp file write Lua profiles in pprof format to the file
+  -aapp dir|cid  run the AApp in dir or saved at cid on an MFS, call
+           'function' with the string args and print the root CID
+  -repo dir  keep the blocks of -aapp in dir(default: ~/.glua/repo)
+  -cover file  write the lines that ran to the file, as HTML for *.html,
+           a summary for *.txt, or else merged into the LCOV tracefile
   -v       show version information`)
 	}
 	flag.Parse()
+	if flag.NArg() > 0 && flag.Arg(0) == "lint" {
+		return doLint(flag.Args()[1:])
+	}
+	if flag.NArg() > 0 && flag.Arg(0) == "fmt" {
+		return doFmt(flag.Args()[1:])
+	}
+	if flag.NArg() > 0 && flag.Arg(0) == "test" {
+		return doTest(flag.Args()[1:])
+	}
+	if len(opt_dap) > 0 {
+		return doDAP(opt_dap, flag.Arg(0))
+	}
 	if len(opt_p) != 0 {
 		f, err := os.Create(opt_p)
 		if err != nil {
@@ -48,17 +89,54 @@ Available options are:
 		pprof.StartCPUProfile(f)
 		defer pprof.StopCPUProfile()
 	}
-	if len(opt_e) == 0 && !opt_i && !opt_v && flag.NArg() == 0 {
+	if len(opt_e) == 0 && !opt_i && !opt_v && flag.NArg() == 0 && len(opt_aapp) == 0 {
 		opt_i = true
 	}
 
-	status := 0
-
-	L := lua.NewState()
+	var opts lua.Options
+	if len(opt_cover) != 0 {
+		cov := lua.NewCoverage()
+		opts.Coverage = cov
+		defer func() {
+			if err := writeCoverage(cov, opt_cover); err != nil {
+				fmt.Println(err.Error())
+			}
+		}()
+	}
+	var L *lua.LState
+	if len(opt_aapp) != 0 {
+		var closer func()
+		var err error
+		if L, closer, err = newAAppState(opt_aapp, opt_repo, opts); err != nil {
+			fmt.Println(err.Error())
+			return 1
+		}
+		defer closer()
+	} else {
+		L = lua.NewState(opts)
+	}
 	defer L.Close()
 	if opt_m > 0 {
 		L.SetMx(opt_m)
 	}
+	if len(opt_lp) != 0 {
+		f, err := os.Create(opt_lp)
+		if err != nil {
+			fmt.Println(err.Error())
+			return 1
+		}
+		defer f.Close()
+		profiler := lua.NewProfiler(0)
+		if err := L.SetProfiler(profiler); err != nil {
+			fmt.Println(err.Error())
+			return 1
+		}
+		defer func() {
+			if err := profiler.WritePprof(f); err != nil {
+				fmt.Println(err.Error())
+			}
+		}()
+	}
 
 	if opt_v || opt_i {
 		fmt.Println(lua.PackageCopyRight)
@@ -70,7 +148,26 @@ Available options are:
 		}
 	}
 
-	if nargs := flag.NArg(); nargs > 0 {
+	if len(opt_aapp) != 0 {
+		defer func() {
+			if c, err := L.FlushMFS(); err != nil {
+				fmt.Println(err.Error())
+				status = 1
+			} else {
+				fmt.Println(c.String())
+			}
+		}()
+		if err := runAApp(L); err != nil {
+			fmt.Println(err.Error())
+			return 1
+		}
+		if flag.NArg() > 0 {
+			if err := callAApp(L, flag.Arg(0), flag.Args()[1:]); err != nil {
+				fmt.Println(err.Error())
+				status = 1
+			}
+		}
+	} else if nargs := flag.NArg(); nargs > 0 {
 		script := flag.Arg(0)
 		argtb := L.NewTable()
 		for i := 1; i < nargs; i++ {
@@ -100,10 +197,23 @@ Available options are:
 				fmt.Println(proto.String())
 			}
 		}
+		if opt_debug {
+			d, closer, err := newDebugger(script)
+			if err != nil {
+				fmt.Println(err.Error())
+				return 1
+			}
+			defer closer()
+			if err := L.SetDebugger(d); err != nil {
+				fmt.Println(err.Error())
+				return 1
+			}
+		}
 		if err := L.DoFile(script); err != nil {
 			fmt.Println(err.Error())
 			status = 1
 		}
+		L.SetDebugger(nil)
 	}
 
 	if len(opt_e) > 0 {
@@ -114,65 +224,246 @@ Available options are:
 	}
 
 	if opt_i {
-		doREPL(L)
+		doREPL(L, len(opt_aapp) != 0)
 	}
 	return status
 }
 
-// do read/eval/print/loop
-func doREPL(L *lua.LState) {
-	rl, err := readline.New("> ")
+// write the coverage report to name, by its extension
+func writeCoverage(cov *lua.Coverage, name string) error {
+	switch filepath.Ext(name) {
+	case ".html", ".htm":
+		f, err := os.Create(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return cov.WriteHTML(f, ioutil.ReadFile)
+	case ".txt":
+		f, err := os.Create(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return cov.WriteText(f)
+	}
+	if f, err := os.Open(name); err == nil {
+		err = cov.ReadLCOV(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	f, err := os.Create(name)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	defer rl.Close()
-	for {
-		if str, err := loadline(rl, L); err == nil {
-			if err := L.DoString(str); err != nil {
-				fmt.Println(err)
+	defer f.Close()
+	return cov.WriteLCOV(f)
+}
+
+// luaFiles returns the given files, directories are searched for *.lua files
+func luaFiles(paths []string) ([]string, error) {
+	var files []string
+	for _, path := range paths {
+		err := filepath.Walk(path, func(name string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() && (name == path || strings.HasSuffix(name, ".lua")) {
+				files = append(files, name)
 			}
-		} else { // error on loadline
-			fmt.Println(err)
-			return
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// lint the given scripts
+func doLint(paths []string) int {
+	files, err := luaFiles(paths)
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+
+	status := 0
+	linter := lint.New()
+	for _, name := range files {
+		file, err := os.Open(name)
+		if err != nil {
+			fmt.Println(err.Error())
+			return 1
+		}
+		diags, err := linter.CheckFile(file, name)
+		file.Close()
+		if err != nil {
+			fmt.Println(err.Error())
+			status = 1
+			continue
+		}
+		for _, d := range diags {
+			fmt.Println(d.String())
+			status = 1
 		}
 	}
+	return status
 }
 
-func incomplete(err error) bool {
-	if lerr, ok := err.(*lua.ApiError); ok {
-		if perr, ok := lerr.Cause.(*parse.Error); ok {
-			return perr.Pos.Line == parse.EOF
+// format the given scripts, to stdout or in place with -w
+func doFmt(args []string) int {
+	fs := flag.NewFlagSet("fmt", flag.ContinueOnError)
+	var opt_w bool
+	fs.BoolVar(&opt_w, "w", false, "write result to the source file instead of stdout")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	files, err := luaFiles(fs.Args())
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+
+	status := 0
+	for _, name := range files {
+		src, err := ioutil.ReadFile(name)
+		if err != nil {
+			fmt.Println(err.Error())
+			return 1
+		}
+		out, err := format.Source(src, name)
+		if err != nil {
+			fmt.Println(err.Error())
+			status = 1
+			continue
+		}
+		if !opt_w {
+			os.Stdout.Write(out)
+		} else if string(out) != string(src) {
+			if err := ioutil.WriteFile(name, out, 0644); err != nil {
+				fmt.Println(err.Error())
+				return 1
+			}
 		}
 	}
-	return false
+	return status
 }
 
-func loadline(rl *readline.Instance, L *lua.LState) (string, error) {
-	rl.SetPrompt("> ")
-	if line, err := rl.Readline(); err == nil {
-		if _, err := L.LoadString("return " + line); err == nil { // try add return <...> then compile
-			return line, nil
-		} else {
-			return multiline(line, rl, L)
+// run the tests of the given *_test.lua files
+func doTest(args []string) int {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	var opt_fixture, opt_run, opt_format, opt_o, opt_cover string
+	fs.StringVar(&opt_fixture, "fixture", "", "directory copied to the MFS of every test")
+	fs.StringVar(&opt_run, "run", "", "run only the tests matching the regexp")
+	fs.StringVar(&opt_format, "format", "tap", "report format, tap or junit")
+	fs.StringVar(&opt_o, "o", "", "write the report to the file instead of stdout")
+	fs.StringVar(&opt_cover, "cover", "", "write the lines that ran to the file")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	paths := fs.Args()
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+	files, err := luatest.Files(paths)
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+
+	runner := &luatest.Runner{Fixture: opt_fixture}
+	if len(opt_run) > 0 {
+		if runner.Match, err = regexp.Compile(opt_run); err != nil {
+			fmt.Println(err.Error())
+			return 1
 		}
-	} else {
-		return "", err
 	}
+	var cov *lua.Coverage
+	if len(opt_cover) > 0 {
+		cov = lua.NewCoverage()
+		runner.Options.Coverage = cov
+	}
+
+	var w io.Writer = os.Stdout
+	if len(opt_o) > 0 {
+		f, err := os.Create(opt_o)
+		if err != nil {
+			fmt.Println(err.Error())
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+	switch opt_format {
+	case "tap":
+		runner.Reporter = luatest.NewTAPReporter(w)
+	case "junit":
+		runner.Reporter = luatest.NewJUnitReporter(w)
+	default:
+		fmt.Printf("unknown report format %v\n", opt_format)
+		return 1
+	}
+
+	status := 0
+	if runner.Run(files) > 0 {
+		status = 1
+	}
+	if err := runner.Reporter.Close(); err != nil {
+		fmt.Println(err.Error())
+		status = 1
+	}
+	if cov != nil {
+		if err := writeCoverage(cov, opt_cover); err != nil {
+			fmt.Println(err.Error())
+			status = 1
+		}
+	}
+	return status
 }
 
-func multiline(ml string, rl *readline.Instance, L *lua.LState) (string, error) {
-	for {
-		if _, err := L.LoadString(ml); err == nil { // try compile
-			return ml, nil
-		} else if !incomplete(err) { // syntax error , but not EOF
-			return ml, nil
-		} else {
-			rl.SetPrompt(">> ")
-			if line, err := rl.Readline(); err == nil {
-				ml = ml + "\n" + line
-			} else {
-				return "", err
-			}
+// serve debug sessions of the AApp in dir, the files are copied to an MFS
+// held in memory for each session
+func doDAP(addr string, dir string) int {
+	if len(dir) == 0 {
+		dir = "."
+	}
+	newState := func() (*lua.LState, error) {
+		L, err := lua.NewMFSState(context.Background(), nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := L.MFS_ImportDir(dir, "/"); err != nil {
+			L.Close()
+			return nil, err
 		}
+		return L, nil
 	}
+
+	var err error
+	if addr == "stdio" {
+		var L *lua.LState
+		if L, err = newState(); err == nil {
+			defer L.Close()
+			err = dap.NewServer(L).Serve(stdio{os.Stdin, os.Stdout})
+		}
+	} else {
+		// only listen on localhost unless a host is given
+		if strings.HasPrefix(addr, ":") {
+			addr = "localhost" + addr
+		}
+		err = dap.ListenAndServe(addr, newState)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	return 0
+}
+
+type stdio struct {
+	io.Reader
+	io.Writer
 }
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ayachain/go-aya-alvm"
+	"github.com/ayachain/go-aya-alvm/parse"
+	"github.com/chzyer/readline"
+	"github.com/ipfs/go-mfs"
+)
+
+/*
+  Interactive mode.
+
+  Lines are run as expressions when they compile as such and their results
+  are printed, tables nested up to replDepth levels. Lines starting with a
+  colon are meta commands, see replHelp. The history is kept in
+  ~/.glua_history and tab completes globals and the fields of tables,
+  including those reached through __index metatables.
+*/
+
+const replDepth = 3
+
+const replHelp = `:load file       run a script, an MFS path like /Script/x.lua with -aapp
+:call fn args..  call the global fn with string args and print the JSON results
+:flush           flush the MFS and print the root CID (-aapp only)
+:ls [path]       list an MFS directory, / by default (-aapp only)
+:help            show this help`
+
+// do read/eval/print/loop, aapp tells whether an MFS root is mounted
+func doREPL(L *lua.LState, aapp bool) {
+	cfg := &readline.Config{
+		Prompt:       "> ",
+		AutoComplete: &completer{L},
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		cfg.HistoryFile = filepath.Join(home, ".glua_history")
+	}
+	rl, err := readline.NewEx(cfg)
+	if err != nil {
+		panic(err)
+	}
+	defer rl.Close()
+	for {
+		str, err := loadline(rl, L)
+		if err != nil { // error on loadline
+			fmt.Println(err)
+			return
+		}
+		if strings.HasPrefix(str, ":") {
+			if err := doMeta(L, aapp, str); err != nil {
+				fmt.Println(err)
+			}
+			continue
+		}
+		top := L.GetTop()
+		fn, err := L.LoadString("return " + str)
+		if err != nil {
+			fn, err = L.LoadString(str)
+		}
+		if err == nil {
+			L.Push(fn)
+			err = L.PCall(0, lua.MultRet, nil)
+		}
+		if err != nil {
+			fmt.Println(err)
+		} else if L.GetTop() > top {
+			var values []string
+			for i := top + 1; i <= L.GetTop(); i++ {
+				values = append(values, pretty(L.Get(i), replDepth, ""))
+			}
+			fmt.Println(strings.Join(values, "\t"))
+		}
+		L.SetTop(top)
+	}
+}
+
+// doMeta runs a meta command
+func doMeta(L *lua.LState, aapp bool, line string) error {
+	fields := strings.Fields(line[1:])
+	if len(fields) == 0 {
+		fields = []string{"help"}
+	}
+	needAApp := func() error {
+		if !aapp {
+			return fmt.Errorf(":%v needs an AApp mounted with -aapp", fields[0])
+		}
+		return nil
+	}
+	switch fields[0] {
+	case "load":
+		if len(fields) != 2 {
+			return fmt.Errorf("usage: :load file")
+		}
+		if !aapp {
+			return L.DoFile(fields[1])
+		}
+		fn, err := L.LoadScript(fields[1])
+		if err != nil {
+			return err
+		}
+		L.Push(fn)
+		return L.PCall(0, 0, nil)
+	case "call":
+		if len(fields) < 2 {
+			return fmt.Errorf("usage: :call fn args..")
+		}
+		return callAApp(L, fields[1], fields[2:])
+	case "flush":
+		if err := needAApp(); err != nil {
+			return err
+		}
+		c, err := L.FlushMFS()
+		if err != nil {
+			return err
+		}
+		fmt.Println(c.String())
+	case "ls":
+		if err := needAApp(); err != nil {
+			return err
+		}
+		path := "/"
+		if len(fields) > 1 {
+			path = fields[1]
+		}
+		dir, err := L.MFS_LookupDir(path)
+		if err != nil {
+			return err
+		}
+		entries, err := dir.List(context.Background())
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			name := e.Name
+			if e.Type == int(mfs.TDir) {
+				name += "/"
+			}
+			fmt.Printf("%-46v %10v  %v\n", e.Hash, e.Size, name)
+		}
+	case "help":
+		fmt.Println(replHelp)
+	default:
+		return fmt.Errorf("unknown command :%v, try :help", fields[0])
+	}
+	return nil
+}
+
+// pretty formats a value like a table constructor, tables nested deeper than
+// depth are elided
+func pretty(lv lua.LValue, depth int, indent string) string {
+	switch v := lv.(type) {
+	case lua.LString:
+		return fmt.Sprintf("%q", string(v))
+	case *lua.LTable:
+		if depth == 0 {
+			return "{...}"
+		}
+		var fields []string
+		n := v.Len()
+		for i := 1; i <= n; i++ {
+			fields = append(fields, pretty(v.RawGetInt(i), depth-1, indent+"  "))
+		}
+		var named []string
+		v.ForEach(func(key, value lua.LValue) {
+			if num, ok := key.(lua.LNumber); ok && float64(num) == float64(int(num)) && int(num) >= 1 && int(num) <= n {
+				return
+			}
+			name := "[" + pretty(key, 0, "") + "]"
+			if str, ok := key.(lua.LString); ok && isIdentifier(string(str)) {
+				name = string(str)
+			}
+			named = append(named, name+" = "+pretty(value, depth-1, indent+"  "))
+		})
+		sort.Strings(named)
+		fields = append(fields, named...)
+		if len(fields) == 0 {
+			return "{}"
+		}
+		if short := "{" + strings.Join(fields, ", ") + "}"; len(short) <= 72 && !strings.Contains(short, "\n") {
+			return short
+		}
+		return "{\n" + indent + "  " + strings.Join(fields, ",\n"+indent+"  ") + "\n" + indent + "}"
+	}
+	return lv.String()
+}
+
+func isIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+/* completion {{{ */
+
+type completer struct {
+	L *lua.LState
+}
+
+// fields returns the table whose fields complete after lv, following
+// __index metatables like the method calls on strings do
+func (c *completer) fields(lv lua.LValue) *lua.LTable {
+	if tb, ok := lv.(*lua.LTable); ok {
+		return tb
+	}
+	if mt, ok := c.L.GetMetatable(lv).(*lua.LTable); ok {
+		if index, ok := mt.RawGetString("__index").(*lua.LTable); ok {
+			return index
+		}
+	}
+	return nil
+}
+
+// Do completes the dotted name before pos, e.g. "string.fo" or "s:up"
+func (c *completer) Do(line []rune, pos int) ([][]rune, int) {
+	start := pos
+	for start > 0 {
+		r := line[start-1]
+		if r != '.' && r != ':' && r != '_' && !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+			break
+		}
+		start--
+	}
+	word := string(line[start:pos])
+	if strings.HasPrefix(word, ":") {
+		return nil, 0
+	}
+
+	tb := c.L.G.Global
+	prefix := word
+	methods := false
+	if i := strings.LastIndexAny(word, ".:"); i >= 0 {
+		methods = word[i] == ':'
+		prefix = word[i+1:]
+		var lv lua.LValue = c.L.G.Global
+		for _, name := range strings.FieldsFunc(word[:i], func(r rune) bool { return r == '.' || r == ':' }) {
+			if tb = c.fields(lv); tb == nil {
+				return nil, 0
+			}
+			lv = tb.RawGetString(name)
+		}
+		if tb = c.fields(lv); tb == nil {
+			return nil, 0
+		}
+	}
+
+	var names []string
+	seen := make(map[string]bool)
+	for depth := 0; tb != nil && depth < 8; depth++ {
+		tb.ForEach(func(key, value lua.LValue) {
+			name, ok := key.(lua.LString)
+			if !ok || !isIdentifier(string(name)) || !strings.HasPrefix(string(name), prefix) || seen[string(name)] {
+				return
+			}
+			if methods && value.Type() != lua.LTFunction {
+				return
+			}
+			seen[string(name)] = true
+			names = append(names, string(name))
+		})
+		// fields inherited through __index
+		mt, _ := c.L.GetMetatable(tb).(*lua.LTable)
+		if mt == nil {
+			break
+		}
+		tb, _ = mt.RawGetString("__index").(*lua.LTable)
+	}
+	sort.Strings(names)
+	candidates := make([][]rune, 0, len(names))
+	for _, name := range names {
+		candidates = append(candidates, []rune(name[len(prefix):]))
+	}
+	return candidates, len([]rune(prefix))
+}
+
+/* }}} */
+
+func incomplete(err error) bool {
+	if lerr, ok := err.(*lua.ApiError); ok {
+		if perr, ok := lerr.Cause.(*parse.Error); ok {
+			return perr.Pos.Line == parse.EOF
+		}
+	}
+	return false
+}
+
+func loadline(rl *readline.Instance, L *lua.LState) (string, error) {
+	rl.SetPrompt("> ")
+	if line, err := rl.Readline(); err == nil {
+		if strings.HasPrefix(line, ":") {
+			return line, nil
+		}
+		if _, err := L.LoadString("return " + line); err == nil { // try add return <...> then compile
+			return line, nil
+		} else {
+			return multiline(line, rl, L)
+		}
+	} else {
+		return "", err
+	}
+}
+
+func multiline(ml string, rl *readline.Instance, L *lua.LState) (string, error) {
+	for {
+		if _, err := L.LoadString(ml); err == nil { // try compile
+			return ml, nil
+		} else if !incomplete(err) { // syntax error , but not EOF
+			return ml, nil
+		} else {
+			rl.SetPrompt(">> ")
+			if line, err := rl.Readline(); err == nil {
+				ml = ml + "\n" + line
+			} else {
+				return "", err
+			}
+		}
+	}
+}
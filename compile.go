@@ -119,17 +119,38 @@ func isVarArgReturnExpr(expr ast.Expr) bool {
 	return false
 }
 
-func lnumberValue(expr ast.Expr) (LNumber, bool) {
+func lnumberValue(expr ast.Expr, integers bool) (LValue, bool) {
 	if ex, ok := expr.(*ast.NumberExpr); ok {
-		lv, err := parseNumber(ex.Value)
-		if err != nil {
-			lv = LNumber(math.NaN())
-		}
-		return lv, true
+		return numberConst(ex.Value, integers), true
 	} else if ex, ok := expr.(*constLValueExpr); ok {
-		return ex.Value.(LNumber), true
+		return ex.Value, true
+	}
+	return LNumber(0), false
+}
+
+// numberConst converts a numeral, to an LInteger if integers are enabled and
+// it is an integer one.
+func numberConst(value string, integers bool) LValue {
+	lv, err := parseNumberValue(value, integers)
+	if err != nil {
+		return LNumber(math.NaN())
 	}
-	return 0, false
+	return lv
+}
+
+var arithOpcodes = map[string]int{
+	"+":  OP_ADD,
+	"-":  OP_SUB,
+	"*":  OP_MUL,
+	"/":  OP_DIV,
+	"%":  OP_MOD,
+	"^":  OP_POW,
+	"//": OP_IDIV,
+	"&":  OP_BAND,
+	"|":  OP_BOR,
+	"~":  OP_BXOR,
+	"<<": OP_SHL,
+	">>": OP_SHR,
 }
 
 /* utilities }}} */
@@ -369,6 +390,9 @@ func newFuncContext(sourcename string, parent *funcContext) *funcContext {
 		labelPc:  map[int]int{},
 	}
 	fc.Blocks = []*codeBlock{fc.Block}
+	if parent != nil {
+		fc.Proto.Integers = parent.Proto.Integers
+	}
 	return fc
 }
 
@@ -969,10 +993,7 @@ func compileExpr(context *funcContext, reg int, expr ast.Expr, ec *expcontext) i
 		code.AddABx(OP_LOADK, sreg, context.ConstIndex(LString(ex.Value)), sline(ex))
 		return sused
 	case *ast.NumberExpr:
-		num, err := parseNumber(ex.Value)
-		if err != nil {
-			num = LNumber(math.NaN())
-		}
+		num := numberConst(ex.Value, context.Proto.Integers)
 		code.AddABx(OP_LOADK, sreg, context.ConstIndex(num), sline(ex))
 		return sused
 	case *constLValueExpr:
@@ -1029,7 +1050,7 @@ func compileExpr(context *funcContext, reg int, expr ast.Expr, ec *expcontext) i
 	case *ast.StringConcatOpExpr:
 		compileStringConcatOpExpr(context, reg, ex, ec)
 		return sused
-	case *ast.UnaryMinusOpExpr, *ast.UnaryNotOpExpr, *ast.UnaryLenOpExpr:
+	case *ast.UnaryMinusOpExpr, *ast.UnaryNotOpExpr, *ast.UnaryLenOpExpr, *ast.UnaryBNotOpExpr:
 		compileUnaryOpExpr(context, reg, ex, ec)
 		return sused
 	case *ast.RelationalOpExpr:
@@ -1084,35 +1105,37 @@ func compileExprWithMVPropagation(context *funcContext, expr ast.Expr, reg *int,
 	compileExprWithPropagation(context, expr, reg, save, context.Code.PropagateMV)
 } // }}}
 
-func constFold(exp ast.Expr) ast.Expr { // {{{
+func constFold(exp ast.Expr, integers bool) ast.Expr { // {{{
 	switch expr := exp.(type) {
 	case *ast.ArithmeticOpExpr:
-		lvalue, lisconst := lnumberValue(constFold(expr.Lhs))
-		rvalue, risconst := lnumberValue(constFold(expr.Rhs))
+		opcode, ok := arithOpcodes[expr.Operator]
+		if !ok {
+			panic(fmt.Sprintf("unknown binop: %v", expr.Operator))
+		}
+		if opcode >= OP_IDIV && !integers {
+			return expr
+		}
+		lvalue, lisconst := lnumberValue(constFold(expr.Lhs, integers), integers)
+		rvalue, risconst := lnumberValue(constFold(expr.Rhs, integers), integers)
 		if lisconst && risconst {
-			switch expr.Operator {
-			case "+":
-				return &constLValueExpr{Value: lvalue + rvalue}
-			case "-":
-				return &constLValueExpr{Value: lvalue - rvalue}
-			case "*":
-				return &constLValueExpr{Value: lvalue * rvalue}
-			case "/":
-				return &constLValueExpr{Value: lvalue / rvalue}
-			case "%":
-				return &constLValueExpr{Value: luaModulo(lvalue, rvalue)}
-			case "^":
-				return &constLValueExpr{Value: LNumber(math.Pow(float64(lvalue), float64(rvalue)))}
-			default:
-				panic(fmt.Sprintf("unknown binop: %v", expr.Operator))
+			if isFloatArith(opcode, lvalue, rvalue) {
+				v1, _ := lvalue.assertFloat64()
+				v2, _ := rvalue.assertFloat64()
+				return &constLValueExpr{Value: numberArith(nil, opcode, LNumber(v1), LNumber(v2))}
+			}
+			// errors such as a division by zero are raised when the code runs
+			if value, msg := integerArith(opcode, lvalue, rvalue); len(msg) == 0 {
+				return &constLValueExpr{Value: value}
 			}
-		} else {
-			return expr
 		}
+		return expr
 	case *ast.UnaryMinusOpExpr:
-		expr.Expr = constFold(expr.Expr)
-		if value, ok := lnumberValue(expr.Expr); ok {
-			return &constLValueExpr{Value: LNumber(-value)}
+		expr.Expr = constFold(expr.Expr, integers)
+		if value, ok := lnumberValue(expr.Expr, integers); ok {
+			if it, ok := value.(LInteger); ok {
+				return &constLValueExpr{Value: -it}
+			}
+			return &constLValueExpr{Value: -value.(LNumber)}
 		}
 		return expr
 	default:
@@ -1235,7 +1258,10 @@ func compileTableExpr(context *funcContext, reg int, ex *ast.TableExpr, ec *expc
 } // }}}
 
 func compileArithmeticOpExpr(context *funcContext, reg int, expr *ast.ArithmeticOpExpr, ec *expcontext) { // {{{
-	exp := constFold(expr)
+	if arithOpcodes[expr.Operator] >= OP_IDIV && !context.Proto.Integers {
+		raiseCompileError(context, sline(expr), "integer operators are not enabled")
+	}
+	exp := constFold(expr, context.Proto.Integers)
 	if ex, ok := exp.(*constLValueExpr); ok {
 		exp.SetLine(sline(expr))
 		compileExpr(context, reg, ex, ec)
@@ -1248,22 +1274,7 @@ func compileArithmeticOpExpr(context *funcContext, reg int, expr *ast.Arithmetic
 	c := reg
 	compileExprWithKMVPropagation(context, expr.Rhs, &reg, &c)
 
-	op := 0
-	switch expr.Operator {
-	case "+":
-		op = OP_ADD
-	case "-":
-		op = OP_SUB
-	case "*":
-		op = OP_MUL
-	case "/":
-		op = OP_DIV
-	case "%":
-		op = OP_MOD
-	case "^":
-		op = OP_POW
-	}
-	context.Code.AddABC(op, a, b, c, sline(expr))
+	context.Code.AddABC(arithOpcodes[expr.Operator], a, b, c, sline(expr))
 } // }}}
 
 func compileStringConcatOpExpr(context *funcContext, reg int, expr *ast.StringConcatOpExpr, ec *expcontext) { // {{{
@@ -1293,7 +1304,7 @@ func compileUnaryOpExpr(context *funcContext, reg int, expr ast.Expr, ec *expcon
 	var operandexpr ast.Expr
 	switch ex := expr.(type) {
 	case *ast.UnaryMinusOpExpr:
-		exp := constFold(ex)
+		exp := constFold(ex, context.Proto.Integers)
 		if lvexpr, ok := exp.(*constLValueExpr); ok {
 			exp.SetLine(sline(expr))
 			compileExpr(context, reg, lvexpr, ec)
@@ -1317,6 +1328,12 @@ func compileUnaryOpExpr(context *funcContext, reg int, expr ast.Expr, ec *expcon
 	case *ast.UnaryLenOpExpr:
 		opcode = OP_LEN
 		operandexpr = ex.Expr
+	case *ast.UnaryBNotOpExpr:
+		if !context.Proto.Integers {
+			raiseCompileError(context, sline(expr), "integer operators are not enabled")
+		}
+		opcode = OP_BNOT
+		operandexpr = ex.Expr
 	}
 
 	a := savereg(ec, reg)
@@ -1586,19 +1603,30 @@ func patchCode(context *funcContext) { // {{{
 		curop := opGetOpCode(inst)
 		switch curop {
 		case OP_CLOSURE:
+			if reg := opGetArgA(inst); reg > maxreg {
+				maxreg = reg
+			}
 			pc += int(context.Proto.FunctionPrototypes[opGetArgBx(inst)].NumUpvalues)
 			moven = 0
 			continue
 		case OP_SETGLOBAL, OP_SETUPVAL, OP_EQ, OP_LT, OP_LE, OP_TEST,
-			OP_TAILCALL, OP_RETURN, OP_FORPREP, OP_FORLOOP, OP_TFORLOOP,
-			OP_SETLIST, OP_CLOSE:
+			OP_TAILCALL, OP_RETURN, OP_SETLIST, OP_CLOSE:
 			/* nothing to do */
+		case OP_FORPREP, OP_FORLOOP:
+			// the loop writes the visible control variable R(A+3)
+			if reg := opGetArgA(inst) + 3; reg > maxreg {
+				maxreg = reg
+			}
+		case OP_TFORLOOP:
+			if reg := opGetArgA(inst) + 2 + opGetArgC(inst); reg > maxreg {
+				maxreg = reg
+			}
 		case OP_CALL:
-			if reg := opGetArgA(inst) + opGetArgC(inst) - 2; reg > maxreg {
+			if reg := opGetArgA(inst) + intMax(opGetArgC(inst)-2, 0); reg > maxreg {
 				maxreg = reg
 			}
 		case OP_VARARG:
-			if reg := opGetArgA(inst) + opGetArgB(inst) - 1; reg > maxreg {
+			if reg := opGetArgA(inst) + intMax(opGetArgB(inst)-1, 0); reg > maxreg {
 				maxreg = reg
 			}
 		case OP_SELF:
@@ -1653,6 +1681,16 @@ func patchCode(context *funcContext) { // {{{
 } // }}}
 
 func Compile(chunk []ast.Stmt, name string) (proto *FunctionProto, err error) { // {{{
+	return compile(chunk, name, false)
+} // }}}
+
+// CompileIntegers compiles chunk with the integers of Lua 5.3, for states with
+// Options.Integers set.
+func CompileIntegers(chunk []ast.Stmt, name string) (proto *FunctionProto, err error) { // {{{
+	return compile(chunk, name, true)
+} // }}}
+
+func compile(chunk []ast.Stmt, name string, integers bool) (proto *FunctionProto, err error) { // {{{
 	defer func() {
 		if rcv := recover(); rcv != nil {
 			if _, ok := rcv.(*CompileError); ok {
@@ -1666,6 +1704,7 @@ func Compile(chunk []ast.Stmt, name string) (proto *FunctionProto, err error) {
 	parlist := &ast.ParList{HasVargs: true, Names: []string{}}
 	funcexpr := &ast.FunctionExpr{ParList: parlist, Stmts: chunk}
 	context := newFuncContext(name, nil)
+	context.Proto.Integers = integers
 	compileFunctionExpr(context, funcexpr, ecnone(0))
 	proto = context.Proto
 	return
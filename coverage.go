@@ -0,0 +1,318 @@
+package lua
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+  Code coverage.
+
+  States whose Options set a Coverage run mainLoopWithCoverage, which counts
+  how often every instruction runs. The count of a line is the count of its
+  most frequent instruction, so a line of several instructions that ran once
+  is reported once. Lines are read from FunctionProto.DbgSourcePositions of
+  the chunks and all functions they define, so functions that were never
+  called are reported as well.
+
+  A Coverage may be shared by any number of states, also concurrently, and
+  results of other runs are merged with Merge and ReadLCOV.
+*/
+
+// FileCoverage is the coverage of a source, the hit count of every line that
+// has code.
+type FileCoverage struct {
+	Source string
+	Lines  map[int]int64
+}
+
+// Hit returns the number of lines that ran.
+func (fc *FileCoverage) Hit() int {
+	n := 0
+	for _, count := range fc.Lines {
+		if count > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// Percent returns the share of lines that ran.
+func (fc *FileCoverage) Percent() float64 {
+	if len(fc.Lines) == 0 {
+		return 100
+	}
+	return float64(fc.Hit()) * 100 / float64(len(fc.Lines))
+}
+
+type Coverage struct {
+	mu     sync.Mutex
+	protos map[*FunctionProto][]int64
+	merged map[string]map[int]int64
+}
+
+func NewCoverage() *Coverage {
+	return &Coverage{
+		protos: make(map[*FunctionProto][]int64),
+		merged: make(map[string]map[int]int64),
+	}
+}
+
+// hits returns the counters of the instructions of proto, the functions
+// defined by proto are registered along with it.
+func (c *Coverage) hits(proto *FunctionProto) []int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if hits, ok := c.protos[proto]; ok {
+		return hits
+	}
+	var register func(p *FunctionProto)
+	register = func(p *FunctionProto) {
+		if _, ok := c.protos[p]; ok {
+			return
+		}
+		c.protos[p] = make([]int64, len(p.Code))
+		for _, child := range p.FunctionPrototypes {
+			register(child)
+		}
+	}
+	register(proto)
+	return c.protos[proto]
+}
+
+func mainLoopWithCoverage(L *LState, baseframe *callFrame) {
+	var inst uint32
+	var cf *callFrame
+	var proto *FunctionProto
+	var hits []int64
+
+	if L.stack.IsEmpty() {
+		return
+	}
+
+	L.currentFrame = L.stack.Last()
+	if L.currentFrame.Fn.IsG {
+		callGFunction(L, false)
+		return
+	}
+
+	cov := L.Options.Coverage
+	for {
+		cf = L.currentFrame
+		if cf.Fn.Proto != proto {
+			proto = cf.Fn.Proto
+			hits = cov.hits(proto)
+		}
+		atomic.AddInt64(&hits[cf.Pc], 1)
+		inst = proto.Code[cf.Pc]
+		cf.Pc++
+		if L.ctx != nil {
+			select {
+			case <-L.ctx.Done():
+				L.RaiseError("%v", L.ctx.Err())
+				return
+			default:
+			}
+		}
+		if jumpTable[int(inst>>26)](L, inst, baseframe) == 1 {
+			return
+		}
+	}
+}
+
+/* results {{{ */
+
+// Files returns the coverage of every source, sorted by name.
+func (c *Coverage) Files() []*FileCoverage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	bySource := make(map[string]*FileCoverage)
+	file := func(source string) *FileCoverage {
+		fc, ok := bySource[source]
+		if !ok {
+			fc = &FileCoverage{Source: source, Lines: make(map[int]int64)}
+			bySource[source] = fc
+		}
+		return fc
+	}
+	for proto, hits := range c.protos {
+		fc := file(proto.SourceName)
+		lines := make(map[int]int64)
+		for pc, line := range proto.DbgSourcePositions {
+			if line <= 0 || pc >= len(hits) || unreachableReturn(proto, pc) {
+				continue
+			}
+			if count := atomic.LoadInt64(&hits[pc]); count >= lines[line] {
+				lines[line] = count
+			}
+		}
+		for line, count := range lines {
+			fc.Lines[line] += count
+		}
+	}
+	for source, lines := range c.merged {
+		fc := file(source)
+		for line, count := range lines {
+			fc.Lines[line] += count
+		}
+	}
+
+	files := make([]*FileCoverage, 0, len(bySource))
+	for _, fc := range bySource {
+		files = append(files, fc)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Source < files[j].Source })
+	return files
+}
+
+// unreachableReturn tells whether pc is the return the compiler appends to
+// a function that ends with a return statement.
+func unreachableReturn(proto *FunctionProto, pc int) bool {
+	return pc > 0 && pc == len(proto.Code)-1 &&
+		opGetOpCode(proto.Code[pc]) == OP_RETURN && opGetOpCode(proto.Code[pc-1]) == OP_RETURN
+}
+
+func (c *Coverage) merge(source string, line int, count int64) {
+	lines, ok := c.merged[source]
+	if !ok {
+		lines = make(map[int]int64)
+		c.merged[source] = lines
+	}
+	lines[line] += count
+}
+
+// Merge adds the results of other to c.
+func (c *Coverage) Merge(other *Coverage) {
+	files := other.Files()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, fc := range files {
+		for line, count := range fc.Lines {
+			c.merge(fc.Source, line, count)
+		}
+	}
+}
+
+// ReadLCOV adds the line counts of an LCOV tracefile, e.g. one written by
+// WriteLCOV in an earlier run, to c.
+func (c *Coverage) ReadLCOV(r io.Reader) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	source := ""
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "SF:"):
+			source = line[3:]
+		case strings.HasPrefix(line, "DA:"):
+			fields := strings.Split(line[3:], ",")
+			if len(fields) < 2 {
+				return fmt.Errorf("lcov:%v: malformed line data", n)
+			}
+			lnum, err1 := strconv.Atoi(fields[0])
+			count, err2 := strconv.ParseInt(fields[1], 10, 64)
+			if err1 != nil || err2 != nil {
+				return fmt.Errorf("lcov:%v: malformed line data", n)
+			}
+			c.merge(source, lnum, count)
+		case line == "end_of_record":
+			source = ""
+		}
+	}
+	return scanner.Err()
+}
+
+func sortedLines(fc *FileCoverage) []int {
+	lines := make([]int, 0, len(fc.Lines))
+	for line := range fc.Lines {
+		lines = append(lines, line)
+	}
+	sort.Ints(lines)
+	return lines
+}
+
+// WriteLCOV writes the results as an LCOV tracefile.
+func (c *Coverage) WriteLCOV(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "TN:")
+	for _, fc := range c.Files() {
+		fmt.Fprintf(bw, "SF:%v\n", fc.Source)
+		for _, line := range sortedLines(fc) {
+			fmt.Fprintf(bw, "DA:%v,%v\n", line, fc.Lines[line])
+		}
+		fmt.Fprintf(bw, "LF:%v\nLH:%v\nend_of_record\n", len(fc.Lines), fc.Hit())
+	}
+	return bw.Flush()
+}
+
+// WriteText writes the share of lines that ran of every source and in total.
+func (c *Coverage) WriteText(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	found, hit := 0, 0
+	for _, fc := range c.Files() {
+		fmt.Fprintf(bw, "%v\t%v/%v\t%.1f%%\n", fc.Source, fc.Hit(), len(fc.Lines), fc.Percent())
+		found += len(fc.Lines)
+		hit += fc.Hit()
+	}
+	percent := 100.0
+	if found > 0 {
+		percent = float64(hit) * 100 / float64(found)
+	}
+	fmt.Fprintf(bw, "total\t%v/%v\t%.1f%%\n", hit, found, percent)
+	return bw.Flush()
+}
+
+// WriteHTML writes the results as a single page, with the sources returned
+// by source marked up by line. Sources that can not be read are only listed.
+func (c *Coverage) WriteHTML(w io.Writer, source func(name string) ([]byte, error)) error {
+	bw := bufio.NewWriter(w)
+	files := c.Files()
+	fmt.Fprint(bw, `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Coverage</title><style>
+body { font-family: sans-serif; }
+pre { line-height: 1.3; }
+.hit { background: #dfd; }
+.miss { background: #fdd; }
+.count { color: #888; display: inline-block; width: 6em; text-align: right; }
+</style></head><body>
+<h1>Coverage</h1>
+<table>
+`)
+	for i, fc := range files {
+		fmt.Fprintf(bw, "<tr><td><a href=\"#file%v\">%v</a></td><td>%v/%v</td><td>%.1f%%</td></tr>\n",
+			i, html.EscapeString(fc.Source), fc.Hit(), len(fc.Lines), fc.Percent())
+	}
+	fmt.Fprint(bw, "</table>\n")
+	for i, fc := range files {
+		fmt.Fprintf(bw, "<h2 id=\"file%v\">%v</h2>\n", i, html.EscapeString(fc.Source))
+		src, err := source(fc.Source)
+		if err != nil {
+			continue
+		}
+		fmt.Fprint(bw, "<pre>")
+		for n, text := range strings.Split(string(src), "\n") {
+			count, ok := fc.Lines[n+1]
+			switch {
+			case !ok:
+				fmt.Fprintf(bw, "<span><span class=\"count\"></span> %v</span>\n", html.EscapeString(text))
+			case count > 0:
+				fmt.Fprintf(bw, "<span class=\"hit\"><span class=\"count\">%v</span> %v</span>\n", count, html.EscapeString(text))
+			default:
+				fmt.Fprintf(bw, "<span class=\"miss\"><span class=\"count\">0</span> %v</span>\n", html.EscapeString(text))
+			}
+		}
+		fmt.Fprint(bw, "</pre>\n")
+	}
+	fmt.Fprint(bw, "</body></html>\n")
+	return bw.Flush()
+}
+
+/* }}} */
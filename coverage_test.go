@@ -0,0 +1,61 @@
+package lua
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const coverageTestSrc = `local function unused()
+  return 1
+end
+local n = 0
+for i = 1, 3 do
+  n = n + i
+end
+if n > 10 then
+  n = 0
+end
+`
+
+func coverageLines(fc *FileCoverage) string {
+	var lines []string
+	for _, line := range sortedLines(fc) {
+		lines = append(lines, fmt.Sprintf("%v:%v", line, fc.Lines[line]))
+	}
+	return strings.Join(lines, " ")
+}
+
+func TestCoverage(t *testing.T) {
+	cov := NewCoverage()
+	for i := 0; i < 2; i++ {
+		L := NewState(Options{Coverage: cov})
+		errorIfNotNil(t, L.DoString(coverageTestSrc))
+		L.Close()
+	}
+	files := cov.Files()
+	errorIfNotEqual(t, 1, len(files))
+	errorIfNotEqual(t, "<string>", files[0].Source)
+	errorIfNotEqual(t, "1:2 2:0 4:2 5:8 6:6 8:2 9:0", coverageLines(files[0]))
+	errorIfNotEqual(t, 5, files[0].Hit())
+
+	var lcov bytes.Buffer
+	errorIfNotNil(t, cov.WriteLCOV(&lcov))
+	errorIfFalse(t, strings.Contains(lcov.String(), "SF:<string>\nDA:1,2\nDA:2,0\n"), "unexpected lcov %v", lcov.String())
+	errorIfFalse(t, strings.Contains(lcov.String(), "LF:7\nLH:5\nend_of_record\n"), "unexpected lcov %v", lcov.String())
+
+	// merging a former run doubles the counts
+	merged := NewCoverage()
+	errorIfNotNil(t, merged.ReadLCOV(bytes.NewReader(lcov.Bytes())))
+	merged.Merge(cov)
+	errorIfNotEqual(t, "1:4 2:0 4:4 5:16 6:12 8:4 9:0", coverageLines(merged.Files()[0]))
+
+	var text bytes.Buffer
+	errorIfNotNil(t, merged.WriteText(&text))
+	errorIfNotEqual(t, "<string>\t5/7\t71.4%\ntotal\t5/7\t71.4%\n", text.String())
+
+	var page bytes.Buffer
+	errorIfNotNil(t, merged.WriteHTML(&page, func(string) ([]byte, error) { return []byte(coverageTestSrc), nil }))
+	errorIfFalse(t, strings.Contains(page.String(), `<span class="miss"><span class="count">0</span>   return 1</span>`), "unexpected html %v", page.String())
+}
@@ -0,0 +1,361 @@
+package lua
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ipfs/go-cid"
+	cbornode "github.com/ipfs/go-ipld-cbor"
+	ipld "github.com/ipfs/go-ipld-format"
+	mh "github.com/multiformats/go-multihash"
+)
+
+/*
+  IPLD nodes.
+
+  The dag module stores Lua values as DAG-CBOR nodes in the DAG service of
+  the state, where other IPLD tools can traverse them, and links them with
+  CID userdata:
+
+	local dag = require("dag")
+	local root = dag.put({name = "a", prev = dag.cid("bafy...")})
+	local v = dag.get(root)
+	dag.cp(root, "/nodes/a")
+
+  Tables are arrays and maps like in JSON, map keys must be strings. Strings
+  that are not UTF-8 are stored as bytes, null is json.null.
+*/
+
+// ADagPreload adds dag to the given Lua state's package.preload table:
+//
+//	local dag = require("dag")
+func ADagPreload(L *LState) {
+	L.PreloadModule("dag", ADagLoader)
+}
+
+// ADagLoader is the module loader function.
+func ADagLoader(L *LState) int {
+	t := L.NewTable()
+	L.SetFuncs(t, dagFuncs)
+	L.Push(t)
+	return 1
+}
+
+var dagFuncs = map[string]LGFunction{
+	"put": dagPut,
+	"get": dagGet,
+	"cp":  dagCp,
+	"cid": dagCid,
+}
+
+const lCidClass = "cid*"
+
+// NewCidValue returns c as a CID userdata.
+func (ls *LState) NewCidValue(c cid.Cid) *LUserData {
+	ud := ls.NewUserData()
+	ud.Value = c
+	mt, ok := ls.GetTypeMetatable(lCidClass).(*LTable)
+	if !ok {
+		mt = ls.NewTypeMetatable(lCidClass)
+		ls.SetFuncs(mt, map[string]LGFunction{
+			"__tostring": cidToString,
+			"__eq":       cidEq,
+			"__concat":   errorConcat,
+		})
+	}
+	ls.SetMetatable(ud, mt)
+	return ud
+}
+
+// checkCid returns the CID userdata or string at n.
+func checkCid(L *LState, n int) cid.Cid {
+	switch lv := L.Get(n).(type) {
+	case *LUserData:
+		if c, ok := lv.Value.(cid.Cid); ok {
+			return c
+		}
+	case LString:
+		c, err := cid.Decode(string(lv))
+		if err != nil {
+			L.RaiseAAppError(NewAAppError(ErrCodeInvalid, "", err))
+		}
+		return c
+	}
+	L.TypeError(n, LTUserData)
+	return cid.Undef
+}
+
+func cidToString(L *LState) int {
+	L.Push(LString(checkCid(L, 1).String()))
+	return 1
+}
+
+func cidEq(L *LState) int {
+	L.Push(LBool(checkCid(L, 1).Equals(checkCid(L, 2))))
+	return 1
+}
+
+// dagService returns the DAG service of the state or raises an error.
+func (ls *LState) dagService() (ipld.DAGService, context.Context) {
+	if ls.dserv == nil {
+		ls.RaiseAAppError(NewAAppError(ErrCodeClosed, "no DAG service", nil))
+	}
+	ctx := ls.Context()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return ls.dserv, ctx
+}
+
+// dag.cid(s) parses a CID.
+func dagCid(L *LState) int {
+	L.CheckString(1)
+	L.Push(L.NewCidValue(checkCid(L, 1)))
+	return 1
+}
+
+// dag.put(v) stores v as a DAG-CBOR node and returns its CID.
+func dagPut(L *LState) int {
+	obj, err := toIPLD(L.CheckAny(1), make(map[*LTable]bool))
+	if err != nil {
+		L.RaiseAAppError(NewAAppError(ErrCodeInvalid, "", err))
+	}
+	nd, err := cbornode.WrapObject(obj, mh.SHA2_256, -1)
+	if err != nil {
+		L.RaiseAAppError(NewAAppError(ErrCodeInvalid, "", err))
+	}
+	dserv, ctx := L.dagService()
+	if err := dserv.Add(ctx, nd); err != nil {
+		L.RaiseAAppError(err)
+	}
+	L.Push(L.NewCidValue(nd.Cid()))
+	return 1
+}
+
+// dag.get(cid) returns the value of a DAG-CBOR node.
+func dagGet(L *LState) int {
+	c := checkCid(L, 1)
+	if c.Type() != cid.DagCBOR {
+		L.RaiseAAppError(NewAAppError(ErrCodeInvalid, fmt.Sprintf("%v is not a DAG-CBOR node", c), nil))
+	}
+	dserv, ctx := L.dagService()
+	nd, err := dserv.Get(ctx, c)
+	if err != nil {
+		if err == ipld.ErrNotFound {
+			err = NewAAppError(ErrCodeNotFound, c.String(), err)
+		}
+		L.RaiseAAppError(err)
+	}
+	var obj interface{}
+	if err := cbornode.DecodeInto(nd.RawData(), &obj); err != nil {
+		L.RaiseAAppError(NewAAppError(ErrCodeInvalid, "", err))
+	}
+	lv, err := L.fromIPLD(obj)
+	if err != nil {
+		L.RaiseAAppError(NewAAppError(ErrCodeInvalid, "", err))
+	}
+	L.Push(lv)
+	return 1
+}
+
+// dag.cp(cid, path) links the node into /Data at path.
+func dagCp(L *LState) int {
+	c := checkCid(L, 1)
+	path := L.CheckString(2)
+	if !strings.HasPrefix(path, "/") {
+		path = "/Data/" + path
+	} else {
+		path = "/Data" + path
+	}
+	dserv, ctx := L.dagService()
+	nd, err := dserv.Get(ctx, c)
+	if err != nil {
+		L.RaiseAAppError(err)
+	}
+	if err := L.MFS_Cp(path, nd); err != nil {
+		L.RaiseAAppError(err)
+	}
+	return 0
+}
+
+// toIPLD converts a Lua value to the data model of go-ipld-cbor.
+func toIPLD(lv LValue, visited map[*LTable]bool) (interface{}, error) {
+	switch converted := lv.(type) {
+	case *LNilType:
+		return nil, nil
+	case LBool:
+		return bool(converted), nil
+	case LInteger:
+		return int64(converted), nil
+	case LNumber:
+		f := float64(converted)
+		if f == math.Trunc(f) && math.Abs(f) < 1<<63 && !(f == 0 && math.Signbit(f)) {
+			return int64(f), nil
+		}
+		return f, nil
+	case LString:
+		if utf8.ValidString(string(converted)) {
+			return string(converted), nil
+		}
+		return []byte(converted), nil
+	case *LUserData:
+		switch v := converted.Value.(type) {
+		case cid.Cid:
+			return v, nil
+		case jsonNullValue:
+			return nil, nil
+		case *big.Int:
+			if v.IsInt64() {
+				return v.Int64(), nil
+			}
+			if v.IsUint64() {
+				return v.Uint64(), nil
+			}
+		}
+	case *LTable:
+		if visited[converted] {
+			return nil, errNested
+		}
+		visited[converted] = true
+		defer delete(visited, converted)
+		return tableToIPLD(converted, visited)
+	}
+	return nil, fmt.Errorf("cannot encode %v to DAG-CBOR", lv.Type())
+}
+
+// ipldIndex returns the array index of a table key, a positive integral
+// number that an int holds.
+func ipldIndex(key LValue) (int, bool) {
+	k, ok := key.(LNumber)
+	if !ok || k < 1 || k > math.MaxInt32 || k != LNumber(math.Trunc(float64(k))) {
+		return 0, false
+	}
+	return int(k), true
+}
+
+func tableToIPLD(tb *LTable, visited map[*LTable]bool) (interface{}, error) {
+	n, max, total := 0, 0, 0
+	tb.ForEach(func(key, _ LValue) {
+		total++
+		if i, ok := ipldIndex(key); ok {
+			n++
+			if i > max {
+				max = i
+			}
+		}
+	})
+
+	kind := jsonTableKind(tb)
+	if kind == jsonArray && n != total {
+		return nil, errInvalidKeys
+	}
+	if kind == jsonArray || kind == "" && n == total && max == n {
+		arr := make([]interface{}, max)
+		for i := range arr {
+			v, err := toIPLD(tb.RawGetInt(i+1), visited)
+			if err != nil {
+				return nil, err
+			}
+			arr[i] = v
+		}
+		return arr, nil
+	}
+
+	obj := make(map[string]interface{}, total)
+	var err error
+	tb.ForEach(func(key, value LValue) {
+		if err != nil {
+			return
+		}
+		name, ok := key.(LString)
+		if !ok {
+			err = errInvalidKeys
+			return
+		}
+		obj[string(name)], err = toIPLD(value, visited)
+	})
+	return obj, err
+}
+
+// fromIPLD converts a value decoded by go-ipld-cbor, arrays and maps are
+// tagged json.array and json.object. Map keys must be strings.
+func (ls *LState) fromIPLD(v interface{}) (LValue, error) {
+	switch converted := v.(type) {
+	case nil:
+		return ls.jsonNull(), nil
+	case bool:
+		return LBool(converted), nil
+	case int:
+		return ls.ipldInteger(int64(converted)), nil
+	case int64:
+		return ls.ipldInteger(converted), nil
+	case uint64:
+		if converted > math.MaxInt64 {
+			return ls.NewBigInt(new(big.Int).SetUint64(converted)), nil
+		}
+		return ls.ipldInteger(int64(converted)), nil
+	case float64:
+		return LNumber(converted), nil
+	case string:
+		return LString(converted), nil
+	case []byte:
+		return LString(converted), nil
+	case cid.Cid:
+		return ls.NewCidValue(converted), nil
+	case []interface{}:
+		arr := ls.CreateTable(len(converted), 0)
+		for i, item := range converted {
+			lv, err := ls.fromIPLD(item)
+			if err != nil {
+				return nil, err
+			}
+			arr.RawSetInt(i+1, lv)
+		}
+		ls.SetMetatable(arr, ls.jsonMarker(jsonArray))
+		return arr, nil
+	case map[string]interface{}:
+		tbl := ls.CreateTable(0, len(converted))
+		for key, item := range converted {
+			lv, err := ls.fromIPLD(item)
+			if err != nil {
+				return nil, err
+			}
+			tbl.RawSetString(key, lv)
+		}
+		ls.SetMetatable(tbl, ls.jsonMarker(jsonObject))
+		return tbl, nil
+	case map[interface{}]interface{}:
+		// 1 and "1" would be the same key
+		tbl := ls.CreateTable(0, len(converted))
+		for key, item := range converted {
+			name, ok := key.(string)
+			if !ok {
+				return nil, errInvalidKeys
+			}
+			lv, err := ls.fromIPLD(item)
+			if err != nil {
+				return nil, err
+			}
+			tbl.RawSetString(name, lv)
+		}
+		ls.SetMetatable(tbl, ls.jsonMarker(jsonObject))
+		return tbl, nil
+	}
+	return LNil, nil
+}
+
+// ipldInteger converts an integer of a node to an integer if they are
+// enabled, or else to a number or a bigint if a number can not hold it.
+func (ls *LState) ipldInteger(i int64) LValue {
+	switch {
+	case ls.Options.Integers:
+		return LInteger(i)
+	case i > 1<<53 || i < -1<<53:
+		return ls.NewBigInt(big.NewInt(i))
+	}
+	return LNumber(i)
+}
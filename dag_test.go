@@ -0,0 +1,83 @@
+package lua
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestDagPutGet(t *testing.T) {
+	L, err := NewMFSState(context.Background(), nil, nil)
+	errorIfNotNil(t, err)
+	defer L.Close()
+	errorIfNotNil(t, L.MFS_Mkdir("/Data", true))
+	AJsonPreload(L)
+	ADagPreload(L)
+	errorIfScriptFail(t, L, `
+	local dag, json = require("dag"), require("json")
+	local leaf = dag.put({name = "leaf", size = 3, ratio = 0.5, raw = "\255\0", empty = {}})
+	assert(tostring(leaf):find("^bafy"), tostring(leaf))
+	assert(dag.put({name = "leaf", size = 3, ratio = 0.5, raw = "\255\0", empty = {}}) == leaf)
+
+	local root = dag.put({items = {leaf, leaf}, none = json.null, ok = true})
+	local v = dag.get(root)
+	assert(v.ok == true and v.none == json.null and #v.items == 2)
+	assert(v.items[1] == leaf and v.items[2] == dag.cid(tostring(leaf)))
+	local l = dag.get(v.items[1])
+	assert(l.name == "leaf" and l.size == 3 and l.ratio == 0.5 and l.raw == "\255\0")
+	assert(json.encode(l.empty) == "[]")
+	assert(dag.get(tostring(leaf)).name == "leaf")
+
+	local ok, e = pcall(dag.put, {[1] = 1, [3] = 3})
+	assert(not ok and error.is(e, error.INVALID), tostring(e))
+	assert(not pcall(dag.get, "nonsense"))
+	dag.cp(root, "/root")
+	`)
+
+	dir, err := L.MFS_LookupDir("/Data")
+	errorIfNotNil(t, err)
+	names, err := dir.ListNames(context.Background())
+	errorIfNotNil(t, err)
+	errorIfNotEqual(t, "[root]", fmt.Sprint(names))
+}
+
+func TestDagIntegers(t *testing.T) {
+	for _, integers := range []bool{false, true} {
+		L, err := NewMFSState(context.Background(), nil, nil, Options{Integers: integers})
+		errorIfNotNil(t, err)
+		errorIfNotNil(t, L.MFS_Mkdir("/Data", true))
+		ADagPreload(L)
+		ABigIntPreload(L)
+		L.SetGlobal("integers", LBool(integers))
+		errorIfScriptFail(t, L, `
+		local dag, bigint = require("dag"), require("bigint")
+		local big = bigint.new("18446744073709551615")
+		local v = dag.get(dag.put({small = 3, big = big, wide = bigint.new("9007199254740993")}))
+		assert(v.small == 3 and v.big == big)
+		if integers then
+			assert(math.type(v.small) == "integer" and v.wide == 9007199254740993)
+		else
+			assert(bigint.is(v.wide) and tostring(v.wide) == "9007199254740993")
+		end
+		`)
+		L.Close()
+	}
+}
+
+func TestDagKeys(t *testing.T) {
+	for _, key := range []LValue{LNumber(math.Copysign(0, -1)), LNumber(0.5), LNumber(1 << 63), LNumber(math.Inf(1)), LString("1")} {
+		_, ok := ipldIndex(key)
+		errorIfFalse(t, !ok, "%v is an array index", key)
+	}
+	i, ok := ipldIndex(LNumber(3))
+	errorIfFalse(t, ok && i == 3, "3 is not an array index")
+
+	L := NewState()
+	defer L.Close()
+	_, err := L.fromIPLD(map[interface{}]interface{}{uint64(1): "a", "1": "b"})
+	errorIfFalse(t, err == errInvalidKeys, "non-string map key decoded: %v", err)
+	v, err := L.fromIPLD(map[interface{}]interface{}{"a": []interface{}{int64(1)}})
+	errorIfNotNil(t, err)
+	errorIfNotEqual(t, LNumber(1), v.(*LTable).RawGetString("a").(*LTable).RawGetInt(1))
+}
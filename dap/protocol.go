@@ -0,0 +1,202 @@
+package dap
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/* wire format {{{ */
+
+// Messages are JSON objects preceded by a Content-Length header, see
+// https://microsoft.github.io/debug-adapter-protocol/overview
+
+type request struct {
+	Seq       int             `json:"seq"`
+	Type      string          `json:"type"`
+	Command   string          `json:"command"`
+	Arguments json.RawMessage `json:"arguments,omitempty"`
+}
+
+type response struct {
+	Seq        int         `json:"seq"`
+	Type       string      `json:"type"`
+	RequestSeq int         `json:"request_seq"`
+	Success    bool        `json:"success"`
+	Command    string      `json:"command"`
+	Message    string      `json:"message,omitempty"`
+	Body       interface{} `json:"body,omitempty"`
+}
+
+type event struct {
+	Seq   int         `json:"seq"`
+	Type  string      `json:"type"`
+	Event string      `json:"event"`
+	Body  interface{} `json:"body,omitempty"`
+}
+
+type conn struct {
+	rd *textproto.Reader
+	w  io.Writer
+
+	mu  sync.Mutex
+	seq int
+}
+
+func newConn(rw io.ReadWriter) *conn {
+	return &conn{rd: textproto.NewReader(bufio.NewReader(rw)), w: rw}
+}
+
+func (c *conn) read() (*request, error) {
+	length := -1
+	for {
+		line, err := c.rd.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		if line == "" {
+			break
+		}
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			return nil, fmt.Errorf("malformed header %q", line)
+		}
+		if strings.EqualFold(strings.TrimSpace(line[:i]), "Content-Length") {
+			if length, err = strconv.Atoi(strings.TrimSpace(line[i+1:])); err != nil {
+				return nil, fmt.Errorf("malformed header %q", line)
+			}
+		}
+	}
+	if length < 0 {
+		return nil, fmt.Errorf("missing Content-Length header")
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(c.rd.R, buf); err != nil {
+		return nil, err
+	}
+	req := &request{}
+	if err := json.Unmarshal(buf, req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func (c *conn) write(msg interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	switch m := msg.(type) {
+	case *response:
+		m.Seq, m.Type = c.seq, "response"
+	case *event:
+		m.Seq, m.Type = c.seq, "event"
+	}
+	buf, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(c.w, "Content-Length: %d\r\n\r\n", len(buf)); err != nil {
+		return err
+	}
+	_, err = c.w.Write(buf)
+	return err
+}
+
+func (c *conn) respond(req *request, body interface{}) error {
+	return c.write(&response{RequestSeq: req.Seq, Success: true, Command: req.Command, Body: body})
+}
+
+func (c *conn) fail(req *request, err error) error {
+	return c.write(&response{RequestSeq: req.Seq, Command: req.Command, Message: err.Error()})
+}
+
+func (c *conn) event(name string, body interface{}) error {
+	return c.write(&event{Event: name, Body: body})
+}
+
+/* }}} */
+
+/* bodies {{{ */
+
+type source struct {
+	Name            string `json:"name,omitempty"`
+	Path            string `json:"path,omitempty"`
+	SourceReference int    `json:"sourceReference,omitempty"`
+}
+
+type stackFrame struct {
+	Id     int     `json:"id"`
+	Name   string  `json:"name"`
+	Source *source `json:"source,omitempty"`
+	Line   int     `json:"line"`
+	Column int     `json:"column"`
+}
+
+type scope struct {
+	Name               string `json:"name"`
+	VariablesReference int    `json:"variablesReference"`
+	Expensive          bool   `json:"expensive"`
+}
+
+type variable struct {
+	Name               string `json:"name"`
+	Value              string `json:"value"`
+	Type               string `json:"type,omitempty"`
+	VariablesReference int    `json:"variablesReference"`
+}
+
+type breakpoint struct {
+	Verified bool `json:"verified"`
+	Line     int  `json:"line,omitempty"`
+}
+
+type launchArguments struct {
+	// Program is the script to run, /Script/aapp.lua by default.
+	Program     string `json:"program"`
+	StopOnEntry bool   `json:"stopOnEntry"`
+}
+
+type setBreakpointsArguments struct {
+	Source      source `json:"source"`
+	Breakpoints []struct {
+		Line int `json:"line"`
+	} `json:"breakpoints"`
+	// deprecated, but still sent by some clients
+	Lines []int `json:"lines"`
+}
+
+type setFunctionBreakpointsArguments struct {
+	Breakpoints []struct {
+		Name string `json:"name"`
+	} `json:"breakpoints"`
+}
+
+type frameArguments struct {
+	FrameId int `json:"frameId"`
+}
+
+type stackTraceArguments struct {
+	StartFrame int `json:"startFrame"`
+	Levels     int `json:"levels"`
+}
+
+type variablesArguments struct {
+	VariablesReference int `json:"variablesReference"`
+}
+
+type evaluateArguments struct {
+	Expression string `json:"expression"`
+	FrameId    int    `json:"frameId"`
+}
+
+type sourceArguments struct {
+	Source          *source `json:"source"`
+	SourceReference int     `json:"sourceReference"`
+}
+
+/* }}} */
@@ -0,0 +1,576 @@
+// Debug Adapter Protocol server for AApp scripts.
+package dap
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ayachain/go-aya-alvm"
+)
+
+// DefaultProgram is run by a launch request without a program.
+const DefaultProgram = lua.ALVM_PATH_Maincript
+
+const threadId = 1
+
+var errNotStopped = errors.New("the script is not stopped")
+
+// forwarded hands a request to the goroutine of a stopped script.
+type forwarded struct {
+	req  *request
+	done chan struct{}
+}
+
+// varRef is what a variablesReference points to, refs are only valid until
+// the script resumes.
+type varRef struct {
+	level int
+	scope string
+	table *lua.LTable
+}
+
+// Server debugs the scripts of one state for one client. Scripts and the
+// sources shown to the client are read from the MFS /Script tree of the
+// state.
+type Server struct {
+	L *lua.LState
+
+	d    *lua.Debugger
+	conn *conn
+
+	mu      sync.Mutex
+	stopped chan forwarded
+	sources map[string]int
+	paths   []string
+
+	program    *lua.LFunction
+	entry      bool
+	configured bool
+	started    bool
+	quit       bool
+	cancel     context.CancelFunc
+	done       chan struct{}
+
+	// only used by the goroutine of the stopped script
+	refs []varRef
+}
+
+// NewServer returns a Server for L. The state must not run other code while
+// it is served.
+func NewServer(L *lua.LState) *Server {
+	s := &Server{
+		L:       L,
+		sources: make(map[string]int),
+		done:    make(chan struct{}),
+	}
+	s.d = lua.NewDebugger(s.handle)
+	return s
+}
+
+// Serve runs a debug session on rw until the client disconnects or closes
+// the connection. A running script is stopped when Serve returns.
+func (s *Server) Serve(rw io.ReadWriter) error {
+	s.conn = newConn(rw)
+	for {
+		req, err := s.conn.read()
+		if err != nil {
+			s.terminate()
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		ch := s.stopped
+		s.mu.Unlock()
+		if ch != nil {
+			f := forwarded{req, make(chan struct{})}
+			ch <- f
+			<-f.done
+		} else {
+			s.dispatch(req, false)
+		}
+
+		if req.Command == "disconnect" || req.Command == "terminate" {
+			s.terminate()
+			return nil
+		}
+	}
+}
+
+// ListenAndServe accepts debug sessions on the TCP address addr, each on a
+// state returned by newState.
+func ListenAndServe(addr string, newState func() (*lua.LState, error)) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer c.Close()
+			L, err := newState()
+			if err != nil {
+				return
+			}
+			defer L.Close()
+			NewServer(L).Serve(c)
+		}()
+	}
+}
+
+/* requests {{{ */
+
+// dispatch handles a request, on the goroutine of the script when it is
+// stopped. It returns true with the action to take when the script resumes.
+func (s *Server) dispatch(req *request, stopped bool) (lua.DebugAction, bool) {
+	var body interface{}
+	var err error
+	action, resume := lua.DebugContinue, false
+
+	switch req.Command {
+	case "initialize":
+		body = map[string]interface{}{
+			"supportsConfigurationDoneRequest": true,
+			"supportsFunctionBreakpoints":      true,
+			"supportsEvaluateForHovers":        true,
+			"supportsTerminateRequest":         true,
+		}
+		defer s.conn.event("initialized", nil)
+	case "launch":
+		if err = s.launch(req); err == nil {
+			defer s.start()
+		}
+	case "configurationDone":
+		s.mu.Lock()
+		s.configured = true
+		s.mu.Unlock()
+		defer s.start()
+	case "setBreakpoints":
+		body, err = s.setBreakpoints(req)
+	case "setFunctionBreakpoints":
+		body, err = s.setFunctionBreakpoints(req)
+	case "setExceptionBreakpoints":
+		body = map[string]interface{}{}
+	case "threads":
+		body = map[string]interface{}{
+			"threads": []map[string]interface{}{{"id": threadId, "name": "main"}},
+		}
+	case "pause":
+		s.d.Pause()
+	case "source":
+		body, err = s.source(req)
+	case "disconnect", "terminate":
+		s.stop()
+		resume = stopped
+	case "stackTrace", "scopes", "variables", "evaluate", "continue", "next", "stepIn", "stepOut":
+		if !stopped {
+			err = errNotStopped
+			break
+		}
+		switch req.Command {
+		case "stackTrace":
+			body, err = s.stackTrace(req)
+		case "scopes":
+			body, err = s.scopes(req)
+		case "variables":
+			body, err = s.variables(req)
+		case "evaluate":
+			body, err = s.evaluate(req)
+		case "continue":
+			body = map[string]interface{}{"allThreadsContinued": true}
+			action, resume = lua.DebugContinue, true
+		case "next":
+			action, resume = lua.DebugStepOver, true
+		case "stepIn":
+			action, resume = lua.DebugStepIn, true
+		case "stepOut":
+			action, resume = lua.DebugStepOut, true
+		}
+	default:
+		err = fmt.Errorf("unsupported request '%v'", req.Command)
+	}
+
+	if err != nil {
+		s.conn.fail(req, err)
+	} else {
+		s.conn.respond(req, body)
+	}
+	return action, resume
+}
+
+func (s *Server) launch(req *request) error {
+	args := launchArguments{Program: DefaultProgram}
+	if len(req.Arguments) > 0 {
+		if err := json.Unmarshal(req.Arguments, &args); err != nil {
+			return err
+		}
+	}
+	fn, err := s.L.LoadScript(args.Program)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.program = fn
+	s.entry = args.StopOnEntry
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *Server) setBreakpoints(req *request) (interface{}, error) {
+	var args setBreakpointsArguments
+	if err := json.Unmarshal(req.Arguments, &args); err != nil {
+		return nil, err
+	}
+	lines := args.Lines
+	if args.Breakpoints != nil {
+		lines = lines[:0]
+		for _, bp := range args.Breakpoints {
+			lines = append(lines, bp.Line)
+		}
+	}
+	s.d.SetBreakpoints(s.scriptPath(&args.Source), lines)
+	bps := make([]breakpoint, 0, len(lines))
+	for _, line := range lines {
+		bps = append(bps, breakpoint{Verified: true, Line: line})
+	}
+	return map[string]interface{}{"breakpoints": bps}, nil
+}
+
+func (s *Server) setFunctionBreakpoints(req *request) (interface{}, error) {
+	var args setFunctionBreakpointsArguments
+	if err := json.Unmarshal(req.Arguments, &args); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(args.Breakpoints))
+	bps := make([]breakpoint, 0, len(args.Breakpoints))
+	for _, bp := range args.Breakpoints {
+		names = append(names, bp.Name)
+		bps = append(bps, breakpoint{Verified: true})
+	}
+	s.d.SetFunctionBreakpoints(names)
+	return map[string]interface{}{"breakpoints": bps}, nil
+}
+
+func (s *Server) source(req *request) (interface{}, error) {
+	var args sourceArguments
+	if err := json.Unmarshal(req.Arguments, &args); err != nil {
+		return nil, err
+	}
+	if args.Source == nil {
+		args.Source = &source{SourceReference: args.SourceReference}
+	}
+	file, err := s.L.MFS_LookupFile(s.scriptPath(args.Source))
+	if err != nil {
+		return nil, err
+	}
+	content, err := s.L.MFS_ReadAll(file, 0)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"content": string(content), "mimeType": "text/x-lua"}, nil
+}
+
+func (s *Server) stackTrace(req *request) (interface{}, error) {
+	var args stackTraceArguments
+	if err := json.Unmarshal(req.Arguments, &args); err != nil {
+		return nil, err
+	}
+	all := s.d.Stack()
+	frames := make([]stackFrame, 0, len(all))
+	for i, f := range all {
+		if i < args.StartFrame || args.Levels > 0 && len(frames) == args.Levels {
+			continue
+		}
+		sf := stackFrame{Id: f.Level + 1, Name: f.Name, Column: 1}
+		if f.Line >= 0 {
+			sf.Line = f.Line
+			sf.Source = s.frameSource(f.Source)
+		}
+		frames = append(frames, sf)
+	}
+	return map[string]interface{}{"stackFrames": frames, "totalFrames": len(all)}, nil
+}
+
+func (s *Server) scopes(req *request) (interface{}, error) {
+	var args frameArguments
+	if err := json.Unmarshal(req.Arguments, &args); err != nil {
+		return nil, err
+	}
+	level := args.FrameId - 1
+	frames := s.d.Stack()
+	if level < 0 || level >= len(frames) {
+		return nil, fmt.Errorf("invalid frame %v", args.FrameId)
+	}
+	scopes := []scope{
+		{Name: "Locals", VariablesReference: s.ref(varRef{level: level, scope: "locals"})},
+		{Name: "Upvalues", VariablesReference: s.ref(varRef{level: level, scope: "upvalues"})},
+		{Name: "Globals", VariablesReference: s.ref(varRef{table: frames[level].Fn.Env}), Expensive: true},
+	}
+	return map[string]interface{}{"scopes": scopes}, nil
+}
+
+func (s *Server) variables(req *request) (interface{}, error) {
+	var args variablesArguments
+	if err := json.Unmarshal(req.Arguments, &args); err != nil {
+		return nil, err
+	}
+	if args.VariablesReference < 1 || args.VariablesReference > len(s.refs) {
+		return nil, fmt.Errorf("invalid variablesReference %v", args.VariablesReference)
+	}
+	r := s.refs[args.VariablesReference-1]
+	vars := []variable{}
+	switch {
+	case r.table != nil:
+		vars = s.tableVariables(r.table)
+	case r.scope == "locals":
+		for _, v := range s.d.Locals(r.level) {
+			vars = append(vars, s.variable(v.Name, v.Value))
+		}
+	case r.scope == "upvalues":
+		for _, v := range s.d.Upvalues(r.level) {
+			vars = append(vars, s.variable(v.Name, v.Value))
+		}
+	}
+	return map[string]interface{}{"variables": vars}, nil
+}
+
+func (s *Server) evaluate(req *request) (interface{}, error) {
+	var args evaluateArguments
+	if err := json.Unmarshal(req.Arguments, &args); err != nil {
+		return nil, err
+	}
+	level := 0
+	if args.FrameId > 0 {
+		level = args.FrameId - 1
+	}
+	values, err := s.d.Eval(level, args.Expression)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]string, 0, len(values))
+	for _, lv := range values {
+		results = append(results, formatValue(lv))
+	}
+	ref := 0
+	if len(values) == 1 {
+		ref = s.variable("", values[0]).VariablesReference
+	}
+	return map[string]interface{}{"result": strings.Join(results, ", "), "variablesReference": ref}, nil
+}
+
+/* }}} */
+
+/* script {{{ */
+
+// start runs the launched program once the client is configured.
+func (s *Server) start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.program == nil || !s.configured || s.started {
+		return
+	}
+	s.started = true
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	if s.entry {
+		s.d.Pause()
+	}
+	go s.run(ctx, s.program)
+}
+
+func (s *Server) run(ctx context.Context, fn *lua.LFunction) {
+	defer close(s.done)
+	L := s.L
+	L.SetContext(ctx)
+	err := L.SetDebugger(s.d)
+	if err == nil {
+		L.Push(fn)
+		err = L.PCall(0, lua.MultRet, nil)
+		L.SetDebugger(nil)
+	}
+	L.RemoveContext()
+
+	exitCode := 0
+	s.mu.Lock()
+	quit := s.quit
+	s.mu.Unlock()
+	if err != nil && !quit {
+		exitCode = 1
+		s.conn.event("output", map[string]interface{}{"category": "stderr", "output": err.Error() + "\n"})
+	}
+	s.conn.event("exited", map[string]interface{}{"exitCode": exitCode})
+	s.conn.event("terminated", nil)
+}
+
+// stop makes a running script fail at its next instruction.
+func (s *Server) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.quit = true
+	if s.cancel != nil {
+		s.cancel()
+	}
+}
+
+// terminate stops a running script and waits for it.
+func (s *Server) terminate() {
+	s.stop()
+	s.mu.Lock()
+	started, ch := s.started, s.stopped
+	s.mu.Unlock()
+	if ch != nil {
+		f := forwarded{&request{Command: "disconnect"}, make(chan struct{})}
+		ch <- f
+		<-f.done
+	}
+	if started {
+		<-s.done
+	}
+}
+
+// handle serves the requests of the client while the script is stopped.
+func (s *Server) handle(d *lua.Debugger, reason lua.DebugReason) lua.DebugAction {
+	s.mu.Lock()
+	if s.quit {
+		s.mu.Unlock()
+		return lua.DebugContinue
+	}
+	ch := make(chan forwarded)
+	s.stopped = ch
+	s.mu.Unlock()
+
+	s.refs = s.refs[:0]
+	name := reason.String()
+	if s.entry {
+		name, s.entry = "entry", false
+	}
+	s.conn.event("stopped", map[string]interface{}{
+		"reason":            name,
+		"threadId":          threadId,
+		"allThreadsStopped": true,
+	})
+
+	for f := range ch {
+		action, resume := s.dispatch(f.req, true)
+		if resume {
+			s.mu.Lock()
+			s.stopped = nil
+			s.mu.Unlock()
+			close(f.done)
+			return action
+		}
+		close(f.done)
+	}
+	return lua.DebugContinue
+}
+
+/* }}} */
+
+/* values {{{ */
+
+func (s *Server) ref(r varRef) int {
+	s.refs = append(s.refs, r)
+	return len(s.refs)
+}
+
+func (s *Server) variable(name string, lv lua.LValue) variable {
+	v := variable{Name: name, Value: formatValue(lv), Type: lv.Type().String()}
+	if tb, ok := lv.(*lua.LTable); ok {
+		v.VariablesReference = s.ref(varRef{table: tb})
+	}
+	return v
+}
+
+// tableVariables lists the fields of tb, array items first and the others
+// sorted by name.
+func (s *Server) tableVariables(tb *lua.LTable) []variable {
+	type field struct {
+		key   lua.LValue
+		value lua.LValue
+	}
+	var fields []field
+	tb.ForEach(func(key, value lua.LValue) {
+		fields = append(fields, field{key, value})
+	})
+	sort.SliceStable(fields, func(i, j int) bool {
+		ni, iok := fields[i].key.(lua.LNumber)
+		nj, jok := fields[j].key.(lua.LNumber)
+		switch {
+		case iok && jok:
+			return ni < nj
+		case iok != jok:
+			return iok
+		}
+		return fields[i].key.String() < fields[j].key.String()
+	})
+	vars := make([]variable, 0, len(fields))
+	for _, f := range fields {
+		name := f.key.String()
+		if _, ok := f.key.(lua.LString); !ok {
+			name = "[" + formatValue(f.key) + "]"
+		}
+		vars = append(vars, s.variable(name, f.value))
+	}
+	return vars
+}
+
+func formatValue(lv lua.LValue) string {
+	if str, ok := lv.(lua.LString); ok {
+		return fmt.Sprintf("%q", string(str))
+	}
+	return lv.String()
+}
+
+/* }}} */
+
+/* sources {{{ */
+
+// scriptPath maps a source of the client to a path of the MFS. Local copies
+// of an AApp are matched by the part of the path from their Script directory.
+func (s *Server) scriptPath(src *source) string {
+	if src.SourceReference > 0 {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if src.SourceReference <= len(s.paths) {
+			return s.paths[src.SourceReference-1]
+		}
+	}
+	p := strings.Replace(src.Path, "\\", "/", -1)
+	if i := strings.LastIndex(p, lua.ALVM_PATH_Script+"/"); i >= 0 {
+		return p[i:]
+	}
+	return path.Join(lua.ALVM_PATH_Script, p)
+}
+
+// frameSource returns the source of a chunk name, with a reference the client
+// can use to fetch the source from the MFS.
+func (s *Server) frameSource(name string) *source {
+	if !strings.HasPrefix(name, lua.ALVM_PATH_Script+"/") {
+		return &source{Name: name}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ref, ok := s.sources[name]
+	if !ok {
+		s.paths = append(s.paths, name)
+		ref = len(s.paths)
+		s.sources[name] = ref
+	}
+	return &source{Name: path.Base(name), Path: name, SourceReference: ref}
+}
+
+/* }}} */
@@ -0,0 +1,224 @@
+package dap
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ayachain/go-aya-alvm"
+)
+
+const serverTestScript = `local cfg = {name = "app", 10}
+local function add(a, b)
+  local s = a + b
+  return s + cfg[1]
+end
+result = add(1, 2)
+`
+
+type message struct {
+	Type       string          `json:"type"`
+	RequestSeq int             `json:"request_seq"`
+	Success    bool            `json:"success"`
+	Message    string          `json:"message"`
+	Event      string          `json:"event"`
+	Body       json.RawMessage `json:"body"`
+}
+
+// testClient is a scripted DAP client.
+type testClient struct {
+	t    *testing.T
+	c    net.Conn
+	seq  int
+	msgs chan *message
+}
+
+func newTestClient(t *testing.T, c net.Conn) *testClient {
+	tc := &testClient{t: t, c: c, msgs: make(chan *message, 64)}
+	go func() {
+		defer close(tc.msgs)
+		rd := textproto.NewReader(bufio.NewReader(c))
+		for {
+			header, err := rd.ReadMIMEHeader()
+			if err != nil {
+				return
+			}
+			length, _ := strconv.Atoi(header.Get("Content-Length"))
+			buf := make([]byte, length)
+			if _, err := io.ReadFull(rd.R, buf); err != nil {
+				return
+			}
+			msg := &message{}
+			if err := json.Unmarshal(buf, msg); err != nil {
+				t.Error(err)
+				return
+			}
+			tc.msgs <- msg
+		}
+	}()
+	return tc
+}
+
+func (tc *testClient) next() *message {
+	select {
+	case msg := <-tc.msgs:
+		if msg == nil {
+			tc.t.Fatal("connection closed")
+		}
+		return msg
+	case <-time.After(5 * time.Second):
+		tc.t.Fatal("timeout")
+	}
+	return nil
+}
+
+// request sends a request and decodes the body of its response into body.
+func (tc *testClient) request(command string, args interface{}, body interface{}) {
+	tc.t.Helper()
+	tc.seq++
+	buf, _ := json.Marshal(map[string]interface{}{"seq": tc.seq, "type": "request", "command": command, "arguments": args})
+	fmt.Fprintf(tc.c, "Content-Length: %d\r\n\r\n%s", len(buf), buf)
+	for {
+		msg := tc.next()
+		if msg.Type != "response" {
+			tc.t.Fatalf("%v: unexpected %v event", command, msg.Event)
+		}
+		if msg.RequestSeq != tc.seq {
+			continue
+		}
+		if !msg.Success {
+			tc.t.Fatalf("%v: %v", command, msg.Message)
+		}
+		if body != nil {
+			if err := json.Unmarshal(msg.Body, body); err != nil {
+				tc.t.Fatal(err)
+			}
+		}
+		return
+	}
+}
+
+func (tc *testClient) event(name string, body interface{}) {
+	tc.t.Helper()
+	msg := tc.next()
+	if msg.Type != "event" || msg.Event != name {
+		tc.t.Fatalf("%v event expected, got %v %v", name, msg.Type, msg.Event)
+	}
+	if body != nil {
+		if err := json.Unmarshal(msg.Body, body); err != nil {
+			tc.t.Fatal(err)
+		}
+	}
+}
+
+func newTestState(t *testing.T) *lua.LState {
+	dir, err := ioutil.TempDir("", "dap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "Script"), 0755)
+	if err := ioutil.WriteFile(filepath.Join(dir, "Script", "aapp.lua"), []byte(serverTestScript), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	L, err := lua.NewMFSState(context.Background(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := L.MFS_ImportDir(dir, "/"); err != nil {
+		t.Fatal(err)
+	}
+	return L
+}
+
+func TestServer(t *testing.T) {
+	L := newTestState(t)
+	defer L.Close()
+	c1, c2 := net.Pipe()
+	served := make(chan error)
+	go func() { served <- NewServer(L).Serve(c1) }()
+	tc := newTestClient(t, c2)
+
+	tc.request("initialize", map[string]interface{}{"adapterID": "alvm"}, nil)
+	tc.event("initialized", nil)
+	var bps struct{ Breakpoints []breakpoint }
+	tc.request("setBreakpoints", map[string]interface{}{
+		"source":      map[string]interface{}{"path": "/home/dev/app/Script/aapp.lua"},
+		"breakpoints": []map[string]interface{}{{"line": 4}},
+	}, &bps)
+	if len(bps.Breakpoints) != 1 || !bps.Breakpoints[0].Verified {
+		t.Errorf("unexpected breakpoints %v", bps.Breakpoints)
+	}
+	tc.request("launch", map[string]interface{}{"program": "/Script/aapp.lua"}, nil)
+	tc.request("configurationDone", nil, nil)
+
+	var stopped struct{ Reason string }
+	tc.event("stopped", &stopped)
+	if stopped.Reason != "breakpoint" {
+		t.Errorf("unexpected reason %v", stopped.Reason)
+	}
+	var trace struct{ StackFrames []stackFrame }
+	tc.request("stackTrace", map[string]interface{}{"threadId": 1}, &trace)
+	top := trace.StackFrames[0]
+	if top.Name != "add" || top.Line != 4 || top.Source.Path != "/Script/aapp.lua" {
+		t.Errorf("unexpected frame %+v", top)
+	}
+
+	var scopes struct{ Scopes []scope }
+	tc.request("scopes", map[string]interface{}{"frameId": top.Id}, &scopes)
+	var vars struct{ Variables []variable }
+	tc.request("variables", map[string]interface{}{"variablesReference": scopes.Scopes[0].VariablesReference}, &vars)
+	if fmt.Sprint(vars.Variables) != "[{a 1 number 0} {b 2 number 0} {s 3 number 0}]" {
+		t.Errorf("unexpected locals %v", vars.Variables)
+	}
+
+	var result struct {
+		Result             string
+		VariablesReference int
+	}
+	tc.request("evaluate", map[string]interface{}{"expression": "cfg", "frameId": top.Id}, &result)
+	tc.request("variables", map[string]interface{}{"variablesReference": result.VariablesReference}, &vars)
+	if fmt.Sprint(vars.Variables) != `[{[1] 10 number 0} {name "app" string 0}]` {
+		t.Errorf("unexpected fields %v", vars.Variables)
+	}
+	tc.request("evaluate", map[string]interface{}{"expression": "s * 2", "frameId": top.Id}, &result)
+	if result.Result != "6" {
+		t.Errorf("unexpected result %v", result.Result)
+	}
+
+	var src struct{ Content string }
+	tc.request("source", map[string]interface{}{"source": top.Source}, &src)
+	if src.Content != serverTestScript {
+		t.Errorf("unexpected source %q", src.Content)
+	}
+
+	tc.request("next", map[string]interface{}{"threadId": 1}, nil)
+	tc.event("stopped", &stopped)
+	tc.request("stackTrace", map[string]interface{}{"threadId": 1}, &trace)
+	if stopped.Reason != "step" || trace.StackFrames[0].Line != 6 {
+		t.Errorf("unexpected step %v to %+v", stopped.Reason, trace.StackFrames[0])
+	}
+
+	tc.request("continue", map[string]interface{}{"threadId": 1}, nil)
+	var exited struct{ ExitCode int }
+	tc.event("exited", &exited)
+	tc.event("terminated", nil)
+	if exited.ExitCode != 0 || L.GetGlobal("result") != lua.LNumber(13) {
+		t.Errorf("unexpected exit %v with result %v", exited.ExitCode, L.GetGlobal("result"))
+	}
+	tc.request("disconnect", nil, nil)
+	if err := <-served; err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,493 @@
+package lua
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+  Host side debugger.
+
+  A Debugger is attached with LState.SetDebugger, which switches the state to
+  mainLoopWithDebugger. States without a debugger keep running mainLoop, so
+  the debugger costs nothing unless it is attached.
+
+  Before an instruction of a Lua function runs, the debugger decides whether
+  to stop, much like the line hook of Lua: a line event happens when a
+  function is entered, when the line changes and when a loop jumps back.
+  On a stop the DebugHandler is called on the goroutine running the script
+  and may inspect the suspended state until it returns how to resume.
+*/
+
+// DebugAction tells a stopped state how to resume.
+type DebugAction int
+
+const (
+	// DebugContinue runs until the next breakpoint or pause.
+	DebugContinue DebugAction = iota
+	// DebugStepIn stops at the next line, entering called functions.
+	DebugStepIn
+	// DebugStepOver stops at the next line of the current function or its
+	// callers.
+	DebugStepOver
+	// DebugStepOut stops when the current function has returned.
+	DebugStepOut
+)
+
+// DebugReason tells a DebugHandler why the state stopped.
+type DebugReason int
+
+const (
+	DebugReasonBreakpoint DebugReason = iota
+	DebugReasonFunctionBreakpoint
+	DebugReasonStep
+	DebugReasonPause
+)
+
+func (r DebugReason) String() string {
+	switch r {
+	case DebugReasonBreakpoint:
+		return "breakpoint"
+	case DebugReasonFunctionBreakpoint:
+		return "function breakpoint"
+	case DebugReasonStep:
+		return "step"
+	case DebugReasonPause:
+		return "pause"
+	}
+	return "unknown"
+}
+
+// DebugHandler is called when a state stops. The state is suspended before
+// the line reported by the innermost frame of Debugger.Stack.
+type DebugHandler func(d *Debugger, reason DebugReason) DebugAction
+
+// DebugFrame describes a call frame of a stopped state.
+type DebugFrame struct {
+	// Level is 0 for the innermost frame.
+	Level  int
+	Name   string
+	Source string
+	// Line is the line about to run, -1 for Go functions.
+	Line int
+	Fn   *LFunction
+
+	frame *callFrame
+	pc    int
+}
+
+type DebugVariable struct {
+	Name  string
+	Value LValue
+}
+
+type Debugger struct {
+	handler DebugHandler
+	L       *LState
+
+	mu          sync.RWMutex
+	breakpoints map[string]map[int]bool
+	funcBreaks  map[string]bool
+
+	pause    int32
+	handling bool
+	mode     DebugAction
+	depth    int
+
+	// position of the last traced instruction
+	frame    *callFrame
+	fn       *LFunction
+	tailcall int
+	pc       int
+}
+
+// NewDebugger returns a Debugger that calls handler whenever a state it is
+// attached to stops.
+func NewDebugger(handler DebugHandler) *Debugger {
+	return &Debugger{
+		handler:     handler,
+		breakpoints: make(map[string]map[int]bool),
+		funcBreaks:  make(map[string]bool),
+	}
+}
+
+/* LState {{{ */
+
+// errDebuggerCombined is returned by SetDebugger, as mainLoopWithDebugger
+// neither profiles nor records coverage.
+var errDebuggerCombined = errors.New("a debugger can not be attached with a profiler or coverage")
+
+// SetDebugger attaches d to ls, nil detaches the current debugger. A
+// Debugger can be attached to one state at a time, and not to a state with
+// a profiler or Options.Coverage.
+func (ls *LState) SetDebugger(d *Debugger) error {
+	if d != nil && (ls.profiler != nil || ls.Options.Coverage != nil) {
+		return errDebuggerCombined
+	}
+	if ls.debugger != nil {
+		ls.debugger.L = nil
+	}
+	ls.debugger = d
+	if d != nil {
+		d.L = ls
+		d.frame = nil
+	}
+	ls.resetMainLoop()
+	return nil
+}
+
+// Debugger returns the debugger attached to ls or nil.
+func (ls *LState) Debugger() *Debugger {
+	return ls.debugger
+}
+
+func mainLoopWithDebugger(L *LState, baseframe *callFrame) {
+	var inst uint32
+	var cf *callFrame
+
+	if L.stack.IsEmpty() {
+		return
+	}
+
+	L.currentFrame = L.stack.Last()
+	if L.currentFrame.Fn.IsG {
+		callGFunction(L, false)
+		return
+	}
+
+	d := L.debugger
+	for {
+		cf = L.currentFrame
+		if d.L == L && !d.handling {
+			d.trace(cf)
+		}
+		inst = cf.Fn.Proto.Code[cf.Pc]
+		cf.Pc++
+		if L.ctx != nil {
+			select {
+			case <-L.ctx.Done():
+				L.RaiseError("%v", L.ctx.Err())
+				return
+			default:
+			}
+		}
+		if jumpTable[int(inst>>26)](L, inst, baseframe) == 1 {
+			return
+		}
+	}
+}
+
+/* }}} */
+
+/* breakpoints {{{ */
+
+// SetBreakpoints replaces the line breakpoints of a source. Sources are
+// matched against FunctionProto.SourceName, e.g. the chunk name passed to
+// LState.Load.
+func (d *Debugger) SetBreakpoints(source string, lines []int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(lines) == 0 {
+		delete(d.breakpoints, source)
+		return
+	}
+	set := make(map[int]bool, len(lines))
+	for _, line := range lines {
+		set[line] = true
+	}
+	d.breakpoints[source] = set
+}
+
+func (d *Debugger) AddBreakpoint(source string, line int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.breakpoints[source] == nil {
+		d.breakpoints[source] = make(map[int]bool)
+	}
+	d.breakpoints[source][line] = true
+}
+
+func (d *Debugger) RemoveBreakpoint(source string, line int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.breakpoints[source], line)
+}
+
+// SetFunctionBreakpoints replaces the function breakpoints. A name matches a
+// function called under that name, or a function stored under that path of
+// dotted fields in the globals, like "Transfer" or "token.balance".
+func (d *Debugger) SetFunctionBreakpoints(names []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.funcBreaks = make(map[string]bool, len(names))
+	for _, name := range names {
+		d.funcBreaks[name] = true
+	}
+}
+
+func (d *Debugger) AddFunctionBreakpoint(name string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.funcBreaks[name] = true
+}
+
+func (d *Debugger) RemoveFunctionBreakpoint(name string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.funcBreaks, name)
+}
+
+// Pause stops the state before its next instruction. Pause may be called
+// from any goroutine.
+func (d *Debugger) Pause() {
+	atomic.StoreInt32(&d.pause, 1)
+}
+
+func (d *Debugger) isBreakpoint(source string, line int) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.breakpoints[source][line]
+}
+
+func (d *Debugger) isFunctionBreakpoint(cf *callFrame) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if len(d.funcBreaks) == 0 {
+		return false
+	}
+	if d.funcBreaks[d.L.rawFrameFuncName(cf)] {
+		return true
+	}
+	for name := range d.funcBreaks {
+		var lv LValue = cf.Fn.Env
+		for _, field := range strings.FieldsFunc(name, func(r rune) bool { return r == '.' || r == ':' }) {
+			tb, ok := lv.(*LTable)
+			if !ok {
+				lv = LNil
+				break
+			}
+			lv = tb.RawGetString(field)
+		}
+		if lv == cf.Fn {
+			return true
+		}
+	}
+	return false
+}
+
+/* }}} */
+
+/* tracing {{{ */
+
+func (d *Debugger) trace(cf *callFrame) {
+	proto := cf.Fn.Proto
+	pc := cf.Pc
+	newFrame := cf != d.frame || cf.Fn != d.fn || cf.TailCall != d.tailcall
+	entry := newFrame && pc == 0
+	prev := d.pc
+	if newFrame {
+		// returned from a call, the previous instruction is the call
+		prev = pc - 1
+	}
+	line := proto.DbgSourcePositions[pc]
+	lineEvent := entry || pc <= prev || line != proto.DbgSourcePositions[prev]
+	d.frame, d.fn, d.tailcall, d.pc = cf, cf.Fn, cf.TailCall, pc
+
+	var reason DebugReason
+	switch {
+	case atomic.CompareAndSwapInt32(&d.pause, 1, 0):
+		reason = DebugReasonPause
+	case entry && d.isFunctionBreakpoint(cf):
+		reason = DebugReasonFunctionBreakpoint
+	case lineEvent && d.isBreakpoint(proto.SourceName, line):
+		reason = DebugReasonBreakpoint
+	case d.mode == DebugStepIn && lineEvent,
+		d.mode == DebugStepOver && (cf.Idx < d.depth || cf.Idx == d.depth && lineEvent),
+		d.mode == DebugStepOut && cf.Idx < d.depth:
+		reason = DebugReasonStep
+	default:
+		return
+	}
+
+	d.handling = true
+	defer func() { d.handling = false }()
+	d.mode = d.handler(d, reason)
+	d.depth = cf.Idx
+}
+
+/* }}} */
+
+/* inspection {{{ */
+
+// Stack returns the frames of the stopped state, innermost first.
+func (d *Debugger) Stack() []DebugFrame {
+	if d.L == nil {
+		return nil
+	}
+	var frames []DebugFrame
+	for cf := d.L.currentFrame; cf != nil; cf = cf.Parent {
+		f := DebugFrame{
+			Level: len(frames),
+			Name:  d.L.rawFrameFuncName(cf),
+			Line:  -1,
+			Fn:    cf.Fn,
+			frame: cf,
+		}
+		if !cf.Fn.IsG {
+			f.Source = cf.Fn.Proto.SourceName
+			// the innermost frame is about to run Pc, the others are in a call.
+			f.pc = cf.Pc
+			if len(frames) > 0 {
+				f.pc--
+			}
+			if f.pc >= 0 && f.pc < len(cf.Fn.Proto.DbgSourcePositions) {
+				f.Line = cf.Fn.Proto.DbgSourcePositions[f.pc]
+			}
+		} else {
+			f.Source = "[G]"
+		}
+		frames = append(frames, f)
+	}
+	return frames
+}
+
+func (d *Debugger) stackFrame(level int) (DebugFrame, bool) {
+	frames := d.Stack()
+	if level < 0 || level >= len(frames) {
+		return DebugFrame{}, false
+	}
+	return frames[level], true
+}
+
+// activeLocals returns the locals of a Lua frame and their registers.
+func (f *DebugFrame) activeLocals() ([]string, []int) {
+	var names []string
+	var regs []int
+	if f.Fn.IsG {
+		return names, regs
+	}
+	n := 0
+	for _, info := range f.Fn.Proto.DbgLocals {
+		if info.StartPc > f.pc {
+			break
+		}
+		if f.pc < info.EndPc {
+			names = append(names, info.Name)
+			regs = append(regs, f.frame.LocalBase+n)
+			n++
+		}
+	}
+	return names, regs
+}
+
+// Locals returns the local variables in scope of the frame at level.
+// Internal variables like "(for index)" are left out.
+func (d *Debugger) Locals(level int) []DebugVariable {
+	f, ok := d.stackFrame(level)
+	if !ok {
+		return nil
+	}
+	var vars []DebugVariable
+	names, regs := f.activeLocals()
+	for i, name := range names {
+		if strings.HasPrefix(name, "(") {
+			continue
+		}
+		vars = append(vars, DebugVariable{name, d.L.reg.Get(regs[i])})
+	}
+	return vars
+}
+
+// Upvalues returns the upvalues of the function of the frame at level.
+func (d *Debugger) Upvalues(level int) []DebugVariable {
+	f, ok := d.stackFrame(level)
+	if !ok {
+		return nil
+	}
+	var vars []DebugVariable
+	for i := range f.Fn.Upvalues {
+		name, value := d.L.GetUpvalue(f.Fn, i+1)
+		vars = append(vars, DebugVariable{name, value})
+	}
+	return vars
+}
+
+// Eval runs code in the frame at level and returns its results. code is an
+// expression or a chunk of statements; locals and upvalues of the frame can
+// be read and assigned by name, other names refer to the environment of the
+// frame's function.
+func (d *Debugger) Eval(level int, code string) ([]LValue, error) {
+	L := d.L
+	f, ok := d.stackFrame(level)
+	if !ok {
+		return nil, newApiErrorS(ApiErrorRun, "invalid stack level")
+	}
+	proto, err := L.loadProto(strings.NewReader("return "+code), "(eval)")
+	if err != nil {
+		if proto, err = L.loadProto(strings.NewReader(code), "(eval)"); err != nil {
+			return nil, err
+		}
+	}
+
+	names, regs := f.activeLocals()
+	lookup := func(name string) (get func() LValue, set func(LValue)) {
+		for i := len(names) - 1; i >= 0; i-- {
+			if names[i] == name {
+				reg := regs[i]
+				return func() LValue { return L.reg.Get(reg) }, func(lv LValue) { L.reg.Set(reg, lv) }
+			}
+		}
+		if !f.Fn.IsG {
+			for i, uvname := range f.Fn.Proto.DbgUpvalues {
+				if uvname == name && i < len(f.Fn.Upvalues) {
+					uv := f.Fn.Upvalues[i]
+					return uv.Value, uv.SetValue
+				}
+			}
+		}
+		return nil, nil
+	}
+	env := f.Fn.Env
+	mt := L.NewTable()
+	mt.RawSetString("__index", L.NewFunction(func(L *LState) int {
+		key := L.Get(2)
+		if name, ok := key.(LString); ok {
+			if get, _ := lookup(string(name)); get != nil {
+				L.Push(get())
+				return 1
+			}
+		}
+		L.Push(L.GetTable(env, key))
+		return 1
+	}))
+	mt.RawSetString("__newindex", L.NewFunction(func(L *LState) int {
+		key, value := L.Get(2), L.Get(3)
+		if name, ok := key.(LString); ok {
+			if _, set := lookup(string(name)); set != nil {
+				set(value)
+				return 0
+			}
+		}
+		L.SetTable(env, key, value)
+		return 0
+	}))
+	scope := L.NewTable()
+	scope.Metatable = mt
+
+	top := L.reg.Top()
+	L.Push(newLFunctionL(proto, scope, 0))
+	if err := L.PCall(0, MultRet, nil); err != nil {
+		L.reg.SetTop(top)
+		return nil, err
+	}
+	results := make([]LValue, 0, L.reg.Top()-top)
+	for i := top; i < L.reg.Top(); i++ {
+		results = append(results, L.reg.Get(i))
+	}
+	L.reg.SetTop(top)
+	return results, nil
+}
+
+/* }}} */
@@ -0,0 +1,106 @@
+package lua
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const debuggerTestSrc = `local base = 10
+local function add(a, b)
+  local s = a + b
+  return s + base
+end
+function twice(x)
+  local y = add(x, x)
+  return y * 2
+end
+result = twice(1)
+result = result + twice(2)
+`
+
+func runDebugged(t *testing.T, d *Debugger) {
+	L := NewState()
+	defer L.Close()
+	errorIfNotNil(t, L.SetDebugger(d))
+	errorIfNotNil(t, L.DoString(debuggerTestSrc))
+	L.SetDebugger(nil)
+}
+
+func TestDebuggerBreakpointsAndEval(t *testing.T) {
+	var stops []string
+	d := NewDebugger(func(d *Debugger, reason DebugReason) DebugAction {
+		top := d.Stack()[0]
+		var locals []string
+		for _, v := range d.Locals(0) {
+			locals = append(locals, fmt.Sprintf("%v=%v", v.Name, v.Value))
+		}
+		stops = append(stops, fmt.Sprintf("%v %v:%v %v", reason, top.Name, top.Line, strings.Join(locals, ",")))
+		if top.Line == 4 {
+			values, err := d.Eval(0, "s + base, d")
+			errorIfNotNil(t, err)
+			errorIfNotEqual(t, 2, len(values))
+			errorIfNotEqual(t, "nil", values[1].Type().String())
+			_, err = d.Eval(0, "s = 100")
+			errorIfNotNil(t, err)
+		}
+		return DebugContinue
+	})
+	d.AddBreakpoint("<string>", 4)
+	d.AddFunctionBreakpoint("twice")
+	runDebugged(t, d)
+
+	errorIfNotEqual(t, strings.Join([]string{
+		"function breakpoint twice:7 x=1",
+		"breakpoint add:4 a=1,b=1,s=2",
+		"function breakpoint twice:7 x=2",
+		"breakpoint add:4 a=2,b=2,s=4",
+	}, "\n"), strings.Join(stops, "\n"))
+
+	up := NewDebugger(func(d *Debugger, reason DebugReason) DebugAction {
+		vars := d.Upvalues(0)
+		errorIfNotEqual(t, 1, len(vars))
+		errorIfNotEqual(t, "base", vars[0].Name)
+		errorIfNotEqual(t, LNumber(10), vars[0].Value)
+		frames := d.Stack()
+		errorIfNotEqual(t, "twice", frames[1].Name)
+		errorIfNotEqual(t, 7, frames[1].Line)
+		return DebugContinue
+	})
+	up.AddBreakpoint("<string>", 3)
+
+	L := NewState()
+	defer L.Close()
+	L.SetDebugger(d)
+	errorIfNotNil(t, L.DoString(debuggerTestSrc))
+	// s was set to 100 at both stops: (100 + 10) * 2 + (100 + 10) * 2
+	errorIfNotEqual(t, LNumber(440), L.GetGlobal("result"))
+	L.SetDebugger(up)
+	errorIfNotNil(t, L.DoString(debuggerTestSrc))
+}
+
+func TestDebuggerStepping(t *testing.T) {
+	var lines []int
+	actions := []DebugAction{DebugStepOver, DebugStepOver, DebugStepOver, DebugStepIn, DebugStepIn, DebugStepOut, DebugStepOver, DebugStepOver, DebugStepOut}
+	d := NewDebugger(func(d *Debugger, reason DebugReason) DebugAction {
+		lines = append(lines, d.Stack()[0].Line)
+		if len(lines) > len(actions) {
+			return DebugContinue
+		}
+		return actions[len(lines)-1]
+	})
+	d.Pause()
+	runDebugged(t, d)
+	// paused at 1, over the definitions to 10, into twice and add, out of
+	// add to 8 as nothing of 7 is left, over the return of twice back to the
+	// assignment on 10, then out of the main chunk.
+	errorIfNotEqual(t, "[1 2 6 10 7 3 8 10 11]", fmt.Sprint(lines))
+}
+
+func TestDebuggerCombined(t *testing.T) {
+	L := NewState(Options{Coverage: NewCoverage()})
+	defer L.Close()
+	d := NewDebugger(func(d *Debugger, reason DebugReason) DebugAction { return DebugContinue })
+	errorIfNotEqual(t, errDebuggerCombined, L.SetDebugger(d))
+	errorIfNotNil(t, L.Debugger())
+}
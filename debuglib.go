@@ -41,8 +41,8 @@ func debugGetInfo(L *LState) int {
 	case *LFunction:
 		dbg = &Debug{}
 		fn, err = L.GetInfo(">"+what, dbg, lv)
-	case LNumber:
-		dbg, ok = L.GetStack(int(lv))
+	case LNumber, LInteger:
+		dbg, ok = L.GetStack(L.CheckInt(1))
 		if !ok {
 			L.Push(LNil)
 			return 1
@@ -0,0 +1,735 @@
+// Lua source formatter.
+package format
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/ayachain/go-aya-alvm/ast"
+	"github.com/ayachain/go-aya-alvm/parse"
+)
+
+/*
+  The formatter prints the AST of a chunk in a canonical layout:
+
+    - blocks are indented by two spaces, one statement per line
+    - at most one blank line is kept between statements
+    - optional parentheses and semicolons are dropped, required ones added
+    - strings use double quotes unless they contain one, strings with line
+      breaks are printed as long strings
+    - table constructors are printed on one line unless they span several
+      lines in the source, then one field per line with a trailing comma
+
+  The AST only knows the lines of statements and expressions, so comments are
+  placed by line: a comment on a line of its own is printed before the
+  statement that follows it, a comment after code is appended to the line
+  that ends the statement. Formatting formatted source does not change it.
+*/
+
+const indentString = "  "
+
+// Source formats the Lua source in src. Syntax errors are returned as
+// *parse.Error.
+func Source(src []byte, name string) ([]byte, error) {
+	chunk, comments, err := parse.ParseComments(bytes.NewReader(src), name)
+	if err != nil {
+		return nil, err
+	}
+	return Chunk(chunk, comments), nil
+}
+
+// Chunk prints a parsed chunk and its comments.
+func Chunk(chunk []ast.Stmt, comments []ast.Comment) []byte {
+	p := &printer{comments: comments, first: true}
+	p.block(chunk)
+	p.flush(int(^uint(0) >> 1))
+	if p.buf.Len() > 0 {
+		p.buf.WriteByte('\n')
+	}
+	return p.buf.Bytes()
+}
+
+type printer struct {
+	buf      bytes.Buffer
+	indent   int
+	comments []ast.Comment
+	// last is the last source line printed so far.
+	last int
+	// first is set at the beginning of a block, where no blank line is kept.
+	first bool
+}
+
+func (p *printer) write(s string) { p.buf.WriteString(s) }
+
+func (p *printer) newline() {
+	if p.buf.Len() > 0 {
+		p.buf.WriteByte('\n')
+	}
+	p.write(strings.Repeat(indentString, p.indent))
+}
+
+// line starts a new output line for source line n, keeping one blank line if
+// the source had any.
+func (p *printer) line(n int) {
+	if !p.first && n > p.last+1 {
+		p.buf.WriteByte('\n')
+	}
+	p.first = false
+	p.newline()
+}
+
+func (p *printer) advance(n int) {
+	if n > p.last {
+		p.last = n
+	}
+}
+
+/* comments {{{ */
+
+func commentEnd(c ast.Comment) int {
+	return c.Pos.Line + strings.Count(c.Text, "\n")
+}
+
+// flush prints the comments before source line n on lines of their own.
+func (p *printer) flush(n int) {
+	for len(p.comments) > 0 && p.comments[0].Pos.Line < n {
+		c := p.comments[0]
+		p.comments = p.comments[1:]
+		p.line(c.Pos.Line)
+		p.write(strings.TrimRight(c.Text, " \t"))
+		p.advance(commentEnd(c))
+	}
+}
+
+// trailing appends the comments that follow code up to source line n.
+func (p *printer) trailing(n int) {
+	for len(p.comments) > 0 && !p.comments[0].OwnLine && p.comments[0].Pos.Line <= n {
+		c := p.comments[0]
+		p.comments = p.comments[1:]
+		p.write(" ")
+		p.write(strings.TrimRight(c.Text, " \t"))
+		p.advance(commentEnd(c))
+	}
+}
+
+/* }}} */
+
+/* statements {{{ */
+
+func (p *printer) block(stmts []ast.Stmt) {
+	for _, stmt := range stmts {
+		p.flush(stmt.Line())
+		p.stmt(stmt)
+	}
+}
+
+// body prints the block of a compound statement and the comments up to the
+// line of its closing keyword.
+func (p *printer) body(stmts []ast.Stmt, open, close int) {
+	p.trailing(open)
+	p.advance(open)
+	p.indent++
+	p.first = true
+	p.block(stmts)
+	if close > 0 {
+		p.flush(close)
+	}
+	p.indent--
+	p.first = false
+}
+
+// end prints the closing keyword of a compound statement.
+func (p *printer) end(keyword string, line int) {
+	p.newline()
+	p.write(keyword)
+	p.advance(line)
+}
+
+func (p *printer) stmt(stmt ast.Stmt) {
+	p.line(stmt.Line())
+	start := p.buf.Len()
+	switch st := stmt.(type) {
+	case *ast.AssignStmt:
+		p.exprList(st.Lhs)
+		p.write(" = ")
+		p.exprList(st.Rhs)
+	case *ast.LocalAssignStmt:
+		if len(st.Names) == 1 && len(st.Exprs) == 1 {
+			if fn, ok := st.Exprs[0].(*ast.FunctionExpr); ok {
+				p.write("local function " + st.Names[0])
+				p.funcBody(fn)
+				break
+			}
+		}
+		p.write("local " + strings.Join(st.Names, ", "))
+		if len(st.Exprs) > 0 {
+			p.write(" = ")
+			p.exprList(st.Exprs)
+		}
+	case *ast.FuncCallStmt:
+		p.expr(st.Expr, 0)
+	case *ast.DoBlockStmt:
+		p.write("do")
+		p.body(st.Stmts, st.Line(), st.LastLine())
+		p.end("end", st.LastLine())
+	case *ast.WhileStmt:
+		p.write("while ")
+		p.expr(st.Condition, 0)
+		p.write(" do")
+		p.body(st.Stmts, lastLine(st.Condition), st.LastLine())
+		p.end("end", st.LastLine())
+	case *ast.RepeatStmt:
+		p.write("repeat")
+		p.body(st.Stmts, st.Line(), st.Condition.Line())
+		p.end("until ", st.Condition.Line())
+		p.expr(st.Condition, 0)
+	case *ast.IfStmt:
+		p.ifStmt(st, "if ", st.LastLine())
+		p.end("end", st.LastLine())
+	case *ast.NumberForStmt:
+		p.write("for " + st.Name + " = ")
+		p.expr(st.Init, 0)
+		p.write(", ")
+		p.expr(st.Limit, 0)
+		if st.Step != nil {
+			p.write(", ")
+			p.expr(st.Step, 0)
+		}
+		p.write(" do")
+		p.body(st.Stmts, st.Line(), st.LastLine())
+		p.end("end", st.LastLine())
+	case *ast.GenericForStmt:
+		p.write("for " + strings.Join(st.Names, ", ") + " in ")
+		p.exprList(st.Exprs)
+		p.write(" do")
+		p.body(st.Stmts, st.Line(), st.LastLine())
+		p.end("end", st.LastLine())
+	case *ast.FuncDefStmt:
+		p.write("function ")
+		if st.Name.Func == nil {
+			p.expr(st.Name.Receiver, 0)
+			p.write(":" + st.Name.Method)
+		} else {
+			p.expr(st.Name.Func, 0)
+		}
+		p.funcBody(st.Func)
+	case *ast.ReturnStmt:
+		p.write("return")
+		if len(st.Exprs) > 0 {
+			p.write(" ")
+			p.exprList(st.Exprs)
+		}
+	case *ast.BreakStmt:
+		p.write("break")
+	}
+	// a statement starting with a parenthesis would continue a call on the
+	// previous line.
+	if p.buf.Len() > start && p.buf.Bytes()[start] == '(' {
+		code := append([]byte(nil), p.buf.Bytes()[start:]...)
+		p.buf.Truncate(start)
+		p.write(";")
+		p.buf.Write(code)
+	}
+	end := lastLine(stmt)
+	p.advance(end)
+	p.trailing(end)
+}
+
+// ifStmt prints an if statement up to the end keyword on source line close.
+func (p *printer) ifStmt(st *ast.IfStmt, keyword string, close int) {
+	p.write(keyword)
+	p.expr(st.Condition, 0)
+	p.write(" then")
+	// elseif chains are nested IfStmts, their line is the line of elseif.
+	if len(st.Else) == 1 {
+		if elseif, ok := st.Else[0].(*ast.IfStmt); ok {
+			p.body(st.Then, lastLine(st.Condition), elseif.Line())
+			p.newline()
+			p.ifStmt(elseif, "elseif ", close)
+			return
+		}
+	}
+	if len(st.Else) == 0 {
+		p.body(st.Then, lastLine(st.Condition), close)
+		return
+	}
+	// the line of else is unknown, comments after the last statement of the
+	// then block belong to the else block.
+	thenClose := lastLine(st.Condition) + 1
+	if len(st.Then) > 0 {
+		thenClose = lastLine(st.Then[len(st.Then)-1]) + 1
+	}
+	p.body(st.Then, lastLine(st.Condition), thenClose)
+	p.newline()
+	p.write("else")
+	p.body(st.Else, 0, close)
+}
+
+/* }}} */
+
+/* expressions {{{ */
+
+// operator precedences of Lua 5.3, higher binds tighter. Lua 5.1 has the
+// same ones without the integer operators.
+const (
+	precOr = 1 + iota
+	precAnd
+	precCompare
+	precBor
+	precBxor
+	precBand
+	precShift
+	precConcat
+	precAdd
+	precMul
+	precUnary
+	precPow
+	precAtom
+)
+
+func binaryPrec(op string) int {
+	switch op {
+	case "or":
+		return precOr
+	case "and":
+		return precAnd
+	case "<", ">", "<=", ">=", "==", "~=":
+		return precCompare
+	case "|":
+		return precBor
+	case "~":
+		return precBxor
+	case "&":
+		return precBand
+	case "<<", ">>":
+		return precShift
+	case "+", "-":
+		return precAdd
+	case "*", "/", "//", "%":
+		return precMul
+	case "^":
+		return precPow
+	}
+	return precConcat
+}
+
+func (p *printer) exprList(exprs []ast.Expr) {
+	for i, expr := range exprs {
+		if i > 0 {
+			p.write(", ")
+		}
+		p.expr(expr, 0)
+	}
+}
+
+// expr prints expr, in parentheses if it binds less tightly than prec.
+func (p *printer) expr(expr ast.Expr, prec int) {
+	switch ex := expr.(type) {
+	case *ast.NilExpr:
+		p.write("nil")
+	case *ast.TrueExpr:
+		p.write("true")
+	case *ast.FalseExpr:
+		p.write("false")
+	case *ast.NumberExpr:
+		p.write(ex.Value)
+	case *ast.StringExpr:
+		p.write(quote(ex.Value))
+	case *ast.Comma3Expr:
+		p.write("...")
+	case *ast.IdentExpr:
+		p.write(ex.Value)
+	case *ast.AttrGetExpr:
+		p.prefix(ex.Object)
+		if key, ok := ex.Key.(*ast.StringExpr); ok && isName(key.Value) {
+			p.write("." + key.Value)
+		} else {
+			p.write("[")
+			p.expr(ex.Key, 0)
+			p.write("]")
+		}
+	case *ast.FuncCallExpr:
+		if ex.AdjustRet {
+			p.write("(")
+		}
+		if ex.Func != nil {
+			p.prefix(ex.Func)
+		} else {
+			p.prefix(ex.Receiver)
+			p.write(":" + ex.Method)
+		}
+		p.write("(")
+		p.exprList(ex.Args)
+		p.write(")")
+		if ex.AdjustRet {
+			p.write(")")
+		}
+	case *ast.TableExpr:
+		p.table(ex)
+	case *ast.FunctionExpr:
+		p.write("function")
+		p.funcBody(ex)
+	case *ast.LogicalOpExpr:
+		p.binary(ex.Operator, ex.Lhs, ex.Rhs, prec)
+	case *ast.RelationalOpExpr:
+		p.binary(ex.Operator, ex.Lhs, ex.Rhs, prec)
+	case *ast.StringConcatOpExpr:
+		p.binary("..", ex.Lhs, ex.Rhs, prec)
+	case *ast.ArithmeticOpExpr:
+		p.binary(ex.Operator, ex.Lhs, ex.Rhs, prec)
+	case *ast.UnaryMinusOpExpr:
+		p.unary("-", ex.Expr, prec)
+	case *ast.UnaryNotOpExpr:
+		p.unary("not ", ex.Expr, prec)
+	case *ast.UnaryLenOpExpr:
+		p.unary("#", ex.Expr, prec)
+	case *ast.UnaryBNotOpExpr:
+		p.unary("~", ex.Expr, prec)
+	}
+}
+
+// prefix prints the object of an index or a call, which must be a variable,
+// a call or a parenthesized expression.
+func (p *printer) prefix(expr ast.Expr) {
+	switch expr.(type) {
+	case *ast.IdentExpr, *ast.AttrGetExpr, *ast.FuncCallExpr:
+		p.expr(expr, 0)
+	default:
+		p.write("(")
+		p.expr(expr, 0)
+		p.write(")")
+	}
+}
+
+func (p *printer) binary(op string, lhs, rhs ast.Expr, prec int) {
+	opPrec := binaryPrec(op)
+	lprec, rprec := opPrec, opPrec+1
+	if op == ".." || op == "^" {
+		// right associative
+		lprec, rprec = opPrec+1, opPrec
+	}
+	if opPrec < prec {
+		p.write("(")
+	}
+	p.expr(lhs, lprec)
+	p.write(" " + op + " ")
+	p.expr(rhs, rprec)
+	if opPrec < prec {
+		p.write(")")
+	}
+}
+
+func (p *printer) unary(op string, operand ast.Expr, prec int) {
+	if precUnary < prec {
+		p.write("(")
+	}
+	p.write(op)
+	start := p.buf.Len()
+	p.expr(operand, precUnary)
+	if op == "-" && p.buf.Len() > start && p.buf.Bytes()[start] == '-' {
+		// "- -x", not a comment
+		code := append([]byte(nil), p.buf.Bytes()[start:]...)
+		p.buf.Truncate(start)
+		p.write(" ")
+		p.buf.Write(code)
+	}
+	if precUnary < prec {
+		p.write(")")
+	}
+}
+
+func (p *printer) funcBody(fn *ast.FunctionExpr) {
+	params := append([]string{}, fn.ParList.Names...)
+	if fn.ParList.HasVargs {
+		params = append(params, "...")
+	}
+	p.write("(" + strings.Join(params, ", ") + ")")
+	if len(fn.Stmts) == 0 && !p.hasComments(fn.LastLine()) {
+		p.write(" end")
+		p.advance(fn.LastLine())
+		return
+	}
+	p.body(fn.Stmts, fn.Line(), fn.LastLine())
+	p.end("end", fn.LastLine())
+}
+
+func (p *printer) hasComments(before int) bool {
+	return len(p.comments) > 0 && p.comments[0].Pos.Line < before
+}
+
+// table prints a constructor on one line, or one field per line if it spans
+// several lines in the source or in the output.
+func (p *printer) table(tb *ast.TableExpr) {
+	if len(tb.Fields) == 0 && !p.hasComments(tb.LastLine()) {
+		p.write("{}")
+		return
+	}
+	multiline := breaksLine(tb)
+	p.write("{")
+	if multiline {
+		p.trailing(tb.Line())
+		p.advance(tb.Line())
+		p.indent++
+		p.first = true
+	}
+	for i, field := range tb.Fields {
+		if multiline {
+			p.flush(fieldLine(field))
+			p.line(fieldLine(field))
+		} else if i > 0 {
+			p.write(", ")
+		}
+		if field.Key != nil {
+			if key, ok := field.Key.(*ast.StringExpr); ok && isName(key.Value) {
+				p.write(key.Value)
+			} else {
+				p.write("[")
+				p.expr(field.Key, 0)
+				p.write("]")
+			}
+			p.write(" = ")
+		}
+		p.expr(field.Value, 0)
+		if multiline {
+			p.write(",")
+			end := lastLine(field.Value)
+			p.advance(end)
+			p.trailing(end)
+		}
+	}
+	if multiline {
+		p.flush(tb.LastLine())
+		p.indent--
+		p.first = false
+		p.newline()
+	}
+	p.write("}")
+	p.advance(tb.LastLine())
+}
+
+// breaksLine reports whether expr is printed on more than one line.
+func breaksLine(expr ast.Expr) bool {
+	switch ex := expr.(type) {
+	case *ast.StringExpr:
+		return isLongString(ex.Value)
+	case *ast.FunctionExpr:
+		return len(ex.Stmts) > 0 || ex.LastLine() > ex.Line()
+	case *ast.TableExpr:
+		if ex.LastLine() > ex.Line() {
+			return true
+		}
+		for _, field := range ex.Fields {
+			if field.Key != nil && breaksLine(field.Key) || breaksLine(field.Value) {
+				return true
+			}
+		}
+	case *ast.AttrGetExpr:
+		return breaksLine(ex.Object) || breaksLine(ex.Key)
+	case *ast.FuncCallExpr:
+		if ex.Func != nil && breaksLine(ex.Func) || ex.Receiver != nil && breaksLine(ex.Receiver) {
+			return true
+		}
+		for _, arg := range ex.Args {
+			if breaksLine(arg) {
+				return true
+			}
+		}
+	case *ast.LogicalOpExpr:
+		return breaksLine(ex.Lhs) || breaksLine(ex.Rhs)
+	case *ast.RelationalOpExpr:
+		return breaksLine(ex.Lhs) || breaksLine(ex.Rhs)
+	case *ast.StringConcatOpExpr:
+		return breaksLine(ex.Lhs) || breaksLine(ex.Rhs)
+	case *ast.ArithmeticOpExpr:
+		return breaksLine(ex.Lhs) || breaksLine(ex.Rhs)
+	case *ast.UnaryMinusOpExpr:
+		return breaksLine(ex.Expr)
+	case *ast.UnaryNotOpExpr:
+		return breaksLine(ex.Expr)
+	case *ast.UnaryLenOpExpr:
+		return breaksLine(ex.Expr)
+	case *ast.UnaryBNotOpExpr:
+		return breaksLine(ex.Expr)
+	}
+	return false
+}
+
+func fieldLine(field *ast.Field) int {
+	if field.Key != nil {
+		return field.Key.Line()
+	}
+	return field.Value.Line()
+}
+
+/* }}} */
+
+/* lexical helpers {{{ */
+
+var reservedWords = map[string]bool{
+	"and": true, "break": true, "do": true, "else": true, "elseif": true,
+	"end": true, "false": true, "for": true, "function": true, "if": true,
+	"in": true, "local": true, "nil": true, "not": true, "or": true,
+	"repeat": true, "return": true, "then": true, "true": true,
+	"until": true, "while": true,
+}
+
+func isName(s string) bool {
+	if len(s) == 0 || reservedWords[s] {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || i > 0 && '0' <= c && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// isLongString reports whether s is printed as a long string: it has line
+// breaks and no other control characters.
+func isLongString(s string) bool {
+	if !strings.Contains(s, "\n") {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < ' ' && c != '\n' && c != '\t' || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+func quote(s string) string {
+	if isLongString(s) {
+		sep := ""
+		for strings.Contains(s+"]", "]"+sep+"]") {
+			sep += "="
+		}
+		// the line break after the opening bracket is skipped by the lexer.
+		return "[" + sep + "[\n" + s + "]" + sep + "]"
+	}
+	q := byte('"')
+	if strings.IndexByte(s, '"') >= 0 && strings.IndexByte(s, '\'') < 0 {
+		q = '\''
+	}
+	var buf bytes.Buffer
+	buf.WriteByte(q)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case q, '\\':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		case '\a':
+			buf.WriteString(`\a`)
+		case '\b':
+			buf.WriteString(`\b`)
+		case '\f':
+			buf.WriteString(`\f`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
+		case '\v':
+			buf.WriteString(`\v`)
+		default:
+			if c < ' ' || c == 0x7f {
+				fmt.Fprintf(&buf, "\\%03d", c)
+			} else {
+				buf.WriteByte(c)
+			}
+		}
+	}
+	buf.WriteByte(q)
+	return buf.String()
+}
+
+/* }}} */
+
+/* lines {{{ */
+
+// lastLine returns the last source line of a statement or expression.
+func lastLine(node interface{}) int {
+	n := 0
+	max := func(l int) {
+		if l > n {
+			n = l
+		}
+	}
+	exprs := func(list []ast.Expr) {
+		for _, expr := range list {
+			max(lastLine(expr))
+		}
+	}
+	switch nd := node.(type) {
+	case ast.Stmt:
+		max(nd.Line())
+		max(nd.LastLine())
+	case ast.Expr:
+		max(nd.Line())
+		max(nd.LastLine())
+	}
+	switch nd := node.(type) {
+	case *ast.AssignStmt:
+		exprs(nd.Lhs)
+		exprs(nd.Rhs)
+	case *ast.LocalAssignStmt:
+		exprs(nd.Exprs)
+	case *ast.FuncCallStmt:
+		max(lastLine(nd.Expr))
+	case *ast.RepeatStmt:
+		max(lastLine(nd.Condition))
+	case *ast.FuncDefStmt:
+		max(lastLine(nd.Func))
+	case *ast.ReturnStmt:
+		exprs(nd.Exprs)
+	case *ast.StringExpr:
+		if isLongString(nd.Value) {
+			max(nd.Line() + 1 + strings.Count(nd.Value, "\n"))
+		}
+	case *ast.AttrGetExpr:
+		max(lastLine(nd.Object))
+		max(lastLine(nd.Key))
+	case *ast.FuncCallExpr:
+		if nd.Func != nil {
+			max(lastLine(nd.Func))
+		} else {
+			max(lastLine(nd.Receiver))
+		}
+		exprs(nd.Args)
+	case *ast.TableExpr:
+		for _, field := range nd.Fields {
+			if field.Key != nil {
+				max(lastLine(field.Key))
+			}
+			max(lastLine(field.Value))
+		}
+	case *ast.LogicalOpExpr:
+		max(lastLine(nd.Lhs))
+		max(lastLine(nd.Rhs))
+	case *ast.RelationalOpExpr:
+		max(lastLine(nd.Lhs))
+		max(lastLine(nd.Rhs))
+	case *ast.StringConcatOpExpr:
+		max(lastLine(nd.Lhs))
+		max(lastLine(nd.Rhs))
+	case *ast.ArithmeticOpExpr:
+		max(lastLine(nd.Lhs))
+		max(lastLine(nd.Rhs))
+	case *ast.UnaryMinusOpExpr:
+		max(lastLine(nd.Expr))
+	case *ast.UnaryNotOpExpr:
+		max(lastLine(nd.Expr))
+	case *ast.UnaryLenOpExpr:
+		max(lastLine(nd.Expr))
+	case *ast.UnaryBNotOpExpr:
+		max(lastLine(nd.Expr))
+	}
+	return n
+}
+
+/* }}} */
@@ -0,0 +1,86 @@
+package format
+
+import (
+	"strings"
+	"testing"
+)
+
+const formatTestSrc = `-- header
+
+local a,b=1,2 -- trailing
+local t = {1,2; x=1, ["y z"]=2, ["end"]=3}
+local cfg = {
+  name = "app", -- the name
+  -- own line
+  handler = function(x) return x end
+}
+function M.f(x, ...)
+  if x then return (f(x)) elseif y then print"y" else
+    -- about else
+    error('bad "x"')
+  end
+
+
+  while not (a == b) do a = a + - -1 end
+  local n = a//b | ~c & (d<<1), (a|b)&c
+  return -x^2, (-x)^2, (a..b)..c, 1-(2-3), #t, [[
+two
+lines]]
+end
+function obj:m() end
+;(f or print)("x")
+`
+
+const formatTestExpected = `-- header
+
+local a, b = 1, 2 -- trailing
+local t = {1, 2, x = 1, ["y z"] = 2, ["end"] = 3}
+local cfg = {
+  name = "app", -- the name
+  -- own line
+  handler = function(x)
+    return x
+  end,
+}
+function M.f(x, ...)
+  if x then
+    return (f(x))
+  elseif y then
+    print("y")
+  else
+    -- about else
+    error('bad "x"')
+  end
+
+  while not (a == b) do
+    a = a + - -1
+  end
+  local n = a // b | ~c & d << 1, (a | b) & c
+  return -x ^ 2, (-x) ^ 2, (a .. b) .. c, 1 - (2 - 3), #t, [[
+two
+lines]]
+end
+function obj:m() end
+;(f or print)("x")
+`
+
+func TestSource(t *testing.T) {
+	out, err := Source([]byte(formatTestSrc), "<test>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != formatTestExpected {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+	again, err := Source(out, "<test>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(again) != string(out) {
+		t.Errorf("formatting is not idempotent:\n%s", again)
+	}
+
+	if _, err := Source([]byte("local = 1"), "<test>"); err == nil || !strings.Contains(err.Error(), "<test>") {
+		t.Errorf("syntax error expected, got %v", err)
+	}
+}
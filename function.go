@@ -39,7 +39,13 @@ type FunctionProto struct {
 	DbgCalls           []DbgCall
 	DbgUpvalues        []string
 
+	// Integers tells whether the function was compiled with Options.Integers.
+	Integers bool
+
 	stringConstants []string
+	// verified is set atomically, protos of a ProtoCache are shared by states
+	// running on other goroutines.
+	verified int32
 }
 
 /* Upvalue {{{ */
@@ -148,6 +154,18 @@ func (fp *FunctionProto) str(level int, count int) string {
 	return strings.Join(buf, "")
 }
 
+// withSourceName returns a copy of fp and its nested protos that reports
+// name as source. Instructions and constants are shared with fp.
+func (fp *FunctionProto) withSourceName(name string) *FunctionProto {
+	cp := *fp
+	cp.SourceName = name
+	cp.FunctionPrototypes = make([]*FunctionProto, len(fp.FunctionPrototypes))
+	for i, child := range fp.FunctionPrototypes {
+		cp.FunctionPrototypes[i] = child.withSourceName(name)
+	}
+	return &cp
+}
+
 /* }}} */
 
 /* LFunction {{{ */
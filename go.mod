@@ -1,17 +1,22 @@
 module github.com/ayachain/go-aya-alvm
 
 require (
+	github.com/btcsuite/btcd v0.0.0-20190523000118-16327141da8c
 	github.com/ayachain/go-aya-alvm-adb v0.0.0-00010101000000-000000000000
 	github.com/ipfs/go-cid v0.0.2
 	github.com/ipfs/go-datastore v0.0.5
 	github.com/ipfs/go-ipfs v0.4.21
+	github.com/ipfs/go-ipld-cbor v0.0.2
 	github.com/ipfs/go-ipld-format v0.0.2
 	github.com/ipfs/go-merkledag v0.0.3
 	github.com/ipfs/go-mfs v0.0.7
 	github.com/ipfs/go-unixfs v0.0.6
+	github.com/multiformats/go-multihash v0.0.5
 	github.com/pkg/errors v0.8.1
+	golang.org/x/crypto v0.0.0-20190530122614-20be4c3c3ed5
+	golang.org/x/text v0.3.2
 )
 
 replace github.com/ayachain/go-aya-alvm-adb => ../go-aya-alvm-adb
 
-go 1.12
+go 1.13
@@ -0,0 +1,125 @@
+package lua
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/ayachain/go-aya-alvm/parse"
+)
+
+func TestIntegers(t *testing.T) {
+	L := NewState(Options{Integers: true})
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+	assert(math.type(1) == "integer" and math.type(1.0) == "float" and math.type("1") == nil)
+	assert(math.type(2^53) == "float" and math.type(7 // 2) == "integer" and math.type(7 / 2) == "float")
+	assert(7 // 2 == 3 and -7 // 2 == -4 and 7.5 // 2 == 3.0 and -7 % 3 == 2 and 7 % -3 == -2)
+	assert(1 == 1.0 and 1 < 1.5 and 2 > 1.5 and math.maxinteger + 0.0 == 2^63)
+	assert(math.maxinteger < 2^63 and math.maxinteger + 1 == math.mininteger)
+	assert(9007199254740993 ~= 9007199254740992 and 9007199254740993 > 2^53)
+	assert(0xff & 0x0f == 15 and 1 | 2 == 3 and 5 ~ 3 == 6 and ~0 == -1)
+	assert(1 << 4 == 16 and 256 >> 4 == 16 and -1 >> 63 == 1 and 1 << 64 == 0 and 1 >> -1 == 2)
+	assert(3.0 | 0 == 3 and "3" | 0 == 3 and math.type("10" + 1) == "integer")
+	assert(1 + 2 * 3 & 7 == 7 and 1 | 2 ~ 3 & 4 << 1 == 3)
+	assert(math.tointeger(3.0) == 3 and math.tointeger(3.5) == nil and math.floor(-3.5) == -4)
+	assert(math.type(math.floor(3.7)) == "integer" and math.type(#"abc") == "integer")
+	assert(math.max(1, 2.5, 2) == 2.5 and math.type(math.max(3, 2.5)) == "integer")
+	assert(tonumber("0x10") == 16 and math.type(tonumber("10")) == "integer" and tonumber("1e2") == 100)
+	assert(math.ult(1, -1) and tostring(-0x7fffffffffffffff - 1) == "-9223372036854775808")
+	assert(math.tointeger("8") == 8 and math.type(math.tointeger("8")) == "integer" and math.tointeger("x") == nil)
+	assert(math.fmod(-7, 3) == -1 and math.type(math.fmod(7, 3)) == "integer" and math.fmod(7.5, 2) == 1.5)
+	assert(math.fmod(math.mininteger, -1) == 0 and math.fmod(1, 0.0) ~= math.fmod(1, 0.0))
+	local ok, e = pcall(function() return math.fmod(1, 0) end)
+	assert(not ok and e:find("bad argument #2 to fmod %(zero%)"), e)
+	for _, v in ipairs({string.len("abc"), string.byte("a"), select("#", 1, 2), ("abc"):match("()b"), select(2, ("a"):gsub("a", ""))}) do
+		assert(math.type(v) == "integer")
+	end
+	local i, j, _, p = ("abc"):find("(b)()")
+	assert(math.type(i) == "integer" and math.type(j) == "integer" and p == 3 and math.type(p) == "integer")
+
+	local t = {}
+	t[1] = "a"
+	t[2.0] = "b"
+	assert(t[1.0] == "a" and t[2] == "b" and #t == 2)
+	for k in pairs(t) do assert(math.type(k) == "integer") end
+	for i, v in ipairs(t) do assert(math.type(i) == "integer") end
+
+	local n = 0
+	for i = math.maxinteger - 2, math.maxinteger do n = n + 1 end
+	assert(n == 3)
+	n = 0
+	for i = 1, 3.5 do n = n + i; assert(math.type(i) == "integer") end
+	assert(n == 6)
+	for i = 1, 0 do error("runs") end
+	for i = 3, 1, -1 do n = n + i end
+	assert(n == 12)
+	for i = 1, 2, 0.5 do n = n + 1 end
+	assert(n == 15)
+
+	assert(not pcall(function() return 1 // 0 end) and 1 // 0.0 == 1 / 0)
+	assert(not pcall(function() return 1 % 0 end))
+	assert(not pcall(function() return 1.5 | 0 end))
+	assert(not pcall(function() for i = 1, 10, 0 do end end))
+	local ok, e = pcall(function() return {} & 1 end)
+	assert(not ok and e:find("band"), e)
+	local mt = {__idiv = function() return "idiv" end, __bnot = function() return "bnot" end}
+	local v = setmetatable({}, mt)
+	assert(v // 1 == "idiv" and ~v == "bnot")
+	`)
+}
+
+func TestIntegerCodecs(t *testing.T) {
+	L := NewState(Options{Integers: true})
+	defer L.Close()
+	AJsonPreload(L)
+	ACborPreload(L)
+	errorIfScriptFail(t, L, `
+	local json, cbor = require("json"), require("cbor")
+	local v = json.decode('[1,2.5,9007199254740993,-3]')
+	assert(math.type(v[1]) == "integer" and v[3] == 9007199254740993 and v[4] == -3)
+	assert(json.encode(v) == '[1,2.5,9007199254740993,-3]', json.encode(v))
+	local c = cbor.decode(cbor.encode({n = math.maxinteger, m = math.mininteger, f = 0.5}))
+	assert(c.n == math.maxinteger and c.m == math.mininteger and math.type(c.f) == "float")
+	local sparse = cbor.decode(cbor.encode({[1] = "a", [10] = "b", [-3] = "c", [0.5] = "d"}))
+	assert(sparse[1] == "a" and sparse[10] == "b" and sparse[-3] == "c" and sparse[0.5] == "d")
+	for k in pairs(sparse) do assert(k == 0.5 or math.type(k) == "integer") end
+	`)
+}
+
+func TestIntegersDisabled(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	errorIfScriptFail(t, L, `assert(math.type == nil and math.floor(3.5) == 3 and 7 % 2 == 1)`)
+	for _, src := range []string{"return 7 // 2", "return ~1", "return 1 << 2", "return (1 & 2) + 1"} {
+		err := L.DoString(src)
+		errorIfFalse(t, err != nil && strings.Contains(err.Error(), "integer operators are not enabled"), "%v: %v", src, err)
+	}
+}
+
+func TestIntegersBytecode(t *testing.T) {
+	chunk, err := parse.Parse(strings.NewReader("return 1 << 62, 0.5"), "<test>")
+	errorIfNotNil(t, err)
+	proto, err := CompileIntegers(chunk, "<test>")
+	errorIfNotNil(t, err)
+	var buf bytes.Buffer
+	errorIfNotNil(t, DumpFunctionProto(&buf, proto))
+
+	loaded, err := UndumpFunctionProto(bytes.NewReader(buf.Bytes()))
+	errorIfNotNil(t, err)
+	errorIfFalse(t, loaded.Integers, "integers flag lost")
+
+	L := NewState()
+	defer L.Close()
+	_, err = L.Load(bytes.NewReader(buf.Bytes()), "<test>")
+	errorIfFalse(t, err != nil, "binary chunk with integers loaded")
+
+	L2 := NewState(Options{Integers: true})
+	defer L2.Close()
+	fn, err := L2.Load(bytes.NewReader(buf.Bytes()), "<test>")
+	errorIfNotNil(t, err)
+	L2.Push(fn)
+	L2.Call(0, 2)
+	errorIfNotEqual(t, LInteger(1<<62), L2.Get(1))
+	errorIfNotEqual(t, LNumber(0.5), L2.Get(2))
+}
@@ -99,6 +99,9 @@ func (lf *lFile) getWriter(L *LState) (wt mfs.FileDescriptor, err error ) {
 
 	}()
 
+	// a stream still reading the file would block the writer
+	L.closeJsonStreams(lf.vfp, "written")
+
 	fwt, e = lf.vfp.Open( mfs.Flags{Write:true, Sync:false} )
 
 	if e != nil {
@@ -202,7 +205,7 @@ func fileIsWritable(L *LState, file *lFile) int {
 
 	if !file.writable {
 		L.Push(LNil)
-		L.Push(LString(fmt.Sprintf("%s is opened for only reading.", file.Name())))
+		L.Push(L.NewErrorValue(NewAAppError(ErrCodePermission, fmt.Sprintf("%s is opened for only reading.", file.Name()), nil)))
 		L.Push(LNumber(1)) // C-Lua compatibility: Original Lua pushes errno to the stack
 		return 3
 	}
@@ -214,7 +217,7 @@ func fileIsReadable(L *LState, file *lFile) int {
 
 	if !file.readable {
 		L.Push(LNil)
-		L.Push(LString(fmt.Sprintf("%s is opened for only writing.", file.Name())))
+		L.Push(L.NewErrorValue(NewAAppError(ErrCodePermission, fmt.Sprintf("%s is opened for only writing.", file.Name()), nil)))
 		L.Push(LNumber(1)) // C-Lua compatibility: Original Lua pushes errno to the stack
 		return 3
 	}
@@ -287,7 +290,7 @@ func fileWriteAux(L *LState, file *lFile, idx int) int {
 
 	if werr != nil {
 		L.Push(LNil)
-		L.Push(LString(werr.Error()))
+		L.Push(L.NewErrorValue(werr))
 		L.Push(LNumber(1)) // C-Lua compatibility: Original Lua pushes errno to the stack
 		return 3
 	}
@@ -311,7 +314,7 @@ func fileWriteAux(L *LState, file *lFile, idx int) int {
 
 errreturn:
 	L.Push(LNil)
-	L.Push(LString(err.Error()))
+	L.Push(L.NewErrorValue(err))
 	L.Push(LNumber(1)) // C-Lua compatibility: Original Lua pushes errno to the stack
 	return 3
 }
@@ -319,6 +322,7 @@ errreturn:
 func fileCloseAux(L *LState, file *lFile) int {
 
 	file.closed = true;
+	L.closeJsonStreams(file.vfp, "closed")
 
 	L.Push(LTrue)
 
@@ -344,7 +348,7 @@ func fileReadAux(L *LState, file *lFile, idx int) int {
 	rdclose, err = file.getReader(L)
 	if err != nil {
 		L.Push(LNil)
-		L.RaiseError(err.Error())
+		L.RaiseAAppError(err)
 		return 2
 	}
 	defer func() {
@@ -356,9 +360,9 @@ func fileReadAux(L *LState, file *lFile, idx int) int {
 	buffrd := bufio.NewReaderSize(rdclose, lReadBufioSize)
 
 	for i := idx; i <= top; i++ {
-		switch lv := L.Get(i).(type) {
-		case LNumber:
-			size := int64(lv)
+		switch L.Get(i).(type) {
+		case LNumber, LInteger:
+			size := L.CheckInt64(i)
 			if size == 0 {
 				_, err = buffrd.ReadByte()
 				if err == io.EOF {
@@ -449,9 +453,9 @@ normalreturn:
 	return L.GetTop() - top
 
 errreturn:
-	L.RaiseError(err.Error())
+	L.RaiseAAppError(err)
 	//L.Push(LNil)
-	//L.Push(LString(err.Error()))
+	//L.Push(L.NewErrorValue(err))
 	return 2
 }
 
@@ -500,7 +504,7 @@ func fileSeek(L *LState) int {
 
 errreturn:
 	L.Push(LNil)
-	L.Push(LString(err.Error()))
+	L.Push(L.NewErrorValue(err))
 	return 2
 }
 
@@ -530,7 +534,7 @@ func fileLinesIter(L *LState) int {
 	}()
 
 	if err != nil {
-		L.RaiseError(err.Error())
+		L.RaiseAAppError(err)
 	}
 
 	bufrd := bufio.NewReaderSize(rd, lReadBufioSize)
@@ -545,7 +549,7 @@ func fileLinesIter(L *LState) int {
 			return 1
 		}
 
-		L.RaiseError(err.Error())
+		L.RaiseAAppError(err)
 	}
 
 	file.seek += int64(len(buf) + 1)
@@ -590,7 +594,7 @@ func ioInput(L *LState) int {
 	case LString:
 		file, err := newFile(L, nil, string(lv), os.O_RDONLY,false, true)
 		if err != nil {
-			L.RaiseError(err.Error())
+			L.RaiseAAppError(err)
 		}
 		L.Get(UpvalueIndex(1)).(*LTable).RawSetInt(fileDefInIndex, file)
 		L.Push(file)
@@ -634,7 +638,7 @@ func ioLinesIter(L *LState) int {
 	}()
 
 	if err != nil {
-		L.RaiseError(err.Error())
+		L.RaiseAAppError(err)
 	}
 
 	bufrd := bufio.NewReaderSize(rd, lReadBufioSize)
@@ -654,7 +658,7 @@ func ioLinesIter(L *LState) int {
 			return 1
 		}
 
-		L.RaiseError(err.Error())
+		L.RaiseAAppError(err)
 	}
 
 	file.seek += int64(len(buf) + 1)
@@ -695,7 +699,7 @@ func ioOpenFile(L *LState) int {
 	file, err := newFile(L, nil, path, mode, writable, readable)
 	if err != nil {
 		L.Push(LNil)
-		L.Push(LString(err.Error()))
+		L.Push(L.NewErrorValue(err))
 		L.Push(LNumber(1)) // C-Lua compatibility: Original Lua pushes errno to the stack
 		return 3
 	}
@@ -736,7 +740,7 @@ func ioOutput(L *LState) int {
 	case LString:
 		file, err := newFile(L, nil, string(lv), os.O_WRONLY|os.O_CREATE,true, false)
 		if err != nil {
-			L.RaiseError(err.Error())
+			L.RaiseAAppError(err)
 		}
 		L.Get(UpvalueIndex(1)).(*LTable).RawSetInt(fileDefOutIndex, file)
 		L.Push(file)
@@ -1,7 +1,6 @@
 package lua
 
 import (
-	"errors"
 	adb "github.com/ayachain/go-aya-alvm-adb"
 	"github.com/syndtr/goleveldb/leveldb"
 	adbIt "github.com/syndtr/goleveldb/leveldb/iterator"
@@ -10,10 +9,18 @@ import (
 )
 
 var (
-	errEncodeKeyError = errors.New("ADB : encode key expected")
-	errEncodeValueError = errors.New("ADB : encode value expected")
-	errDecodeKeyError = errors.New("ADB : decode key expected")
-	errDecodeValueError = errors.New("ADB : decode value expected")
+	errEncodeKeyError = NewAAppError(ErrCodeInvalid, "ADB : encode key expected", nil)
+	errEncodeValueError = NewAAppError(ErrCodeInvalid, "ADB : encode value expected", nil)
+	errDecodeKeyError = NewAAppError(ErrCodeInvalid, "ADB : decode key expected", nil)
+	errDecodeValueError = NewAAppError(ErrCodeInvalid, "ADB : decode value expected", nil)
+)
+
+// adbEncodingKey holds the encoding of the values of a database. It sorts
+// before the keys of scripts, which are JSON, and iterators start at
+// adbFirstKey after it.
+var (
+	adbEncodingKey = []byte("\x00encoding")
+	adbFirstKey = []byte{0x01}
 )
 
 var levelDBFuncs = map[string]LGFunction{
@@ -56,16 +63,46 @@ const lLevelIteratorClass = "abd.Iterator*"
 const lLevelDBBatchClass = "adb.Batch*"
 const lLevelDBClass = "adb*"
 
+// adbCodec encodes the values of a database, the keys are always JSON so
+// that the order of the keys does not depend on the encoding.
+type adbCodec struct {
+	encode func(L *LState, value LValue) ([]byte, error)
+	decode func(L *LState, data []byte) (LValue, error)
+}
+
+// adbCodecs are the value encodings of adb.open, which fails on a database
+// that was written with another one.
+var adbCodecs = map[string]*adbCodec{
+	"json"	: {
+		encode	: func(L *LState, value LValue) ([]byte, error) { return EncodeWith(value, L.Options.Json) },
+		decode	: func(L *LState, data []byte) (LValue, error) { return L.Decode(data) },
+	},
+	"cbor"	: {
+		encode	: func(L *LState, value LValue) ([]byte, error) { return EncodeCBOR(value) },
+		decode	: func(L *LState, data []byte) (LValue, error) { return L.DecodeCBOR(data) },
+	},
+}
+
+type adbDB struct {
+	*leveldb.DB
+	codec *adbCodec
+}
+
 type adbBatch struct {
 	*leveldb.Batch
-	parent *leveldb.DB
+	parent *adbDB
 }
 
-func checkIterator(L *LState) adbIt.Iterator {
+type adbIterator struct {
+	adbIt.Iterator
+	codec *adbCodec
+}
+
+func checkIterator(L *LState) *adbIterator {
 
 	ud := L.CheckUserData(1)
 
-	if it, ok := ud.Value.(adbIt.Iterator); ok {
+	if it, ok := ud.Value.(*adbIterator); ok {
 		return it
 	}
 
@@ -89,11 +126,11 @@ func checkBatch(L *LState) *adbBatch {
 
 }
 
-func checkLevelDB(L *LState) *leveldb.DB {
+func checkLevelDB(L *LState) *adbDB {
 
 	ud := L.CheckUserData(1)
 
-	if db, ok := ud.Value.(*leveldb.DB); ok {
+	if db, ok := ud.Value.(*adbDB); ok {
 		return db
 	}
 
@@ -158,11 +195,27 @@ func ldbBatch(L *LState) int {
 	return 1
 }
 
-// if path is exist open, if not created dir
+// adb.open(path [, options]) opens the database at path, or creates it.
+// The option encoding selects the encoding of the values, "json" or "cbor",
+// it defaults to Options.AdbEncoding.
 func dbOpenFile(L *LState) int {
 
 	path := L.CheckString(1)
 
+	encoding := L.Options.AdbEncoding
+	if opts := L.OptTable(2, nil); opts != nil {
+		if lv := opts.RawGetString("encoding"); lv != LNil {
+			encoding = lv.String()
+		}
+	}
+	if len(encoding) == 0 {
+		encoding = "json"
+	}
+	codec, ok := adbCodecs[encoding]
+	if !ok {
+		L.ArgError(2, "invalid encoding '" + encoding + "'")
+	}
+
 	if !strings.HasPrefix(path, "/") {
 		path = "/Data/" + path
 	} else {
@@ -173,14 +226,14 @@ func dbOpenFile(L *LState) int {
 	if err != nil {
 
 		if err := L.MFS_Mkdir(path, true); err != nil {
-			L.RaiseError("%v", err.Error())
+			L.RaiseAAppError(err)
 			L.Push(LNil)
 			return 1
 		} else {
 
 			dir, err = L.MFS_LookupDir(path)
 			if err != nil {
-				L.RaiseError("%v", err.Error())
+				L.RaiseAAppError(err)
 				L.Push(LNil)
 				return 1
 			}
@@ -193,14 +246,21 @@ func dbOpenFile(L *LState) int {
 
 	db, err := leveldb.Open( mstorage, nil )
 	if err != nil {
-		L.RaiseError("%v", err.Error())
+		L.RaiseAAppError(err)
+		L.Push(LNil)
+		return 1
+	}
+
+	if err := adbCheckEncoding(db, path, encoding); err != nil {
+		db.Close()
+		L.RaiseAAppError(err)
 		L.Push(LNil)
 		return 1
 	}
 
 	ud := L.NewUserData()
 
-	ud.Value = db
+	ud.Value = &adbDB{db, codec}
 
 	L.SetMetatable(ud, L.GetTypeMetatable(lLevelDBClass))
 
@@ -209,6 +269,33 @@ func dbOpenFile(L *LState) int {
 	return 1
 }
 
+// adbCheckEncoding stores the encoding of a new database and fails if the
+// database was written with another one. Databases that were written before
+// the encoding was stored are JSON.
+func adbCheckEncoding(db *leveldb.DB, path, encoding string) error {
+
+	stored, err := db.Get(adbEncodingKey, nil)
+	if err == leveldb.ErrNotFound {
+
+		it := db.NewIterator(nil, nil)
+		empty := !it.First()
+		it.Release()
+
+		if empty || encoding == "json" {
+			return db.Put(adbEncodingKey, []byte(encoding), nil)
+		}
+		stored, err = []byte("json"), nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if string(stored) != encoding {
+		return NewAAppError(ErrCodeInvalid, "ADB : " + path + " is encoded in " + string(stored) + ", not " + encoding, nil)
+	}
+	return nil
+}
+
 func ldbGet(L *LState) int {
 
 	switch L.GetTop() {
@@ -230,19 +317,19 @@ func ldbGet(L *LState) int {
 	lvkey := L.Get(2)
 	key, err := Encode(lvkey)
 	if err != nil {
-		L.RaiseError("%v", errEncodeKeyError)
+		L.RaiseAAppError(errEncodeKeyError)
 		L.Push(LNil)
 		return 1
 	}
 
 	if v, err := db.Get(key,nil); err != nil {
-		L.RaiseError("%v", err.Error())
+		L.RaiseAAppError(err)
 		L.Push(LNil)
 	} else {
 
-		lv, err := L.Decode(v)
+		lv, err := db.codec.decode(L, v)
 		if err != nil {
-			L.RaiseError("%v", err.Error())
+			L.RaiseAAppError(err)
 			L.Push(LNil)
 		} else {
 			L.Push(lv)
@@ -275,20 +362,20 @@ func ldbPut(L *LState) int {
 
 	key, err := Encode(lvkey)
 	if err != nil {
-		L.RaiseError("%v", errEncodeKeyError)
+		L.RaiseAAppError(errEncodeKeyError)
 		L.Push(LFalse)
 		return 1
 	}
 
-	value, err := Encode(lvvalue)
+	value, err := db.codec.encode(L, lvvalue)
 	if err != nil {
-		L.RaiseError("%v", errEncodeValueError)
+		L.RaiseAAppError(errEncodeValueError)
 		L.Push(LFalse)
 		return 1
 	}
 
 	if err := db.Put(key, value, nil); err != nil {
-		L.RaiseError("%v", err.Error())
+		L.RaiseAAppError(err)
 		L.Push(LFalse)
 		return 1
 	}
@@ -318,13 +405,13 @@ func ldbDelete(L *LState) int {
 	lvkey := L.Get(2)
 	key, err := Encode(lvkey)
 	if err != nil {
-		L.RaiseError("%v", errEncodeKeyError)
+		L.RaiseAAppError(errEncodeKeyError)
 		L.Push(LNil)
 		return 1
 	}
 
 	if err := db.Delete(key,nil); err != nil {
-		L.RaiseError("%v", err.Error())
+		L.RaiseAAppError(err)
 		L.Push(LFalse)
 	} else {
 		L.Push(LTrue)
@@ -354,14 +441,14 @@ func ldbHas(L *LState) int {
 	lvkey := L.Get(2)
 	key, err := Encode(lvkey)
 	if err != nil {
-		L.RaiseError("%v", errEncodeKeyError)
+		L.RaiseAAppError(errEncodeKeyError)
 		L.Push(LNil)
 		return 1
 	}
 
 	exist, err := db.Has(key,nil)
 	if err != nil {
-		L.RaiseError("%v", err.Error())
+		L.RaiseAAppError(err)
 		L.Push(LFalse)
 	} else {
 		L.Push(LBool(exist))
@@ -400,7 +487,7 @@ func ldbWrite(L *LState) int {
 	}
 
 	if err := db.Write( batch.Batch, nil ); err != nil {
-		L.RaiseError("%v", err.Error())
+		L.RaiseAAppError(err)
 		L.Push(LFalse)
 	} else {
 		L.Push(LTrue)
@@ -432,14 +519,14 @@ func ldbBatchPut(L *LState) int {
 
 	key, err := Encode(lvkey)
 	if err != nil {
-		L.RaiseError("%v", errEncodeKeyError)
+		L.RaiseAAppError(errEncodeKeyError)
 		L.Push(LFalse)
 		return 1
 	}
 
-	value, err := Encode(lvvalue)
+	value, err := batch.parent.codec.encode(L, lvvalue)
 	if err != nil {
-		L.RaiseError("%v", errEncodeValueError)
+		L.RaiseAAppError(errEncodeValueError)
 		L.Push(LFalse)
 		return 1
 	}
@@ -472,7 +559,7 @@ func ldbBatchDel(L *LState) int {
 	lvkey := L.Get(2)
 	key, err := Encode(lvkey)
 	if err != nil {
-		L.RaiseError("%v", errEncodeKeyError)
+		L.RaiseAAppError(errEncodeKeyError)
 		L.Push(LNil)
 		return 1
 	}
@@ -519,13 +606,13 @@ func ldbBatchWrite(L *LState) int {
 	}
 
 	if batch.parent == nil {
-		L.RaiseError("%v", "ADB Batch Write : parent ADB is null")
+		L.RaiseAAppError(NewAAppError(ErrCodeClosed, "ADB Batch Write : parent ADB is null", nil))
 		L.Push(LFalse)
 		return 1
 	}
 
 	if err := batch.parent.Write(batch.Batch, nil); err != nil {
-		L.RaiseError("%v", err.Error())
+		L.RaiseAAppError(err)
 		L.Push(LFalse)
 		return 1
 	}
@@ -565,7 +652,7 @@ func ldbIterator(L *LState) int {
 	if st.Type() != LTNil {
 
 		if sbs, converr = Encode(st); converr != nil {
-			L.RaiseError("%v", errEncodeKeyError)
+			L.RaiseAAppError(errEncodeKeyError)
 			L.Push(LNil)
 			return 1
 		}
@@ -575,18 +662,22 @@ func ldbIterator(L *LState) int {
 	if ed.Type() != LTNil {
 
 		if ebs, converr = Encode(ed); converr != nil {
-			L.RaiseError("%v", errEncodeKeyError)
+			L.RaiseAAppError(errEncodeKeyError)
 			L.Push(LNil)
 			return 1
 		}
 
 	}
 
+	if sbs == nil {
+		sbs = adbFirstKey
+	}
+
 	rg := &util.Range{Start: sbs, Limit: ebs}
 	it := db.NewIterator( rg, nil )
 
 	ud := L.NewUserData()
-	ud.Value = it
+	ud.Value = &adbIterator{it, db.codec}
 
 	L.SetMetatable(ud, L.GetTypeMetatable(lLevelIteratorClass))
 	L.Push(ud)
@@ -653,7 +744,7 @@ func itSeek(L *LState) int {
 	keybs, err := Encode(key)
 
 	if err != nil {
-		L.RaiseError("%v", errEncodeKeyError)
+		L.RaiseAAppError(errEncodeKeyError)
 	}
 
 	L.Push(LBool(it.Seek(keybs)))
@@ -698,7 +789,7 @@ func itKey(L *LState) int {
 
 	lv, err := L.Decode(it.Key())
 	if err != nil {
-		L.RaiseError("%v", errDecodeKeyError)
+		L.RaiseAAppError(errDecodeKeyError)
 		L.Push(LNil)
 	} else {
 		L.Push(lv)
@@ -716,9 +807,9 @@ func itValue(L *LState) int {
 		return 1
 	}
 
-	lv, err := L.Decode(it.Value())
+	lv, err := it.codec.decode(L, it.Value())
 	if err != nil {
-		L.RaiseError("%v", errDecodeValueError)
+		L.RaiseAAppError(errDecodeValueError)
 		L.Push(LNil)
 	} else {
 		L.Push(lv)
@@ -21,6 +21,10 @@ const (
 	ChannelLibName = "channel"
 	// CoroutineLibName is the name of the coroutine Library.
 	CoroutineLibName = "coroutine"
+	// Utf8LibName is the name of the utf8 Library.
+	Utf8LibName = "utf8"
+	// ErrorLibName is the name of the error Library, which is also the error function.
+	ErrorLibName   = "error"
 	LevelDBLibName = "adb"
 )
 
@@ -32,10 +36,12 @@ type luaLib struct {
 var luaLibs = []luaLib{
 	{LoadLibName, OpenPackage},
 	{BaseLibName, OpenBase},
+	{ErrorLibName, OpenError},
 	{TabLibName, OpenTable},
 	{IoLibName, OpenIo},
 	{StringLibName, OpenString},
 	{MathLibName, OpenMath},
+	{Utf8LibName, OpenUtf8},
 	{LevelDBLibName, OpenLevelDB},
 	//luaLib{OsLibName, OpenOs},
 	//luaLib{DebugLibName, OpenDebug},
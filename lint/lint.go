@@ -0,0 +1,433 @@
+// Static checks for AApp scripts.
+package lint
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/ayachain/go-aya-alvm"
+	"github.com/ayachain/go-aya-alvm/ast"
+	"github.com/ayachain/go-aya-alvm/parse"
+)
+
+// Diagnostic codes.
+const (
+	// CodeUndefinedGlobal reports a global that is read but neither predefined
+	// nor assigned anywhere in the script.
+	CodeUndefinedGlobal = "undefined-global"
+	// CodeDisabled reports a library or function that is not available to
+	// AApp scripts.
+	CodeDisabled = "disabled"
+	// CodeDynamicAdbPath reports an adb.open call whose path is not a constant.
+	CodeDynamicAdbPath = "dynamic-adb-path"
+	// CodeUnreachable reports a statement that can never run.
+	CodeUnreachable = "unreachable-code"
+	// CodeShadowedLocal reports a local that hides another local of the same
+	// name.
+	CodeShadowedLocal = "shadowed-local"
+)
+
+// Diagnostic is a problem found in a script, Code is one of the Code
+// constants.
+type Diagnostic struct {
+	Source  string
+	Line    int
+	Code    string
+	Message string
+}
+
+func (d *Diagnostic) String() string {
+	return fmt.Sprintf("%v:%v: %v (%v)", d.Source, d.Line, d.Message, d.Code)
+}
+
+// Linter checks scripts against the globals of an AApp state.
+type Linter struct {
+	// Globals are the names defined before a script runs.
+	Globals map[string]bool
+	// Disabled are the Lua names that do not exist or always raise an error
+	// in an AApp state. They take precedence over Globals.
+	Disabled map[string]bool
+}
+
+// New returns a Linter for the libraries opened by lua.NewState.
+func New() *Linter {
+	lt := &Linter{
+		Globals: make(map[string]bool),
+		Disabled: map[string]bool{
+			lua.OsLibName:        true,
+			lua.DebugLibName:     true,
+			lua.CoroutineLibName: true,
+			lua.ChannelLibName:   true,
+			// both raise "loadstring is not supported in alvm aapp."
+			"load":       true,
+			"loadstring": true,
+		},
+	}
+	L := lua.NewState()
+	defer L.Close()
+	L.G.Global.ForEach(func(key, _ lua.LValue) {
+		if name, ok := key.(lua.LString); ok {
+			lt.Globals[string(name)] = true
+		}
+	})
+	return lt
+}
+
+// Lint parses the script read from reader and checks it with the default
+// Linter. Syntax errors are returned as *parse.Error.
+func Lint(reader io.Reader, source string) ([]Diagnostic, error) {
+	return New().CheckFile(reader, source)
+}
+
+// CheckFile parses the script read from reader and checks it.
+func (lt *Linter) CheckFile(reader io.Reader, source string) ([]Diagnostic, error) {
+	chunk, err := parse.Parse(reader, source)
+	if err != nil {
+		return nil, err
+	}
+	return lt.Check(chunk, source), nil
+}
+
+// Check returns the diagnostics of a parsed script ordered by line.
+func (lt *Linter) Check(chunk []ast.Stmt, source string) []Diagnostic {
+	c := &checker{
+		linter:  lt,
+		source:  source,
+		scope:   newScope(nil),
+		written: make(map[string]bool),
+	}
+	c.block(chunk)
+	for _, ref := range c.reads {
+		switch {
+		case c.written[ref.name]:
+		case lt.Disabled[ref.name]:
+			c.report(ref.line, CodeDisabled, "%v is not available in AApp scripts", ref.name)
+		case !lt.Globals[ref.name]:
+			c.report(ref.line, CodeUndefinedGlobal, "undefined global %v", ref.name)
+		}
+	}
+	sort.SliceStable(c.diags, func(i, j int) bool { return c.diags[i].Line < c.diags[j].Line })
+	return c.diags
+}
+
+/* checker {{{ */
+
+type scope struct {
+	parent *scope
+	// names maps the locals declared in the block to their line.
+	names map[string]int
+}
+
+func newScope(parent *scope) *scope {
+	return &scope{parent: parent, names: make(map[string]int)}
+}
+
+func (sc *scope) lookup(name string) (int, bool) {
+	for ; sc != nil; sc = sc.parent {
+		if line, ok := sc.names[name]; ok {
+			return line, true
+		}
+	}
+	return 0, false
+}
+
+type globalRef struct {
+	name string
+	line int
+}
+
+type checker struct {
+	linter  *Linter
+	source  string
+	scope   *scope
+	reads   []globalRef
+	written map[string]bool
+	diags   []Diagnostic
+}
+
+func (c *checker) report(line int, code string, format string, args ...interface{}) {
+	c.diags = append(c.diags, Diagnostic{
+		Source:  c.source,
+		Line:    line,
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func (c *checker) enter() { c.scope = newScope(c.scope) }
+
+func (c *checker) leave() { c.scope = c.scope.parent }
+
+func (c *checker) declare(name string, line int) {
+	if name == "_" {
+		return
+	}
+	if prev, ok := c.scope.lookup(name); ok {
+		c.report(line, CodeShadowedLocal, "local %v shadows the local declared at line %v", name, prev)
+	}
+	c.scope.names[name] = line
+}
+
+func (c *checker) isLocal(name string) bool {
+	_, ok := c.scope.lookup(name)
+	return ok
+}
+
+func (c *checker) block(stmts []ast.Stmt) {
+	dead, reported := false, false
+	for _, stmt := range stmts {
+		if dead && !reported {
+			c.report(stmt.Line(), CodeUnreachable, "unreachable code")
+			reported = true
+		}
+		c.stmt(stmt)
+		if c.terminates(stmt) {
+			dead = true
+		}
+	}
+}
+
+func (c *checker) stmt(stmt ast.Stmt) {
+	switch st := stmt.(type) {
+	case *ast.AssignStmt:
+		c.exprs(st.Rhs)
+		for _, lhs := range st.Lhs {
+			c.assign(lhs)
+		}
+	case *ast.LocalAssignStmt:
+		if st.Function {
+			// local function f: f is visible in its own body, unlike in
+			// local f = function() ... end.
+			c.declare(st.Names[0], st.Line())
+			c.function(st.Exprs[0].(*ast.FunctionExpr), false)
+			return
+		}
+		c.exprs(st.Exprs)
+		for _, name := range st.Names {
+			c.declare(name, st.Line())
+		}
+	case *ast.FuncCallStmt:
+		c.expr(st.Expr)
+	case *ast.DoBlockStmt:
+		c.enter()
+		c.block(st.Stmts)
+		c.leave()
+	case *ast.WhileStmt:
+		c.expr(st.Condition)
+		c.enter()
+		c.block(st.Stmts)
+		c.leave()
+	case *ast.RepeatStmt:
+		// the condition sees the locals of the body.
+		c.enter()
+		c.block(st.Stmts)
+		c.expr(st.Condition)
+		c.leave()
+	case *ast.IfStmt:
+		c.expr(st.Condition)
+		c.enter()
+		c.block(st.Then)
+		c.leave()
+		c.enter()
+		c.block(st.Else)
+		c.leave()
+	case *ast.NumberForStmt:
+		c.expr(st.Init)
+		c.expr(st.Limit)
+		if st.Step != nil {
+			c.expr(st.Step)
+		}
+		c.enter()
+		c.declare(st.Name, st.Line())
+		c.block(st.Stmts)
+		c.leave()
+	case *ast.GenericForStmt:
+		c.exprs(st.Exprs)
+		c.enter()
+		for _, name := range st.Names {
+			c.declare(name, st.Line())
+		}
+		c.block(st.Stmts)
+		c.leave()
+	case *ast.FuncDefStmt:
+		if st.Name.Func == nil {
+			c.expr(st.Name.Receiver)
+			c.function(st.Func, true)
+		} else {
+			c.assign(st.Name.Func)
+			c.function(st.Func, false)
+		}
+	case *ast.ReturnStmt:
+		c.exprs(st.Exprs)
+	case *ast.BreakStmt:
+	}
+}
+
+func (c *checker) assign(lhs ast.Expr) {
+	if ident, ok := lhs.(*ast.IdentExpr); ok {
+		if !c.isLocal(ident.Value) {
+			c.written[ident.Value] = true
+		}
+		return
+	}
+	c.expr(lhs)
+}
+
+func (c *checker) function(fn *ast.FunctionExpr, method bool) {
+	c.enter()
+	if method {
+		c.scope.names["self"] = fn.Line()
+	}
+	for _, name := range fn.ParList.Names {
+		c.declare(name, fn.Line())
+	}
+	c.block(fn.Stmts)
+	c.leave()
+}
+
+func (c *checker) exprs(exprs []ast.Expr) {
+	for _, expr := range exprs {
+		c.expr(expr)
+	}
+}
+
+func (c *checker) expr(expr ast.Expr) {
+	switch ex := expr.(type) {
+	case *ast.IdentExpr:
+		if !c.isLocal(ex.Value) {
+			c.reads = append(c.reads, globalRef{ex.Value, ex.Line()})
+		}
+	case *ast.AttrGetExpr:
+		c.expr(ex.Object)
+		c.expr(ex.Key)
+	case *ast.TableExpr:
+		for _, field := range ex.Fields {
+			if field.Key != nil {
+				c.expr(field.Key)
+			}
+			c.expr(field.Value)
+		}
+	case *ast.FuncCallExpr:
+		if ex.Func != nil {
+			c.expr(ex.Func)
+			c.checkAdbOpen(ex)
+		} else {
+			c.expr(ex.Receiver)
+		}
+		c.exprs(ex.Args)
+	case *ast.LogicalOpExpr:
+		c.expr(ex.Lhs)
+		c.expr(ex.Rhs)
+	case *ast.RelationalOpExpr:
+		c.expr(ex.Lhs)
+		c.expr(ex.Rhs)
+	case *ast.StringConcatOpExpr:
+		c.expr(ex.Lhs)
+		c.expr(ex.Rhs)
+	case *ast.ArithmeticOpExpr:
+		c.expr(ex.Lhs)
+		c.expr(ex.Rhs)
+	case *ast.UnaryMinusOpExpr:
+		c.expr(ex.Expr)
+	case *ast.UnaryNotOpExpr:
+		c.expr(ex.Expr)
+	case *ast.UnaryLenOpExpr:
+		c.expr(ex.Expr)
+	case *ast.UnaryBNotOpExpr:
+		c.expr(ex.Expr)
+	case *ast.FunctionExpr:
+		c.function(ex, false)
+	}
+}
+
+/* }}} */
+
+/* rules {{{ */
+
+// checkAdbOpen reports adb.open calls whose path is only known at run time.
+// Databases live under /Data of the AApp MFS, so their paths should be
+// visible in the script.
+func (c *checker) checkAdbOpen(call *ast.FuncCallExpr) {
+	get, ok := call.Func.(*ast.AttrGetExpr)
+	if !ok {
+		return
+	}
+	obj, ok := get.Object.(*ast.IdentExpr)
+	if !ok || obj.Value != lua.LevelDBLibName || c.isLocal(obj.Value) {
+		return
+	}
+	if key, ok := get.Key.(*ast.StringExpr); !ok || key.Value != "open" {
+		return
+	}
+	if len(call.Args) == 0 || !isConstString(call.Args[0]) {
+		c.report(call.Line(), CodeDynamicAdbPath, "adb.open path is not a constant string")
+	}
+}
+
+func isConstString(expr ast.Expr) bool {
+	switch ex := expr.(type) {
+	case *ast.StringExpr:
+		return true
+	case *ast.StringConcatOpExpr:
+		return isConstString(ex.Lhs) && isConstString(ex.Rhs)
+	}
+	return false
+}
+
+// terminates reports whether control never reaches the statement following
+// stmt in the same block.
+func (c *checker) terminates(stmt ast.Stmt) bool {
+	switch st := stmt.(type) {
+	case *ast.ReturnStmt, *ast.BreakStmt:
+		return true
+	case *ast.DoBlockStmt:
+		return c.blockTerminates(st.Stmts)
+	case *ast.IfStmt:
+		return len(st.Else) > 0 && c.blockTerminates(st.Then) && c.blockTerminates(st.Else)
+	case *ast.FuncCallStmt:
+		call, ok := st.Expr.(*ast.FuncCallExpr)
+		if !ok || call.Func == nil {
+			return false
+		}
+		ident, ok := call.Func.(*ast.IdentExpr)
+		return ok && ident.Value == "error" && !c.isLocal("error") && !c.written["error"]
+	case *ast.WhileStmt:
+		_, ok := st.Condition.(*ast.TrueExpr)
+		return ok && !hasBreak(st.Stmts)
+	case *ast.RepeatStmt:
+		_, ok := st.Condition.(*ast.FalseExpr)
+		return ok && !hasBreak(st.Stmts)
+	}
+	return false
+}
+
+func (c *checker) blockTerminates(stmts []ast.Stmt) bool {
+	for _, stmt := range stmts {
+		if c.terminates(stmt) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasBreak reports whether stmts break out of the loop they belong to.
+func hasBreak(stmts []ast.Stmt) bool {
+	for _, stmt := range stmts {
+		switch st := stmt.(type) {
+		case *ast.BreakStmt:
+			return true
+		case *ast.DoBlockStmt:
+			if hasBreak(st.Stmts) {
+				return true
+			}
+		case *ast.IfStmt:
+			if hasBreak(st.Then) || hasBreak(st.Else) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/* }}} */
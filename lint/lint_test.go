@@ -0,0 +1,53 @@
+package lint
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestLint(t *testing.T) {
+	src := `
+local db = adb.open("/state")
+local path = "/x"
+local other = adb.open(path)
+counter = 0
+function Inc(n)
+  local path = n
+  counter = counter + helper(n)
+  if n then return 1 else error("nil") end
+  print("dead")
+end
+while true do
+  if counter > 1 then break end
+end
+print(os.time(), loadstring)
+do local _ = 1; local _ = 2 end
+local function fact(n) return n < 2 and 1 or n * fact(n - 1) end
+local loop = function() return loop() end
+`
+	expected := []string{
+		"<test>:4: dynamic-adb-path",
+		"<test>:7: shadowed-local",
+		"<test>:8: undefined-global",
+		"<test>:10: unreachable-code",
+		"<test>:15: disabled",
+		"<test>:15: disabled",
+		"<test>:18: undefined-global",
+	}
+	diags, err := Lint(strings.NewReader(src), "<test>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, d := range diags {
+		got = append(got, fmt.Sprintf("%v:%v: %v", d.Source, d.Line, d.Code))
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected diagnostics:\n%v", strings.Join(got, "\n"))
+	}
+
+	if _, err := Lint(strings.NewReader("local = 1"), "<test>"); err == nil {
+		t.Error("syntax error expected")
+	}
+}
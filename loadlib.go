@@ -123,11 +123,12 @@ func loLoaderMFS(L *LState) int {
 	messages := []string{}
 
 	luafi := &mfs.File{}
+	var luapath string
 	var findError error
 
 	for _, pattern := range strings.Split(string(searchPath), ";") {
 
-		luapath := strings.Replace(pattern, "?", name, -1)
+		luapath = strings.Replace(pattern, "?", name, -1)
 
 		if luafi, findError = L.MFS_LookupFile(luapath); findError == nil {
 			break
@@ -142,13 +143,8 @@ func loLoaderMFS(L *LState) int {
 		return 1
 	}
 
-	frd, err := luafi.Open(mfs.Flags{Read:true})
-	if err != nil {
-		L.Push(LString(err.Error()))
-		return 1
-	}
-
-	fn, err1 := L.Load(frd, name)
+	// chunks are named by their path, so debuggers can find the source
+	fn, err1 := L.loadScriptFile(luafi, luapath)
 	if err1 != nil {
 		L.RaiseError(err1.Error())
 	}
@@ -0,0 +1,224 @@
+package luatest
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ayachain/go-aya-alvm"
+)
+
+// OpenAssert replaces the global assert with a table of assertion helpers,
+// which can still be called like the builtin assert.
+//
+//	assert.equal(actual, expected [, message])  tables are compared deeply
+//	assert.not_equal(actual, expected [, message])
+//	assert.is_true(v [, message]), assert.is_false(v [, message])
+//	assert.is_nil(v [, message]), assert.not_nil(v [, message])
+//	assert.error(fn [, substring [, message]])  fn must raise an error
+//	assert.fail([message])
+func OpenAssert(L *lua.LState) {
+	builtin := L.GetGlobal("assert")
+	mod := L.SetFuncs(L.NewTable(), assertFuncs)
+	mt := L.NewTable()
+	mt.RawSetString("__call", L.NewFunction(func(L *lua.LState) int {
+		// drop the assert table itself
+		L.Remove(1)
+		L.Insert(builtin, 1)
+		L.Call(L.GetTop()-1, lua.MultRet)
+		return L.GetTop()
+	}))
+	L.SetMetatable(mod, mt)
+	L.SetGlobal("assert", mod)
+}
+
+var assertFuncs = map[string]lua.LGFunction{
+	"equal":     assertEqual,
+	"not_equal": assertNotEqual,
+	"is_true":   assertIsTrue,
+	"is_false":  assertIsFalse,
+	"is_nil":    assertIsNil,
+	"not_nil":   assertNotNil,
+	"error":     assertError,
+	"fail":      assertFail,
+}
+
+func failAssertion(L *lua.LState, msgIdx int, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if L.GetTop() >= msgIdx && L.Get(msgIdx) != lua.LNil {
+		msg = L.ToString(msgIdx) + ": " + msg
+	}
+	L.RaiseError("%s", msg)
+}
+
+func assertEqual(L *lua.LState) int {
+	actual, expected := L.Get(1), L.Get(2)
+	if d := deepEqual(actual, expected); d != nil {
+		if d.path != "" {
+			failAssertion(L, 3, "expected %v at %v, got %v", dump(d.b), d.path, dump(d.a))
+		}
+		failAssertion(L, 3, "expected %v, got %v", dump(expected), dump(actual))
+	}
+	return 0
+}
+
+func assertNotEqual(L *lua.LState) int {
+	actual, expected := L.Get(1), L.Get(2)
+	if deepEqual(actual, expected) == nil {
+		failAssertion(L, 3, "expected a value other than %v", dump(expected))
+	}
+	return 0
+}
+
+func assertIsTrue(L *lua.LState) int {
+	if L.Get(1) != lua.LTrue {
+		failAssertion(L, 2, "expected true, got %v", dump(L.Get(1)))
+	}
+	return 0
+}
+
+func assertIsFalse(L *lua.LState) int {
+	if L.Get(1) != lua.LFalse {
+		failAssertion(L, 2, "expected false, got %v", dump(L.Get(1)))
+	}
+	return 0
+}
+
+func assertIsNil(L *lua.LState) int {
+	if L.Get(1) != lua.LNil {
+		failAssertion(L, 2, "expected nil, got %v", dump(L.Get(1)))
+	}
+	return 0
+}
+
+func assertNotNil(L *lua.LState) int {
+	if L.Get(1) == lua.LNil {
+		failAssertion(L, 2, "expected a value, got nil")
+	}
+	return 0
+}
+
+func assertError(L *lua.LState) int {
+	fn := L.CheckFunction(1)
+	substr := L.OptString(2, "")
+	L.Push(fn)
+	err := L.PCall(0, 0, nil)
+	if err == nil {
+		failAssertion(L, 3, "expected an error")
+	}
+	msg := err.Error()
+	if apiErr, ok := err.(*lua.ApiError); ok {
+		msg = L.ToStringMeta(apiErr.Object).String()
+	}
+	if !strings.Contains(msg, substr) {
+		failAssertion(L, 3, "expected an error containing %q, got %q", substr, msg)
+	}
+	L.Push(lua.LString(msg))
+	return 1
+}
+
+func assertFail(L *lua.LState) int {
+	L.RaiseError("%s", L.OptString(1, "failed"))
+	return 0
+}
+
+/* deep equality {{{ */
+
+type tablePair struct {
+	a, b *lua.LTable
+}
+
+// difference is where two values differ, path is empty for the values
+// themselves.
+type difference struct {
+	path string
+	a, b lua.LValue
+}
+
+// deepEqual compares tables by their fields and other values like ==. It
+// returns the first difference found or nil.
+func deepEqual(a, b lua.LValue) *difference {
+	return deepEqualSeen(a, b, "", make(map[tablePair]bool))
+}
+
+func deepEqualSeen(a, b lua.LValue, path string, seen map[tablePair]bool) *difference {
+	ta, aok := a.(*lua.LTable)
+	tb, bok := b.(*lua.LTable)
+	if !aok || !bok {
+		if a == b {
+			return nil
+		}
+		return &difference{path, a, b}
+	}
+	if ta == tb || seen[tablePair{ta, tb}] {
+		return nil
+	}
+	seen[tablePair{ta, tb}] = true
+
+	var diff *difference
+	ta.ForEach(func(key, value lua.LValue) {
+		if diff == nil {
+			diff = deepEqualSeen(value, tb.RawGet(key), path+keyPath(key), seen)
+		}
+	})
+	tb.ForEach(func(key, value lua.LValue) {
+		if diff == nil && ta.RawGet(key) == lua.LNil {
+			diff = &difference{path + keyPath(key), lua.LNil, value}
+		}
+	})
+	return diff
+}
+
+func keyPath(key lua.LValue) string {
+	if str, ok := key.(lua.LString); ok && isIdentifier(string(str)) {
+		return "." + string(str)
+	}
+	return "[" + dump(key) + "]"
+}
+
+func isIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+/* }}} */
+
+// dump formats a value for assertion messages, tables with their fields.
+func dump(lv lua.LValue) string {
+	return dumpSeen(lv, make(map[*lua.LTable]bool))
+}
+
+func dumpSeen(lv lua.LValue, seen map[*lua.LTable]bool) string {
+	switch v := lv.(type) {
+	case lua.LString:
+		return fmt.Sprintf("%q", string(v))
+	case *lua.LTable:
+		if seen[v] {
+			return "<cycle>"
+		}
+		seen[v] = true
+		defer delete(seen, v)
+		var fields []string
+		n := v.Len()
+		for i := 1; i <= n; i++ {
+			fields = append(fields, dumpSeen(v.RawGetInt(i), seen))
+		}
+		var named []string
+		v.ForEach(func(key, value lua.LValue) {
+			if num, ok := key.(lua.LNumber); ok && float64(num) == float64(int(num)) && int(num) >= 1 && int(num) <= n {
+				return
+			}
+			named = append(named, strings.TrimPrefix(keyPath(key), ".")+" = "+dumpSeen(value, seen))
+		})
+		sort.Strings(named)
+		return "{" + strings.Join(append(fields, named...), ", ") + "}"
+	}
+	return lv.String()
+}
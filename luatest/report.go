@@ -0,0 +1,137 @@
+package luatest
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+/* TAP {{{ */
+
+type tapReporter struct {
+	w io.Writer
+	n int
+}
+
+// NewTAPReporter returns a Reporter that writes the Test Anything Protocol
+// version 13 as the tests finish, with the plan at the end. The duration and
+// the error of a test are written as a YAML block.
+func NewTAPReporter(w io.Writer) Reporter {
+	fmt.Fprintln(w, "TAP version 13")
+	return &tapReporter{w: w}
+}
+
+func (tr *tapReporter) Report(r *Result) {
+	tr.n++
+	status := "ok"
+	if r.Err != nil {
+		status = "not ok"
+	}
+	desc := r.File
+	if len(r.Name) > 0 {
+		desc += ": " + r.Name
+	}
+	fmt.Fprintf(tr.w, "%v %v - %v\n", status, tr.n, desc)
+	fmt.Fprintln(tr.w, "  ---")
+	fmt.Fprintf(tr.w, "  duration_ms: %.3f\n", float64(r.Duration)/float64(time.Millisecond))
+	if r.Err != nil {
+		fmt.Fprintln(tr.w, "  message: |")
+		for _, line := range strings.Split(strings.TrimRight(r.Err.Error(), "\n"), "\n") {
+			fmt.Fprintf(tr.w, "    %v\n", line)
+		}
+	}
+	fmt.Fprintln(tr.w, "  ...")
+}
+
+func (tr *tapReporter) Close() error {
+	_, err := fmt.Fprintf(tr.w, "1..%v\n", tr.n)
+	return err
+}
+
+/* }}} */
+
+/* JUnit {{{ */
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+type junitCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitSuite struct {
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Time     string      `xml:"time,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitSuites struct {
+	XMLName  xml.Name      `xml:"testsuites"`
+	Tests    int           `xml:"tests,attr"`
+	Failures int           `xml:"failures,attr"`
+	Suites   []*junitSuite `xml:"testsuite"`
+}
+
+type junitReporter struct {
+	w      io.Writer
+	suites junitSuites
+}
+
+// NewJUnitReporter returns a Reporter that writes JUnit XML when it is
+// closed, with a testsuite per test file.
+func NewJUnitReporter(w io.Writer) Reporter {
+	return &junitReporter{w: w}
+}
+
+func seconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+func (jr *junitReporter) Report(r *Result) {
+	var suite *junitSuite
+	if n := len(jr.suites.Suites); n > 0 && jr.suites.Suites[n-1].Name == r.File {
+		suite = jr.suites.Suites[n-1]
+	} else {
+		suite = &junitSuite{Name: r.File}
+		jr.suites.Suites = append(jr.suites.Suites, suite)
+	}
+	tc := junitCase{ClassName: r.File, Name: r.Name, Time: seconds(r.Duration)}
+	if len(tc.Name) == 0 {
+		tc.Name = "(load)"
+	}
+	if r.Err != nil {
+		msg := r.Err.Error()
+		tc.Failure = &junitFailure{Message: strings.SplitN(msg, "\n", 2)[0], Text: msg}
+		suite.Failures++
+		jr.suites.Failures++
+	}
+	suite.Cases = append(suite.Cases, tc)
+	suite.Tests++
+	jr.suites.Tests++
+	total, _ := time.ParseDuration(suite.Time + "s")
+	suite.Time = seconds(total + r.Duration)
+}
+
+func (jr *junitReporter) Close() error {
+	if _, err := io.WriteString(jr.w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(jr.w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(&jr.suites); err != nil {
+		return err
+	}
+	_, err := io.WriteString(jr.w, "\n")
+	return err
+}
+
+/* }}} */
@@ -0,0 +1,184 @@
+// Unit tests for AApp scripts.
+//
+// A test file is a Lua script named *_test.lua, its tests are the global
+// functions whose names start with "test", run in the order they are defined.
+// Every test runs in a fresh state on an MFS held in memory, seeded from a
+// fixture directory: the AApp /Script/aapp.lua of the fixture is run first,
+// like NewAVMState does, then the test file and then the test function.
+package luatest
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ayachain/go-aya-alvm"
+)
+
+// Result is the outcome of a test. A test file that can not be loaded is
+// reported as a failed test without a name.
+type Result struct {
+	File     string
+	Name     string
+	Duration time.Duration
+	// Err is nil if the test passed.
+	Err error
+}
+
+// Reporter receives the results of the tests as they finish.
+type Reporter interface {
+	Report(r *Result)
+	Close() error
+}
+
+type Runner struct {
+	// Fixture is a directory that is copied to the MFS root of every state.
+	Fixture string
+	// Match selects the tests to run by name, all tests run if it is nil.
+	Match *regexp.Regexp
+	// Options of the test states, e.g. with a Coverage shared by all tests.
+	Options lua.Options
+	// Reporter receives the results, it may be nil.
+	Reporter Reporter
+}
+
+// Files returns the test files of paths, directories are searched for
+// *_test.lua files.
+func Files(paths []string) ([]string, error) {
+	var files []string
+	for _, path := range paths {
+		err := filepath.Walk(path, func(name string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() && (name == path || strings.HasSuffix(name, "_test.lua")) {
+				files = append(files, name)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// newState returns a fresh AApp state with the test file loaded.
+func (r *Runner) newState(file string) (*lua.LState, error) {
+	L, err := lua.NewMFSState(context.Background(), nil, nil, r.Options)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.setup(L, file); err != nil {
+		L.Close()
+		return nil, err
+	}
+	return L, nil
+}
+
+func (r *Runner) setup(L *lua.LState, file string) error {
+	if len(r.Fixture) > 0 {
+		if err := L.MFS_ImportDir(r.Fixture, "/"); err != nil {
+			return err
+		}
+	}
+	if _, err := L.MFS_LookupFile(lua.ALVM_PATH_Maincript); err == nil {
+		fn, err := L.LoadScript(lua.ALVM_PATH_Maincript)
+		if err != nil {
+			return err
+		}
+		L.Push(fn)
+		if err := L.PCall(0, 0, nil); err != nil {
+			return err
+		}
+	}
+	OpenAssert(L)
+	return L.DoFile(file)
+}
+
+// tests returns the names of the tests a state has loaded from file.
+func tests(L *lua.LState, file string) []string {
+	type test struct {
+		name string
+		line int
+	}
+	var found []test
+	L.G.Global.ForEach(func(key, value lua.LValue) {
+		name, ok := key.(lua.LString)
+		fn, isfn := value.(*lua.LFunction)
+		if !ok || !isfn || fn.IsG || !strings.HasPrefix(strings.ToLower(string(name)), "test") {
+			return
+		}
+		// leave out functions of the AApp
+		if fn.Proto.SourceName == file {
+			found = append(found, test{string(name), fn.Proto.LineDefined})
+		}
+	})
+	sort.Slice(found, func(i, j int) bool { return found[i].line < found[j].line })
+	names := make([]string, 0, len(found))
+	for _, t := range found {
+		names = append(names, t.name)
+	}
+	return names
+}
+
+// RunFile runs the tests of a file and returns their results.
+func (r *Runner) RunFile(file string) []*Result {
+	var results []*Result
+	report := func(res *Result) {
+		results = append(results, res)
+		if r.Reporter != nil {
+			r.Reporter.Report(res)
+		}
+	}
+
+	start := time.Now()
+	L, err := r.newState(file)
+	if err != nil {
+		report(&Result{File: file, Duration: time.Since(start), Err: err})
+		return results
+	}
+	names := tests(L, file)
+	L.Close()
+
+	for _, name := range names {
+		if r.Match != nil && !r.Match.MatchString(name) {
+			continue
+		}
+		report(r.run(file, name))
+	}
+	return results
+}
+
+func (r *Runner) run(file, name string) *Result {
+	res := &Result{File: file, Name: name}
+	start := time.Now()
+	defer func() { res.Duration = time.Since(start) }()
+
+	L, err := r.newState(file)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	defer L.Close()
+	L.Push(L.GetGlobal(name))
+	res.Err = L.PCall(0, 0, nil)
+	return res
+}
+
+// Run runs the tests of all files and returns the number of failed tests.
+func (r *Runner) Run(files []string) int {
+	failed := 0
+	for _, file := range files {
+		for _, res := range r.RunFile(file) {
+			if res.Err != nil {
+				failed++
+			}
+		}
+	}
+	return failed
+}
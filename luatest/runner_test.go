@@ -0,0 +1,137 @@
+package luatest
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+const fixtureScript = `
+counter = 0
+function Inc(n)
+  counter = counter + n
+  return counter
+end
+`
+
+const testScript = `
+function test_inc()
+  assert.equal(Inc(2), 2)
+  assert.equal(Inc(3), 5)
+end
+
+function test_fresh_state()
+  assert.equal(counter, 0)
+end
+
+function test_tables()
+  assert.equal({a = {1, 2}}, {a = {1, 3}})
+end
+
+function test_error()
+  local msg = assert.error(function() error("boom") end, "boom")
+  assert(msg:find("boom"), "message returned")
+end
+
+function helper()
+end
+`
+
+func writeFile(t *testing.T, name, content string) {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "luatest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fixture := filepath.Join(dir, "fixture")
+	writeFile(t, filepath.Join(fixture, "Script", "aapp.lua"), fixtureScript)
+	file := filepath.Join(dir, "tests", "inc_test.lua")
+	writeFile(t, file, testScript)
+	writeFile(t, filepath.Join(dir, "tests", "other.lua"), "error('not a test')")
+
+	files, err := Files([]string{filepath.Join(dir, "tests")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0] != file {
+		t.Fatalf("unexpected files %v", files)
+	}
+
+	var tap bytes.Buffer
+	r := &Runner{Fixture: fixture, Reporter: NewTAPReporter(&tap)}
+	results := r.RunFile(file)
+	r.Reporter.Close()
+
+	var got []string
+	for _, res := range results {
+		got = append(got, res.Name)
+	}
+	if strings.Join(got, " ") != "test_inc test_fresh_state test_tables test_error" {
+		t.Fatalf("unexpected tests %v", got)
+	}
+	for i, res := range results {
+		if failed := res.Err != nil; failed != (i == 2) {
+			t.Errorf("%v: unexpected error %v", res.Name, res.Err)
+		}
+	}
+	if msg := results[2].Err.Error(); !strings.Contains(msg, "expected 3 at .a[2], got 2") {
+		t.Errorf("unexpected message %v", msg)
+	}
+
+	out := tap.String()
+	for _, expected := range []string{
+		"TAP version 13\nok 1 - " + file + ": test_inc\n",
+		"not ok 3 - " + file + ": test_tables\n  ---\n  duration_ms: ",
+		"  message: |\n",
+		"\n1..4\n",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("missing %q in %v", expected, out)
+		}
+	}
+
+	var junit bytes.Buffer
+	r = &Runner{Fixture: fixture, Match: regexp.MustCompile("tables"), Reporter: NewJUnitReporter(&junit)}
+	if failed := r.Run([]string{file}); failed != 1 {
+		t.Errorf("expected 1 failure, got %v", failed)
+	}
+	r.Reporter.Close()
+	out = junit.String()
+	for _, expected := range []string{
+		`<testsuites tests="1" failures="1">`,
+		`<testcase classname="` + file + `" name="test_tables" time="`,
+		`<failure message="`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("missing %q in %v", expected, out)
+		}
+	}
+}
+
+func TestLoadError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "luatest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "bad_test.lua")
+	writeFile(t, file, "function test_x(")
+
+	results := (&Runner{}).RunFile(file)
+	if len(results) != 1 || results[0].Err == nil || results[0].Name != "" {
+		t.Fatalf("expected a load failure, got %v", results)
+	}
+}
@@ -9,6 +9,11 @@ func OpenMath(L *LState) int {
 	mod := L.RegisterModule(MathLibName, mathFuncs).(*LTable)
 	mod.RawSetString("pi", LNumber(math.Pi))
 	mod.RawSetString("huge", LNumber(math.MaxFloat64))
+	if L.Options.Integers {
+		L.SetFuncs(mod, mathIntegerFuncs)
+		mod.RawSetString("maxinteger", LInteger(math.MaxInt64))
+		mod.RawSetString("mininteger", LInteger(math.MinInt64))
+	}
 	L.Push(mod)
 	return 1
 }
@@ -229,3 +234,172 @@ func mathTanh(L *LState) int {
 }
 
 //
+
+// mathIntegerFuncs replace and extend mathFuncs if Options.Integers is set.
+var mathIntegerFuncs = map[string]LGFunction{
+	"abs":       mathIntAbs,
+	"ceil":      mathIntCeil,
+	"floor":     mathIntFloor,
+	"fmod":      mathIntFmod,
+	"max":       mathIntMax,
+	"min":       mathIntMin,
+	"random":    mathIntRandom,
+	"tointeger": mathToInteger,
+	"type":      mathType,
+	"ult":       mathUlt,
+}
+
+// checkNumberValue is CheckNumber keeping integers.
+func checkNumberValue(L *LState, n int) (LValue, float64) {
+	v := L.Get(n)
+	f, ok := v.assertFloat64()
+	if !ok {
+		L.TypeError(n, LTNumber)
+	}
+	return v, f
+}
+
+func checkInteger(L *LState, n int) LInteger {
+	v, _ := checkNumberValue(L, n)
+	it, ok := toInteger(v)
+	if !ok {
+		L.ArgError(n, "number has no integer representation")
+	}
+	return it
+}
+
+// pushFloatAsInteger pushes f as an integer if it fits into one.
+func pushFloatAsInteger(L *LState, f float64) {
+	if it, ok := floatToInteger(f); ok {
+		L.Push(it)
+	} else {
+		L.Push(LNumber(f))
+	}
+}
+
+func mathIntAbs(L *LState) int {
+	switch v, f := checkNumberValue(L, 1); it := v.(type) {
+	case LInteger:
+		if it < 0 {
+			it = -it
+		}
+		L.Push(it)
+	default:
+		L.Push(LNumber(math.Abs(f)))
+	}
+	return 1
+}
+
+func mathIntCeil(L *LState) int {
+	v, f := checkNumberValue(L, 1)
+	if _, ok := v.(LInteger); ok {
+		L.Push(v)
+	} else {
+		pushFloatAsInteger(L, math.Ceil(f))
+	}
+	return 1
+}
+
+func mathIntFloor(L *LState) int {
+	v, f := checkNumberValue(L, 1)
+	if _, ok := v.(LInteger); ok {
+		L.Push(v)
+	} else {
+		pushFloatAsInteger(L, math.Floor(f))
+	}
+	return 1
+}
+
+func mathIntFmod(L *LState) int {
+	v1, f1 := checkNumberValue(L, 1)
+	v2, f2 := checkNumberValue(L, 2)
+	m, ok1 := v1.(LInteger)
+	d, ok2 := v2.(LInteger)
+	switch {
+	case !ok1 || !ok2:
+		L.Push(LNumber(math.Mod(f1, f2)))
+	case d == 0:
+		L.ArgError(2, "zero")
+	case d == -1:
+		L.Push(LInteger(0)) // minint % -1 overflows
+	default:
+		L.Push(m % d)
+	}
+	return 1
+}
+
+func mathIntMax(L *LState) int {
+	max, fmax := checkNumberValue(L, 1)
+	top := L.GetTop()
+	for i := 2; i <= top; i++ {
+		v, f := checkNumberValue(L, i)
+		if numberLessThan(max, v, fmax, f, false) {
+			max, fmax = v, f
+		}
+	}
+	L.Push(max)
+	return 1
+}
+
+func mathIntMin(L *LState) int {
+	min, fmin := checkNumberValue(L, 1)
+	top := L.GetTop()
+	for i := 2; i <= top; i++ {
+		v, f := checkNumberValue(L, i)
+		if numberLessThan(v, min, f, fmin, false) {
+			min, fmin = v, f
+		}
+	}
+	L.Push(min)
+	return 1
+}
+
+func mathIntRandom(L *LState) int {
+	switch L.GetTop() {
+	case 0:
+		L.Push(LNumber(rand.Float64()))
+	case 1:
+		n := checkInteger(L, 1)
+		if n < 1 {
+			L.ArgError(1, "interval is empty")
+		}
+		L.Push(LInteger(rand.Int63n(int64(n))) + 1)
+	default:
+		min, max := checkInteger(L, 1), checkInteger(L, 2)
+		if min > max {
+			L.ArgError(2, "interval is empty")
+		}
+		if n := uint64(max-min) + 1; n != 0 {
+			L.Push(min + LInteger(rand.Uint64()%n))
+		} else {
+			L.Push(LInteger(rand.Uint64()))
+		}
+	}
+	return 1
+}
+
+func mathToInteger(L *LState) int {
+	if it, ok := toInteger(L.CheckAny(1)); ok {
+		L.Push(it)
+	} else {
+		L.Push(LNil)
+	}
+	return 1
+}
+
+func mathType(L *LState) int {
+	switch L.CheckAny(1).(type) {
+	case LInteger:
+		L.Push(LString("integer"))
+	case LNumber:
+		L.Push(LString("float"))
+	default:
+		L.Push(LNil)
+	}
+	return 1
+}
+
+func mathUlt(L *LState) int {
+	L.Push(LBool(uint64(checkInteger(L, 1)) < uint64(checkInteger(L, 2))))
+	return 1
+}
@@ -4,7 +4,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	bsrv "github.com/ipfs/go-blockservice"
 	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
 	ipld "github.com/ipfs/go-ipld-format"
 	dag "github.com/ipfs/go-merkledag"
 	"github.com/ipfs/go-mfs"
@@ -13,14 +18,45 @@ import (
 	"io/ioutil"
 	"os"
 	gopath "path"
+	"path/filepath"
 	"strings"
 )
 
+// NewMFSState returns a state whose MFS is rooted at nd in the DAGService
+// dserv, without an IPFS node. A nil dserv keeps the blocks in memory and a
+// nil nd starts with an empty root directory. Unlike NewAVMState no script is
+// loaded, which suits tools and tests running AApp scripts locally.
+func NewMFSState(ctx context.Context, dserv ipld.DAGService, nd *dag.ProtoNode, opts ...Options) (*LState, error) {
+
+	if dserv == nil {
+		bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+		dserv = dag.NewDAGService(bsrv.New(bstore, offline.Exchange(bstore)))
+	}
+
+	if nd == nil {
+		nd = ft.EmptyDirNode()
+		if err := dserv.Add(ctx, nd); err != nil {
+			return nil, err
+		}
+	}
+
+	root, err := mfs.NewRoot(ctx, dserv, nd, func(context.Context, cid.Cid) error { return nil })
+	if err != nil {
+		return nil, err
+	}
+
+	l := NewState(opts...)
+	l.ProtoNode = nd
+	l.mfsRoot = root
+	l.dserv = dserv
+	return l, nil
+}
+
 func checkPath( path string ) error {
 	if strings.HasPrefix(path, "/") {
 		return nil
 	} else {
-		return errors.New("paths must start with a leading slash")
+		return NewAAppError(ErrCodeInvalid, "paths must start with a leading slash", nil)
 	}
 }
 
@@ -42,13 +78,13 @@ func ( l *LState ) MFS_LookupFile ( path string ) (*mfs.File, error) {
 
 	if fsn, err := mfs.Lookup( l.mfsRoot, path); err != nil {
 
-		return nil, fmt.Errorf("%v not search file or directory", path)
+		return nil, NewAAppError(ErrCodeNotFound, fmt.Sprintf("%v not search file or directory", path), err)
 
 	} else {
 
 		fi, ok := fsn.(*mfs.File)
 		if !ok {
-			return nil, fmt.Errorf("%v was not a file", path)
+			return nil, NewAAppError(ErrCodeInvalid, fmt.Sprintf("%v was not a file", path), nil)
 		}
 
 		return fi, nil
@@ -65,13 +101,13 @@ func ( l *LState ) MFS_LookupDir ( path string ) (*mfs.Directory, error) {
 
 	if fsn, err := mfs.Lookup( l.mfsRoot, path); err != nil {
 
-		return nil, fmt.Errorf("%v not search file or directory", path)
+		return nil, NewAAppError(ErrCodeNotFound, fmt.Sprintf("%v not search file or directory", path), err)
 
 	} else {
 
 		fd, ok := fsn.(*mfs.Directory)
 		if !ok {
-			return nil, fmt.Errorf("%v was not a directory", path)
+			return nil, NewAAppError(ErrCodeInvalid, fmt.Sprintf("%v was not a directory", path), nil)
 		}
 
 		return fd, nil
@@ -89,7 +125,7 @@ func ( l *LState ) MFS_ReadAll( file *mfs.File, offset int64 ) ([]byte, error) {
 
 
 	if offset < 0 {
-		return nil, fmt.Errorf("cannot specify negative offset")
+		return nil, NewAAppError(ErrCodeInvalid, "cannot specify negative offset", nil)
 	}
 
 	filen, err := rfd.Size()
@@ -98,7 +134,7 @@ func ( l *LState ) MFS_ReadAll( file *mfs.File, offset int64 ) ([]byte, error) {
 	}
 
 	if offset > filen {
-		return nil, fmt.Errorf("offset was past end of file (%d > %d)", offset, filen)
+		return nil, NewAAppError(ErrCodeInvalid, fmt.Sprintf("offset was past end of file (%d > %d)", offset, filen), nil)
 	}
 
 	_, err = rfd.Seek(int64(offset), io.SeekStart)
@@ -123,7 +159,7 @@ func ( l *LState ) MFS_ReadOffset( file *mfs.File, offset int64, size int ) ([]b
 
 
 	if offset < 0 {
-		return nil, fmt.Errorf("cannot specify negative offset")
+		return nil, NewAAppError(ErrCodeInvalid, "cannot specify negative offset", nil)
 	}
 
 	filen, err := rfd.Size()
@@ -132,11 +168,11 @@ func ( l *LState ) MFS_ReadOffset( file *mfs.File, offset int64, size int ) ([]b
 	}
 
 	if offset > filen {
-		return nil, fmt.Errorf("offset was past end of file (%d > %d)", offset, filen)
+		return nil, NewAAppError(ErrCodeInvalid, fmt.Sprintf("offset was past end of file (%d > %d)", offset, filen), nil)
 	}
 
 	if offset + int64(size) > filen {
-		return nil, fmt.Errorf("offset + size was past end of file (%d > %d)", offset + int64(size), filen)
+		return nil, NewAAppError(ErrCodeInvalid, fmt.Sprintf("offset + size was past end of file (%d > %d)", offset + int64(size), filen), nil)
 	}
 
 	_, err = rfd.Seek(int64(offset), io.SeekStart)
@@ -194,6 +230,56 @@ func ( l *LState ) MFS_Mkdir( path string, parent bool ) error {
 }
 
 
+// MFS_ImportDir copies the files below the local directory dir to path.
+func (l *LState) MFS_ImportDir(dir string, path string) error {
+
+	if err := checkPath(path); err != nil {
+		return err
+	}
+
+	return filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		target := gopath.Join(path, filepath.ToSlash(rel))
+
+		if info.IsDir() {
+			if _, err := l.MFS_LookupDir(target); err == nil {
+				return nil
+			}
+			return l.MFS_Mkdir(target, true)
+		}
+
+		bs, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+
+		fli, err := l.MFS_OpenFile(target, os.O_CREATE)
+		if err != nil {
+			return err
+		}
+
+		fwt, err := fli.Open(mfs.Flags{Write: true, Sync: true})
+		if err != nil {
+			return err
+		}
+		defer fwt.Close()
+
+		if err := fwt.Truncate(0); err != nil {
+			return err
+		}
+		_, err = fwt.Write(bs)
+		return err
+	})
+}
+
+
 /// Other
 func ( l *LState ) MFS_Rm( path string, recursive, force bool) error {
 
@@ -202,7 +288,7 @@ func ( l *LState ) MFS_Rm( path string, recursive, force bool) error {
 	}
 
 	if path == "/" {
-		return fmt.Errorf("cannot delete root")
+		return NewAAppError(ErrCodeInvalid, "cannot delete root", nil)
 	}
 
 	// 'rm a/b/c/' will fail unless we trim the slash at the end
@@ -213,12 +299,12 @@ func ( l *LState ) MFS_Rm( path string, recursive, force bool) error {
 	dir, name := gopath.Split(path)
 	parent, err := mfs.Lookup(l.mfsRoot, dir)
 	if err != nil {
-		return fmt.Errorf("parent lookup: %s", err)
+		return NewAAppError(ErrCodeNotFound, "parent lookup", err)
 	}
 
 	pdir, ok := parent.(*mfs.Directory)
 	if !ok {
-		return fmt.Errorf("no such file or directory: %s", path)
+		return NewAAppError(ErrCodeNotFound, fmt.Sprintf("no such file or directory: %s", path), nil)
 	}
 
 	// get child node by name, when the node is corrupted and nonexistent,
@@ -231,7 +317,7 @@ func ( l *LState ) MFS_Rm( path string, recursive, force bool) error {
 	switch child.(type) {
 	case *mfs.Directory:
 		if !recursive {
-			return fmt.Errorf("%s is a directory, use -r to remove directories", path)
+			return NewAAppError(ErrCodeInvalid, fmt.Sprintf("%s is a directory, use -r to remove directories", path), nil)
 		}
 	}
 
@@ -289,6 +375,14 @@ func ( l *LState ) MFS_Flush( path string ) (cid.Cid, error) {
 		return cid.Cid{}, err
 	}
 
+	// flushing a file waits for the read locks of its streams, flushing a
+	// directory does not lock its files
+	if nd, err := mfs.Lookup(l.mfsRoot, path); err == nil {
+		if fi, ok := nd.(*mfs.File); ok {
+			l.closeJsonStreams(fi, "flushed")
+		}
+	}
+
 	ctx, cancel := context.WithCancel( context.Background() )
 	defer cancel()
 
@@ -438,13 +532,13 @@ func getFileHandle(r *mfs.Root, path string, create bool, builder cid.Builder) (
 	case nil:
 		fi, ok := target.(*mfs.File)
 		if !ok {
-			return nil, fmt.Errorf("%s was not a file", path)
+			return nil, NewAAppError(ErrCodeInvalid, fmt.Sprintf("%s was not a file", path), nil)
 		}
 		return fi, nil
 
 	case os.ErrNotExist:
 		if !create {
-			return nil, err
+			return nil, NewAAppError(ErrCodeNotFound, fmt.Sprintf("%v not search file or directory", path), err)
 		}
 
 		// if create is specified and the file doesnt exist, we create the file
@@ -455,7 +549,7 @@ func getFileHandle(r *mfs.Root, path string, create bool, builder cid.Builder) (
 		}
 		pdir, ok := pdiri.(*mfs.Directory)
 		if !ok {
-			return nil, fmt.Errorf("%s was not a directory", dirname)
+			return nil, NewAAppError(ErrCodeInvalid, fmt.Sprintf("%s was not a directory", dirname), nil)
 		}
 		if builder == nil {
 			builder = pdir.GetCidBuilder()
@@ -15,7 +15,7 @@ func init() {
 
 func getIntField(L *LState, tb *LTable, key string, v int) int {
 	ret := tb.RawGetString(key)
-	if ln, ok := ret.(LNumber); ok {
+	if ln, ok := ret.assertFloat64(); ok {
 		return int(ln)
 	}
 	return v
@@ -45,6 +45,8 @@ func isDigit(ch int) bool {
 type Scanner struct {
 	Pos    ast.Position
 	reader *bufio.Reader
+	// raw receives the characters read by Next while a comment is scanned.
+	raw *bytes.Buffer
 }
 
 func NewScanner(reader io.Reader, source string) *Scanner {
@@ -94,6 +96,9 @@ func (sc *Scanner) Next() int {
 	default:
 		sc.Pos.Column++
 	}
+	if sc.raw != nil && ch >= 0 {
+		writeChar(sc.raw, ch)
+	}
 	return ch
 }
 
@@ -331,10 +336,19 @@ redo:
 			tok.Type = EOF
 		case '-':
 			if sc.Peek() == '-' {
+				var text bytes.Buffer
+				text.WriteByte('-')
+				sc.raw = &text
 				err = sc.skipComments(sc.Next())
+				sc.raw = nil
 				if err != nil {
 					goto finally
 				}
+				lexer.Comments = append(lexer.Comments, ast.Comment{
+					Text:    strings.TrimRight(text.String(), "\n"),
+					Pos:     tok.Pos,
+					OwnLine: lexer.Token.Pos.Line != tok.Pos.Line,
+				})
 				goto redo
 			} else {
 				tok.Type = ch
@@ -368,13 +382,18 @@ redo:
 				tok.Str = "~="
 				sc.Next()
 			} else {
-				err = sc.Error("~", "Invalid '~' token")
+				tok.Type = ch
+				tok.Str = string(rune(ch))
 			}
 		case '<':
 			if sc.Peek() == '=' {
 				tok.Type = TLte
 				tok.Str = "<="
 				sc.Next()
+			} else if sc.Peek() == '<' {
+				tok.Type = TShl
+				tok.Str = "<<"
+				sc.Next()
 			} else {
 				tok.Type = ch
 				tok.Str = string(ch)
@@ -384,9 +403,22 @@ redo:
 				tok.Type = TGte
 				tok.Str = ">="
 				sc.Next()
+			} else if sc.Peek() == '>' {
+				tok.Type = TShr
+				tok.Str = ">>"
+				sc.Next()
 			} else {
 				tok.Type = ch
-				tok.Str = string(ch)
+				tok.Str = string(rune(ch))
+			}
+		case '/':
+			if sc.Peek() == '/' {
+				tok.Type = T2Slash
+				tok.Str = "//"
+				sc.Next()
+			} else {
+				tok.Type = ch
+				tok.Str = string(rune(ch))
 			}
 		case '.':
 			ch2 := sc.Peek()
@@ -408,7 +440,7 @@ redo:
 				tok.Type = '.'
 			}
 			tok.Str = buf.String()
-		case '+', '*', '/', '%', '^', '#', '(', ')', '{', '}', ']', ';', ':', ',':
+		case '+', '*', '%', '^', '#', '&', '|', '(', ')', '{', '}', ']', ';', ':', ',':
 			tok.Type = ch
 			tok.Str = string(ch)
 		default:
@@ -431,6 +463,7 @@ type Lexer struct {
 	PNewLine      bool
 	Token         ast.Token
 	PrevTokenType int
+	Comments      []ast.Comment
 }
 
 func (lx *Lexer) Lex(lval *yySymType) int {
@@ -456,7 +489,14 @@ func (lx *Lexer) TokenError(tok ast.Token, message string) {
 }
 
 func Parse(reader io.Reader, name string) (chunk []ast.Stmt, err error) {
-	lexer := &Lexer{NewScanner(reader, name), nil, false, ast.Token{Str: ""}, TNil}
+	chunk, _, err = ParseComments(reader, name)
+	return
+}
+
+// ParseComments is like Parse, but also returns the comments of the source
+// in the order they appear.
+func ParseComments(reader io.Reader, name string) (chunk []ast.Stmt, comments []ast.Comment, err error) {
+	lexer := &Lexer{NewScanner(reader, name), nil, false, ast.Token{Str: ""}, TNil, nil}
 	chunk = nil
 	defer func() {
 		if e := recover(); e != nil {
@@ -465,6 +505,7 @@ func Parse(reader io.Reader, name string) (chunk []ast.Stmt, err error) {
 	}()
 	yyParse(lexer)
 	chunk = lexer.Stmts
+	comments = lexer.Comments
 	return
 }
 
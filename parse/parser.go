@@ -1,9 +1,12 @@
+// Code generated by goyacc -o parser.go parser.go.y. DO NOT EDIT.
+
 //line parser.go.y:2
 package parse
 
 import __yyfmt__ "fmt"
 
 //line parser.go.y:2
+
 import (
 	"github.com/ayachain/go-aya-alvm/ast"
 )
@@ -57,12 +60,18 @@ const TLte = 57369
 const TGte = 57370
 const T2Comma = 57371
 const T3Comma = 57372
-const TIdent = 57373
-const TNumber = 57374
-const TString = 57375
-const UNARY = 57376
+const T2Slash = 57373
+const TShl = 57374
+const TShr = 57375
+const TIdent = 57376
+const TNumber = 57377
+const TString = 57378
+const UNARY = 57379
 
-var yyToknames = []string{
+var yyToknames = [...]string{
+	"$end",
+	"error",
+	"$unk",
 	"TAnd",
 	"TBreak",
 	"TDo",
@@ -90,28 +99,46 @@ var yyToknames = []string{
 	"TGte",
 	"T2Comma",
 	"T3Comma",
+	"T2Slash",
+	"TShl",
+	"TShr",
 	"TIdent",
 	"TNumber",
 	"TString",
-	" {",
-	" (",
-	" >",
-	" <",
-	" +",
-	" -",
-	" *",
-	" /",
-	" %",
+	"'{'",
+	"'}'",
+	"'('",
+	"'>'",
+	"'<'",
+	"'|'",
+	"'~'",
+	"'&'",
+	"'+'",
+	"'-'",
+	"'*'",
+	"'/'",
+	"'%'",
 	"UNARY",
-	" ^",
+	"'^'",
+	"';'",
+	"'='",
+	"','",
+	"':'",
+	"'.'",
+	"'['",
+	"']'",
+	"'#'",
+	"')'",
 }
-var yyStatenames = []string{}
+
+var yyStatenames = [...]string{}
 
 const yyEofCode = 1
 const yyErrCode = 2
-const yyMaxDepth = 200
+const yyInitialStackSize = 16
+
+//line parser.go.y:548
 
-//line parser.go.y:514
 func TokenName(c int) string {
 	if c >= TAnd && c-TAnd < len(yyToknames) {
 		if yyToknames[c-TAnd] != "" {
@@ -122,232 +149,283 @@ func TokenName(c int) string {
 }
 
 //line yacctab:1
-var yyExca = []int{
+var yyExca = [...]int8{
 	-1, 1,
 	1, -1,
 	-2, 0,
 	-1, 17,
-	46, 31,
-	47, 31,
-	-2, 68,
-	-1, 93,
-	46, 32,
-	47, 32,
-	-2, 68,
+	53, 31,
+	54, 31,
+	-2, 75,
+	-1, 101,
+	53, 32,
+	54, 32,
+	-2, 75,
 }
 
-const yyNprod = 95
 const yyPrivate = 57344
 
-var yyTokenNames []string
-var yyStates []string
-
-const yyLast = 579
-
-var yyAct = []int{
-
-	24, 88, 50, 23, 45, 84, 56, 65, 137, 153,
-	136, 113, 52, 142, 54, 53, 33, 134, 65, 132,
-	62, 63, 32, 61, 108, 109, 48, 111, 106, 41,
-	42, 105, 49, 155, 166, 81, 82, 83, 138, 104,
-	22, 91, 131, 80, 95, 92, 162, 74, 48, 85,
-	150, 99, 165, 148, 49, 149, 75, 76, 77, 78,
-	79, 67, 80, 107, 106, 148, 114, 115, 116, 117,
-	118, 119, 120, 121, 122, 123, 124, 125, 126, 127,
-	128, 129, 72, 73, 71, 70, 74, 65, 39, 40,
-	47, 139, 133, 68, 69, 75, 76, 77, 78, 79,
-	60, 80, 141, 144, 143, 146, 145, 31, 67, 147,
-	9, 48, 110, 97, 48, 152, 151, 49, 38, 62,
-	49, 17, 66, 77, 78, 79, 96, 80, 59, 72,
-	73, 71, 70, 74, 154, 102, 91, 156, 55, 157,
-	68, 69, 75, 76, 77, 78, 79, 21, 80, 187,
-	94, 20, 26, 184, 37, 179, 163, 112, 25, 35,
-	178, 93, 170, 172, 27, 171, 164, 173, 19, 159,
-	175, 174, 29, 89, 28, 39, 40, 20, 182, 181,
-	100, 34, 135, 183, 67, 39, 40, 47, 186, 64,
-	51, 1, 90, 87, 36, 130, 86, 30, 66, 18,
-	46, 44, 43, 8, 58, 72, 73, 71, 70, 74,
-	57, 67, 168, 169, 167, 3, 68, 69, 75, 76,
-	77, 78, 79, 160, 80, 66, 4, 2, 0, 0,
-	0, 158, 72, 73, 71, 70, 74, 0, 0, 0,
-	0, 0, 0, 68, 69, 75, 76, 77, 78, 79,
-	26, 80, 37, 0, 0, 0, 25, 35, 140, 0,
+const yyLast = 775
+
+var yyAct = [...]uint8{
+	24, 96, 51, 23, 46, 92, 57, 167, 40, 41,
+	121, 48, 53, 146, 55, 54, 33, 63, 66, 119,
+	114, 64, 32, 62, 156, 113, 49, 47, 45, 44,
+	116, 117, 50, 148, 66, 88, 89, 90, 91, 75,
+	169, 82, 99, 145, 176, 103, 100, 151, 49, 150,
+	42, 43, 107, 180, 50, 76, 77, 78, 79, 80,
+	152, 81, 112, 81, 115, 114, 22, 122, 123, 124,
+	125, 126, 127, 128, 129, 130, 131, 132, 133, 134,
+	135, 136, 137, 138, 139, 140, 141, 142, 143, 82,
+	31, 39, 66, 9, 17, 40, 41, 21, 48, 153,
+	147, 93, 20, 164, 179, 78, 79, 80, 162, 81,
+	155, 158, 157, 160, 159, 61, 163, 161, 68, 49,
+	162, 118, 49, 166, 165, 50, 105, 104, 50, 60,
+	56, 110, 67, 201, 102, 101, 198, 63, 193, 73,
+	74, 72, 71, 75, 192, 82, 86, 87, 168, 186,
+	99, 170, 19, 171, 69, 70, 84, 85, 83, 76,
+	77, 78, 79, 80, 178, 81, 182, 183, 181, 173,
+	177, 108, 149, 65, 120, 95, 184, 52, 1, 185,
+	144, 187, 68, 30, 189, 188, 18, 8, 59, 58,
+	3, 174, 196, 195, 4, 2, 67, 197, 0, 0,
+	0, 0, 200, 73, 74, 72, 71, 75, 0, 82,
+	86, 87, 0, 0, 0, 0, 68, 0, 69, 70,
+	84, 85, 83, 76, 77, 78, 79, 80, 0, 81,
+	67, 0, 0, 0, 0, 0, 172, 73, 74, 72,
+	71, 75, 0, 82, 86, 87, 0, 0, 0, 0,
+	0, 0, 69, 70, 84, 85, 83, 76, 77, 78,
+	79, 80, 68, 81, 190, 0, 0, 0, 0, 0,
+	154, 0, 0, 0, 0, 0, 67, 0, 0, 0,
+	0, 0, 0, 73, 74, 72, 71, 75, 0, 82,
+	86, 87, 0, 0, 68, 0, 0, 0, 69, 70,
+	84, 85, 83, 76, 77, 78, 79, 80, 67, 81,
+	0, 0, 191, 0, 0, 73, 74, 72, 71, 75,
+	0, 82, 86, 87, 0, 0, 0, 0, 0, 0,
+	69, 70, 84, 85, 83, 76, 77, 78, 79, 80,
+	26, 81, 38, 0, 175, 0, 25, 35, 0, 0,
 	0, 0, 27, 0, 0, 0, 0, 0, 0, 0,
-	29, 21, 28, 39, 40, 20, 26, 0, 37, 34,
-	0, 0, 25, 35, 0, 0, 0, 0, 27, 0,
-	0, 0, 36, 98, 0, 0, 29, 89, 28, 39,
-	40, 20, 26, 0, 37, 34, 0, 0, 25, 35,
-	0, 0, 0, 0, 27, 67, 90, 176, 36, 0,
-	0, 0, 29, 21, 28, 39, 40, 20, 0, 66,
-	0, 34, 0, 0, 0, 0, 72, 73, 71, 70,
-	74, 0, 67, 0, 36, 0, 0, 68, 69, 75,
-	76, 77, 78, 79, 0, 80, 66, 0, 177, 0,
-	0, 0, 0, 72, 73, 71, 70, 74, 0, 67,
-	0, 185, 0, 0, 68, 69, 75, 76, 77, 78,
-	79, 0, 80, 66, 0, 161, 0, 0, 0, 0,
-	72, 73, 71, 70, 74, 0, 67, 0, 0, 0,
-	0, 68, 69, 75, 76, 77, 78, 79, 0, 80,
-	66, 0, 0, 180, 0, 0, 0, 72, 73, 71,
-	70, 74, 0, 67, 0, 0, 0, 0, 68, 69,
-	75, 76, 77, 78, 79, 0, 80, 66, 0, 0,
-	103, 0, 0, 0, 72, 73, 71, 70, 74, 0,
-	67, 0, 101, 0, 0, 68, 69, 75, 76, 77,
-	78, 79, 0, 80, 66, 0, 0, 0, 0, 0,
-	0, 72, 73, 71, 70, 74, 0, 67, 0, 0,
-	0, 0, 68, 69, 75, 76, 77, 78, 79, 0,
-	80, 66, 0, 0, 0, 0, 0, 0, 72, 73,
-	71, 70, 74, 0, 0, 0, 0, 0, 0, 68,
-	69, 75, 76, 77, 78, 79, 0, 80, 72, 73,
-	71, 70, 74, 0, 0, 0, 0, 0, 0, 68,
-	69, 75, 76, 77, 78, 79, 0, 80, 7, 10,
-	0, 0, 0, 0, 14, 15, 13, 0, 16, 0,
-	0, 0, 6, 12, 0, 0, 0, 11, 0, 0,
-	0, 0, 0, 0, 21, 0, 0, 0, 20, 0,
-	0, 0, 0, 0, 0, 0, 0, 0, 5,
+	29, 0, 0, 0, 21, 28, 40, 41, 26, 20,
+	38, 0, 0, 37, 25, 35, 34, 0, 0, 0,
+	27, 0, 0, 0, 0, 0, 0, 0, 29, 36,
+	106, 0, 97, 28, 40, 41, 94, 20, 0, 0,
+	26, 37, 38, 0, 34, 0, 25, 35, 0, 0,
+	0, 0, 27, 0, 0, 98, 68, 36, 199, 0,
+	29, 0, 0, 0, 97, 28, 40, 41, 0, 20,
+	67, 0, 0, 37, 0, 0, 34, 73, 74, 72,
+	71, 75, 0, 82, 86, 87, 0, 98, 0, 36,
+	0, 0, 69, 70, 84, 85, 83, 76, 77, 78,
+	79, 80, 26, 81, 38, 0, 0, 0, 25, 35,
+	0, 0, 0, 0, 27, 0, 0, 0, 0, 68,
+	0, 0, 29, 0, 0, 0, 21, 28, 40, 41,
+	0, 20, 0, 67, 0, 37, 194, 0, 34, 0,
+	73, 74, 72, 71, 75, 0, 82, 86, 87, 0,
+	0, 36, 0, 68, 0, 69, 70, 84, 85, 83,
+	76, 77, 78, 79, 80, 0, 81, 67, 0, 0,
+	111, 0, 0, 0, 73, 74, 72, 71, 75, 0,
+	82, 86, 87, 0, 0, 68, 0, 109, 0, 69,
+	70, 84, 85, 83, 76, 77, 78, 79, 80, 67,
+	81, 0, 0, 0, 0, 0, 73, 74, 72, 71,
+	75, 0, 82, 86, 87, 0, 0, 68, 0, 0,
+	0, 69, 70, 84, 85, 83, 76, 77, 78, 79,
+	80, 67, 81, 0, 0, 0, 0, 0, 73, 74,
+	72, 71, 75, 0, 82, 86, 87, 68, 0, 0,
+	0, 0, 0, 69, 70, 84, 85, 83, 76, 77,
+	78, 79, 80, 0, 81, 0, 0, 0, 73, 74,
+	72, 71, 75, 0, 82, 86, 87, 0, 0, 0,
+	0, 0, 0, 69, 70, 84, 85, 83, 76, 77,
+	78, 79, 80, 0, 81, 73, 74, 72, 71, 75,
+	0, 82, 86, 87, 0, 0, 0, 0, 0, 0,
+	69, 70, 84, 85, 83, 76, 77, 78, 79, 80,
+	75, 81, 82, 86, 87, 0, 0, 0, 0, 0,
+	0, 0, 0, 84, 85, 83, 76, 77, 78, 79,
+	80, 0, 81, 7, 10, 0, 0, 0, 0, 14,
+	15, 13, 0, 16, 0, 0, 0, 6, 12, 0,
+	0, 0, 11, 0, 75, 0, 82, 86, 87, 0,
+	0, 0, 21, 0, 0, 0, 0, 20, 85, 83,
+	76, 77, 78, 79, 80, 75, 81, 82, 86, 87,
+	5, 0, 75, 0, 82, 86, 87, 0, 0, 0,
+	83, 76, 77, 78, 79, 80, 0, 81, 76, 77,
+	78, 79, 80, 0, 81,
 }
-var yyPact = []int{
-
-	-1000, -1000, 533, -5, -1000, -1000, 292, -1000, -17, 152,
-	-1000, 292, -1000, 292, 107, 97, 88, -1000, -1000, -1000,
-	292, -1000, -1000, -29, 473, -1000, -1000, -1000, -1000, -1000,
-	-1000, 152, -1000, -1000, 292, 292, 292, 14, -1000, -1000,
-	142, 292, 116, 292, 95, -1000, 82, 240, -1000, -1000,
-	171, -1000, 446, 112, 419, -7, 17, 14, -24, -1000,
-	81, -19, -1000, 104, -42, 292, 292, 292, 292, 292,
-	292, 292, 292, 292, 292, 292, 292, 292, 292, 292,
-	292, -1, -1, -1, -1000, -11, -1000, -37, -1000, -8,
-	292, 473, -29, -1000, 152, 207, -1000, 55, -1000, -40,
-	-1000, -1000, 292, -1000, 292, 292, 34, -1000, 24, 19,
-	14, 292, -1000, -1000, 473, 57, 493, 18, 18, 18,
-	18, 18, 18, 18, 83, 83, -1, -1, -1, -1,
-	-44, -1000, -1000, -14, -1000, 266, -1000, -1000, 292, 180,
-	-1000, -1000, -1000, 160, 473, -1000, 338, 40, -1000, -1000,
-	-1000, -1000, -29, -1000, 157, 22, -1000, 473, -12, -1000,
-	205, 292, -1000, 154, -1000, -1000, 292, -1000, -1000, 292,
-	311, 151, -1000, 473, 146, 392, -1000, 292, -1000, -1000,
-	-1000, 144, 365, -1000, -1000, -1000, 140, -1000,
+
+var yyPact = [...]int16{
+	-1000, -1000, 698, 14, -1000, -1000, 452, -1000, -3, -28,
+	-1000, 452, -1000, 452, 96, 95, 103, -1000, -1000, -1000,
+	452, -1000, -1000, -20, 573, -1000, -1000, -1000, -1000, -1000,
+	-1000, -28, -1000, -1000, 452, 452, 452, 452, 62, -1000,
+	-1000, 358, 452, 63, 452, 93, -1000, 92, 330, -1000,
+	-1000, 162, -1000, 541, 108, 509, 9, 11, 62, -25,
+	-1000, 87, -34, -1000, 114, -50, 452, 452, 452, 452,
+	452, 452, 452, 452, 452, 452, 452, 452, 452, 452,
+	452, 452, 452, 452, 452, 452, 452, 452, 12, 12,
+	12, 12, -1000, -17, -1000, -5, -1000, 7, 452, 573,
+	-20, -1000, -28, 212, -1000, 59, -1000, -36, -1000, -1000,
+	452, -1000, 452, 452, 86, -1000, 82, 69, 62, 452,
+	-1000, -1000, 573, 603, 630, 651, 651, 651, 651, 651,
+	651, 10, 58, 58, 12, 12, 12, 12, 12, 723,
+	695, 716, 10, 10, -53, -1000, -1000, -14, -1000, 390,
+	-1000, -1000, 452, 178, -1000, -1000, -1000, 160, 573, -1000,
+	290, 38, -1000, -1000, -1000, -1000, -20, -1000, 155, 74,
+	-1000, 573, 0, -1000, 159, 452, -1000, 140, -1000, -1000,
+	452, -1000, -1000, 452, 258, 135, -1000, 573, 129, 475,
+	-1000, 452, -1000, -1000, -1000, 127, 412, -1000, -1000, -1000,
+	124, -1000,
 }
-var yyPgo = []int{
 
-	0, 190, 227, 2, 226, 223, 215, 210, 204, 203,
-	118, 6, 3, 0, 22, 107, 168, 199, 4, 197,
-	5, 195, 16, 193, 1, 182,
+var yyPgo = [...]uint8{
+	0, 177, 195, 2, 194, 191, 190, 189, 188, 187,
+	91, 6, 3, 0, 22, 90, 152, 186, 4, 183,
+	5, 180, 16, 175, 1, 172,
 }
-var yyR1 = []int{
 
+var yyR1 = [...]int8{
 	0, 1, 1, 1, 2, 2, 2, 3, 4, 4,
 	4, 4, 4, 4, 4, 4, 4, 4, 4, 4,
 	4, 4, 5, 5, 6, 6, 6, 7, 7, 8,
 	8, 9, 9, 10, 10, 10, 11, 11, 12, 12,
 	13, 13, 13, 13, 13, 13, 13, 13, 13, 13,
 	13, 13, 13, 13, 13, 13, 13, 13, 13, 13,
-	13, 13, 13, 13, 13, 13, 13, 14, 15, 15,
-	15, 15, 17, 16, 16, 18, 18, 18, 18, 19,
-	20, 20, 21, 21, 21, 22, 22, 23, 23, 23,
-	24, 24, 24, 25, 25,
+	13, 13, 13, 13, 13, 13, 13, 13, 13, 13,
+	13, 13, 13, 13, 14, 15, 15, 15, 15, 17,
+	16, 16, 18, 18, 18, 18, 19, 20, 20, 21,
+	21, 21, 22, 22, 23, 23, 23, 24, 24, 24,
+	25, 25,
 }
-var yyR2 = []int{
 
+var yyR2 = [...]int8{
 	0, 1, 2, 3, 0, 2, 2, 1, 3, 1,
 	3, 5, 4, 6, 8, 9, 11, 7, 3, 4,
 	4, 2, 0, 5, 1, 2, 1, 1, 3, 1,
 	3, 1, 3, 1, 4, 3, 1, 3, 1, 3,
 	1, 1, 1, 1, 1, 1, 1, 1, 1, 3,
 	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
-	3, 3, 3, 3, 2, 2, 2, 1, 1, 1,
-	1, 3, 3, 2, 4, 2, 3, 1, 1, 2,
-	5, 4, 1, 1, 3, 2, 3, 1, 3, 2,
-	3, 5, 1, 1, 1,
+	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
+	2, 2, 2, 2, 1, 1, 1, 1, 3, 3,
+	2, 4, 2, 3, 1, 1, 2, 5, 4, 1,
+	1, 3, 2, 3, 1, 3, 2, 3, 5, 1,
+	1, 1,
 }
-var yyChk = []int{
 
-	-1000, -1, -2, -6, -4, 45, 19, 5, -9, -15,
+var yyChk = [...]int16{
+	-1000, -1, -2, -6, -4, 52, 19, 5, -9, -15,
 	6, 24, 20, 13, 11, 12, 15, -10, -17, -16,
-	35, 31, 45, -12, -13, 16, 10, 22, 32, 30,
-	-19, -15, -14, -22, 39, 17, 52, 12, -10, 33,
-	34, 46, 47, 50, 49, -18, 48, 35, -22, -14,
-	-3, -1, -13, -3, -13, 31, -11, -7, -8, 31,
-	12, -11, 31, -13, -16, 47, 18, 4, 36, 37,
-	28, 27, 25, 26, 29, 38, 39, 40, 41, 42,
-	44, -13, -13, -13, -20, 35, 54, -23, -24, 31,
-	50, -13, -12, -10, -15, -13, 31, 31, 53, -12,
-	9, 6, 23, 21, 46, 14, 47, -20, 48, 49,
-	31, 46, 53, 53, -13, -13, -13, -13, -13, -13,
+	39, 34, 52, -12, -13, 16, 10, 22, 35, 30,
+	-19, -15, -14, -22, 46, 17, 59, 43, 12, -10,
+	36, 37, 53, 54, 57, 56, -18, 55, 39, -22,
+	-14, -3, -1, -13, -3, -13, 34, -11, -7, -8,
+	34, 12, -11, 34, -13, -16, 54, 18, 4, 40,
+	41, 28, 27, 25, 26, 29, 45, 46, 47, 48,
+	49, 51, 31, 44, 42, 43, 32, 33, -13, -13,
+	-13, -13, -20, 39, 38, -23, -24, 34, 57, -13,
+	-12, -10, -15, -13, 34, 34, 60, -12, 9, 6,
+	23, 21, 53, 14, 54, -20, 55, 56, 34, 53,
+	60, 60, -13, -13, -13, -13, -13, -13, -13, -13,
 	-13, -13, -13, -13, -13, -13, -13, -13, -13, -13,
-	-21, 53, 30, -11, 54, -25, 47, 45, 46, -13,
-	51, -18, 53, -3, -13, -3, -13, -12, 31, 31,
-	31, -20, -12, 53, -3, 47, -24, -13, 51, 9,
-	-5, 47, 6, -3, 9, 30, 46, 9, 7, 8,
-	-13, -3, 9, -13, -3, -13, 6, 47, 9, 9,
-	21, -3, -13, -3, 9, 6, -3, 9,
+	-13, -13, -13, -13, -21, 60, 30, -11, 38, -25,
+	54, 52, 53, -13, 58, -18, 60, -3, -13, -3,
+	-13, -12, 34, 34, 34, -20, -12, 60, -3, 54,
+	-24, -13, 58, 9, -5, 54, 6, -3, 9, 30,
+	53, 9, 7, 8, -13, -3, 9, -13, -3, -13,
+	6, 54, 9, 9, 21, -3, -13, -3, 9, 6,
+	-3, 9,
 }
-var yyDef = []int{
 
+var yyDef = [...]int8{
 	4, -2, 1, 2, 5, 6, 24, 26, 0, 9,
-	4, 0, 4, 0, 0, 0, 0, -2, 69, 70,
+	4, 0, 4, 0, 0, 0, 0, -2, 76, 77,
 	0, 33, 3, 25, 38, 40, 41, 42, 43, 44,
-	45, 46, 47, 48, 0, 0, 0, 0, 68, 67,
-	0, 0, 0, 0, 0, 73, 0, 0, 77, 78,
-	0, 7, 0, 0, 0, 36, 0, 0, 27, 29,
-	0, 21, 36, 0, 70, 0, 0, 0, 0, 0,
+	45, 46, 47, 48, 0, 0, 0, 0, 0, 75,
+	74, 0, 0, 0, 0, 0, 80, 0, 0, 84,
+	85, 0, 7, 0, 0, 0, 36, 0, 0, 27,
+	29, 0, 21, 36, 0, 77, 0, 0, 0, 0,
 	0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
-	0, 64, 65, 66, 79, 0, 85, 0, 87, 33,
-	0, 92, 8, -2, 0, 0, 35, 0, 75, 0,
-	10, 4, 0, 4, 0, 0, 0, 18, 0, 0,
-	0, 0, 71, 72, 39, 49, 50, 51, 52, 53,
-	54, 55, 56, 57, 58, 59, 60, 61, 62, 63,
-	0, 4, 82, 83, 86, 89, 93, 94, 0, 0,
-	34, 74, 76, 0, 12, 22, 0, 0, 37, 28,
-	30, 19, 20, 4, 0, 0, 88, 90, 0, 11,
-	0, 0, 4, 0, 81, 84, 0, 13, 4, 0,
-	0, 0, 80, 91, 0, 0, 4, 0, 17, 14,
-	4, 0, 0, 23, 15, 4, 0, 16,
+	0, 0, 0, 0, 0, 0, 0, 0, 70, 71,
+	72, 73, 86, 0, 92, 0, 94, 33, 0, 99,
+	8, -2, 0, 0, 35, 0, 82, 0, 10, 4,
+	0, 4, 0, 0, 0, 18, 0, 0, 0, 0,
+	78, 79, 39, 49, 50, 51, 52, 53, 54, 55,
+	56, 57, 58, 59, 60, 61, 62, 63, 64, 65,
+	66, 67, 68, 69, 0, 4, 89, 90, 93, 96,
+	100, 101, 0, 0, 34, 81, 83, 0, 12, 22,
+	0, 0, 37, 28, 30, 19, 20, 4, 0, 0,
+	95, 97, 0, 11, 0, 0, 4, 0, 88, 91,
+	0, 13, 4, 0, 0, 0, 87, 98, 0, 0,
+	4, 0, 17, 14, 4, 0, 0, 23, 15, 4,
+	0, 16,
 }
-var yyTok1 = []int{
 
+var yyTok1 = [...]int8{
 	1, 3, 3, 3, 3, 3, 3, 3, 3, 3,
 	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
 	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
-	3, 3, 3, 3, 3, 52, 3, 42, 3, 3,
-	35, 53, 40, 38, 47, 39, 49, 41, 3, 3,
-	3, 3, 3, 3, 3, 3, 3, 3, 48, 45,
-	37, 46, 36, 3, 3, 3, 3, 3, 3, 3,
+	3, 3, 3, 3, 3, 59, 3, 49, 44, 3,
+	39, 60, 47, 45, 54, 46, 56, 48, 3, 3,
+	3, 3, 3, 3, 3, 3, 3, 3, 55, 52,
+	41, 53, 40, 3, 3, 3, 3, 3, 3, 3,
 	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
 	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
-	3, 50, 3, 51, 44, 3, 3, 3, 3, 3,
+	3, 57, 3, 58, 51, 3, 3, 3, 3, 3,
 	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
 	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
-	3, 3, 3, 34, 3, 54,
+	3, 3, 3, 37, 42, 38, 43,
 }
-var yyTok2 = []int{
 
+var yyTok2 = [...]int8{
 	2, 3, 4, 5, 6, 7, 8, 9, 10, 11,
 	12, 13, 14, 15, 16, 17, 18, 19, 20, 21,
 	22, 23, 24, 25, 26, 27, 28, 29, 30, 31,
-	32, 33, 43,
+	32, 33, 34, 35, 36, 50,
 }
-var yyTok3 = []int{
+
+var yyTok3 = [...]int8{
 	0,
 }
 
+var yyErrorMessages = [...]struct {
+	state int
+	token int
+	msg   string
+}{}
+
 //line yaccpar:1
 
 /*	parser for yacc output	*/
 
-var yyDebug = 0
+var (
+	yyDebug        = 0
+	yyErrorVerbose = false
+)
 
 type yyLexer interface {
 	Lex(lval *yySymType) int
 	Error(s string)
 }
 
+type yyParser interface {
+	Parse(yyLexer) int
+	Lookahead() int
+}
+
+type yyParserImpl struct {
+	lval  yySymType
+	stack [yyInitialStackSize]yySymType
+	char  int
+}
+
+func (p *yyParserImpl) Lookahead() int {
+	return p.char
+}
+
+func yyNewParser() yyParser {
+	return &yyParserImpl{}
+}
+
 const yyFlag = -1000
 
 func yyTokname(c int) string {
-	// 4 is TOKSTART above
-	if c >= 4 && c-4 < len(yyToknames) {
-		if yyToknames[c-4] != "" {
-			return yyToknames[c-4]
+	if c >= 1 && c-1 < len(yyToknames) {
+		if yyToknames[c-1] != "" {
+			return yyToknames[c-1]
 		}
 	}
 	return __yyfmt__.Sprintf("tok-%v", c)
@@ -362,51 +440,127 @@ func yyStatname(s int) string {
 	return __yyfmt__.Sprintf("state-%v", s)
 }
 
-func yylex1(lex yyLexer, lval *yySymType) int {
-	c := 0
-	char := lex.Lex(lval)
+func yyErrorMessage(state, lookAhead int) string {
+	const TOKSTART = 4
+
+	if !yyErrorVerbose {
+		return "syntax error"
+	}
+
+	for _, e := range yyErrorMessages {
+		if e.state == state && e.token == lookAhead {
+			return "syntax error: " + e.msg
+		}
+	}
+
+	res := "syntax error: unexpected " + yyTokname(lookAhead)
+
+	// To match Bison, suggest at most four expected tokens.
+	expected := make([]int, 0, 4)
+
+	// Look for shiftable tokens.
+	base := int(yyPact[state])
+	for tok := TOKSTART; tok-1 < len(yyToknames); tok++ {
+		if n := base + tok; n >= 0 && n < yyLast && int(yyChk[int(yyAct[n])]) == tok {
+			if len(expected) == cap(expected) {
+				return res
+			}
+			expected = append(expected, tok)
+		}
+	}
+
+	if yyDef[state] == -2 {
+		i := 0
+		for yyExca[i] != -1 || int(yyExca[i+1]) != state {
+			i += 2
+		}
+
+		// Look for tokens that we accept or reduce.
+		for i += 2; yyExca[i] >= 0; i += 2 {
+			tok := int(yyExca[i])
+			if tok < TOKSTART || yyExca[i+1] == 0 {
+				continue
+			}
+			if len(expected) == cap(expected) {
+				return res
+			}
+			expected = append(expected, tok)
+		}
+
+		// If the default action is to accept or reduce, give up.
+		if yyExca[i+1] != 0 {
+			return res
+		}
+	}
+
+	for i, tok := range expected {
+		if i == 0 {
+			res += ", expecting "
+		} else {
+			res += " or "
+		}
+		res += yyTokname(tok)
+	}
+	return res
+}
+
+func yylex1(lex yyLexer, lval *yySymType) (char, token int) {
+	token = 0
+	char = lex.Lex(lval)
 	if char <= 0 {
-		c = yyTok1[0]
+		token = int(yyTok1[0])
 		goto out
 	}
 	if char < len(yyTok1) {
-		c = yyTok1[char]
+		token = int(yyTok1[char])
 		goto out
 	}
 	if char >= yyPrivate {
 		if char < yyPrivate+len(yyTok2) {
-			c = yyTok2[char-yyPrivate]
+			token = int(yyTok2[char-yyPrivate])
 			goto out
 		}
 	}
 	for i := 0; i < len(yyTok3); i += 2 {
-		c = yyTok3[i+0]
-		if c == char {
-			c = yyTok3[i+1]
+		token = int(yyTok3[i+0])
+		if token == char {
+			token = int(yyTok3[i+1])
 			goto out
 		}
 	}
 
 out:
-	if c == 0 {
-		c = yyTok2[1] /* unknown char */
+	if token == 0 {
+		token = int(yyTok2[1]) /* unknown char */
 	}
 	if yyDebug >= 3 {
-		__yyfmt__.Printf("lex %s(%d)\n", yyTokname(c), uint(char))
+		__yyfmt__.Printf("lex %s(%d)\n", yyTokname(token), uint(char))
 	}
-	return c
+	return char, token
 }
 
 func yyParse(yylex yyLexer) int {
+	return yyNewParser().Parse(yylex)
+}
+
+func (yyrcvr *yyParserImpl) Parse(yylex yyLexer) int {
 	var yyn int
-	var yylval yySymType
 	var yyVAL yySymType
-	yyS := make([]yySymType, yyMaxDepth)
+	var yyDollar []yySymType
+	_ = yyDollar // silence set and not used
+	yyS := yyrcvr.stack[:]
 
 	Nerrs := 0   /* number of errors */
 	Errflag := 0 /* error recovery flag */
 	yystate := 0
-	yychar := -1
+	yyrcvr.char = -1
+	yytoken := -1 // yyrcvr.char translated into internal numbering
+	defer func() {
+		// Make sure we report no lookahead when not parsing.
+		yystate = -1
+		yyrcvr.char = -1
+		yytoken = -1
+	}()
 	yyp := -1
 	goto yystack
 
@@ -419,7 +573,7 @@ ret1:
 yystack:
 	/* put a state and value onto the stack */
 	if yyDebug >= 4 {
-		__yyfmt__.Printf("char %v in %v\n", yyTokname(yychar), yyStatname(yystate))
+		__yyfmt__.Printf("char %v in %v\n", yyTokname(yytoken), yyStatname(yystate))
 	}
 
 	yyp++
@@ -432,21 +586,22 @@ yystack:
 	yyS[yyp].yys = yystate
 
 yynewstate:
-	yyn = yyPact[yystate]
+	yyn = int(yyPact[yystate])
 	if yyn <= yyFlag {
 		goto yydefault /* simple state */
 	}
-	if yychar < 0 {
-		yychar = yylex1(yylex, &yylval)
+	if yyrcvr.char < 0 {
+		yyrcvr.char, yytoken = yylex1(yylex, &yyrcvr.lval)
 	}
-	yyn += yychar
+	yyn += yytoken
 	if yyn < 0 || yyn >= yyLast {
 		goto yydefault
 	}
-	yyn = yyAct[yyn]
-	if yyChk[yyn] == yychar { /* valid shift */
-		yychar = -1
-		yyVAL = yylval
+	yyn = int(yyAct[yyn])
+	if int(yyChk[yyn]) == yytoken { /* valid shift */
+		yyrcvr.char = -1
+		yytoken = -1
+		yyVAL = yyrcvr.lval
 		yystate = yyn
 		if Errflag > 0 {
 			Errflag--
@@ -456,27 +611,27 @@ yynewstate:
 
 yydefault:
 	/* default state action */
-	yyn = yyDef[yystate]
+	yyn = int(yyDef[yystate])
 	if yyn == -2 {
-		if yychar < 0 {
-			yychar = yylex1(yylex, &yylval)
+		if yyrcvr.char < 0 {
+			yyrcvr.char, yytoken = yylex1(yylex, &yyrcvr.lval)
 		}
 
 		/* look through exception table */
 		xi := 0
 		for {
-			if yyExca[xi+0] == -1 && yyExca[xi+1] == yystate {
+			if yyExca[xi+0] == -1 && int(yyExca[xi+1]) == yystate {
 				break
 			}
 			xi += 2
 		}
 		for xi += 2; ; xi += 2 {
-			yyn = yyExca[xi+0]
-			if yyn < 0 || yyn == yychar {
+			yyn = int(yyExca[xi+0])
+			if yyn < 0 || yyn == yytoken {
 				break
 			}
 		}
-		yyn = yyExca[xi+1]
+		yyn = int(yyExca[xi+1])
 		if yyn < 0 {
 			goto ret0
 		}
@@ -485,11 +640,11 @@ yydefault:
 		/* error ... attempt to resume parsing */
 		switch Errflag {
 		case 0: /* brand new error */
-			yylex.Error("syntax error")
+			yylex.Error(yyErrorMessage(yystate, yytoken))
 			Nerrs++
 			if yyDebug >= 1 {
 				__yyfmt__.Printf("%s", yyStatname(yystate))
-				__yyfmt__.Printf(" saw %s\n", yyTokname(yychar))
+				__yyfmt__.Printf(" saw %s\n", yyTokname(yytoken))
 			}
 			fallthrough
 
@@ -498,10 +653,10 @@ yydefault:
 
 			/* find a state where "error" is a legal shift action */
 			for yyp >= 0 {
-				yyn = yyPact[yyS[yyp].yys] + yyErrCode
+				yyn = int(yyPact[yyS[yyp].yys]) + yyErrCode
 				if yyn >= 0 && yyn < yyLast {
-					yystate = yyAct[yyn] /* simulate a shift of "error" */
-					if yyChk[yystate] == yyErrCode {
+					yystate = int(yyAct[yyn]) /* simulate a shift of "error" */
+					if int(yyChk[yystate]) == yyErrCode {
 						goto yystack
 					}
 				}
@@ -517,12 +672,13 @@ yydefault:
 
 		case 3: /* no shift yet; clobber input char */
 			if yyDebug >= 2 {
-				__yyfmt__.Printf("error recovery discards %s\n", yyTokname(yychar))
+				__yyfmt__.Printf("error recovery discards %s\n", yyTokname(yytoken))
 			}
-			if yychar == yyEofCode {
+			if yytoken == yyEofCode {
 				goto ret1
 			}
-			yychar = -1
+			yyrcvr.char = -1
+			yytoken = -1
 			goto yynewstate /* try again in the same state */
 		}
 	}
@@ -536,599 +692,751 @@ yydefault:
 	yypt := yyp
 	_ = yypt // guard against "declared and not used"
 
-	yyp -= yyR2[yyn]
+	yyp -= int(yyR2[yyn])
+	// yyp is now the index of $0. Perform the default action. Iff the
+	// reduced production is ε, $1 is possibly out of range.
+	if yyp+1 >= len(yyS) {
+		nyys := make([]yySymType, len(yyS)*2)
+		copy(nyys, yyS)
+		yyS = nyys
+	}
 	yyVAL = yyS[yyp+1]
 
 	/* consult goto table to find next state */
-	yyn = yyR1[yyn]
-	yyg := yyPgo[yyn]
+	yyn = int(yyR1[yyn])
+	yyg := int(yyPgo[yyn])
 	yyj := yyg + yyS[yyp].yys + 1
 
 	if yyj >= yyLast {
-		yystate = yyAct[yyg]
+		yystate = int(yyAct[yyg])
 	} else {
-		yystate = yyAct[yyj]
-		if yyChk[yystate] != -yyn {
-			yystate = yyAct[yyg]
+		yystate = int(yyAct[yyj])
+		if int(yyChk[yystate]) != -yyn {
+			yystate = int(yyAct[yyg])
 		}
 	}
 	// dummy call; replaced with literal code
 	switch yynt {
 
 	case 1:
-		//line parser.go.y:73
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.go.y:77
 		{
-			yyVAL.stmts = yyS[yypt-0].stmts
+			yyVAL.stmts = yyDollar[1].stmts
 			if l, ok := yylex.(*Lexer); ok {
 				l.Stmts = yyVAL.stmts
 			}
 		}
 	case 2:
-		//line parser.go.y:79
+		yyDollar = yyS[yypt-2 : yypt+1]
+//line parser.go.y:83
 		{
-			yyVAL.stmts = append(yyS[yypt-1].stmts, yyS[yypt-0].stmt)
+			yyVAL.stmts = append(yyDollar[1].stmts, yyDollar[2].stmt)
 			if l, ok := yylex.(*Lexer); ok {
 				l.Stmts = yyVAL.stmts
 			}
 		}
 	case 3:
-		//line parser.go.y:85
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.go.y:89
 		{
-			yyVAL.stmts = append(yyS[yypt-2].stmts, yyS[yypt-1].stmt)
+			yyVAL.stmts = append(yyDollar[1].stmts, yyDollar[2].stmt)
 			if l, ok := yylex.(*Lexer); ok {
 				l.Stmts = yyVAL.stmts
 			}
 		}
 	case 4:
-		//line parser.go.y:93
+		yyDollar = yyS[yypt-0 : yypt+1]
+//line parser.go.y:97
 		{
 			yyVAL.stmts = []ast.Stmt{}
 		}
 	case 5:
-		//line parser.go.y:96
+		yyDollar = yyS[yypt-2 : yypt+1]
+//line parser.go.y:100
 		{
-			yyVAL.stmts = append(yyS[yypt-1].stmts, yyS[yypt-0].stmt)
+			yyVAL.stmts = append(yyDollar[1].stmts, yyDollar[2].stmt)
 		}
 	case 6:
-		//line parser.go.y:99
+		yyDollar = yyS[yypt-2 : yypt+1]
+//line parser.go.y:103
 		{
-			yyVAL.stmts = yyS[yypt-1].stmts
+			yyVAL.stmts = yyDollar[1].stmts
 		}
 	case 7:
-		//line parser.go.y:104
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.go.y:108
 		{
-			yyVAL.stmts = yyS[yypt-0].stmts
+			yyVAL.stmts = yyDollar[1].stmts
 		}
 	case 8:
-		//line parser.go.y:109
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.go.y:113
 		{
-			yyVAL.stmt = &ast.AssignStmt{Lhs: yyS[yypt-2].exprlist, Rhs: yyS[yypt-0].exprlist}
-			yyVAL.stmt.SetLine(yyS[yypt-2].exprlist[0].Line())
+			yyVAL.stmt = &ast.AssignStmt{Lhs: yyDollar[1].exprlist, Rhs: yyDollar[3].exprlist}
+			yyVAL.stmt.SetLine(yyDollar[1].exprlist[0].Line())
 		}
 	case 9:
-		//line parser.go.y:114
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.go.y:118
 		{
-			if _, ok := yyS[yypt-0].expr.(*ast.FuncCallExpr); !ok {
+			if _, ok := yyDollar[1].expr.(*ast.FuncCallExpr); !ok {
 				yylex.(*Lexer).Error("parse error")
 			} else {
-				yyVAL.stmt = &ast.FuncCallStmt{Expr: yyS[yypt-0].expr}
-				yyVAL.stmt.SetLine(yyS[yypt-0].expr.Line())
+				yyVAL.stmt = &ast.FuncCallStmt{Expr: yyDollar[1].expr}
+				yyVAL.stmt.SetLine(yyDollar[1].expr.Line())
 			}
 		}
 	case 10:
-		//line parser.go.y:122
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.go.y:126
 		{
-			yyVAL.stmt = &ast.DoBlockStmt{Stmts: yyS[yypt-1].stmts}
-			yyVAL.stmt.SetLine(yyS[yypt-2].token.Pos.Line)
-			yyVAL.stmt.SetLastLine(yyS[yypt-0].token.Pos.Line)
+			yyVAL.stmt = &ast.DoBlockStmt{Stmts: yyDollar[2].stmts}
+			yyVAL.stmt.SetLine(yyDollar[1].token.Pos.Line)
+			yyVAL.stmt.SetLastLine(yyDollar[3].token.Pos.Line)
 		}
 	case 11:
-		//line parser.go.y:127
+		yyDollar = yyS[yypt-5 : yypt+1]
+//line parser.go.y:131
 		{
-			yyVAL.stmt = &ast.WhileStmt{Condition: yyS[yypt-3].expr, Stmts: yyS[yypt-1].stmts}
-			yyVAL.stmt.SetLine(yyS[yypt-4].token.Pos.Line)
-			yyVAL.stmt.SetLastLine(yyS[yypt-0].token.Pos.Line)
+			yyVAL.stmt = &ast.WhileStmt{Condition: yyDollar[2].expr, Stmts: yyDollar[4].stmts}
+			yyVAL.stmt.SetLine(yyDollar[1].token.Pos.Line)
+			yyVAL.stmt.SetLastLine(yyDollar[5].token.Pos.Line)
 		}
 	case 12:
-		//line parser.go.y:132
+		yyDollar = yyS[yypt-4 : yypt+1]
+//line parser.go.y:136
 		{
-			yyVAL.stmt = &ast.RepeatStmt{Condition: yyS[yypt-0].expr, Stmts: yyS[yypt-2].stmts}
-			yyVAL.stmt.SetLine(yyS[yypt-3].token.Pos.Line)
-			yyVAL.stmt.SetLastLine(yyS[yypt-0].expr.Line())
+			yyVAL.stmt = &ast.RepeatStmt{Condition: yyDollar[4].expr, Stmts: yyDollar[2].stmts}
+			yyVAL.stmt.SetLine(yyDollar[1].token.Pos.Line)
+			yyVAL.stmt.SetLastLine(yyDollar[4].expr.Line())
 		}
 	case 13:
-		//line parser.go.y:137
+		yyDollar = yyS[yypt-6 : yypt+1]
+//line parser.go.y:141
 		{
-			yyVAL.stmt = &ast.IfStmt{Condition: yyS[yypt-4].expr, Then: yyS[yypt-2].stmts}
+			yyVAL.stmt = &ast.IfStmt{Condition: yyDollar[2].expr, Then: yyDollar[4].stmts}
 			cur := yyVAL.stmt
-			for _, elseif := range yyS[yypt-1].stmts {
+			for _, elseif := range yyDollar[5].stmts {
 				cur.(*ast.IfStmt).Else = []ast.Stmt{elseif}
 				cur = elseif
 			}
-			yyVAL.stmt.SetLine(yyS[yypt-5].token.Pos.Line)
-			yyVAL.stmt.SetLastLine(yyS[yypt-0].token.Pos.Line)
+			yyVAL.stmt.SetLine(yyDollar[1].token.Pos.Line)
+			yyVAL.stmt.SetLastLine(yyDollar[6].token.Pos.Line)
 		}
 	case 14:
-		//line parser.go.y:147
+		yyDollar = yyS[yypt-8 : yypt+1]
+//line parser.go.y:151
 		{
-			yyVAL.stmt = &ast.IfStmt{Condition: yyS[yypt-6].expr, Then: yyS[yypt-4].stmts}
+			yyVAL.stmt = &ast.IfStmt{Condition: yyDollar[2].expr, Then: yyDollar[4].stmts}
 			cur := yyVAL.stmt
-			for _, elseif := range yyS[yypt-3].stmts {
+			for _, elseif := range yyDollar[5].stmts {
 				cur.(*ast.IfStmt).Else = []ast.Stmt{elseif}
 				cur = elseif
 			}
-			cur.(*ast.IfStmt).Else = yyS[yypt-1].stmts
-			yyVAL.stmt.SetLine(yyS[yypt-7].token.Pos.Line)
-			yyVAL.stmt.SetLastLine(yyS[yypt-0].token.Pos.Line)
+			cur.(*ast.IfStmt).Else = yyDollar[7].stmts
+			yyVAL.stmt.SetLine(yyDollar[1].token.Pos.Line)
+			yyVAL.stmt.SetLastLine(yyDollar[8].token.Pos.Line)
 		}
 	case 15:
-		//line parser.go.y:158
+		yyDollar = yyS[yypt-9 : yypt+1]
+//line parser.go.y:162
 		{
-			yyVAL.stmt = &ast.NumberForStmt{Name: yyS[yypt-7].token.Str, Init: yyS[yypt-5].expr, Limit: yyS[yypt-3].expr, Stmts: yyS[yypt-1].stmts}
-			yyVAL.stmt.SetLine(yyS[yypt-8].token.Pos.Line)
-			yyVAL.stmt.SetLastLine(yyS[yypt-0].token.Pos.Line)
+			yyVAL.stmt = &ast.NumberForStmt{Name: yyDollar[2].token.Str, Init: yyDollar[4].expr, Limit: yyDollar[6].expr, Stmts: yyDollar[8].stmts}
+			yyVAL.stmt.SetLine(yyDollar[1].token.Pos.Line)
+			yyVAL.stmt.SetLastLine(yyDollar[9].token.Pos.Line)
 		}
 	case 16:
-		//line parser.go.y:163
+		yyDollar = yyS[yypt-11 : yypt+1]
+//line parser.go.y:167
 		{
-			yyVAL.stmt = &ast.NumberForStmt{Name: yyS[yypt-9].token.Str, Init: yyS[yypt-7].expr, Limit: yyS[yypt-5].expr, Step: yyS[yypt-3].expr, Stmts: yyS[yypt-1].stmts}
-			yyVAL.stmt.SetLine(yyS[yypt-10].token.Pos.Line)
-			yyVAL.stmt.SetLastLine(yyS[yypt-0].token.Pos.Line)
+			yyVAL.stmt = &ast.NumberForStmt{Name: yyDollar[2].token.Str, Init: yyDollar[4].expr, Limit: yyDollar[6].expr, Step: yyDollar[8].expr, Stmts: yyDollar[10].stmts}
+			yyVAL.stmt.SetLine(yyDollar[1].token.Pos.Line)
+			yyVAL.stmt.SetLastLine(yyDollar[11].token.Pos.Line)
 		}
 	case 17:
-		//line parser.go.y:168
+		yyDollar = yyS[yypt-7 : yypt+1]
+//line parser.go.y:172
 		{
-			yyVAL.stmt = &ast.GenericForStmt{Names: yyS[yypt-5].namelist, Exprs: yyS[yypt-3].exprlist, Stmts: yyS[yypt-1].stmts}
-			yyVAL.stmt.SetLine(yyS[yypt-6].token.Pos.Line)
-			yyVAL.stmt.SetLastLine(yyS[yypt-0].token.Pos.Line)
+			yyVAL.stmt = &ast.GenericForStmt{Names: yyDollar[2].namelist, Exprs: yyDollar[4].exprlist, Stmts: yyDollar[6].stmts}
+			yyVAL.stmt.SetLine(yyDollar[1].token.Pos.Line)
+			yyVAL.stmt.SetLastLine(yyDollar[7].token.Pos.Line)
 		}
 	case 18:
-		//line parser.go.y:173
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.go.y:177
 		{
-			yyVAL.stmt = &ast.FuncDefStmt{Name: yyS[yypt-1].funcname, Func: yyS[yypt-0].funcexpr}
-			yyVAL.stmt.SetLine(yyS[yypt-2].token.Pos.Line)
-			yyVAL.stmt.SetLastLine(yyS[yypt-0].funcexpr.LastLine())
+			yyVAL.stmt = &ast.FuncDefStmt{Name: yyDollar[2].funcname, Func: yyDollar[3].funcexpr}
+			yyVAL.stmt.SetLine(yyDollar[1].token.Pos.Line)
+			yyVAL.stmt.SetLastLine(yyDollar[3].funcexpr.LastLine())
 		}
 	case 19:
-		//line parser.go.y:178
+		yyDollar = yyS[yypt-4 : yypt+1]
+//line parser.go.y:182
 		{
-			yyVAL.stmt = &ast.LocalAssignStmt{Names: []string{yyS[yypt-1].token.Str}, Exprs: []ast.Expr{yyS[yypt-0].funcexpr}}
-			yyVAL.stmt.SetLine(yyS[yypt-3].token.Pos.Line)
-			yyVAL.stmt.SetLastLine(yyS[yypt-0].funcexpr.LastLine())
+			yyVAL.stmt = &ast.LocalAssignStmt{Names: []string{yyDollar[3].token.Str}, Exprs: []ast.Expr{yyDollar[4].funcexpr}, Function: true}
+			yyVAL.stmt.SetLine(yyDollar[1].token.Pos.Line)
+			yyVAL.stmt.SetLastLine(yyDollar[4].funcexpr.LastLine())
 		}
 	case 20:
-		//line parser.go.y:183
+		yyDollar = yyS[yypt-4 : yypt+1]
+//line parser.go.y:187
 		{
-			yyVAL.stmt = &ast.LocalAssignStmt{Names: yyS[yypt-2].namelist, Exprs: yyS[yypt-0].exprlist}
-			yyVAL.stmt.SetLine(yyS[yypt-3].token.Pos.Line)
+			yyVAL.stmt = &ast.LocalAssignStmt{Names: yyDollar[2].namelist, Exprs: yyDollar[4].exprlist}
+			yyVAL.stmt.SetLine(yyDollar[1].token.Pos.Line)
 		}
 	case 21:
-		//line parser.go.y:187
+		yyDollar = yyS[yypt-2 : yypt+1]
+//line parser.go.y:191
 		{
-			yyVAL.stmt = &ast.LocalAssignStmt{Names: yyS[yypt-0].namelist, Exprs: []ast.Expr{}}
-			yyVAL.stmt.SetLine(yyS[yypt-1].token.Pos.Line)
+			yyVAL.stmt = &ast.LocalAssignStmt{Names: yyDollar[2].namelist, Exprs: []ast.Expr{}}
+			yyVAL.stmt.SetLine(yyDollar[1].token.Pos.Line)
 		}
 	case 22:
-		//line parser.go.y:193
+		yyDollar = yyS[yypt-0 : yypt+1]
+//line parser.go.y:197
 		{
 			yyVAL.stmts = []ast.Stmt{}
 		}
 	case 23:
-		//line parser.go.y:196
+		yyDollar = yyS[yypt-5 : yypt+1]
+//line parser.go.y:200
 		{
-			yyVAL.stmts = append(yyS[yypt-4].stmts, &ast.IfStmt{Condition: yyS[yypt-2].expr, Then: yyS[yypt-0].stmts})
-			yyVAL.stmts[len(yyVAL.stmts)-1].SetLine(yyS[yypt-3].token.Pos.Line)
+			yyVAL.stmts = append(yyDollar[1].stmts, &ast.IfStmt{Condition: yyDollar[3].expr, Then: yyDollar[5].stmts})
+			yyVAL.stmts[len(yyVAL.stmts)-1].SetLine(yyDollar[2].token.Pos.Line)
 		}
 	case 24:
-		//line parser.go.y:202
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.go.y:206
 		{
 			yyVAL.stmt = &ast.ReturnStmt{Exprs: nil}
-			yyVAL.stmt.SetLine(yyS[yypt-0].token.Pos.Line)
+			yyVAL.stmt.SetLine(yyDollar[1].token.Pos.Line)
 		}
 	case 25:
-		//line parser.go.y:206
+		yyDollar = yyS[yypt-2 : yypt+1]
+//line parser.go.y:210
 		{
-			yyVAL.stmt = &ast.ReturnStmt{Exprs: yyS[yypt-0].exprlist}
-			yyVAL.stmt.SetLine(yyS[yypt-1].token.Pos.Line)
+			yyVAL.stmt = &ast.ReturnStmt{Exprs: yyDollar[2].exprlist}
+			yyVAL.stmt.SetLine(yyDollar[1].token.Pos.Line)
 		}
 	case 26:
-		//line parser.go.y:210
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.go.y:214
 		{
 			yyVAL.stmt = &ast.BreakStmt{}
-			yyVAL.stmt.SetLine(yyS[yypt-0].token.Pos.Line)
+			yyVAL.stmt.SetLine(yyDollar[1].token.Pos.Line)
 		}
 	case 27:
-		//line parser.go.y:216
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.go.y:220
 		{
-			yyVAL.funcname = yyS[yypt-0].funcname
+			yyVAL.funcname = yyDollar[1].funcname
 		}
 	case 28:
-		//line parser.go.y:219
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.go.y:223
 		{
-			yyVAL.funcname = &ast.FuncName{Func: nil, Receiver: yyS[yypt-2].funcname.Func, Method: yyS[yypt-0].token.Str}
+			yyVAL.funcname = &ast.FuncName{Func: nil, Receiver: yyDollar[1].funcname.Func, Method: yyDollar[3].token.Str}
 		}
 	case 29:
-		//line parser.go.y:224
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.go.y:228
 		{
-			yyVAL.funcname = &ast.FuncName{Func: &ast.IdentExpr{Value: yyS[yypt-0].token.Str}}
-			yyVAL.funcname.Func.SetLine(yyS[yypt-0].token.Pos.Line)
+			yyVAL.funcname = &ast.FuncName{Func: &ast.IdentExpr{Value: yyDollar[1].token.Str}}
+			yyVAL.funcname.Func.SetLine(yyDollar[1].token.Pos.Line)
 		}
 	case 30:
-		//line parser.go.y:228
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.go.y:232
 		{
-			key := &ast.StringExpr{Value: yyS[yypt-0].token.Str}
-			key.SetLine(yyS[yypt-0].token.Pos.Line)
-			fn := &ast.AttrGetExpr{Object: yyS[yypt-2].funcname.Func, Key: key}
-			fn.SetLine(yyS[yypt-0].token.Pos.Line)
+			key := &ast.StringExpr{Value: yyDollar[3].token.Str}
+			key.SetLine(yyDollar[3].token.Pos.Line)
+			fn := &ast.AttrGetExpr{Object: yyDollar[1].funcname.Func, Key: key}
+			fn.SetLine(yyDollar[3].token.Pos.Line)
 			yyVAL.funcname = &ast.FuncName{Func: fn}
 		}
 	case 31:
-		//line parser.go.y:237
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.go.y:241
 		{
-			yyVAL.exprlist = []ast.Expr{yyS[yypt-0].expr}
+			yyVAL.exprlist = []ast.Expr{yyDollar[1].expr}
 		}
 	case 32:
-		//line parser.go.y:240
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.go.y:244
 		{
-			yyVAL.exprlist = append(yyS[yypt-2].exprlist, yyS[yypt-0].expr)
+			yyVAL.exprlist = append(yyDollar[1].exprlist, yyDollar[3].expr)
 		}
 	case 33:
-		//line parser.go.y:245
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.go.y:249
 		{
-			yyVAL.expr = &ast.IdentExpr{Value: yyS[yypt-0].token.Str}
-			yyVAL.expr.SetLine(yyS[yypt-0].token.Pos.Line)
+			yyVAL.expr = &ast.IdentExpr{Value: yyDollar[1].token.Str}
+			yyVAL.expr.SetLine(yyDollar[1].token.Pos.Line)
 		}
 	case 34:
-		//line parser.go.y:249
+		yyDollar = yyS[yypt-4 : yypt+1]
+//line parser.go.y:253
 		{
-			yyVAL.expr = &ast.AttrGetExpr{Object: yyS[yypt-3].expr, Key: yyS[yypt-1].expr}
-			yyVAL.expr.SetLine(yyS[yypt-3].expr.Line())
+			yyVAL.expr = &ast.AttrGetExpr{Object: yyDollar[1].expr, Key: yyDollar[3].expr}
+			yyVAL.expr.SetLine(yyDollar[1].expr.Line())
 		}
 	case 35:
-		//line parser.go.y:253
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.go.y:257
 		{
-			key := &ast.StringExpr{Value: yyS[yypt-0].token.Str}
-			key.SetLine(yyS[yypt-0].token.Pos.Line)
-			yyVAL.expr = &ast.AttrGetExpr{Object: yyS[yypt-2].expr, Key: key}
-			yyVAL.expr.SetLine(yyS[yypt-2].expr.Line())
+			key := &ast.StringExpr{Value: yyDollar[3].token.Str}
+			key.SetLine(yyDollar[3].token.Pos.Line)
+			yyVAL.expr = &ast.AttrGetExpr{Object: yyDollar[1].expr, Key: key}
+			yyVAL.expr.SetLine(yyDollar[1].expr.Line())
 		}
 	case 36:
-		//line parser.go.y:261
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.go.y:265
 		{
-			yyVAL.namelist = []string{yyS[yypt-0].token.Str}
+			yyVAL.namelist = []string{yyDollar[1].token.Str}
 		}
 	case 37:
-		//line parser.go.y:264
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.go.y:268
 		{
-			yyVAL.namelist = append(yyS[yypt-2].namelist, yyS[yypt-0].token.Str)
+			yyVAL.namelist = append(yyDollar[1].namelist, yyDollar[3].token.Str)
 		}
 	case 38:
-		//line parser.go.y:269
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.go.y:273
 		{
-			yyVAL.exprlist = []ast.Expr{yyS[yypt-0].expr}
+			yyVAL.exprlist = []ast.Expr{yyDollar[1].expr}
 		}
 	case 39:
-		//line parser.go.y:272
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.go.y:276
 		{
-			yyVAL.exprlist = append(yyS[yypt-2].exprlist, yyS[yypt-0].expr)
+			yyVAL.exprlist = append(yyDollar[1].exprlist, yyDollar[3].expr)
 		}
 	case 40:
-		//line parser.go.y:277
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.go.y:281
 		{
 			yyVAL.expr = &ast.NilExpr{}
-			yyVAL.expr.SetLine(yyS[yypt-0].token.Pos.Line)
+			yyVAL.expr.SetLine(yyDollar[1].token.Pos.Line)
 		}
 	case 41:
-		//line parser.go.y:281
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.go.y:285
 		{
 			yyVAL.expr = &ast.FalseExpr{}
-			yyVAL.expr.SetLine(yyS[yypt-0].token.Pos.Line)
+			yyVAL.expr.SetLine(yyDollar[1].token.Pos.Line)
 		}
 	case 42:
-		//line parser.go.y:285
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.go.y:289
 		{
 			yyVAL.expr = &ast.TrueExpr{}
-			yyVAL.expr.SetLine(yyS[yypt-0].token.Pos.Line)
+			yyVAL.expr.SetLine(yyDollar[1].token.Pos.Line)
 		}
 	case 43:
-		//line parser.go.y:289
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.go.y:293
 		{
-			yyVAL.expr = &ast.NumberExpr{Value: yyS[yypt-0].token.Str}
-			yyVAL.expr.SetLine(yyS[yypt-0].token.Pos.Line)
+			yyVAL.expr = &ast.NumberExpr{Value: yyDollar[1].token.Str}
+			yyVAL.expr.SetLine(yyDollar[1].token.Pos.Line)
 		}
 	case 44:
-		//line parser.go.y:293
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.go.y:297
 		{
 			yyVAL.expr = &ast.Comma3Expr{}
-			yyVAL.expr.SetLine(yyS[yypt-0].token.Pos.Line)
+			yyVAL.expr.SetLine(yyDollar[1].token.Pos.Line)
 		}
 	case 45:
-		//line parser.go.y:297
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.go.y:301
 		{
-			yyVAL.expr = yyS[yypt-0].expr
+			yyVAL.expr = yyDollar[1].expr
 		}
 	case 46:
-		//line parser.go.y:300
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.go.y:304
 		{
-			yyVAL.expr = yyS[yypt-0].expr
+			yyVAL.expr = yyDollar[1].expr
 		}
 	case 47:
-		//line parser.go.y:303
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.go.y:307
 		{
-			yyVAL.expr = yyS[yypt-0].expr
+			yyVAL.expr = yyDollar[1].expr
 		}
 	case 48:
-		//line parser.go.y:306
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.go.y:310
 		{
-			yyVAL.expr = yyS[yypt-0].expr
+			yyVAL.expr = yyDollar[1].expr
 		}
 	case 49:
-		//line parser.go.y:309
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.go.y:313
 		{
-			yyVAL.expr = &ast.LogicalOpExpr{Lhs: yyS[yypt-2].expr, Operator: "or", Rhs: yyS[yypt-0].expr}
-			yyVAL.expr.SetLine(yyS[yypt-2].expr.Line())
+			yyVAL.expr = &ast.LogicalOpExpr{Lhs: yyDollar[1].expr, Operator: "or", Rhs: yyDollar[3].expr}
+			yyVAL.expr.SetLine(yyDollar[1].expr.Line())
 		}
 	case 50:
-		//line parser.go.y:313
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.go.y:317
 		{
-			yyVAL.expr = &ast.LogicalOpExpr{Lhs: yyS[yypt-2].expr, Operator: "and", Rhs: yyS[yypt-0].expr}
-			yyVAL.expr.SetLine(yyS[yypt-2].expr.Line())
+			yyVAL.expr = &ast.LogicalOpExpr{Lhs: yyDollar[1].expr, Operator: "and", Rhs: yyDollar[3].expr}
+			yyVAL.expr.SetLine(yyDollar[1].expr.Line())
 		}
 	case 51:
-		//line parser.go.y:317
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.go.y:321
 		{
-			yyVAL.expr = &ast.RelationalOpExpr{Lhs: yyS[yypt-2].expr, Operator: ">", Rhs: yyS[yypt-0].expr}
-			yyVAL.expr.SetLine(yyS[yypt-2].expr.Line())
+			yyVAL.expr = &ast.RelationalOpExpr{Lhs: yyDollar[1].expr, Operator: ">", Rhs: yyDollar[3].expr}
+			yyVAL.expr.SetLine(yyDollar[1].expr.Line())
 		}
 	case 52:
-		//line parser.go.y:321
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.go.y:325
 		{
-			yyVAL.expr = &ast.RelationalOpExpr{Lhs: yyS[yypt-2].expr, Operator: "<", Rhs: yyS[yypt-0].expr}
-			yyVAL.expr.SetLine(yyS[yypt-2].expr.Line())
+			yyVAL.expr = &ast.RelationalOpExpr{Lhs: yyDollar[1].expr, Operator: "<", Rhs: yyDollar[3].expr}
+			yyVAL.expr.SetLine(yyDollar[1].expr.Line())
 		}
 	case 53:
-		//line parser.go.y:325
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.go.y:329
 		{
-			yyVAL.expr = &ast.RelationalOpExpr{Lhs: yyS[yypt-2].expr, Operator: ">=", Rhs: yyS[yypt-0].expr}
-			yyVAL.expr.SetLine(yyS[yypt-2].expr.Line())
+			yyVAL.expr = &ast.RelationalOpExpr{Lhs: yyDollar[1].expr, Operator: ">=", Rhs: yyDollar[3].expr}
+			yyVAL.expr.SetLine(yyDollar[1].expr.Line())
 		}
 	case 54:
-		//line parser.go.y:329
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.go.y:333
 		{
-			yyVAL.expr = &ast.RelationalOpExpr{Lhs: yyS[yypt-2].expr, Operator: "<=", Rhs: yyS[yypt-0].expr}
-			yyVAL.expr.SetLine(yyS[yypt-2].expr.Line())
+			yyVAL.expr = &ast.RelationalOpExpr{Lhs: yyDollar[1].expr, Operator: "<=", Rhs: yyDollar[3].expr}
+			yyVAL.expr.SetLine(yyDollar[1].expr.Line())
 		}
 	case 55:
-		//line parser.go.y:333
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.go.y:337
 		{
-			yyVAL.expr = &ast.RelationalOpExpr{Lhs: yyS[yypt-2].expr, Operator: "==", Rhs: yyS[yypt-0].expr}
-			yyVAL.expr.SetLine(yyS[yypt-2].expr.Line())
+			yyVAL.expr = &ast.RelationalOpExpr{Lhs: yyDollar[1].expr, Operator: "==", Rhs: yyDollar[3].expr}
+			yyVAL.expr.SetLine(yyDollar[1].expr.Line())
 		}
 	case 56:
-		//line parser.go.y:337
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.go.y:341
 		{
-			yyVAL.expr = &ast.RelationalOpExpr{Lhs: yyS[yypt-2].expr, Operator: "~=", Rhs: yyS[yypt-0].expr}
-			yyVAL.expr.SetLine(yyS[yypt-2].expr.Line())
+			yyVAL.expr = &ast.RelationalOpExpr{Lhs: yyDollar[1].expr, Operator: "~=", Rhs: yyDollar[3].expr}
+			yyVAL.expr.SetLine(yyDollar[1].expr.Line())
 		}
 	case 57:
-		//line parser.go.y:341
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.go.y:345
 		{
-			yyVAL.expr = &ast.StringConcatOpExpr{Lhs: yyS[yypt-2].expr, Rhs: yyS[yypt-0].expr}
-			yyVAL.expr.SetLine(yyS[yypt-2].expr.Line())
+			yyVAL.expr = &ast.StringConcatOpExpr{Lhs: yyDollar[1].expr, Rhs: yyDollar[3].expr}
+			yyVAL.expr.SetLine(yyDollar[1].expr.Line())
 		}
 	case 58:
-		//line parser.go.y:345
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.go.y:349
 		{
-			yyVAL.expr = &ast.ArithmeticOpExpr{Lhs: yyS[yypt-2].expr, Operator: "+", Rhs: yyS[yypt-0].expr}
-			yyVAL.expr.SetLine(yyS[yypt-2].expr.Line())
+			yyVAL.expr = &ast.ArithmeticOpExpr{Lhs: yyDollar[1].expr, Operator: "+", Rhs: yyDollar[3].expr}
+			yyVAL.expr.SetLine(yyDollar[1].expr.Line())
 		}
 	case 59:
-		//line parser.go.y:349
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.go.y:353
 		{
-			yyVAL.expr = &ast.ArithmeticOpExpr{Lhs: yyS[yypt-2].expr, Operator: "-", Rhs: yyS[yypt-0].expr}
-			yyVAL.expr.SetLine(yyS[yypt-2].expr.Line())
+			yyVAL.expr = &ast.ArithmeticOpExpr{Lhs: yyDollar[1].expr, Operator: "-", Rhs: yyDollar[3].expr}
+			yyVAL.expr.SetLine(yyDollar[1].expr.Line())
 		}
 	case 60:
-		//line parser.go.y:353
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.go.y:357
 		{
-			yyVAL.expr = &ast.ArithmeticOpExpr{Lhs: yyS[yypt-2].expr, Operator: "*", Rhs: yyS[yypt-0].expr}
-			yyVAL.expr.SetLine(yyS[yypt-2].expr.Line())
+			yyVAL.expr = &ast.ArithmeticOpExpr{Lhs: yyDollar[1].expr, Operator: "*", Rhs: yyDollar[3].expr}
+			yyVAL.expr.SetLine(yyDollar[1].expr.Line())
 		}
 	case 61:
-		//line parser.go.y:357
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.go.y:361
 		{
-			yyVAL.expr = &ast.ArithmeticOpExpr{Lhs: yyS[yypt-2].expr, Operator: "/", Rhs: yyS[yypt-0].expr}
-			yyVAL.expr.SetLine(yyS[yypt-2].expr.Line())
+			yyVAL.expr = &ast.ArithmeticOpExpr{Lhs: yyDollar[1].expr, Operator: "/", Rhs: yyDollar[3].expr}
+			yyVAL.expr.SetLine(yyDollar[1].expr.Line())
 		}
 	case 62:
-		//line parser.go.y:361
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.go.y:365
 		{
-			yyVAL.expr = &ast.ArithmeticOpExpr{Lhs: yyS[yypt-2].expr, Operator: "%", Rhs: yyS[yypt-0].expr}
-			yyVAL.expr.SetLine(yyS[yypt-2].expr.Line())
+			yyVAL.expr = &ast.ArithmeticOpExpr{Lhs: yyDollar[1].expr, Operator: "%", Rhs: yyDollar[3].expr}
+			yyVAL.expr.SetLine(yyDollar[1].expr.Line())
 		}
 	case 63:
-		//line parser.go.y:365
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.go.y:369
 		{
-			yyVAL.expr = &ast.ArithmeticOpExpr{Lhs: yyS[yypt-2].expr, Operator: "^", Rhs: yyS[yypt-0].expr}
-			yyVAL.expr.SetLine(yyS[yypt-2].expr.Line())
+			yyVAL.expr = &ast.ArithmeticOpExpr{Lhs: yyDollar[1].expr, Operator: "^", Rhs: yyDollar[3].expr}
+			yyVAL.expr.SetLine(yyDollar[1].expr.Line())
 		}
 	case 64:
-		//line parser.go.y:369
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.go.y:373
 		{
-			yyVAL.expr = &ast.UnaryMinusOpExpr{Expr: yyS[yypt-0].expr}
-			yyVAL.expr.SetLine(yyS[yypt-0].expr.Line())
+			yyVAL.expr = &ast.ArithmeticOpExpr{Lhs: yyDollar[1].expr, Operator: "//", Rhs: yyDollar[3].expr}
+			yyVAL.expr.SetLine(yyDollar[1].expr.Line())
 		}
 	case 65:
-		//line parser.go.y:373
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.go.y:377
 		{
-			yyVAL.expr = &ast.UnaryNotOpExpr{Expr: yyS[yypt-0].expr}
-			yyVAL.expr.SetLine(yyS[yypt-0].expr.Line())
+			yyVAL.expr = &ast.ArithmeticOpExpr{Lhs: yyDollar[1].expr, Operator: "&", Rhs: yyDollar[3].expr}
+			yyVAL.expr.SetLine(yyDollar[1].expr.Line())
 		}
 	case 66:
-		//line parser.go.y:377
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.go.y:381
 		{
-			yyVAL.expr = &ast.UnaryLenOpExpr{Expr: yyS[yypt-0].expr}
-			yyVAL.expr.SetLine(yyS[yypt-0].expr.Line())
+			yyVAL.expr = &ast.ArithmeticOpExpr{Lhs: yyDollar[1].expr, Operator: "|", Rhs: yyDollar[3].expr}
+			yyVAL.expr.SetLine(yyDollar[1].expr.Line())
 		}
 	case 67:
-		//line parser.go.y:383
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.go.y:385
 		{
-			yyVAL.expr = &ast.StringExpr{Value: yyS[yypt-0].token.Str}
-			yyVAL.expr.SetLine(yyS[yypt-0].token.Pos.Line)
+			yyVAL.expr = &ast.ArithmeticOpExpr{Lhs: yyDollar[1].expr, Operator: "~", Rhs: yyDollar[3].expr}
+			yyVAL.expr.SetLine(yyDollar[1].expr.Line())
 		}
 	case 68:
-		//line parser.go.y:389
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.go.y:389
 		{
-			yyVAL.expr = yyS[yypt-0].expr
+			yyVAL.expr = &ast.ArithmeticOpExpr{Lhs: yyDollar[1].expr, Operator: "<<", Rhs: yyDollar[3].expr}
+			yyVAL.expr.SetLine(yyDollar[1].expr.Line())
 		}
 	case 69:
-		//line parser.go.y:392
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.go.y:393
 		{
-			yyVAL.expr = yyS[yypt-0].expr
+			yyVAL.expr = &ast.ArithmeticOpExpr{Lhs: yyDollar[1].expr, Operator: ">>", Rhs: yyDollar[3].expr}
+			yyVAL.expr.SetLine(yyDollar[1].expr.Line())
 		}
 	case 70:
-		//line parser.go.y:395
+		yyDollar = yyS[yypt-2 : yypt+1]
+//line parser.go.y:397
 		{
-			yyVAL.expr = yyS[yypt-0].expr
+			yyVAL.expr = &ast.UnaryMinusOpExpr{Expr: yyDollar[2].expr}
+			yyVAL.expr.SetLine(yyDollar[2].expr.Line())
 		}
 	case 71:
-		//line parser.go.y:398
+		yyDollar = yyS[yypt-2 : yypt+1]
+//line parser.go.y:401
 		{
-			yyVAL.expr = yyS[yypt-1].expr
-			yyVAL.expr.SetLine(yyS[yypt-2].token.Pos.Line)
+			yyVAL.expr = &ast.UnaryNotOpExpr{Expr: yyDollar[2].expr}
+			yyVAL.expr.SetLine(yyDollar[2].expr.Line())
 		}
 	case 72:
-		//line parser.go.y:404
+		yyDollar = yyS[yypt-2 : yypt+1]
+//line parser.go.y:405
 		{
-			yyS[yypt-1].expr.(*ast.FuncCallExpr).AdjustRet = true
-			yyVAL.expr = yyS[yypt-1].expr
+			yyVAL.expr = &ast.UnaryLenOpExpr{Expr: yyDollar[2].expr}
+			yyVAL.expr.SetLine(yyDollar[2].expr.Line())
 		}
 	case 73:
-		//line parser.go.y:410
+		yyDollar = yyS[yypt-2 : yypt+1]
+//line parser.go.y:409
 		{
-			yyVAL.expr = &ast.FuncCallExpr{Func: yyS[yypt-1].expr, Args: yyS[yypt-0].exprlist}
-			yyVAL.expr.SetLine(yyS[yypt-1].expr.Line())
+			yyVAL.expr = &ast.UnaryBNotOpExpr{Expr: yyDollar[2].expr}
+			yyVAL.expr.SetLine(yyDollar[2].expr.Line())
 		}
 	case 74:
-		//line parser.go.y:414
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.go.y:415
 		{
-			yyVAL.expr = &ast.FuncCallExpr{Method: yyS[yypt-1].token.Str, Receiver: yyS[yypt-3].expr, Args: yyS[yypt-0].exprlist}
-			yyVAL.expr.SetLine(yyS[yypt-3].expr.Line())
+			yyVAL.expr = &ast.StringExpr{Value: yyDollar[1].token.Str}
+			yyVAL.expr.SetLine(yyDollar[1].token.Pos.Line)
 		}
 	case 75:
-		//line parser.go.y:420
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.go.y:421
 		{
-			if yylex.(*Lexer).PNewLine {
-				yylex.(*Lexer).TokenError(yyS[yypt-1].token, "ambiguous syntax (function call x new statement)")
-			}
-			yyVAL.exprlist = []ast.Expr{}
+			yyVAL.expr = yyDollar[1].expr
 		}
 	case 76:
-		//line parser.go.y:426
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.go.y:424
 		{
-			if yylex.(*Lexer).PNewLine {
-				yylex.(*Lexer).TokenError(yyS[yypt-2].token, "ambiguous syntax (function call x new statement)")
-			}
-			yyVAL.exprlist = yyS[yypt-1].exprlist
+			yyVAL.expr = yyDollar[1].expr
 		}
 	case 77:
-		//line parser.go.y:432
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.go.y:427
 		{
-			yyVAL.exprlist = []ast.Expr{yyS[yypt-0].expr}
+			yyVAL.expr = yyDollar[1].expr
 		}
 	case 78:
-		//line parser.go.y:435
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.go.y:430
 		{
-			yyVAL.exprlist = []ast.Expr{yyS[yypt-0].expr}
+			yyVAL.expr = yyDollar[2].expr
+			yyVAL.expr.SetLine(yyDollar[1].token.Pos.Line)
 		}
 	case 79:
-		//line parser.go.y:440
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.go.y:436
 		{
-			yyVAL.expr = &ast.FunctionExpr{ParList: yyS[yypt-0].funcexpr.ParList, Stmts: yyS[yypt-0].funcexpr.Stmts}
-			yyVAL.expr.SetLine(yyS[yypt-1].token.Pos.Line)
-			yyVAL.expr.SetLastLine(yyS[yypt-0].funcexpr.LastLine())
+			yyDollar[2].expr.(*ast.FuncCallExpr).AdjustRet = true
+			yyVAL.expr = yyDollar[2].expr
 		}
 	case 80:
-		//line parser.go.y:447
+		yyDollar = yyS[yypt-2 : yypt+1]
+//line parser.go.y:442
 		{
-			yyVAL.funcexpr = &ast.FunctionExpr{ParList: yyS[yypt-3].parlist, Stmts: yyS[yypt-1].stmts}
-			yyVAL.funcexpr.SetLine(yyS[yypt-4].token.Pos.Line)
-			yyVAL.funcexpr.SetLastLine(yyS[yypt-0].token.Pos.Line)
+			yyVAL.expr = &ast.FuncCallExpr{Func: yyDollar[1].expr, Args: yyDollar[2].exprlist}
+			yyVAL.expr.SetLine(yyDollar[1].expr.Line())
 		}
 	case 81:
-		//line parser.go.y:452
+		yyDollar = yyS[yypt-4 : yypt+1]
+//line parser.go.y:446
 		{
-			yyVAL.funcexpr = &ast.FunctionExpr{ParList: &ast.ParList{HasVargs: false, Names: []string{}}, Stmts: yyS[yypt-1].stmts}
-			yyVAL.funcexpr.SetLine(yyS[yypt-3].token.Pos.Line)
-			yyVAL.funcexpr.SetLastLine(yyS[yypt-0].token.Pos.Line)
+			yyVAL.expr = &ast.FuncCallExpr{Method: yyDollar[3].token.Str, Receiver: yyDollar[1].expr, Args: yyDollar[4].exprlist}
+			yyVAL.expr.SetLine(yyDollar[1].expr.Line())
 		}
 	case 82:
-		//line parser.go.y:459
+		yyDollar = yyS[yypt-2 : yypt+1]
+//line parser.go.y:452
 		{
-			yyVAL.parlist = &ast.ParList{HasVargs: true, Names: []string{}}
+			if yylex.(*Lexer).PNewLine {
+				yylex.(*Lexer).TokenError(yyDollar[1].token, "ambiguous syntax (function call x new statement)")
+			}
+			yyVAL.exprlist = []ast.Expr{}
 		}
 	case 83:
-		//line parser.go.y:462
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.go.y:458
 		{
-			yyVAL.parlist = &ast.ParList{HasVargs: false, Names: []string{}}
-			yyVAL.parlist.Names = append(yyVAL.parlist.Names, yyS[yypt-0].namelist...)
+			if yylex.(*Lexer).PNewLine {
+				yylex.(*Lexer).TokenError(yyDollar[1].token, "ambiguous syntax (function call x new statement)")
+			}
+			yyVAL.exprlist = yyDollar[2].exprlist
 		}
 	case 84:
-		//line parser.go.y:466
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.go.y:464
 		{
-			yyVAL.parlist = &ast.ParList{HasVargs: true, Names: []string{}}
-			yyVAL.parlist.Names = append(yyVAL.parlist.Names, yyS[yypt-2].namelist...)
+			yyVAL.exprlist = []ast.Expr{yyDollar[1].expr}
 		}
 	case 85:
-		//line parser.go.y:473
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.go.y:467
 		{
-			yyVAL.expr = &ast.TableExpr{Fields: []*ast.Field{}}
-			yyVAL.expr.SetLine(yyS[yypt-1].token.Pos.Line)
+			yyVAL.exprlist = []ast.Expr{yyDollar[1].expr}
 		}
 	case 86:
-		//line parser.go.y:477
+		yyDollar = yyS[yypt-2 : yypt+1]
+//line parser.go.y:472
 		{
-			yyVAL.expr = &ast.TableExpr{Fields: yyS[yypt-1].fieldlist}
-			yyVAL.expr.SetLine(yyS[yypt-2].token.Pos.Line)
+			yyVAL.expr = &ast.FunctionExpr{ParList: yyDollar[2].funcexpr.ParList, Stmts: yyDollar[2].funcexpr.Stmts}
+			yyVAL.expr.SetLine(yyDollar[1].token.Pos.Line)
+			yyVAL.expr.SetLastLine(yyDollar[2].funcexpr.LastLine())
 		}
 	case 87:
-		//line parser.go.y:484
+		yyDollar = yyS[yypt-5 : yypt+1]
+//line parser.go.y:479
 		{
-			yyVAL.fieldlist = []*ast.Field{yyS[yypt-0].field}
+			yyVAL.funcexpr = &ast.FunctionExpr{ParList: yyDollar[2].parlist, Stmts: yyDollar[4].stmts}
+			yyVAL.funcexpr.SetLine(yyDollar[1].token.Pos.Line)
+			yyVAL.funcexpr.SetLastLine(yyDollar[5].token.Pos.Line)
 		}
 	case 88:
-		//line parser.go.y:487
+		yyDollar = yyS[yypt-4 : yypt+1]
+//line parser.go.y:484
 		{
-			yyVAL.fieldlist = append(yyS[yypt-2].fieldlist, yyS[yypt-0].field)
+			yyVAL.funcexpr = &ast.FunctionExpr{ParList: &ast.ParList{HasVargs: false, Names: []string{}}, Stmts: yyDollar[3].stmts}
+			yyVAL.funcexpr.SetLine(yyDollar[1].token.Pos.Line)
+			yyVAL.funcexpr.SetLastLine(yyDollar[4].token.Pos.Line)
 		}
 	case 89:
-		//line parser.go.y:490
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.go.y:491
 		{
-			yyVAL.fieldlist = yyS[yypt-1].fieldlist
+			yyVAL.parlist = &ast.ParList{HasVargs: true, Names: []string{}}
 		}
 	case 90:
-		//line parser.go.y:495
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.go.y:494
 		{
-			yyVAL.field = &ast.Field{Key: &ast.StringExpr{Value: yyS[yypt-2].token.Str}, Value: yyS[yypt-0].expr}
-			yyVAL.field.Key.SetLine(yyS[yypt-2].token.Pos.Line)
+			yyVAL.parlist = &ast.ParList{HasVargs: false, Names: []string{}}
+			yyVAL.parlist.Names = append(yyVAL.parlist.Names, yyDollar[1].namelist...)
 		}
 	case 91:
-		//line parser.go.y:499
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.go.y:498
 		{
-			yyVAL.field = &ast.Field{Key: yyS[yypt-3].expr, Value: yyS[yypt-0].expr}
+			yyVAL.parlist = &ast.ParList{HasVargs: true, Names: []string{}}
+			yyVAL.parlist.Names = append(yyVAL.parlist.Names, yyDollar[1].namelist...)
 		}
 	case 92:
-		//line parser.go.y:502
+		yyDollar = yyS[yypt-2 : yypt+1]
+//line parser.go.y:505
 		{
-			yyVAL.field = &ast.Field{Value: yyS[yypt-0].expr}
+			yyVAL.expr = &ast.TableExpr{Fields: []*ast.Field{}}
+			yyVAL.expr.SetLine(yyDollar[1].token.Pos.Line)
+			yyVAL.expr.SetLastLine(yyDollar[2].token.Pos.Line)
 		}
 	case 93:
-		//line parser.go.y:507
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.go.y:510
 		{
-			yyVAL.fieldsep = ","
+			yyVAL.expr = &ast.TableExpr{Fields: yyDollar[2].fieldlist}
+			yyVAL.expr.SetLine(yyDollar[1].token.Pos.Line)
+			yyVAL.expr.SetLastLine(yyDollar[3].token.Pos.Line)
 		}
 	case 94:
-		//line parser.go.y:510
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.go.y:518
+		{
+			yyVAL.fieldlist = []*ast.Field{yyDollar[1].field}
+		}
+	case 95:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.go.y:521
+		{
+			yyVAL.fieldlist = append(yyDollar[1].fieldlist, yyDollar[3].field)
+		}
+	case 96:
+		yyDollar = yyS[yypt-2 : yypt+1]
+//line parser.go.y:524
+		{
+			yyVAL.fieldlist = yyDollar[1].fieldlist
+		}
+	case 97:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.go.y:529
+		{
+			yyVAL.field = &ast.Field{Key: &ast.StringExpr{Value: yyDollar[1].token.Str}, Value: yyDollar[3].expr}
+			yyVAL.field.Key.SetLine(yyDollar[1].token.Pos.Line)
+		}
+	case 98:
+		yyDollar = yyS[yypt-5 : yypt+1]
+//line parser.go.y:533
+		{
+			yyVAL.field = &ast.Field{Key: yyDollar[2].expr, Value: yyDollar[5].expr}
+		}
+	case 99:
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.go.y:536
+		{
+			yyVAL.field = &ast.Field{Value: yyDollar[1].expr}
+		}
+	case 100:
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.go.y:541
+		{
+			yyVAL.fieldsep = ","
+		}
+	case 101:
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.go.y:544
 		{
 			yyVAL.fieldsep = ";"
 		}
@@ -4,8 +4,17 @@ import (
 	"bytes"
 )
 
+// PerfromGlobal calls the global function with the arguments and returns its
+// results encoded with the Json options of the state, the value of the global
+// if it is not a function. Set Options.CanonicalResults to compare results
+// across nodes by their hash.
 func ( l *LState ) PerfromGlobal ( global string, arg ...string ) ( []byte, error ) {
 
+	opts := l.Options.Json
+	if l.Options.CanonicalResults {
+		opts.Canonical = true
+	}
+
 	lfn := l.GetGlobal(global)
 
 	switch lfn.Type(){
@@ -13,7 +22,7 @@ func ( l *LState ) PerfromGlobal ( global string, arg ...string ) ( []byte, erro
 		break
 
 	default:
-		return Encode(lfn)
+		return EncodeWith(lfn, opts)
 	}
 
 	var params []LValue
@@ -37,7 +46,7 @@ func ( l *LState ) PerfromGlobal ( global string, arg ...string ) ( []byte, erro
 
 		ret := l.Get(-1)
 
-		if bs, err := Encode(ret); err != nil {
+		if bs, err := EncodeWith(ret, opts); err != nil {
 			return nil, err
 		} else {
 			bsarr = append(bsarr, bs)
@@ -0,0 +1,539 @@
+package lua
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/*
+  Lua profiler.
+
+  A Profiler is attached with LState.SetProfiler, which switches the state to
+  mainLoopWithProfiler. Before an instruction runs, it is counted for the Lua
+  call stack it runs in and the time since the previous instruction is
+  charged to the stack of that instruction. When the instruction calls an
+  LGFunction, the time until the next instruction is charged to the
+  LGFunction on top of the stack, so Go functions like the adb calls show up
+  with their callers.
+
+  Time is either read from the clock before every instruction, or sampled by
+  a ticker that is only checked before every instruction. Coroutines run in
+  their own states and are charged to the function that resumed them.
+*/
+
+// ProfileEntry is the self cost of a function or a line. Line is the line a
+// function is defined on, 0 for Go functions.
+type ProfileEntry struct {
+	Function     string
+	Source       string
+	Line         int
+	Instructions int64
+	Time         time.Duration
+}
+
+type profFunc struct {
+	id     int
+	name   string
+	source string
+	line   int
+	isG    bool
+}
+
+type profKey struct {
+	fn   *profFunc
+	line int
+}
+
+// profNode is a call stack, the path from the root node.
+type profNode struct {
+	profKey
+	parent       *profNode
+	children     map[profKey]*profNode
+	instructions int64
+	nanos        int64
+}
+
+func (n *profNode) child(key profKey) *profNode {
+	c, ok := n.children[key]
+	if !ok {
+		c = &profNode{profKey: key, parent: n, children: make(map[profKey]*profNode)}
+		n.children[key] = c
+	}
+	return c
+}
+
+type Profiler struct {
+	interval time.Duration
+	ticks    int64
+	seen     int64
+	stop     chan struct{}
+
+	root  *profNode
+	funcs map[interface{}]*profFunc
+	start time.Time
+
+	depth    int
+	last     time.Time
+	lastNode *profNode
+	frames   []*callFrame
+}
+
+// NewProfiler returns a Profiler that reads the clock before every
+// instruction if interval is 0, or else samples the running stack every
+// interval. A sampling Profiler runs a ticker until it is stopped.
+func NewProfiler(interval time.Duration) *Profiler {
+	p := &Profiler{
+		interval: interval,
+		root:     &profNode{children: make(map[profKey]*profNode)},
+		funcs:    make(map[interface{}]*profFunc),
+		start:    time.Now(),
+	}
+	if interval > 0 {
+		p.stop = make(chan struct{})
+		ticker := time.NewTicker(interval)
+		go func() {
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					atomic.AddInt64(&p.ticks, 1)
+				case <-p.stop:
+					return
+				}
+			}
+		}()
+	}
+	return p
+}
+
+// Stop stops the ticker of a sampling Profiler.
+func (p *Profiler) Stop() {
+	if p.stop != nil {
+		close(p.stop)
+		p.stop = nil
+	}
+}
+
+/* LState {{{ */
+
+// errProfilerCombined is returned by SetProfiler, as mainLoopWithProfiler
+// does not record coverage and mainLoopWithDebugger does not profile.
+var errProfilerCombined = errors.New("a profiler can not be attached with a debugger or coverage")
+
+// SetProfiler attaches p to ls, nil detaches the current profiler. A
+// Profiler can be attached to one state at a time, and not to a state with
+// a debugger or Options.Coverage.
+func (ls *LState) SetProfiler(p *Profiler) error {
+	if p != nil && (ls.debugger != nil || ls.Options.Coverage != nil) {
+		return errProfilerCombined
+	}
+	ls.profiler = p
+	ls.resetMainLoop()
+	return nil
+}
+
+// Profiler returns the profiler attached to ls or nil.
+func (ls *LState) Profiler() *Profiler {
+	return ls.profiler
+}
+
+func mainLoopWithProfiler(L *LState, baseframe *callFrame) {
+	var inst uint32
+	var cf *callFrame
+
+	if L.stack.IsEmpty() {
+		return
+	}
+
+	p := L.profiler
+	p.enter()
+	defer p.exit(L)
+
+	L.currentFrame = L.stack.Last()
+	if L.currentFrame.Fn.IsG {
+		p.charge()
+		p.lastNode = p.stackNode(L, L.currentFrame)
+		callGFunction(L, false)
+		return
+	}
+
+	for {
+		cf = L.currentFrame
+		inst = cf.Fn.Proto.Code[cf.Pc]
+		p.step(L, cf, inst)
+		cf.Pc++
+		if L.ctx != nil {
+			select {
+			case <-L.ctx.Done():
+				L.RaiseError("%v", L.ctx.Err())
+				return
+			default:
+			}
+		}
+		if jumpTable[int(inst>>26)](L, inst, baseframe) == 1 {
+			return
+		}
+	}
+}
+
+/* }}} */
+
+/* accounting {{{ */
+
+func (p *Profiler) enter() {
+	if p.depth == 0 {
+		p.last = time.Now()
+		p.seen = atomic.LoadInt64(&p.ticks)
+		p.lastNode = nil
+	}
+	p.depth++
+}
+
+func (p *Profiler) exit(L *LState) {
+	p.charge()
+	p.depth--
+	p.lastNode = nil
+	if p.depth > 0 && L.currentFrame != nil {
+		// back in the caller, usually an LGFunction like pcall
+		p.lastNode = p.stackNode(L, L.currentFrame)
+	}
+}
+
+// charge charges the time since the last instruction to its stack.
+func (p *Profiler) charge() {
+	if p.interval > 0 {
+		ticks := atomic.LoadInt64(&p.ticks)
+		if ticks != p.seen && p.lastNode != nil {
+			p.lastNode.nanos += (ticks - p.seen) * int64(p.interval)
+		}
+		p.seen = ticks
+		return
+	}
+	now := time.Now()
+	if p.lastNode != nil {
+		p.lastNode.nanos += int64(now.Sub(p.last))
+	}
+	p.last = now
+}
+
+func (p *Profiler) step(L *LState, cf *callFrame, inst uint32) {
+	p.charge()
+	node := p.stackNode(L, cf)
+	node.instructions++
+	p.lastNode = node
+	switch opGetOpCode(inst) {
+	case OP_CALL, OP_TAILCALL, OP_TFORLOOP:
+		if fn, ok := L.reg.Get(cf.LocalBase + opGetArgA(inst)).(*LFunction); ok && fn.IsG {
+			p.lastNode = node.child(profKey{p.goFunction(fn), 0})
+		}
+	}
+}
+
+// stackNode returns the node of the stack from the root to cf.
+func (p *Profiler) stackNode(L *LState, cf *callFrame) *profNode {
+	p.frames = p.frames[:0]
+	for ; cf != nil; cf = cf.Parent {
+		p.frames = append(p.frames, cf)
+	}
+	node := p.root
+	for i := len(p.frames) - 1; i >= 0; i-- {
+		frame := p.frames[i]
+		if frame.Fn.IsG {
+			node = node.child(profKey{p.goFunction(frame.Fn), 0})
+			continue
+		}
+		// callers are in the call instruction, the innermost frame is about to
+		// run Pc.
+		pc := frame.Pc
+		if i > 0 {
+			pc--
+		}
+		line := 0
+		if positions := frame.Fn.Proto.DbgSourcePositions; pc >= 0 && pc < len(positions) {
+			line = positions[pc]
+		}
+		node = node.child(profKey{p.luaFunction(L, frame), line})
+	}
+	return node
+}
+
+func (p *Profiler) luaFunction(L *LState, cf *callFrame) *profFunc {
+	proto := cf.Fn.Proto
+	if fn, ok := p.funcs[proto]; ok {
+		return fn
+	}
+	// named after the first call, like the tracebacks. pprof drops <...>
+	// from names, so the names of tracebacks for anonymous functions are not
+	// used.
+	fn := &profFunc{
+		id:     len(p.funcs) + 1,
+		name:   L.rawFrameFuncName(cf),
+		source: proto.SourceName,
+		line:   proto.LineDefined,
+	}
+	if strings.HasPrefix(fn.name, "<") {
+		fn.name = fmt.Sprintf("anonymous:%v", proto.LineDefined)
+	}
+	p.funcs[proto] = fn
+	return fn
+}
+
+func (p *Profiler) goFunction(lf *LFunction) *profFunc {
+	pc := reflect.ValueOf(lf.GFunction).Pointer()
+	if fn, ok := p.funcs[pc]; ok {
+		return fn
+	}
+	fn := &profFunc{id: len(p.funcs) + 1, name: "?", source: "[G]", isG: true}
+	if f := runtime.FuncForPC(pc); f != nil {
+		fn.name = f.Name()[strings.LastIndex(f.Name(), "/")+1:]
+	}
+	p.funcs[pc] = fn
+	return fn
+}
+
+/* }}} */
+
+/* reports {{{ */
+
+func (p *Profiler) walk(f func(n *profNode)) {
+	var visit func(n *profNode)
+	visit = func(n *profNode) {
+		f(n)
+		for _, c := range n.children {
+			visit(c)
+		}
+	}
+	for _, c := range p.root.children {
+		visit(c)
+	}
+}
+
+func sortProfileEntries(entries []ProfileEntry) []ProfileEntry {
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		switch {
+		case a.Time != b.Time:
+			return a.Time > b.Time
+		case a.Instructions != b.Instructions:
+			return a.Instructions > b.Instructions
+		case a.Source != b.Source:
+			return a.Source < b.Source
+		}
+		return a.Line < b.Line
+	})
+	return entries
+}
+
+// Functions returns the self cost of every function, most expensive first.
+func (p *Profiler) Functions() []ProfileEntry {
+	byFunc := make(map[*profFunc]*ProfileEntry)
+	p.walk(func(n *profNode) {
+		e, ok := byFunc[n.fn]
+		if !ok {
+			e = &ProfileEntry{Function: n.fn.name, Source: n.fn.source, Line: n.fn.line}
+			byFunc[n.fn] = e
+		}
+		e.Instructions += n.instructions
+		e.Time += time.Duration(n.nanos)
+	})
+	entries := make([]ProfileEntry, 0, len(byFunc))
+	for _, e := range byFunc {
+		entries = append(entries, *e)
+	}
+	return sortProfileEntries(entries)
+}
+
+// Lines returns the self cost of every line of Lua code, most expensive
+// first. Calls of Go functions are charged to the line they are called
+// from.
+func (p *Profiler) Lines() []ProfileEntry {
+	type line struct {
+		source string
+		line   int
+	}
+	byLine := make(map[line]*ProfileEntry)
+	p.walk(func(n *profNode) {
+		key := n.profKey
+		if key.fn.isG {
+			// a Go function, its time is spent on the line of the caller
+			if n.parent == p.root || n.parent.fn.isG {
+				return
+			}
+			key = n.parent.profKey
+		}
+		e, ok := byLine[line{key.fn.source, key.line}]
+		if !ok {
+			e = &ProfileEntry{Function: key.fn.name, Source: key.fn.source, Line: key.line}
+			byLine[line{key.fn.source, key.line}] = e
+		}
+		e.Instructions += n.instructions
+		e.Time += time.Duration(n.nanos)
+	})
+	entries := make([]ProfileEntry, 0, len(byLine))
+	for _, e := range byLine {
+		entries = append(entries, *e)
+	}
+	return sortProfileEntries(entries)
+}
+
+// WritePprof writes the profile in the gzipped protocol buffer format of
+// pprof, https://github.com/google/pprof/blob/master/proto/profile.proto.
+// Samples are the Lua call stacks with their instructions and time,
+// locations are the lines of Lua functions and the Go functions they call.
+func (p *Profiler) WritePprof(w io.Writer) error {
+	strs := map[string]int64{"": 0}
+	table := []string{""}
+	str := func(s string) int64 {
+		if i, ok := strs[s]; ok {
+			return i
+		}
+		strs[s] = int64(len(table))
+		table = append(table, s)
+		return strs[s]
+	}
+	valueType := func(b *protobuf, typ, unit string) {
+		b.int64(1, str(typ))
+		b.int64(2, str(unit))
+	}
+
+	var b protobuf
+	b.message(1, func(b *protobuf) { valueType(b, "instructions", "count") })
+	b.message(1, func(b *protobuf) { valueType(b, "time", "nanoseconds") })
+
+	locations := make(map[profKey]uint64)
+	funcs := make(map[*profFunc]bool)
+	var locs []profKey
+	p.walk(func(n *profNode) {
+		if n.instructions == 0 && n.nanos == 0 {
+			return
+		}
+		var ids []uint64
+		for c := n; c != p.root; c = c.parent {
+			id, ok := locations[c.profKey]
+			if !ok {
+				id = uint64(len(locs) + 1)
+				locations[c.profKey] = id
+				locs = append(locs, c.profKey)
+				funcs[c.fn] = true
+			}
+			ids = append(ids, id)
+		}
+		b.message(2, func(b *protobuf) {
+			b.uint64s(1, ids)
+			b.int64s(2, []int64{n.instructions, n.nanos})
+		})
+	})
+	for i, key := range locs {
+		b.message(4, func(b *protobuf) {
+			b.uint64(1, uint64(i+1))
+			b.message(4, func(b *protobuf) {
+				b.uint64(1, uint64(key.fn.id))
+				b.int64(2, int64(key.line))
+			})
+		})
+	}
+	fns := make([]*profFunc, 0, len(funcs))
+	for fn := range funcs {
+		fns = append(fns, fn)
+	}
+	sort.Slice(fns, func(i, j int) bool { return fns[i].id < fns[j].id })
+	for _, fn := range fns {
+		b.message(5, func(b *protobuf) {
+			b.uint64(1, uint64(fn.id))
+			b.int64(2, str(fn.name))
+			b.int64(3, str(fn.name))
+			b.int64(4, str(fn.source))
+			b.int64(5, int64(fn.line))
+		})
+	}
+	b.int64(9, p.start.UnixNano())
+	b.int64(10, int64(time.Since(p.start)))
+	b.message(11, func(b *protobuf) { valueType(b, "time", "nanoseconds") })
+	period := int64(p.interval)
+	if period == 0 {
+		period = 1
+	}
+	b.int64(12, period)
+	// strings last, all of them are known now
+	for _, s := range table {
+		b.string(6, s)
+	}
+
+	zw := gzip.NewWriter(w)
+	if _, err := zw.Write(b.buf); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+/* }}} */
+
+/* protobuf {{{ */
+
+// protobuf encodes the few field types of profile.proto.
+type protobuf struct {
+	buf []byte
+}
+
+func (b *protobuf) varint(x uint64) {
+	for x >= 0x80 {
+		b.buf = append(b.buf, byte(x)|0x80)
+		x >>= 7
+	}
+	b.buf = append(b.buf, byte(x))
+}
+
+func (b *protobuf) key(tag int, wire int) {
+	b.varint(uint64(tag)<<3 | uint64(wire))
+}
+
+func (b *protobuf) uint64(tag int, x uint64) {
+	b.key(tag, 0)
+	b.varint(x)
+}
+
+func (b *protobuf) int64(tag int, x int64) {
+	b.uint64(tag, uint64(x))
+}
+
+func (b *protobuf) bytes(tag int, data []byte) {
+	b.key(tag, 2)
+	b.varint(uint64(len(data)))
+	b.buf = append(b.buf, data...)
+}
+
+func (b *protobuf) string(tag int, s string) {
+	b.bytes(tag, []byte(s))
+}
+
+func (b *protobuf) uint64s(tag int, xs []uint64) {
+	var packed protobuf
+	for _, x := range xs {
+		packed.varint(x)
+	}
+	b.bytes(tag, packed.buf)
+}
+
+func (b *protobuf) int64s(tag int, xs []int64) {
+	var packed protobuf
+	for _, x := range xs {
+		packed.varint(uint64(x))
+	}
+	b.bytes(tag, packed.buf)
+}
+
+func (b *protobuf) message(tag int, f func(b *protobuf)) {
+	var msg protobuf
+	f(&msg)
+	b.bytes(tag, msg.buf)
+}
+
+/* }}} */
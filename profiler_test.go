@@ -0,0 +1,75 @@
+package lua
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+const profilerTestSrc = `local function inner(n)
+  local s = 0
+  for i = 1, n do s = s + i end
+  return s
+end
+function outer()
+  sleep()
+  local s = inner(100)
+  return s
+end
+outer()
+`
+
+func TestProfiler(t *testing.T) {
+	for _, interval := range []time.Duration{0, time.Millisecond} {
+		L := NewState()
+		L.SetGlobal("sleep", L.NewFunction(func(L *LState) int {
+			time.Sleep(20 * time.Millisecond)
+			return 0
+		}))
+		p := NewProfiler(interval)
+		errorIfNotNil(t, L.SetProfiler(p))
+		errorIfScriptFail(t, L, profilerTestSrc)
+		L.SetProfiler(nil)
+		p.Stop()
+		L.Close()
+
+		funcs := p.Functions()
+		errorIfFalse(t, strings.HasSuffix(funcs[0].Function, "TestProfiler.func1"), "sleep expected, got %v", funcs[0].Function)
+		errorIfFalse(t, funcs[0].Time >= 10*time.Millisecond, "sleep took %v", funcs[0].Time)
+		errorIfNotEqual(t, int64(0), funcs[0].Instructions)
+		for _, e := range funcs {
+			if e.Function == "inner" {
+				errorIfNotEqual(t, 1, e.Line)
+				// LOADK, 4 to prepare the loop, 100 * (ADD, FORLOOP), FORLOOP, RETURN
+				errorIfNotEqual(t, int64(207), e.Instructions)
+			}
+		}
+
+		lines := p.Lines()
+		errorIfNotEqual(t, 7, lines[0].Line)
+		errorIfNotEqual(t, "outer", lines[0].Function)
+		for _, e := range lines {
+			if e.Line == 3 {
+				errorIfNotEqual(t, int64(205), e.Instructions)
+			}
+		}
+
+		var buf bytes.Buffer
+		errorIfNotNil(t, p.WritePprof(&buf))
+		zr, err := gzip.NewReader(&buf)
+		errorIfNotNil(t, err)
+		data, err := ioutil.ReadAll(zr)
+		errorIfNotNil(t, err)
+		errorIfFalse(t, bytes.Contains(data, []byte("inner")), "no inner in the profile")
+	}
+}
+
+func TestProfilerCombined(t *testing.T) {
+	L := NewState(Options{Coverage: NewCoverage()})
+	defer L.Close()
+	errorIfNotEqual(t, errProfilerCombined, L.SetProfiler(NewProfiler(0)))
+	errorIfNotNil(t, L.Profiler())
+}
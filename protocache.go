@@ -0,0 +1,198 @@
+package lua
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-mfs"
+)
+
+// ProtoCache holds compiled FunctionProtos keyed by the CID of the script
+// file they were compiled from. Script files are content addressed, so an
+// entry never has to be invalidated because the source changed.
+type ProtoCache interface {
+	Get(key ProtoCacheKey) (*FunctionProto, bool)
+	Put(key ProtoCacheKey, proto *FunctionProto)
+}
+
+// ProtoCacheKey identifies a proto by the CID of its script file and the
+// kind of numbers it was compiled for, see Options.Integers.
+type ProtoCacheKey struct {
+	Cid      cid.Cid
+	Integers bool
+}
+
+func (k ProtoCacheKey) String() string {
+	if k.Integers {
+		return k.Cid.String() + "/integers"
+	}
+	return k.Cid.String()
+}
+
+// DefaultProtoCacheSize is the number of protos DefaultProtoCache keeps.
+const DefaultProtoCacheSize = 256
+
+// DefaultProtoCache is used by states whose Options do not set a ProtoCache.
+var DefaultProtoCache ProtoCache = NewProtoCache(DefaultProtoCacheSize)
+
+/* memory cache {{{ */
+
+type protoCacheEntry struct {
+	key   ProtoCacheKey
+	proto *FunctionProto
+}
+
+type memProtoCache struct {
+	mu   sync.Mutex
+	size int
+	// lru holds the entries, the most recently used first.
+	lru    *list.List
+	protos map[ProtoCacheKey]*list.Element
+}
+
+// NewProtoCache returns a ProtoCache that keeps up to size protos in memory
+// and drops the least recently used ones. Protos are never modified after
+// compilation, so they are shared between states.
+func NewProtoCache(size int) ProtoCache {
+	return &memProtoCache{size: size, lru: list.New(), protos: make(map[ProtoCacheKey]*list.Element)}
+}
+
+func (mc *memProtoCache) Get(key ProtoCacheKey) (*FunctionProto, bool) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	elem, ok := mc.protos[key]
+	if !ok {
+		return nil, false
+	}
+	mc.lru.MoveToFront(elem)
+	return elem.Value.(*protoCacheEntry).proto, true
+}
+
+func (mc *memProtoCache) Put(key ProtoCacheKey, proto *FunctionProto) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if elem, ok := mc.protos[key]; ok {
+		elem.Value.(*protoCacheEntry).proto = proto
+		mc.lru.MoveToFront(elem)
+		return
+	}
+	mc.protos[key] = mc.lru.PushFront(&protoCacheEntry{key: key, proto: proto})
+	for mc.lru.Len() > mc.size {
+		oldest := mc.lru.Back()
+		mc.lru.Remove(oldest)
+		delete(mc.protos, oldest.Value.(*protoCacheEntry).key)
+	}
+}
+
+/* }}} */
+
+/* datastore cache {{{ */
+
+const protoCacheKeyPrefix = "/alvm/bytecode/"
+
+type dsProtoCache struct {
+	ds datastore.Datastore
+}
+
+// NewDatastoreProtoCache returns a ProtoCache that persists protos in the
+// binary chunk format, e.g. in the repo datastore of the IPFS node. Entries
+// written by another BytecodeVersion are treated as misses and removed.
+func NewDatastoreProtoCache(ds datastore.Datastore) ProtoCache {
+	return &dsProtoCache{ds: ds}
+}
+
+func (dc *dsProtoCache) key(key ProtoCacheKey) datastore.Key {
+	return datastore.NewKey(protoCacheKeyPrefix + key.String())
+}
+
+func (dc *dsProtoCache) Get(key ProtoCacheKey) (*FunctionProto, bool) {
+	val, err := dc.ds.Get(dc.key(key))
+	if err != nil {
+		return nil, false
+	}
+	proto, err := UndumpFunctionProto(bytes.NewReader(val))
+	if err != nil {
+		// stale or corrupted entry, compile again and overwrite it.
+		dc.ds.Delete(dc.key(key))
+		return nil, false
+	}
+	return proto, true
+}
+
+func (dc *dsProtoCache) Put(key ProtoCacheKey, proto *FunctionProto) {
+	var buf bytes.Buffer
+	if err := DumpFunctionProto(&buf, proto); err != nil {
+		return
+	}
+	dc.ds.Put(dc.key(key), buf.Bytes())
+}
+
+/* }}} */
+
+func (ls *LState) protoCache() ProtoCache {
+	if ls.Options.ProtoCache != nil {
+		return ls.Options.ProtoCache
+	}
+	return DefaultProtoCache
+}
+
+// loadScriptFile loads a script file of the AApp MFS. The compiled proto is
+// looked up in the proto cache by the CID of the file, and only parsed and
+// compiled on a miss.
+func (ls *LState) loadScriptFile(file *mfs.File, name string) (*LFunction, error) {
+	nd, err := file.GetNode()
+	if err != nil {
+		return nil, newApiErrorE(ApiErrorFile, err)
+	}
+	key := ProtoCacheKey{Cid: nd.Cid(), Integers: ls.Options.Integers}
+
+	cache := ls.protoCache()
+	if proto, ok := cache.Get(key); ok && proto.Integers == key.Integers {
+		if err := ls.verifyProto(proto); err != nil {
+			return nil, err
+		}
+		if proto.SourceName != name {
+			proto = proto.withSourceName(name)
+		}
+		return newLFunctionL(proto, ls.currentEnv(), 0), nil
+	}
+
+	rd, err := file.Open(mfs.Flags{Read: true})
+	if err != nil {
+		return nil, newApiErrorE(ApiErrorFile, err)
+	}
+	defer rd.Close()
+
+	// binary chunks are cheap to undump and must stay refusable per state,
+	// so only protos compiled from source are shared through the cache.
+	brd := bufio.NewReader(rd)
+	sig, _ := brd.Peek(len(BytecodeSignature))
+	binary := IsBinaryChunk(sig)
+
+	proto, err := ls.loadProto(brd, name)
+	if err != nil {
+		return nil, err
+	}
+	if !binary {
+		cache.Put(key, proto)
+	}
+	return newLFunctionL(proto, ls.currentEnv(), 0), nil
+}
+
+// LoadScript loads the script file at path of the AApp MFS, like dofile
+// without calling it. Paths outside of /Script are taken relative to it.
+func (ls *LState) LoadScript(path string) (*LFunction, error) {
+	path, err := checkScriptPath(path)
+	if err != nil {
+		return nil, newApiErrorE(ApiErrorFile, err)
+	}
+	file, err := ls.MFS_LookupFile(path)
+	if err != nil {
+		return nil, newApiErrorE(ApiErrorFile, err)
+	}
+	return ls.loadScriptFile(file, path)
+}
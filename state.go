@@ -5,6 +5,7 @@ package lua
 ////////////////////////////////////////////////////////
 
 import (
+	"bufio"
 	"context"
 	"fmt"
 	"github.com/ayachain/go-aya-alvm/parse"
@@ -44,10 +45,12 @@ type ApiError struct {
 	StackTrace string
 	// Underlying error. This attribute is set only if the Type is ApiErrorFile or ApiErrorSyntax
 	Cause error
+	// Frames of the stack trace, innermost first.
+	Frames []StackFrame
 }
 
 func newApiError(code ApiErrorType, object LValue) *ApiError {
-	return &ApiError{code, object, "", nil}
+	return &ApiError{Type: code, Object: object}
 }
 
 func newApiErrorS(code ApiErrorType, message string) *ApiError {
@@ -55,14 +58,20 @@ func newApiErrorS(code ApiErrorType, message string) *ApiError {
 }
 
 func newApiErrorE(code ApiErrorType, err error) *ApiError {
-	return &ApiError{code, LString(err.Error()), "", err}
+	return &ApiError{Type: code, Object: LString(err.Error()), Cause: err}
 }
 
 func (e *ApiError) Error() string {
+	msg := e.Object.String()
+	if ud, ok := e.Object.(*LUserData); ok {
+		if aerr, ok := ud.Value.(*AAppError); ok {
+			msg = aerr.Code + ": " + aerr.Error()
+		}
+	}
 	if len(e.StackTrace) > 0 {
-		return fmt.Sprintf("%s\n%s", e.Object.String(), e.StackTrace)
+		return fmt.Sprintf("%s\n%s", msg, e.StackTrace)
 	}
-	return e.Object.String()
+	return msg
 }
 
 type ApiErrorType int
@@ -122,6 +131,22 @@ type Options struct {
 	// `CallStackSize` in order to minimize memory usage. This does incur a slight performance penalty.
 	MinimizeStackMemory bool
 	AAppns string
+	// Cache of compiled script files keyed by their CID and Integers. This defaults to `lua.DefaultProtoCache`.
+	ProtoCache ProtoCache
+	// Controls whether or not precompiled binary chunks are refused when loading code.
+	DisableBinaryChunks bool
+	// Records the lines that run if not nil, the Coverage may be shared by several states.
+	Coverage *Coverage
+	// Options of the json library and of the JSON encoding of the values adb stores.
+	Json JsonOptions
+	// Encodes the results of PerfromGlobal in the canonical form of JSON, without changing the
+	// encoding of the json library and adb.
+	CanonicalResults bool
+	// Encoding of the values of adb databases, "json" or "cbor". This defaults to "json".
+	AdbEncoding string
+	// Enables the integers of Lua 5.3: integer numerals, the // and bitwise operators, integer for loops
+	// and the integer functions of the math library. Scripts otherwise keep the numbers of Lua 5.1.
+	Integers bool
 }
 
 /* }}} */
@@ -575,6 +600,22 @@ func (rg *registry) SetNumber(reg int, val LNumber) {
 	}
 }
 
+func (rg *registry) SetInteger(reg int, val LInteger) {
+	newSize := reg + 1
+	// this section is inlined by go-inline
+	// source function is 'func (rg *registry) checkSize(requiredSize int) ' in '_state.go'
+	{
+		requiredSize := newSize
+		if requiredSize > cap(rg.array) {
+			rg.resize(requiredSize)
+		}
+	}
+	rg.array[reg] = rg.alloc.LInteger2I(val)
+	if reg >= rg.top {
+		rg.top = reg + 1
+	}
+}
+
 func (rg *registry) IsFull() bool {
 	return rg.top >= cap(rg.array)
 }
@@ -599,7 +640,7 @@ func newGlobal() *Global {
 
 func panicWithTraceback(L *LState) {
 	err := newApiError(ApiErrorRun, L.Get(-1))
-	err.StackTrace = L.stackTrace(0)
+	L.setStackTrace(err, "")
 	panic(err)
 }
 
@@ -633,6 +674,7 @@ func newLState(options Options) *LState {
 	}
 	ls.reg = newRegistry(ls, options.RegistrySize, options.RegistryGrowStep, options.RegistryMaxSize, al)
 	ls.Env = ls.G.Global
+	ls.resetMainLoop()
 	return ls
 }
 
@@ -1414,6 +1456,7 @@ func NewAVMState( ctx context.Context, aappns string, pnode *dag.ProtoNode, ind
 	}
 
 	l.mfsRoot = vfs
+	l.dserv = ind.DAG
 
 	//载入代码
 	var lerr error
@@ -1429,12 +1472,7 @@ func NewAVMState( ctx context.Context, aappns string, pnode *dag.ProtoNode, ind
 		return nil, lerr
 	}
 
-	mrd, lerr := mfil.Open( mfs.Flags{Read:true} )
-	if lerr != nil {
-		return nil, lerr
-	}
-
-	lfn, lerr := l.Load( mrd, "_aapp.lua" )
+	lfn, lerr := l.loadScriptFile( mfil, "_aapp.lua" )
 	if lerr != nil {
 		return nil, lerr
 	}
@@ -1485,6 +1523,7 @@ func (ls *LState) Close() {
 		file.Close()
 		os.Remove(file.Name())
 	}
+	ls.closeJsonStreams(nil, "closed")
 	ls.stack.FreeAll()
 	ls.stack = nil
 }
@@ -1657,13 +1696,17 @@ func (ls *LState) NewThread() (*LState, context.CancelFunc) {
 	thread.Env = ls.Env
 	var f context.CancelFunc = nil
 	if ls.ctx != nil {
-		thread.mainLoop = mainLoopWithContext
 		thread.ctx, f = context.WithCancel(ls.ctx)
+		thread.resetMainLoop()
 	}
 	return thread, f
 }
 
+// NewFunctionFromProto raises an error if proto does not pass VerifyProto.
 func (ls *LState) NewFunctionFromProto(proto *FunctionProto) *LFunction {
+	if err := VerifyProto(proto); err != nil {
+		ls.RaiseError("%v", err)
+	}
 	return newLFunctionL(proto, ls.Env, int(proto.NumUpvalues))
 }
 
@@ -1700,6 +1743,9 @@ func (ls *LState) ToInt(n int) int {
 	if lv, ok := ls.Get(n).(LNumber); ok {
 		return int(lv)
 	}
+	if lv, ok := ls.Get(n).(LInteger); ok {
+		return int(lv)
+	}
 	if lv, ok := ls.Get(n).(LString); ok {
 		if num, err := parseNumber(string(lv)); err == nil {
 			return int(num)
@@ -1712,6 +1758,9 @@ func (ls *LState) ToInt64(n int) int64 {
 	if lv, ok := ls.Get(n).(LNumber); ok {
 		return int64(lv)
 	}
+	if lv, ok := ls.Get(n).(LInteger); ok {
+		return int64(lv)
+	}
 	if lv, ok := ls.Get(n).(LString); ok {
 		if num, err := parseNumber(string(lv)); err == nil {
 			return int64(num)
@@ -2002,8 +2051,8 @@ func (ls *LState) ObjLen(v1 LValue) int {
 		ls.Push(v1)
 		ls.Call(1, 1)
 		ret := ls.reg.Pop()
-		if ret.Type() == LTNumber {
-			return int(ret.(LNumber))
+		if v, ok := ret.assertFloat64(); ok {
+			return int(v)
 		}
 	} else if v1.Type() == LTTable {
 		return v1.(*LTable).Len()
@@ -2050,15 +2099,49 @@ func (ls *LState) Register(name string, fn LGFunction) {
 /* load and function call operations {{{ */
 
 func (ls *LState) Load(reader io.Reader, name string) (*LFunction, error) {
-	chunk, err := parse.Parse(reader, name)
+	proto, err := ls.loadProto(reader, name)
+	if err != nil {
+		return nil, err
+	}
+	return newLFunctionL(proto, ls.currentEnv(), 0), nil
+}
+
+// loadProto compiles the source chunk read from reader, or undumps it if it
+// is a binary chunk.
+func (ls *LState) loadProto(reader io.Reader, name string) (*FunctionProto, error) {
+	brd := bufio.NewReader(reader)
+	if sig, _ := brd.Peek(len(BytecodeSignature)); IsBinaryChunk(sig) {
+		if ls.Options.DisableBinaryChunks {
+			return nil, newApiErrorS(ApiErrorSyntax, fmt.Sprintf("%v: attempt to load a binary chunk", name))
+		}
+		proto, err := UndumpFunctionProto(brd)
+		if err != nil {
+			return nil, newApiErrorE(ApiErrorSyntax, err)
+		}
+		if proto.NumUpvalues != 0 {
+			return nil, newApiErrorS(ApiErrorSyntax, fmt.Sprintf("%v: main function of a binary chunk has upvalues", name))
+		}
+		if proto.Integers && !ls.Options.Integers {
+			return nil, newApiErrorS(ApiErrorSyntax, fmt.Sprintf("%v: binary chunk uses integers, which are not enabled", name))
+		}
+		return proto, ls.verifyProto(proto)
+	}
+	chunk, err := parse.Parse(brd, name)
 	if err != nil {
 		return nil, newApiErrorE(ApiErrorSyntax, err)
 	}
-	proto, err := Compile(chunk, name)
+	proto, err := compile(chunk, name, ls.Options.Integers)
 	if err != nil {
 		return nil, newApiErrorE(ApiErrorSyntax, err)
 	}
-	return newLFunctionL(proto, ls.currentEnv(), 0), nil
+	return proto, ls.verifyProto(proto)
+}
+
+func (ls *LState) verifyProto(proto *FunctionProto) error {
+	if err := VerifyProto(proto); err != nil {
+		return newApiErrorE(ApiErrorSyntax, err)
+	}
+	return nil
 }
 
 func (ls *LState) Call(nargs, nret int) {
@@ -2084,7 +2167,7 @@ func (ls *LState) PCall(nargs, nret int, errfunc *LFunction) (err error) {
 				if ls.Options.IncludeGoStackTrace {
 					buf := make([]byte, 4096)
 					runtime.Stack(buf, false)
-					err.(*ApiError).StackTrace = strings.Trim(string(buf), "\000") + "\n" + ls.stackTrace(0)
+					ls.setStackTrace(err.(*ApiError), strings.Trim(string(buf), "\000")+"\n")
 				}
 			} else {
 				err = rcv.(*ApiError)
@@ -2102,18 +2185,18 @@ func (ls *LState) PCall(nargs, nret int, errfunc *LFunction) (err error) {
 							if ls.Options.IncludeGoStackTrace {
 								buf := make([]byte, 4096)
 								runtime.Stack(buf, false)
-								err.(*ApiError).StackTrace = strings.Trim(string(buf), "\000") + ls.stackTrace(0)
+								ls.setStackTrace(err.(*ApiError), strings.Trim(string(buf), "\000"))
 							}
 						} else {
 							err = rcv.(*ApiError)
-							err.(*ApiError).StackTrace = ls.stackTrace(0)
+							ls.setStackTrace(err.(*ApiError), "")
 						}
 					}
 				}()
 				ls.Call(1, 1)
 				err = newApiError(ApiErrorError, ls.Get(-1))
 			} else if len(err.(*ApiError).StackTrace) == 0 {
-				err.(*ApiError).StackTrace = ls.stackTrace(0)
+				ls.setStackTrace(err.(*ApiError), "")
 			}
 			ls.stack.SetSp(sp)
 			ls.currentFrame = ls.stack.Last()
@@ -2295,8 +2378,8 @@ func (ls *LState) SetMx(mx int) {
 
 // SetContext set a context ctx to this LState. The provided ctx must be non-nil.
 func (ls *LState) SetContext(ctx context.Context) {
-	ls.mainLoop = mainLoopWithContext
 	ls.ctx = ctx
+	ls.resetMainLoop()
 }
 
 // Context returns the LState's context. To change the context, use WithContext.
@@ -2307,11 +2390,28 @@ func (ls *LState) Context() context.Context {
 // RemoveContext removes the context associated with this LState and returns this context.
 func (ls *LState) RemoveContext() context.Context {
 	oldctx := ls.ctx
-	ls.mainLoop = mainLoop
 	ls.ctx = nil
+	ls.resetMainLoop()
 	return oldctx
 }
 
+// resetMainLoop selects the main loop for the attached debugger, profiler,
+// coverage and context, in this order of precedence.
+func (ls *LState) resetMainLoop() {
+	switch {
+	case ls.debugger != nil:
+		ls.mainLoop = mainLoopWithDebugger
+	case ls.profiler != nil:
+		ls.mainLoop = mainLoopWithProfiler
+	case ls.Options.Coverage != nil:
+		ls.mainLoop = mainLoopWithCoverage
+	case ls.ctx != nil:
+		ls.mainLoop = mainLoopWithContext
+	default:
+		ls.mainLoop = mainLoop
+	}
+}
+
 // Converts the Lua value at the given acceptable index to the chan LValue.
 func (ls *LState) ToChannel(n int) chan LValue {
 	if lv, ok := ls.Get(n).(LChannel); ok {
@@ -0,0 +1,353 @@
+package lua
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+/*
+  string.pack, string.unpack and string.packsize of Lua 5.3.
+
+  Formats are the ones of Lua 5.3: "<", ">" and "=" select the endianness,
+  "![n]" the maximum alignment, then b/B, h/H, l/L, j/J, T and i[n]/I[n]
+  are signed and unsigned integers, f, d and n floats, c[n] fixed size
+  strings, z zero terminated strings, s[n] strings preceded by their length,
+  x a padding byte and Xop aligns to op. Native sizes are those of 64-bit
+  machines and the native endianness is little endian.
+*/
+
+type packOption int
+
+const (
+	packInt packOption = iota
+	packUint
+	packFloat
+	packChar
+	packString
+	packZstr
+	packPadding
+	packPaddAlign
+	packNop
+)
+
+// the limit of the sizes of integers, like in Lua 5.3.
+const packMaxIntSize = 16
+
+// packFormat reads the options of a format one by one.
+type packFormat struct {
+	L        *LState
+	fmt      string
+	pos      int
+	little   bool
+	maxAlign int
+}
+
+func newPackFormat(L *LState, format string) *packFormat {
+	return &packFormat{L: L, fmt: format, little: true, maxAlign: 1}
+}
+
+func (f *packFormat) more() bool {
+	return f.pos < len(f.fmt)
+}
+
+// num reads an optional size, df if there is none.
+func (f *packFormat) num(df int) int {
+	if !f.more() || f.fmt[f.pos] < '0' || f.fmt[f.pos] > '9' {
+		return df
+	}
+	n := 0
+	for ; f.more() && f.fmt[f.pos] >= '0' && f.fmt[f.pos] <= '9' && n <= (math.MaxInt32-9)/10; f.pos++ {
+		n = n*10 + int(f.fmt[f.pos]-'0')
+	}
+	return n
+}
+
+func (f *packFormat) numLimit(df int) int {
+	n := f.num(df)
+	if n > packMaxIntSize || n <= 0 {
+		f.L.RaiseError("integral size (%d) out of limits [1,%d]", n, packMaxIntSize)
+	}
+	return n
+}
+
+// option reads the next option and returns its kind and size.
+func (f *packFormat) option() (packOption, int) {
+	c := f.fmt[f.pos]
+	f.pos++
+	switch c {
+	case 'b':
+		return packInt, 1
+	case 'B':
+		return packUint, 1
+	case 'h':
+		return packInt, 2
+	case 'H':
+		return packUint, 2
+	case 'l', 'j':
+		return packInt, 8
+	case 'L', 'J', 'T':
+		return packUint, 8
+	case 'i':
+		return packInt, f.numLimit(4)
+	case 'I':
+		return packUint, f.numLimit(4)
+	case 'f':
+		return packFloat, 4
+	case 'd', 'n':
+		return packFloat, 8
+	case 's':
+		return packString, f.numLimit(8)
+	case 'c':
+		size := f.num(-1)
+		if size == -1 {
+			f.L.RaiseError("missing size for format option 'c'")
+		}
+		return packChar, size
+	case 'z':
+		return packZstr, 0
+	case 'x':
+		return packPadding, 1
+	case 'X':
+		return packPaddAlign, 0
+	case ' ':
+	case '<', '=':
+		f.little = true
+	case '>':
+		f.little = false
+	case '!':
+		f.maxAlign = f.numLimit(8)
+	default:
+		f.L.ArgError(1, fmt.Sprintf("invalid format option '%c'", c))
+	}
+	return packNop, 0
+}
+
+// details reads the next option and returns with its kind and size the
+// number of padding bytes that align it at the offset total.
+func (f *packFormat) details(total int) (packOption, int, int) {
+	opt, size := f.option()
+	align := size
+	if opt == packPaddAlign {
+		if !f.more() {
+			f.L.ArgError(1, "invalid next option for option 'X'")
+		}
+		var next packOption
+		if next, align = f.option(); next == packChar || align == 0 {
+			f.L.ArgError(1, "invalid next option for option 'X'")
+		}
+	}
+	if align <= 1 || opt == packChar {
+		return opt, size, 0
+	}
+	if align > f.maxAlign {
+		align = f.maxAlign
+	}
+	if align&(align-1) != 0 {
+		f.L.ArgError(1, "format asks for alignment not power of 2")
+	}
+	return opt, size, (align - total&(align-1)) & (align - 1)
+}
+
+// appendPackInt appends the size bytes of v, sign extended if neg.
+func appendPackInt(buf []byte, v uint64, little bool, size int, neg bool) []byte {
+	start := len(buf)
+	for i := 0; i < size; i++ {
+		b := byte(0)
+		if i < 8 {
+			b = byte(v >> (8 * uint(i)))
+		} else if neg {
+			b = 0xff
+		}
+		buf = append(buf, b)
+	}
+	if !little {
+		for i, j := start, len(buf)-1; i < j; i, j = i+1, j-1 {
+			buf[i], buf[j] = buf[j], buf[i]
+		}
+	}
+	return buf
+}
+
+// unpackInt reads an integer of len(data) bytes, which must fit into 64 bits.
+func unpackInt(L *LState, data string, little bool, signed bool) uint64 {
+	size := len(data)
+	at := func(i int) byte {
+		if little {
+			return data[i]
+		}
+		return data[size-1-i]
+	}
+	var v uint64
+	for i := size - 1; i >= 0; i-- {
+		if i < 8 {
+			v = v<<8 | uint64(at(i))
+		}
+	}
+	if size < 8 {
+		if signed {
+			mask := uint64(1) << (uint(size)*8 - 1)
+			v = (v ^ mask) - mask
+		}
+	} else if size > 8 {
+		ext := byte(0)
+		if signed && int64(v) < 0 {
+			ext = 0xff
+		}
+		for i := 8; i < size; i++ {
+			if at(i) != ext {
+				L.RaiseError("%d-byte integer does not fit into Lua Integer", size)
+			}
+		}
+	}
+	return v
+}
+
+// string.pack(fmt, v1, v2, ...)
+func strPack(L *LState) int {
+	f := newPackFormat(L, L.CheckString(1))
+	var buf []byte
+	arg := 1
+	for f.more() {
+		opt, size, ntoalign := f.details(len(buf))
+		for ; ntoalign > 0; ntoalign-- {
+			buf = append(buf, 0)
+		}
+		switch opt {
+		case packInt:
+			arg++
+			n := int64(checkInteger(L, arg))
+			if size < 8 {
+				if lim := int64(1) << (uint(size)*8 - 1); n < -lim || n >= lim {
+					L.ArgError(arg, "integer overflow")
+				}
+			}
+			buf = appendPackInt(buf, uint64(n), f.little, size, n < 0)
+		case packUint:
+			arg++
+			n := uint64(checkInteger(L, arg))
+			if size < 8 && n >= uint64(1)<<(uint(size)*8) {
+				L.ArgError(arg, "unsigned overflow")
+			}
+			buf = appendPackInt(buf, n, f.little, size, false)
+		case packFloat:
+			arg++
+			v := float64(L.CheckNumber(arg))
+			if size == 4 {
+				buf = appendPackInt(buf, uint64(math.Float32bits(float32(v))), f.little, size, false)
+			} else {
+				buf = appendPackInt(buf, math.Float64bits(v), f.little, size, false)
+			}
+		case packChar:
+			arg++
+			s := L.CheckString(arg)
+			if len(s) > size {
+				L.ArgError(arg, "string longer than given size")
+			}
+			buf = append(buf, s...)
+			for i := len(s); i < size; i++ {
+				buf = append(buf, 0)
+			}
+		case packString:
+			arg++
+			s := L.CheckString(arg)
+			if size < 8 && uint64(len(s)) >= uint64(1)<<(uint(size)*8) {
+				L.ArgError(arg, "string length does not fit in given size")
+			}
+			buf = appendPackInt(buf, uint64(len(s)), f.little, size, false)
+			buf = append(buf, s...)
+		case packZstr:
+			arg++
+			s := L.CheckString(arg)
+			if strings.IndexByte(s, 0) >= 0 {
+				L.ArgError(arg, "string contains zeros")
+			}
+			buf = append(buf, s...)
+			buf = append(buf, 0)
+		case packPadding:
+			buf = append(buf, 0)
+		}
+	}
+	L.Push(LString(buf))
+	return 1
+}
+
+// string.unpack(fmt, s [, pos]) returns the values packed in s from pos on
+// and the position after them.
+func strUnpack(L *LState) int {
+	f := newPackFormat(L, L.CheckString(1))
+	data := L.CheckString(2)
+	pos := L.OptInt(3, 1)
+	if pos < 0 {
+		if -pos > len(data) {
+			pos = 0
+		} else {
+			pos = len(data) + pos + 1
+		}
+	}
+	pos--
+	if pos < 0 || pos > len(data) {
+		L.ArgError(3, "initial position out of string")
+	}
+	n := 0
+	for f.more() {
+		opt, size, ntoalign := f.details(pos)
+		if ntoalign+size > len(data)-pos {
+			L.ArgError(2, "data string too short")
+		}
+		pos += ntoalign
+		switch opt {
+		case packInt, packUint:
+			pushInteger(L, int64(unpackInt(L, data[pos:pos+size], f.little, opt == packInt)))
+			n++
+		case packFloat:
+			bits := unpackInt(L, data[pos:pos+size], f.little, false)
+			if size == 4 {
+				L.Push(LNumber(math.Float32frombits(uint32(bits))))
+			} else {
+				L.Push(LNumber(math.Float64frombits(bits)))
+			}
+			n++
+		case packChar:
+			L.Push(LString(data[pos : pos+size]))
+			n++
+		case packString:
+			l := unpackInt(L, data[pos:pos+size], f.little, false)
+			if l > uint64(len(data)-pos-size) {
+				L.ArgError(2, "data string too short")
+			}
+			L.Push(LString(data[pos+size : pos+size+int(l)]))
+			pos += int(l)
+			n++
+		case packZstr:
+			l := strings.IndexByte(data[pos:], 0)
+			if l < 0 {
+				L.ArgError(2, "unfinished string for format 'z'")
+			}
+			L.Push(LString(data[pos : pos+l]))
+			pos += l + 1
+			n++
+		}
+		pos += size
+	}
+	pushInteger(L, int64(pos+1))
+	return n + 1
+}
+
+// string.packsize(fmt) returns the size of the strings that fmt packs.
+func strPackSize(L *LState) int {
+	f := newPackFormat(L, L.CheckString(1))
+	total := 0
+	for f.more() {
+		opt, size, ntoalign := f.details(total)
+		if opt == packString || opt == packZstr {
+			L.ArgError(1, "variable-length format")
+		}
+		if size += ntoalign; total > math.MaxInt32-size {
+			L.ArgError(1, "format result too large")
+		}
+		total += size
+	}
+	pushInteger(L, int64(total))
+	return 1
+}
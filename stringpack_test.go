@@ -0,0 +1,45 @@
+package lua
+
+import (
+	"testing"
+)
+
+func TestStringPack(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+	assert(string.pack("<i4", 1) == "\1\0\0\0" and string.pack(">i4", 1) == "\0\0\0\1")
+	assert(string.pack("<h", -2) == "\254\255" and string.pack("B", 255) == "\255")
+	assert(string.pack(">I3", 0x010203) == "\1\2\3" and string.pack("<i16", -1) == string.rep("\255", 16))
+	assert(string.pack("z", "ab") == "ab\0" and string.pack("s1", "ab") == "\2ab" and string.pack("c4", "ab") == "ab\0\0")
+	assert(string.pack(">d", 1.5) == "\63\248\0\0\0\0\0\0" and string.pack("<f", 0.5) == "\0\0\0\63")
+	assert(#string.pack("!4 b i4", 1, 2) == 8 and #string.pack("b i4", 1, 2) == 5 and #string.pack("!8 b Xd", 1) == 8)
+	assert(string.packsize("i4 i8 d x c3") == 24 and string.packsize("!8 b d") == 16)
+
+	local data = string.pack(">I2 s2 z b d", 513, "payload", "name", -5, 0.25)
+	local n, s, z, b, d, next = string.unpack(">I2 s2 z b d", data)
+	assert(n == 513 and s == "payload" and z == "name" and b == -5 and d == 0.25 and next == #data + 1)
+	assert(select(2, string.unpack("<i2", "\0\1\2", 2)) == 4 and string.unpack("<i2", "\0\1\2", -2) == 0x0201)
+	assert(("<I4"):unpack("\255\255\255\255") == 4294967295 and string.unpack("<i4", "\255\255\255\255") == -1)
+	assert(string.unpack("<i9", string.pack("<i9", -3)) == -3)
+
+	assert(not pcall(string.pack, "b", 128) and not pcall(string.pack, "B", -1))
+	assert(not pcall(string.pack, "c2", "abc") and not pcall(string.pack, "z", "a\0b"))
+	assert(not pcall(string.pack, "i17", 1) and not pcall(string.pack, "y", 1))
+	assert(not pcall(string.pack, "i4", 1.5) and not pcall(string.pack, "!3 i4", 1))
+	assert(not pcall(string.packsize, "s") and not pcall(string.packsize, "z"))
+	assert(not pcall(string.unpack, "i4", "\0\0\0") and not pcall(string.unpack, "z", "abc"))
+	assert(not pcall(string.unpack, "<i9", "\0\0\0\0\0\0\0\0\1"))
+	assert(not pcall(string.unpack, "b", "a", 3))
+	`)
+}
+
+func TestStringPackIntegers(t *testing.T) {
+	L := NewState(Options{Integers: true})
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+	local v, next = string.unpack("<j", string.pack("<j", math.maxinteger))
+	assert(v == math.maxinteger and math.type(v) == "integer" and math.type(next) == "integer")
+	assert(string.unpack("<J", string.pack("<J", -1)) == -1 and math.type(string.packsize("i4")) == "integer")
+	`)
+}
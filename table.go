@@ -131,6 +131,14 @@ func (tb *LTable) Remove(pos int) LValue {
 	return oldval
 }
 
+// floatKey returns the float key of the same value as the integer key it, so
+// that t[1] and t[1.0] are the same field. Integers that floats cannot
+// represent exactly stay integer keys.
+func floatKey(it LInteger) (LNumber, bool) {
+	f := LNumber(it)
+	return f, f != 1<<63 && LInteger(f) == it
+}
+
 // RawSet sets a given LValue to a given index without the __newindex metamethod.
 // It is recommended to use `RawSetString` or `RawSetInt` for performance
 // if you already know the given LValue is a string or number.
@@ -159,6 +167,11 @@ func (tb *LTable) RawSet(key LValue, value LValue) {
 	case LString:
 		tb.RawSetString(string(v), value)
 		return
+	case LInteger:
+		if f, ok := floatKey(v); ok {
+			tb.RawSet(f, value)
+			return
+		}
 	}
 
 	tb.RawSetH(key, value)
@@ -213,9 +226,14 @@ func (tb *LTable) RawSetString(key string, value LValue) {
 
 // RawSetH sets a given LValue to a given index without the __newindex metamethod.
 func (tb *LTable) RawSetH(key LValue, value LValue) {
-	if s, ok := key.(LString); ok {
-		tb.RawSetString(string(s), value)
+	switch k := key.(type) {
+	case LString:
+		tb.RawSetString(string(k), value)
 		return
+	case LInteger:
+		if f, ok := floatKey(k); ok {
+			key = f
+		}
 	}
 	if tb.dict == nil {
 		tb.dict = make(map[LValue]LValue, len(tb.strdict))
@@ -259,6 +277,10 @@ func (tb *LTable) RawGet(key LValue) LValue {
 			return ret
 		}
 		return LNil
+	case LInteger:
+		if f, ok := floatKey(v); ok {
+			return tb.RawGet(f)
+		}
 	}
 	if tb.dict == nil {
 		return LNil
@@ -283,14 +305,19 @@ func (tb *LTable) RawGetInt(key int) LValue {
 
 // RawGet returns an LValue associated with a given key without __index metamethod.
 func (tb *LTable) RawGetH(key LValue) LValue {
-	if s, sok := key.(LString); sok {
+	switch k := key.(type) {
+	case LString:
 		if tb.strdict == nil {
 			return LNil
 		}
-		if v, vok := tb.strdict[string(s)]; vok {
+		if v, vok := tb.strdict[string(k)]; vok {
 			return v
 		}
 		return LNil
+	case LInteger:
+		if f, ok := floatKey(k); ok {
+			key = f
+		}
 	}
 	if tb.dict == nil {
 		return LNil
@@ -340,9 +367,14 @@ func (tb *LTable) ForEach(cb func(LValue, LValue)) {
 // This function is equivalent to lua_next ( http://www.lua.org/manual/5.1/manual.html#lua_next ).
 func (tb *LTable) Next(key LValue) (LValue, LValue) {
 	init := false
-	if key == LNil {
+	switch k := key.(type) {
+	case *LNilType:
 		key = LNumber(0)
 		init = true
+	case LInteger:
+		if f, ok := floatKey(k); ok {
+			key = f
+		}
 	}
 
 	if init || key != LNumber(0) {
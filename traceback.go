@@ -0,0 +1,146 @@
+package lua
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+/*
+  Structured stack traces.
+
+  Along with the formatted StackTrace, errors returned by PCall and the Do*
+  functions carry the frames of the stack at the point the error was raised,
+  innermost first. Snippets of the source lines are added on demand with
+  AddSnippets, e.g. from the /Script directory of the AApp by ScriptSource.
+*/
+
+// StackFrame is a function on the stack of an error.
+type StackFrame struct {
+	// Function is the name of the function as in tracebacks, "main chunk"
+	// for chunks and "(tailcall)" for frames that were replaced by tail calls.
+	Function string `json:"function"`
+	Source   string `json:"source,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	IsGo     bool   `json:"go,omitempty"`
+	// Snippet is the source line, set by AddSnippets.
+	Snippet string `json:"snippet,omitempty"`
+}
+
+// stackFrames returns the frames of the current stack.
+func (ls *LState) stackFrames() []StackFrame {
+	var frames []StackFrame
+	for cf := ls.currentFrame; cf != nil; cf = cf.Parent {
+		name, _ := ls.frameFuncName(cf)
+		if cf.Fn.IsG {
+			frames = append(frames, StackFrame{Function: name, Source: "[G]", IsGo: true})
+			continue
+		}
+		frame := StackFrame{Function: name, Source: cf.Fn.Proto.SourceName}
+		if pc := cf.Pc - 1; pc >= 0 && pc < len(cf.Fn.Proto.DbgSourcePositions) {
+			frame.Line = cf.Fn.Proto.DbgSourcePositions[pc]
+		}
+		frames = append(frames, frame)
+		for tc := cf.TailCall; tc > 0; tc-- {
+			frames = append(frames, StackFrame{Function: "(tailcall)"})
+		}
+	}
+	return frames
+}
+
+// setStackTrace sets the traceback and the frames of err, prefixed by a Go
+// stack trace if there is one.
+func (ls *LState) setStackTrace(err *ApiError, gotrace string) {
+	err.StackTrace = gotrace + ls.stackTrace(0)
+	err.Frames = ls.stackFrames()
+}
+
+// AddSnippets sets the Snippet of the Lua frames to their source line, read
+// by source. Sources that can not be read are skipped.
+func (e *ApiError) AddSnippets(source func(name string) ([]byte, error)) {
+	lines := make(map[string][]string)
+	for i := range e.Frames {
+		frame := &e.Frames[i]
+		if frame.IsGo || frame.Line <= 0 {
+			continue
+		}
+		src, ok := lines[frame.Source]
+		if !ok {
+			if data, err := source(frame.Source); err == nil {
+				src = strings.Split(string(data), "\n")
+			}
+			lines[frame.Source] = src
+		}
+		if frame.Line <= len(src) {
+			frame.Snippet = strings.TrimSpace(src[frame.Line-1])
+		}
+	}
+}
+
+// ScriptSource returns the source of a chunk loaded from the /Script
+// directory of the AApp, by its chunk name. It suits AddSnippets.
+func (ls *LState) ScriptSource(name string) ([]byte, error) {
+	if ls.mfsRoot == nil {
+		return nil, errors.New("no AApp is mounted")
+	}
+	path := ALVM_PATH_Maincript
+	if name != "_aapp.lua" {
+		var err error
+		if path, err = checkScriptPath(name); err != nil {
+			return nil, err
+		}
+	}
+	file, err := ls.MFS_LookupFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ls.MFS_ReadAll(file, 0)
+}
+
+var apiErrorTypeNames = [...]string{
+	ApiErrorSyntax: "syntax",
+	ApiErrorFile:   "file",
+	ApiErrorRun:    "run",
+	ApiErrorError:  "error",
+	ApiErrorPanic:  "panic",
+}
+
+func (t ApiErrorType) String() string {
+	if int(t) >= 0 && int(t) < len(apiErrorTypeNames) {
+		return apiErrorTypeNames[t]
+	}
+	return "unknown"
+}
+
+// MarshalJSON encodes the error for logs. An error value that is a table is
+// kept as JSON in "value" if it can be encoded, an AAppError adds its code.
+func (e *ApiError) MarshalJSON() ([]byte, error) {
+	out := struct {
+		Type    string          `json:"type"`
+		Code    string          `json:"code,omitempty"`
+		Message string          `json:"message"`
+		Value   json.RawMessage `json:"value,omitempty"`
+		Frames  []StackFrame    `json:"frames,omitempty"`
+		Cause   string          `json:"cause,omitempty"`
+	}{
+		Type:   e.Type.String(),
+		Frames: e.Frames,
+	}
+	if e.Object != nil {
+		out.Message = e.Object.String()
+		if ud, ok := e.Object.(*LUserData); ok {
+			if aerr, ok := ud.Value.(*AAppError); ok {
+				out.Code, out.Message = aerr.Code, aerr.Error()
+			}
+		}
+		if _, ok := e.Object.(*LTable); ok {
+			if data, err := Encode(e.Object); err == nil {
+				out.Value = data
+			}
+		}
+	}
+	if e.Cause != nil {
+		out.Cause = e.Cause.Error()
+	}
+	return json.Marshal(out)
+}
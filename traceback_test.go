@@ -0,0 +1,86 @@
+package lua
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+const tracebackTestSrc = `function inner()
+  error({code = 7})
+end
+function outer()
+  inner()
+  return 1
+end
+outer()
+`
+
+func TestStackFrames(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	err := L.DoString(tracebackTestSrc)
+	aerr, ok := err.(*ApiError)
+	errorIfFalse(t, ok, "expected an ApiError, got %v", err)
+
+	tb, ok := aerr.Object.(*LTable)
+	errorIfFalse(t, ok, "expected the table raised, got %v", aerr.Object)
+	errorIfNotEqual(t, LNumber(7), tb.RawGetString("code"))
+
+	var frames []string
+	for _, f := range aerr.Frames {
+		frames = append(frames, fmt.Sprintf("%v %v:%v %v", f.Function, f.Source, f.Line, f.IsGo))
+	}
+	errorIfNotEqual(t, "[error [G]:0 true inner <string>:2 false outer <string>:5 false main chunk <string>:8 false]", fmt.Sprint(frames))
+
+	aerr.AddSnippets(func(name string) ([]byte, error) {
+		errorIfNotEqual(t, "<string>", name)
+		return []byte(tracebackTestSrc), nil
+	})
+	errorIfNotEqual(t, "error({code = 7})", aerr.Frames[1].Snippet)
+	errorIfNotEqual(t, "inner()", aerr.Frames[2].Snippet)
+
+	data, jerr := json.Marshal(aerr)
+	errorIfNotNil(t, jerr)
+	var decoded struct {
+		Type   string
+		Value  map[string]int
+		Frames []StackFrame
+	}
+	errorIfNotNil(t, json.Unmarshal(data, &decoded))
+	errorIfNotEqual(t, "run", decoded.Type)
+	errorIfNotEqual(t, 7, decoded.Value["code"])
+	errorIfNotEqual(t, 4, len(decoded.Frames))
+	errorIfNotEqual(t, "inner()", decoded.Frames[2].Snippet)
+}
+
+func TestScriptSource(t *testing.T) {
+	L, err := NewMFSState(context.Background(), nil, nil)
+	errorIfNotNil(t, err)
+	defer L.Close()
+	errorIfNotNil(t, L.MFS_Mkdir(ALVM_PATH_Script, true))
+	fi, err := L.MFS_OpenFile("/Script/lib.lua", os.O_CREATE)
+	errorIfNotNil(t, err)
+	w, err := L.MFS_OpenWriter(fi, 0)
+	errorIfNotNil(t, err)
+	_, err = w.Write([]byte("local x = 1\nerror('lib failed')\n"))
+	errorIfNotNil(t, err)
+	errorIfNotNil(t, w.(interface{ Close() error }).Close())
+
+	err = L.DoString(`dofile("/lib.lua")`)
+	aerr, ok := err.(*ApiError)
+	errorIfFalse(t, ok, "expected an ApiError, got %v", err)
+	aerr.AddSnippets(L.ScriptSource)
+	found := false
+	for _, f := range aerr.Frames {
+		if f.Source == "/Script/lib.lua" {
+			found = true
+			errorIfNotEqual(t, 2, f.Line)
+			errorIfNotEqual(t, "error('lib failed')", f.Snippet)
+		}
+	}
+	errorIfFalse(t, found, "no frame of /Script/lib.lua in %v", strings.TrimSpace(aerr.StackTrace))
+}
@@ -0,0 +1,235 @@
+package lua
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// utf8CharPattern matches exactly one UTF-8 byte sequence.
+const utf8CharPattern = "[\x00-\x7F\xC2-\xF4][\x80-\xBF]*"
+
+func OpenUtf8(L *LState) int {
+	mod := L.RegisterModule(Utf8LibName, utf8Funcs).(*LTable)
+	mod.RawSetString("charpattern", LString(utf8CharPattern))
+	L.Push(mod)
+	return 1
+}
+
+var utf8Funcs = map[string]LGFunction{
+	"char":      utf8Char,
+	"codepoint": utf8Codepoint,
+	"codes":     utf8Codes,
+	"len":       utf8Len,
+	"offset":    utf8Offset,
+	"valid":     utf8Valid,
+	"upper":     utf8Upper,
+	"lower":     utf8Lower,
+	"normalize": utf8Normalize,
+}
+
+// utf8PosRelat converts a position that counts from the end if negative.
+func utf8PosRelat(pos, l int) int {
+	if pos >= 0 {
+		return pos
+	} else if -pos > l {
+		return 0
+	}
+	return l + pos + 1
+}
+
+func utf8IsCont(s string, i int) bool {
+	return i < len(s) && s[i]&0xC0 == 0x80
+}
+
+// utf8CheckString returns the string argument n, which must be valid UTF-8.
+func utf8CheckString(L *LState, n int) string {
+	s := L.CheckString(n)
+	if !utf8.ValidString(s) {
+		L.ArgError(n, "invalid UTF-8 string")
+	}
+	return s
+}
+
+// utf8.char(...) returns the string of the code points.
+func utf8Char(L *LState) int {
+	top := L.GetTop()
+	var buf strings.Builder
+	for i := 1; i <= top; i++ {
+		code := L.CheckInt64(i)
+		if code < 0 || code > utf8.MaxRune || !utf8.ValidRune(rune(code)) {
+			L.ArgError(i, "value out of range")
+		}
+		buf.WriteRune(rune(code))
+	}
+	L.Push(LString(buf.String()))
+	return 1
+}
+
+// utf8.codepoint(s [, i [, j]]) returns the code points of the characters
+// that start between the bytes i and j.
+func utf8Codepoint(L *LState) int {
+	s := L.CheckString(1)
+	i := utf8PosRelat(L.OptInt(2, 1), len(s))
+	j := utf8PosRelat(L.OptInt(3, i), len(s))
+	if i < 1 {
+		L.ArgError(2, "out of range")
+	}
+	if j > len(s) {
+		L.ArgError(3, "out of range")
+	}
+	n := 0
+	for pos := i - 1; pos < j; n++ {
+		r, size := utf8.DecodeRuneInString(s[pos:])
+		if r == utf8.RuneError && size <= 1 {
+			L.RaiseError("invalid UTF-8 code")
+		}
+		pushInteger(L, int64(r))
+		pos += size
+	}
+	return n
+}
+
+func utf8CodesIter(L *LState) int {
+	s := L.CheckString(1)
+	n := L.CheckInt(2) - 1
+	if n < 0 {
+		n = 0
+	} else if n < len(s) {
+		n++
+		for utf8IsCont(s, n) {
+			n++
+		}
+	}
+	if n >= len(s) {
+		return 0
+	}
+	r, size := utf8.DecodeRuneInString(s[n:])
+	if r == utf8.RuneError && size <= 1 || utf8IsCont(s, n+size) {
+		L.RaiseError("invalid UTF-8 code")
+	}
+	pushInteger(L, int64(n+1))
+	pushInteger(L, int64(r))
+	return 2
+}
+
+// utf8.codes(s) iterates over the positions and code points of s.
+func utf8Codes(L *LState) int {
+	L.CheckString(1)
+	L.Push(L.NewFunction(utf8CodesIter))
+	L.Push(L.Get(1))
+	pushInteger(L, 0)
+	return 3
+}
+
+// utf8.len(s [, i [, j]]) counts the characters that start between the
+// bytes i and j. It returns nil and the position of the first invalid byte
+// if there is one.
+func utf8Len(L *LState) int {
+	s := L.CheckString(1)
+	i := utf8PosRelat(L.OptInt(2, 1), len(s))
+	j := utf8PosRelat(L.OptInt(3, -1), len(s))
+	if i < 1 || i > len(s)+1 {
+		L.ArgError(2, "initial position out of string")
+	}
+	if j > len(s) {
+		L.ArgError(3, "final position out of string")
+	}
+	n := 0
+	for pos := i - 1; pos < j; n++ {
+		r, size := utf8.DecodeRuneInString(s[pos:])
+		if r == utf8.RuneError && size <= 1 {
+			L.Push(LNil)
+			pushInteger(L, int64(pos+1))
+			return 2
+		}
+		pos += size
+	}
+	pushInteger(L, int64(n))
+	return 1
+}
+
+// utf8.offset(s, n [, i]) returns the byte position where the n-th character
+// counted from the byte i starts, or nil.
+func utf8Offset(L *LState) int {
+	s := L.CheckString(1)
+	n := L.CheckInt(2)
+	posi := 1
+	if n < 0 {
+		posi = len(s) + 1
+	}
+	posi = utf8PosRelat(L.OptInt(3, posi), len(s))
+	if posi < 1 || posi-1 > len(s) {
+		L.ArgError(3, "position out of range")
+	}
+	posi--
+	if n == 0 {
+		for posi > 0 && utf8IsCont(s, posi) {
+			posi--
+		}
+	} else {
+		if utf8IsCont(s, posi) {
+			L.RaiseError("initial position is a continuation byte")
+		}
+		if n < 0 {
+			for ; n < 0 && posi > 0; n++ {
+				posi--
+				for posi > 0 && utf8IsCont(s, posi) {
+					posi--
+				}
+			}
+		} else {
+			for n--; n > 0 && posi < len(s); n-- {
+				posi++
+				for utf8IsCont(s, posi) {
+					posi++
+				}
+			}
+		}
+	}
+	if n == 0 {
+		pushInteger(L, int64(posi+1))
+	} else {
+		L.Push(LNil)
+	}
+	return 1
+}
+
+// utf8.valid(s) tells whether s is valid UTF-8.
+func utf8Valid(L *LState) int {
+	L.Push(LBool(utf8.ValidString(L.CheckString(1))))
+	return 1
+}
+
+// utf8.upper(s) is string.upper for all of Unicode.
+func utf8Upper(L *LState) int {
+	L.Push(LString(strings.ToUpper(utf8CheckString(L, 1))))
+	return 1
+}
+
+// utf8.lower(s) is string.lower for all of Unicode.
+func utf8Lower(L *LState) int {
+	L.Push(LString(strings.ToLower(utf8CheckString(L, 1))))
+	return 1
+}
+
+var utf8Forms = map[string]norm.Form{
+	"NFC":  norm.NFC,
+	"NFD":  norm.NFD,
+	"NFKC": norm.NFKC,
+	"NFKD": norm.NFKD,
+}
+
+// utf8.normalize(s [, form]) returns the normalization form of s, "NFC" by
+// default, so that equal looking names compare equal.
+func utf8Normalize(L *LState) int {
+	s := utf8CheckString(L, 1)
+	name := L.OptString(2, "NFC")
+	form, ok := utf8Forms[name]
+	if !ok {
+		L.ArgError(2, "unknown normalization form '"+name+"'")
+	}
+	L.Push(LString(form.String(s)))
+	return 1
+}
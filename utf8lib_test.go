@@ -0,0 +1,46 @@
+package lua
+
+import (
+	"testing"
+)
+
+func TestUtf8Lib(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+	local s = "h\195\169llo \228\184\150\231\149\140"
+	assert(utf8.len(s) == 8 and #s == 13 and utf8.len(s, 4) == 6 and utf8.len(s, 3) == nil and utf8.len("") == 0)
+	assert(utf8.char(104, 233, 0x4e16) == "h\195\169\228\184\150" and utf8.char() == "")
+	assert(utf8.codepoint(s, 2) == 233 and select("#", utf8.codepoint(s, 1, -1)) == 8)
+	assert(utf8.offset(s, 3) == 4 and utf8.offset(s, -1) == 11 and utf8.offset(s, 0, 3) == 2)
+	assert(utf8.offset(s, 9) == 14 and utf8.offset(s, 10) == nil)
+
+	local codes = {}
+	for p, c in utf8.codes(s) do codes[#codes + 1] = p .. ":" .. c end
+	assert(table.concat(codes, ",") == "1:104,2:233,4:108,5:108,6:111,7:32,8:19990,11:30028")
+	for c in s:gmatch(utf8.charpattern) do assert(utf8.len(c) == 1) end
+
+	local len, pos = utf8.len("ab\255c")
+	assert(len == nil and pos == 3)
+	assert(utf8.valid(s) and not utf8.valid("\192\128"))
+	assert(not pcall(utf8.codepoint, "\255") and not pcall(utf8.char, 0xd800))
+	assert(not pcall(function() for _ in utf8.codes("a\255") do end end))
+	assert(not pcall(utf8.offset, s, 1, 3))
+
+	assert(utf8.upper("\195\169t\195\169") == "\195\137T\195\137" and not pcall(utf8.upper, "\255"))
+	assert(utf8.lower("\195\137COLE") == "\195\169cole" and not pcall(utf8.lower, "\255"))
+	assert(utf8.normalize("e\204\129") == "\195\169" and utf8.normalize("\195\169", "NFD") == "e\204\129")
+	assert(utf8.normalize("\239\172\129", "NFKC") == "fi" and not pcall(utf8.normalize, "x", "NFX"))
+	`)
+}
+
+func TestUtf8LibIntegers(t *testing.T) {
+	L := NewState(Options{Integers: true})
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+	local s = "h\195\169llo"
+	assert(math.type(utf8.len(s)) == "integer" and math.type(utf8.codepoint(s, 2)) == "integer")
+	assert(math.type(utf8.offset(s, 3)) == "integer" and math.type(select(2, utf8.len("\255"))) == "integer")
+	for p, c in utf8.codes(s) do assert(math.type(p) == "integer" and math.type(c) == "integer") end
+	`)
+}
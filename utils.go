@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"fmt"
 	"io"
+	"math"
 	"reflect"
 	"strconv"
 	"strings"
@@ -155,6 +156,72 @@ func parseNumber(number string) (LNumber, error) {
 	return value, nil
 }
 
+// parseNumberValue converts number like parseNumber, but to an LInteger if
+// integers is set and number is an integer numeral.
+func parseNumberValue(number string, integers bool) (LValue, error) {
+	if integers {
+		if i, ok := parseInteger(strings.Trim(number, " \t\n")); ok {
+			return i, nil
+		}
+	}
+	return parseNumber(number)
+}
+
+// parseInteger parses a decimal or hexadecimal integer numeral with an
+// optional sign. Like in Lua 5.3, hexadecimal numerals wrap around and
+// decimal ones that do not fit are not integers.
+func parseInteger(s string) (LInteger, bool) {
+	neg := false
+	if len(s) > 0 && (s[0] == '-' || s[0] == '+') {
+		neg = s[0] == '-'
+		s = s[1:]
+	}
+	var n uint64
+	if len(s) > 2 && s[0] == '0' && (s[1] == 'x' || s[1] == 'X') {
+		for _, c := range s[2:] {
+			d, err := strconv.ParseUint(string(c), 16, 8)
+			if err != nil {
+				return 0, false
+			}
+			n = n<<4 | d
+		}
+	} else {
+		v, err := strconv.ParseUint(s, 10, 64)
+		if err != nil || v > 1<<63 || v == 1<<63 && !neg {
+			return 0, false
+		}
+		n = v
+	}
+	if neg {
+		n = -n
+	}
+	return LInteger(n), true
+}
+
+// floatToInteger returns f as an integer if it has an exact one.
+func floatToInteger(f float64) (LInteger, bool) {
+	if f == math.Trunc(f) && f >= -(1<<63) && f < 1<<63 {
+		return LInteger(f), true
+	}
+	return 0, false
+}
+
+// toInteger converts an integer, or a float or string with an exact integer
+// value.
+func toInteger(lv LValue) (LInteger, bool) {
+	switch v := lv.(type) {
+	case LInteger:
+		return v, true
+	case LNumber:
+		return floatToInteger(float64(v))
+	case LString:
+		if num, err := parseNumberValue(string(v), true); err == nil {
+			return toInteger(num)
+		}
+	}
+	return 0, false
+}
+
 func popenArgs(arg string) (string, []string) {
 	cmd := "/bin/sh"
 	args := []string{"-c"}
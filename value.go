@@ -4,9 +4,11 @@ import (
 	"context"
 	"fmt"
 	"github.com/ipfs/go-ipfs/core"
+	ipld "github.com/ipfs/go-ipld-format"
 	dag "github.com/ipfs/go-merkledag"
 	"github.com/ipfs/go-mfs"
 	"os"
+	"strconv"
 )
 
 type LValueType int
@@ -50,7 +52,7 @@ func LVAsBool(v LValue) bool { return v != LNil && v != LFalse }
 // if the LValue is a string or number, otherwise an empty string.
 func LVAsString(v LValue) string {
 	switch sn := v.(type) {
-	case LString, LNumber:
+	case LString, LNumber, LInteger:
 		return sn.String()
 	default:
 		return ""
@@ -61,7 +63,7 @@ func LVAsString(v LValue) string {
 // otherwise false.
 func LVCanConvToString(v LValue) bool {
 	switch v.(type) {
-	case LString, LNumber:
+	case LString, LNumber, LInteger:
 		return true
 	default:
 		return false
@@ -73,6 +75,8 @@ func LVAsNumber(v LValue) LNumber {
 	switch lv := v.(type) {
 	case LNumber:
 		return lv
+	case LInteger:
+		return LNumber(lv)
 	case LString:
 		if num, err := parseNumber(string(lv)); err == nil {
 			return num
@@ -161,6 +165,30 @@ func (nm LNumber) Format(f fmt.State, c rune) {
 	}
 }
 
+// LInteger is the integer subtype of numbers of Lua 5.3, which scripts only
+// make if Options.Integers is set. Its type is LTNumber like LNumber.
+type LInteger int64
+
+func (it LInteger) String() string                     { return strconv.FormatInt(int64(it), 10) }
+func (it LInteger) Type() LValueType                   { return LTNumber }
+func (it LInteger) assertFloat64() (float64, bool)     { return float64(it), true }
+func (it LInteger) assertString() (string, bool)       { return "", false }
+func (it LInteger) assertFunction() (*LFunction, bool) { return nil, false }
+
+// fmt.Formatter interface
+func (it LInteger) Format(f fmt.State, c rune) {
+	switch c {
+	case 'q', 's':
+		defaultFormat(it.String(), f, c)
+	case 'e', 'E', 'f', 'F', 'g', 'G':
+		defaultFormat(float64(it), f, c)
+	case 'i':
+		defaultFormat(int64(it), f, 'd')
+	default:
+		defaultFormat(int64(it), f, c)
+	}
+}
+
 type LTable struct {
 	Metatable LValue
 
@@ -200,7 +228,9 @@ type Global struct {
 
 	builtinMts map[int]LValue
 	tempFiles  []*os.File
-	gccount    int32
+	// jsonStreams are the open JSON streams of files.
+	jsonStreams map[*JsonStream]bool
+	gccount     int32
 }
 
 type LState struct {
@@ -213,6 +243,7 @@ type LState struct {
 	ProtoNode *dag.ProtoNode
 
 	mfsRoot		 *mfs.Root
+	dserv		 ipld.DAGService
 	ipfsnode	 *core.IpfsNode
 	stop         int32
 	reg          *registry
@@ -224,6 +255,8 @@ type LState struct {
 	hasErrorFunc bool
 	mainLoop     func(*LState, *callFrame)
 	ctx          context.Context
+	debugger     *Debugger
+	profiler     *Profiler
 }
 
 func (ls *LState) String() string                     { return fmt.Sprintf("thread: %p", ls) }
@@ -0,0 +1,401 @@
+package lua
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+/*
+  Bytecode verifier.
+
+  mainLoop trusts the instruction stream completely, so every proto is
+  verified once before it can be run, whether it was compiled, undumped from
+  a binary chunk or taken from a ProtoCache. The verifier checks that
+
+    - every opcode indexes the jump table
+    - every register lies in the frame (NumUsedRegisters)
+    - every constant, upvalue and nested proto index is in range
+    - jump targets and skipped instructions lie in the code and do not land
+      on the data words following CLOSURE and SETLIST
+    - FORPREP jumps to the FORLOOP of the same loop, which jumps back after it
+    - the words read after MOVEN, CLOSURE, TFORLOOP and SETLIST exist and
+      have the expected shape
+    - the function cannot run past its last instruction
+*/
+
+// VerifyError describes an instruction rejected by the bytecode verifier.
+type VerifyError struct {
+	Source      string
+	LineDefined int
+	// Pc is the 1-based index of the instruction, as printed by FunctionProto.String.
+	Pc      int
+	Line    int
+	Op      string
+	Message string
+}
+
+func (e *VerifyError) Error() string {
+	if e.Pc == 0 {
+		return fmt.Sprintf("%v:%v: bad function: %v", e.Source, e.LineDefined, e.Message)
+	}
+	return fmt.Sprintf("%v:%v: bad instruction [%03d] %v: %v", e.Source, e.Line, e.Pc, e.Op, e.Message)
+}
+
+type protoVerifier struct {
+	proto     *FunctionProto
+	nupvalues int
+	pc        int
+	// data marks code words that are operands of the preceding instruction.
+	data []bool
+}
+
+func (pv *protoVerifier) fail(format string, args ...interface{}) {
+	err := &VerifyError{
+		Source:      pv.proto.SourceName,
+		LineDefined: pv.proto.LineDefined,
+		Message:     fmt.Sprintf(format, args...),
+	}
+	if pv.pc >= 0 && pv.pc < len(pv.proto.Code) {
+		err.Pc = pv.pc + 1
+		if op := opGetOpCode(pv.proto.Code[pv.pc]); op <= opCodeMax {
+			err.Op = opProps[op].Name
+		} else {
+			err.Op = "?"
+		}
+		if pv.pc < len(pv.proto.DbgSourcePositions) {
+			err.Line = pv.proto.DbgSourcePositions[pv.pc]
+		}
+	}
+	panic(err)
+}
+
+func (pv *protoVerifier) reg(r int) {
+	if r < 0 || r >= int(pv.proto.NumUsedRegisters) {
+		pv.fail("register %v out of range (%v registers)", r, pv.proto.NumUsedRegisters)
+	}
+}
+
+func (pv *protoVerifier) regRange(from, to int) {
+	for r := from; r <= to; r++ {
+		pv.reg(r)
+	}
+}
+
+func (pv *protoVerifier) kst(k int) {
+	if k < 0 || k >= len(pv.proto.Constants) {
+		pv.fail("constant %v out of range (%v constants)", k, len(pv.proto.Constants))
+	}
+}
+
+func (pv *protoVerifier) kstString(k int) {
+	pv.kst(k)
+	if pv.proto.Constants[k].Type() != LTString {
+		pv.fail("constant %v is not a string", k)
+	}
+}
+
+func (pv *protoVerifier) rk(x int) {
+	if opIsK(x) {
+		pv.kst(opIndexK(x))
+	} else {
+		pv.reg(x)
+	}
+}
+
+func (pv *protoVerifier) rkString(x int) {
+	if opIsK(x) {
+		pv.kstString(opIndexK(x))
+	} else {
+		pv.reg(x)
+	}
+}
+
+func (pv *protoVerifier) upvalue(n int) {
+	if n >= pv.nupvalues {
+		pv.fail("upvalue %v out of range (%v upvalues)", n, pv.nupvalues)
+	}
+}
+
+// next checks that the n-th word after the current instruction exists.
+func (pv *protoVerifier) next(n int) {
+	if pv.pc+n >= len(pv.proto.Code) {
+		pv.fail("missing instruction %v after the end of the function", pv.pc+n+1)
+	}
+}
+
+func (pv *protoVerifier) operands(n int) {
+	pv.next(n)
+	for i := 1; i <= n; i++ {
+		pv.data[pv.pc+i] = true
+	}
+}
+
+func (pv *protoVerifier) jump(offset int) {
+	target := pv.pc + 1 + offset
+	if target < 0 || target >= len(pv.proto.Code) {
+		pv.fail("jump to [%03d] out of range", target+1)
+	}
+}
+
+func (pv *protoVerifier) verify() {
+	fp := pv.proto
+	code := fp.Code
+	pv.pc = -1
+	if int(fp.NumUpvalues) != pv.nupvalues {
+		pv.fail("%v upvalues, expected %v", fp.NumUpvalues, pv.nupvalues)
+	}
+	if fp.NumUsedRegisters > maxRegisters {
+		pv.fail("%v registers exceed the limit of %v", fp.NumUsedRegisters, maxRegisters)
+	}
+	if fp.NumParameters > fp.NumUsedRegisters {
+		pv.fail("%v parameters for %v registers", fp.NumParameters, fp.NumUsedRegisters)
+	}
+	if len(fp.DbgSourcePositions) != len(code) {
+		pv.fail("%v source positions for %v instructions", len(fp.DbgSourcePositions), len(code))
+	}
+	if len(code) == 0 {
+		pv.fail("function has no instructions")
+	}
+	pv.data = make([]bool, len(code))
+
+	for pv.pc = 0; pv.pc < len(code); pv.pc++ {
+		inst := code[pv.pc]
+		op := opGetOpCode(inst)
+		if op > opCodeMax {
+			pv.fail("invalid opcode %v", op)
+		}
+		a, b, c := opGetArgA(inst), opGetArgB(inst), opGetArgC(inst)
+		switch op {
+		case OP_MOVE, OP_NOT:
+			pv.reg(a)
+			pv.reg(b)
+		case OP_MOVEN:
+			pv.reg(a)
+			pv.reg(b)
+			pv.next(c)
+			for i := 1; i <= c; i++ {
+				mv := code[pv.pc+i]
+				if opGetOpCode(mv) != OP_MOVE {
+					pv.pc += i
+					pv.fail("MOVE expected after MOVEN")
+				}
+				pv.reg(opGetArgA(mv))
+				pv.reg(opGetArgB(mv))
+			}
+		case OP_LOADK:
+			pv.reg(a)
+			pv.kst(opGetArgBx(inst))
+		case OP_LOADBOOL:
+			pv.reg(a)
+			if c != 0 {
+				pv.next(2)
+			}
+		case OP_LOADNIL:
+			if b < a {
+				pv.fail("empty register range %v..%v", a, b)
+			}
+			pv.regRange(a, b)
+		case OP_GETUPVAL, OP_SETUPVAL:
+			pv.reg(a)
+			pv.upvalue(b)
+		case OP_GETGLOBAL, OP_SETGLOBAL:
+			pv.reg(a)
+			pv.kstString(opGetArgBx(inst))
+		case OP_GETTABLE:
+			pv.reg(a)
+			pv.reg(b)
+			pv.rk(c)
+		case OP_GETTABLEKS, OP_SELF:
+			pv.reg(a)
+			pv.reg(b)
+			pv.rkString(c)
+			if op == OP_SELF {
+				pv.reg(a + 1)
+			}
+		case OP_SETTABLE:
+			pv.reg(a)
+			pv.rk(b)
+			pv.rk(c)
+		case OP_SETTABLEKS:
+			pv.reg(a)
+			pv.rkString(b)
+			pv.rk(c)
+		case OP_NEWTABLE:
+			pv.reg(a)
+		case OP_ADD, OP_SUB, OP_MUL, OP_DIV, OP_MOD, OP_POW, OP_IDIV, OP_BAND, OP_BOR, OP_BXOR, OP_SHL, OP_SHR:
+			pv.reg(a)
+			pv.rk(b)
+			pv.rk(c)
+		case OP_UNM, OP_LEN, OP_BNOT:
+			pv.reg(a)
+			pv.rk(b)
+		case OP_CONCAT:
+			pv.reg(a)
+			if b > c {
+				pv.fail("empty register range %v..%v", b, c)
+			}
+			pv.regRange(b, c)
+		case OP_JMP:
+			pv.jump(opGetArgSbx(inst))
+		case OP_EQ, OP_LT, OP_LE:
+			pv.rk(b)
+			pv.rk(c)
+			pv.next(2)
+		case OP_TEST:
+			pv.reg(a)
+			pv.next(2)
+		case OP_TESTSET:
+			pv.reg(a)
+			pv.reg(b)
+			pv.next(2)
+		case OP_CALL, OP_TAILCALL:
+			pv.reg(a)
+			if b > 0 {
+				pv.regRange(a, a+b-1)
+			}
+			if op == OP_CALL && c > 1 {
+				pv.regRange(a, a+c-2)
+			}
+		case OP_RETURN:
+			if b > 1 {
+				pv.regRange(a, a+b-2)
+			}
+		case OP_FORLOOP:
+			pv.regRange(a, a+3)
+			pv.jump(opGetArgSbx(inst))
+		case OP_FORPREP:
+			// an integer loop that does not run skips its FORLOOP too
+			pv.regRange(a, a+3)
+			pv.jump(opGetArgSbx(inst))
+			loop := code[pv.pc+1+opGetArgSbx(inst)]
+			if opGetOpCode(loop) != OP_FORLOOP || opGetArgA(loop) != a || opGetArgSbx(loop) != -opGetArgSbx(inst)-1 {
+				pv.fail("FORPREP does not jump to the FORLOOP of its loop")
+			}
+		case OP_TFORLOOP:
+			pv.regRange(a, a+2)
+			pv.regRange(a+3, a+2+c)
+			pv.next(1)
+			jmp := code[pv.pc+1]
+			if opGetOpCode(jmp) != OP_JMP {
+				pv.fail("JMP expected after TFORLOOP")
+			}
+		case OP_SETLIST:
+			pv.reg(a)
+			if b > 0 {
+				pv.regRange(a+1, a+b)
+			}
+			block := c
+			if c == 0 {
+				pv.operands(1)
+				block = int(code[pv.pc+1])
+			}
+			if block < 1 || int64(block-1)*int64(FieldsPerFlush) > int64(MaxArrayIndex) {
+				pv.fail("invalid SETLIST block %v", block)
+			}
+			if b > FieldsPerFlush {
+				pv.fail("SETLIST of %v items exceeds %v items per block", b, FieldsPerFlush)
+			}
+			if c == 0 {
+				pv.pc++
+			}
+		case OP_CLOSE:
+			pv.reg(a)
+		case OP_CLOSURE:
+			pv.reg(a)
+			bx := opGetArgBx(inst)
+			if bx >= len(fp.FunctionPrototypes) {
+				pv.fail("function prototype %v out of range (%v prototypes)", bx, len(fp.FunctionPrototypes))
+			}
+			nup := int(fp.FunctionPrototypes[bx].NumUpvalues)
+			pv.operands(nup)
+			for i := 1; i <= nup; i++ {
+				uv := code[pv.pc+i]
+				switch opGetOpCode(uv) {
+				case OP_MOVE:
+					pv.reg(opGetArgB(uv))
+				case OP_GETUPVAL:
+					pv.upvalue(opGetArgB(uv))
+				default:
+					pv.pc += i
+					pv.fail("MOVE or GETUPVAL expected after CLOSURE")
+				}
+			}
+			pv.pc += nup
+		case OP_VARARG:
+			pv.reg(a)
+			if b > 1 {
+				pv.regRange(a, a+b-2)
+			}
+		case OP_NOP:
+		}
+	}
+
+	pv.pc = len(code) - 1
+	if opGetOpCode(code[pv.pc]) != OP_RETURN {
+		pv.fail("function does not end with RETURN")
+	}
+	pv.checkTargets()
+
+	for _, child := range fp.FunctionPrototypes {
+		(&protoVerifier{proto: child, nupvalues: int(child.NumUpvalues)}).verify()
+	}
+}
+
+// checkTargets rejects control flow into the operand words of CLOSURE and
+// SETLIST, which would be executed as instructions.
+func (pv *protoVerifier) checkTargets() {
+	code := pv.proto.Code
+	land := func(from, target int) {
+		if pv.data[target] {
+			pv.pc = from
+			pv.fail("control flow into the operands of [%03d]", target)
+		}
+	}
+	for pc := 0; pc < len(code); pc++ {
+		if pv.data[pc] {
+			continue
+		}
+		inst := code[pc]
+		switch opGetOpCode(inst) {
+		case OP_JMP, OP_FORLOOP, OP_FORPREP:
+			land(pc, pc+1+opGetArgSbx(inst))
+		case OP_TFORLOOP:
+			land(pc, pc+2+opGetArgSbx(code[pc+1]))
+		case OP_EQ, OP_LT, OP_LE, OP_TEST, OP_TESTSET:
+			land(pc, pc+2)
+		case OP_LOADBOOL:
+			if opGetArgC(inst) != 0 {
+				land(pc, pc+2)
+			}
+		}
+	}
+}
+
+// VerifyProto checks that proto and its nested protos can be run by mainLoop
+// without indexing outside of the frame, constants, upvalues, nested protos
+// or code. A failure is reported as a *VerifyError. Verified protos are
+// remembered, so verifying a proto again is free.
+func VerifyProto(proto *FunctionProto) (err error) {
+	if atomic.LoadInt32(&proto.verified) != 0 {
+		return nil
+	}
+	defer func() {
+		if rcv := recover(); rcv != nil {
+			if verr, ok := rcv.(*VerifyError); ok {
+				err = verr
+				return
+			}
+			panic(rcv)
+		}
+	}()
+	(&protoVerifier{proto: proto, nupvalues: int(proto.NumUpvalues)}).verify()
+	proto.markVerified()
+	return nil
+}
+
+func (fp *FunctionProto) markVerified() {
+	atomic.StoreInt32(&fp.verified, 1)
+	for _, child := range fp.FunctionPrototypes {
+		child.markVerified()
+	}
+}
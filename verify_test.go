@@ -0,0 +1,101 @@
+package lua
+
+import (
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestVerifyProtoErrors(t *testing.T) {
+	src := `
+local t = {1, 2, 3}
+local function f() return t end
+for i = 1, 2 do t[i] = i end
+for k in pairs(t) do end
+local a, b = f()
+local x, y = ...
+return f
+`
+	find := func(fp *FunctionProto, op int) int {
+		for pc, inst := range fp.Code {
+			if opGetOpCode(inst) == op {
+				return pc
+			}
+		}
+		t.Fatalf("no %v in the test proto", opProps[op].Name)
+		return -1
+	}
+	cases := []struct {
+		mutate  func(fp *FunctionProto)
+		message string
+	}{
+		{func(fp *FunctionProto) { fp.Code[0] = opCreateABx(OP_GETGLOBAL, 0, len(fp.Constants)) }, "constant"},
+		{func(fp *FunctionProto) {
+			fp.Constants = append(fp.Constants, LNumber(1))
+			fp.Code[0] = opCreateABx(OP_GETGLOBAL, 0, len(fp.Constants)-1)
+		}, "is not a string"},
+		{func(fp *FunctionProto) { fp.Code[0] = opCreateABx(OP_CLOSURE, 0, 5) }, "function prototype 5"},
+		{func(fp *FunctionProto) {
+			for pc, inst := range fp.Code {
+				if opGetOpCode(inst) == OP_SETLIST {
+					opSetArgC(&fp.Code[pc], 0)
+					return
+				}
+			}
+		}, "SETLIST"},
+		{func(fp *FunctionProto) {
+			for pc, inst := range fp.Code {
+				if opGetOpCode(inst) == OP_CLOSURE {
+					fp.Code[0] = opCreateASbx(OP_JMP, 0, pc)
+					return
+				}
+			}
+		}, "operands"},
+		{func(fp *FunctionProto) {
+			// a skipped integer loop would continue after the last instruction
+			pc := find(fp, OP_FORPREP)
+			opSetArgSbx(&fp.Code[pc], len(fp.Code)-pc-2)
+		}, "FORLOOP"},
+		{func(fp *FunctionProto) { opSetArgC(&fp.Code[find(fp, OP_CALL)], 200) }, "register"},
+		{func(fp *FunctionProto) { opSetArgB(&fp.Code[find(fp, OP_VARARG)], 200) }, "register"},
+		{func(fp *FunctionProto) { opSetArgC(&fp.Code[find(fp, OP_TFORLOOP)], 200) }, "register"},
+	}
+	for i, c := range cases {
+		proto := compileTestProto(t, src)
+		c.mutate(proto)
+		err := VerifyProto(proto)
+		verr, ok := err.(*VerifyError)
+		if !ok {
+			t.Errorf("case %v: VerifyError expected, got %v", i, err)
+			continue
+		}
+		errorIfFalse(t, strings.Contains(verr.Message, c.message), "case %v: %v", i, verr)
+		errorIfFalse(t, verr.Pc > 0 && verr.Line > 0, "case %v: position expected: %v", i, verr)
+	}
+
+	proto := compileTestProto(t, src)
+	proto.Code[0] = opCreateABx(OP_LOADK, 0, len(proto.Constants))
+	L := NewState()
+	defer L.Close()
+	errorIfGFuncNotFail(t, L, func(L *LState) int {
+		L.NewFunctionFromProto(proto)
+		return 0
+	}, "bad instruction \\[001\\] LOADK")
+}
+
+func TestVerifyProtoShared(t *testing.T) {
+	// like the protos of a ProtoCache, run with -race
+	proto := compileTestProto(t, "return 1")
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			L := NewState()
+			defer L.Close()
+			L.Push(L.NewFunctionFromProto(proto))
+			errorIfNotNil(t, L.PCall(0, 1, nil))
+		}()
+	}
+	wg.Wait()
+}